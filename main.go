@@ -3,21 +3,54 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	brtypes "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
 	openai "github.com/openai/openai-go/v2"
 	"github.com/openai/openai-go/v2/option"
-        "github.com/openai/openai-go/v2/shared"
+	"github.com/openai/openai-go/v2/shared"
+	"gopkg.in/yaml.v3"
 )
 
 // ============================
@@ -31,51 +64,191 @@ type PlanItem struct {
 	AuthorName  string `json:"author_name"`
 	AuthorEmail string `json:"author_email"`
 	AuthorDate  string `json:"author_date"` // RFC3339
+
+	Confidence  *float64 `json:"confidence,omitempty"`   // model's self-reported confidence, 0-1
+	NeedsReview bool     `json:"needs_review,omitempty"` // apply refuses these until reviewed
+	ReviewNotes []string `json:"review_notes,omitempty"` // why the item needs review
+
+	// Squash lists later commits folded into this one by --consolidate;
+	// apply picks SHA and then each of these, and commits once.
+	Squash []string `json:"squash,omitempty"`
+
+	DiffHash string `json:"diff_hash,omitempty"` // normalized diff fingerprint, see diffHash
+	RepeatOf string `json:"repeat_of,omitempty"` // SHA whose identical diff supplied this message
+	Model    string `json:"model,omitempty"`     // model that generated new_message
+
+	// Reverts is the original SHA of the commit this one reverts. The
+	// message names that SHA, and apply replaces it with the rewritten one.
+	Reverts string `json:"reverts,omitempty"`
+
+	// DiffSummary is what --summarizer-model made of the diff; the message
+	// was written from it instead of the diff itself. Kept for debugging.
+	DiffSummary string `json:"diff_summary,omitempty"`
+
+	// Files, Insertions and Deletions describe the diff the message was
+	// written from, and Type and Scope are read from new_message, so a plan
+	// can be reviewed without the repository at hand.
+	Files      []PlanFile `json:"files,omitempty"`
+	Insertions int        `json:"insertions,omitempty"`
+	Deletions  int        `json:"deletions,omitempty"`
+	Type       string     `json:"type,omitempty"`
+	Scope      string     `json:"scope,omitempty"`
+
+	// Status is "ok" or, when no message could be generated, the kind of
+	// failure (see classifyError); Error is the error itself. A failed
+	// item keeps the original message, and apply refuses it unless
+	// --force-partial. Plans without a status are ok.
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (it PlanItem) failed() bool {
+	return it.Status != "" && it.Status != statusOK
+}
+
+// PlanFile is one file of an item's diff.
+type PlanFile struct {
+	Path       string `json:"path"`
+	OldPath    string `json:"old_path,omitempty"` // renames and copies
+	Status     string `json:"status"`             // added, modified, deleted, renamed or copied
+	Insertions int    `json:"insertions,omitempty"`
+	Deletions  int    `json:"deletions,omitempty"`
+	Binary     bool   `json:"binary,omitempty"`
+}
+
+// annotate records the files and line counts of diff on the item.
+func (it *PlanItem) annotate(diff string) {
+	it.Files, it.Insertions, it.Deletions = nil, 0, 0
+	for _, f := range parseDiffFiles(diff) {
+		pf := PlanFile{Path: f.Path, Status: f.Status, Insertions: f.Added, Deletions: f.Deleted, Binary: f.Binary}
+		if f.Status == "renamed" || f.Status == "copied" {
+			pf.OldPath = f.OldPath
+		}
+		it.Files = append(it.Files, pf)
+		it.Insertions += f.Added
+		it.Deletions += f.Deleted
+	}
+}
+
+// lastSHA is the newest original commit an item covers.
+func (it PlanItem) lastSHA() string {
+	if n := len(it.Squash); n > 0 {
+		return it.Squash[n-1]
+	}
+	return it.SHA
 }
 
 type Plan struct {
-	RepoPath    string     `json:"repo_path"`
-	Base        string     `json:"base"` // exclusive (parent side), empty means computed
-	Head        string     `json:"head"` // inclusive tip
-	CreatedAt   string     `json:"created_at"`
-	Model       string     `json:"model"`
+	Version   int    `json:"version"`
+	RepoPath  string `json:"repo_path"`
+	RepoID    string `json:"repo_id,omitempty"`  // root commit SHA, see repoFingerprint
+	Base      string `json:"base"`               // exclusive (parent side), empty means computed
+	Head      string `json:"head"`               // inclusive tip
+	HeadRef   string `json:"head_ref,omitempty"` // ref head was the tip of, checked by apply; "HEAD" if detached
+	CreatedAt string `json:"created_at"`
+	Model     string `json:"model"`
+	Provider  string `json:"provider,omitempty"`
+	GenParams        // sampling controls used to generate the plan
+	Refine    bool   `json:"refine,omitempty"`
+	Mode      string `json:"mode,omitempty"`      // --mode, when not rewrite
+	Generate  string `json:"generate,omitempty"`  // --generate, when not both
+	Translate string `json:"translate,omitempty"` // target language of a translate plan; messages were translated, not regenerated
+	Scrub     bool   `json:"scrub,omitempty"`     // messages were redacted by scrub, not regenerated
+	Partial   bool   `json:"partial,omitempty"`   // planning was interrupted; head is the last planned commit
+	Usage     *Usage `json:"usage,omitempty"`
+	// With --model-routing, Model is the default model, each item records
+	// the model it used, and usage is also broken down per model.
+	ModelRouting string           `json:"model_routing,omitempty"`
+	UsageByModel map[string]Usage `json:"usage_by_model,omitempty"`
+	// Plans collected from the OpenAI Batch API record the batch and the
+	// part of the usage it served (billed at half price).
+	BatchID     string     `json:"batch_id,omitempty"`
+	BatchUsage  *Usage     `json:"batch_usage,omitempty"`
+	ElapsedSec  float64    `json:"elapsed_seconds,omitempty"`
 	AllowMerges bool       `json:"allow_merges"`
 	Items       []PlanItem `json:"items"`
+	Tags        []PlanTag  `json:"tags,omitempty"`
+}
+
+// PlanTag is a tag on a commit in the planned range. apply recreates it on
+// the rewritten commit, since the original stays on the old history.
+type PlanTag struct {
+	Name        string `json:"name"`
+	Target      string `json:"target"` // original commit SHA
+	Annotated   bool   `json:"annotated,omitempty"`
+	Signed      bool   `json:"signed,omitempty"` // the signature itself is not kept
+	TaggerName  string `json:"tagger_name,omitempty"`
+	TaggerEmail string `json:"tagger_email,omitempty"`
+	TaggerDate  string `json:"tagger_date,omitempty"` // RFC3339
+	Message     string `json:"message,omitempty"`
 }
 
+// GenParams are optional sampling controls; nil fields are left to the
+// provider default. They are recorded in the plan so reruns are reproducible.
+type GenParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+}
+
+// AIClient is implemented by each provider. Providers only know how to run a
+// single system+user completion; the commit-message prompt lives in
+// suggest so every provider sees the same instructions.
 type AIClient interface {
-	SuggestMessage(ctx context.Context, model string, diff string, oldMsg string, emojiMode bool) (string, error)
+	Complete(ctx context.Context, model string, system string, user string) (string, error)
 }
 
-// ============================
-// OpenAI SDK Client (v2)
-// ============================
+// diffBudgeter is implemented by clients whose context window differs from
+// the default diff budget.
+type diffBudgeter interface {
+	DiffBudget() int
+}
 
-type OpenAIClient struct {
-	client openai.Client
+const defaultDiffBudget = 40000
+
+// Usage counts API traffic for a run; it is recorded in the plan so `stats`
+// can report token usage and cost afterwards.
+type Usage struct {
+	Requests         int64 `json:"requests"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
 }
 
-func NewOpenAIClient() (*OpenAIClient, error) {
-	apiKey := strings.TrimSpace(os.Getenv("OPENAI_API_KEY"))
-	if apiKey == "" {
-		return nil, errors.New("OPENAI_API_KEY is not set")
-	}
-	base := strings.TrimSpace(os.Getenv("OPENAI_API_BASE"))
+type usageMeter struct {
+	mu sync.Mutex
+	u  Usage
+}
 
-	var opts []option.RequestOption
-	opts = append(opts, option.WithAPIKey(apiKey))
-	if base != "" {
-		opts = append(opts, option.WithBaseURL(base))
-	}
+func (m *usageMeter) add(prompt, completion int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.u.Requests++
+	m.u.PromptTokens += prompt
+	m.u.CompletionTokens += completion
+}
 
-	cli := openai.NewClient(opts...)
-	return &OpenAIClient{client: cli}, nil
+func (m *usageMeter) snapshot() Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.u
+}
+
+func (m *usageMeter) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.u = Usage{}
 }
 
-func (c *OpenAIClient) SuggestMessage(ctx context.Context, model string, diff string, oldMsg string, emojiMode bool) (string, error) {
-	var sys string
+// apiUsage accumulates usage across every provider call in this process.
+var apiUsage usageMeter
+
+// ============================
+// Commit message prompt
+// ============================
+
+func commitSystemPrompt(emojiMode bool) string {
 	if emojiMode {
-		sys = `You are an expert at writing precise, helpful Git commit messages with emojis.
+		return `You are an expert at writing precise, helpful Git commit messages with emojis.
 Use the present tense ("Add feature" not "Added feature")
 Use the imperative mood ("Move cursor to..." not "Moves cursor to...")
 Limit the first line to 72 characters or less
@@ -96,531 +269,10604 @@ Consider starting the commit message with an applicable emoji:
 ⬇️ :arrow_down: when downgrading dependencies
 👕 :shirt: when removing linter warnings
 If the diff is large, summarize purpose + major changes concisely.`
-	} else {
-		sys = `You are an expert at writing precise, helpful Git commit messages.
+	}
+	return `You are an expert at writing precise, helpful Git commit messages.
 Follow the "Conventional Commits" style when appropriate.
 One short summary line (<= 72 chars), then an empty line, then bullet points if needed.
 Use imperative present tense (e.g., "fix: handle nil pointer in X").
 If the diff is large, summarize purpose + major changes concisely.`
-	}
-
-	user := fmt.Sprintf(
-		"Old message:\n\"%s\"\n\nDiff (unified, files & hunks):\n%s",
-		oldMsg, truncate(diff, 40000),
-	)
+}
 
-	params := openai.ChatCompletionNewParams{
-		Model: shared.ChatModel(model),
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage(sys),
-			openai.UserMessage(user),
-		},
-		MaxCompletionTokens:  openai.Int(4000),
-	}
+// Message modes (--mode): how much of the old message a new one keeps.
+const (
+	modeRewrite     = "rewrite"      // generate from the diff; the old message is a hint
+	modePolish      = "polish"       // keep the content, fix the wording
+	modeKeepSubject = "keep-subject" // keep the subject, write a body
+)
 
-	resp, err := c.client.Chat.Completions.New(ctx, params)
-	if err != nil {
-		return "", err
-	}
-	if len(resp.Choices) == 0 {
-		return "", errors.New("no choices returned")
-	}
+// Parts of the message to generate (--generate); the rest is kept.
+const (
+	generateBoth    = "both"
+	generateSubject = "subject"
+	generateBody    = "body"
+)
 
-	// v2 SDKは Content を stringで保持（README参照）
-	txt := strings.TrimSpace(resp.Choices[0].Message.Content)
-	txt = strings.Trim(txt, "` \n")
-	if txt == "" {
-		return "", errors.New("empty content")
-	}
-	return txt, nil
+// messageMode is --mode and --generate. The zero value rewrites the whole
+// message.
+type messageMode struct {
+	mode     string
+	generate string
 }
 
-// ============================
-// Git helpers
-// ============================
+func (m *messageMode) register(fs *flag.FlagSet) {
+	m.mode, m.generate = modeRewrite, generateBoth
+	fs.Func("mode", "how much of the old message to keep: rewrite (generate from the diff), polish (only fix wording and style) or keep-subject (keep the subject, generate a body) (default rewrite)", func(v string) error {
+		switch v {
+		case modeRewrite, modePolish, modeKeepSubject:
+			m.mode = v
+			return nil
+		}
+		return errors.New("must be rewrite, polish or keep-subject")
+	})
+	fs.Func("generate", "which part of the message to generate: both, subject (keep the old body) or body (keep the old subject) (default both)", func(v string) error {
+		switch v {
+		case generateBoth, generateSubject, generateBody:
+			m.generate = v
+			return nil
+		}
+		return errors.New("must be both, subject or body")
+	})
+}
 
-func git(args ...string) (string, error) {
-	var stdout, stderr bytes.Buffer
-	cmd := exec.Command("git", args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("git %v failed: %v, %s", args, err, stderr.String())
+func (m messageMode) check() error {
+	if m.mode == modeKeepSubject && m.generate == generateSubject {
+		return errors.New("--mode keep-subject cannot be combined with --generate subject")
 	}
-	return stdout.String(), nil
+	return nil
 }
 
-func ensureCleanWorktree() error {
-	out, err := git("status", "--porcelain")
-	if err != nil {
-		return err
-	}
+func (m messageMode) keepSubject() bool {
+	return m.mode == modeKeepSubject || m.generate == generateBody
+}
 
-	// Filter out plan.json and other working files
-	lines := strings.Split(strings.TrimSpace(out), "\n")
-	var filteredLines []string
+func (m messageMode) keepBody() bool {
+	return m.generate == generateSubject
+}
 
-	for _, line := range lines {
-		if strings.TrimSpace(line) == "" {
-			continue
-		}
-		// Extract filename from git status --porcelain output
-		// Format: "XY filename" where XY are status codes
-		if len(line) >= 3 {
-			filename := strings.TrimSpace(line[2:])
-			// Ignore plan.json files
-			if filename != "plan.json" {
-				filteredLines = append(filteredLines, line)
-			}
-		}
-	}
+// keepsOld reports whether messages depend on the old message as well as
+// the diff, so rule-based and reused messages won't do.
+func (m messageMode) keepsOld() bool {
+	return m.mode == modePolish || m.keepSubject() || m.keepBody()
+}
 
-	if len(filteredLines) > 0 {
-		return errors.New("worktree is not clean; commit/stash first")
+// lengthRules leaves the kept part of the message as the author wrote it.
+func (m messageMode) lengthRules(lr lengthRules) lengthRules {
+	if m.keepSubject() {
+		lr.subjectMax = 0
 	}
-	return nil
+	if m.keepBody() {
+		lr.bodyWrap = 0
+	}
+	return lr
 }
 
-type CommitMeta struct {
-	SHA         string
-	Subject     string
-	AuthorName  string
-	AuthorEmail string
-	AuthorDate  time.Time
-	IsMerge     bool
-}
+// instruction is what the system prompt adds for the mode.
+func (m messageMode) instruction() string {
+	var s string
+	if m.mode == modePolish {
+		s += `
 
-func listCommits(rangeExpr string) ([]CommitMeta, error) {
-	// %H SHA, %s subject, %an, %ae, %ad (ISO8601), %P parents
-	format := "%H%x1f%s%x1f%an%x1f%ae%x1f%aI%x1f%P%x1e"
-	out, err := git("log", "--reverse", "--format="+format, rangeExpr)
-	if err != nil {
-		return nil, err
+Polish the old message rather than replacing it: keep its meaning, scope, structure and details (reasons, issue references, trailers) and only fix grammar, spelling, tense, capitalization and format. Use the diff only to correct statements it contradicts; do not add new content. If the old message says nothing useful (e.g. "wip", "fix"), write a concise one from the diff instead.`
 	}
-	var commits []CommitMeta
-	records := strings.Split(strings.TrimSuffix(out, "\x1e"), "\x1e")
-	for _, rec := range records {
-		if strings.TrimSpace(rec) == "" {
-			continue
-		}
-		parts := strings.Split(rec, "\x1f")
-		if len(parts) < 6 {
-			continue
-		}
-		dt, _ := time.Parse(time.RFC3339, parts[4])
+	switch {
+	case m.keepSubject():
+		s += `
 
-		parents := strings.Fields(parts[5])
-		isMerge := len(parents) > 1
+The subject line of the old message is final: repeat it unchanged as the first line, then an empty line, then write a body explaining what changed and why, from the diff.`
+	case m.keepBody():
+		s += `
 
-		commits = append(commits, CommitMeta{
-			SHA:         strings.TrimSpace(parts[0]),
-			Subject:     parts[1],
-			AuthorName:  parts[2],
-			AuthorEmail: parts[3],
-			AuthorDate:  dt,
-			IsMerge:     isMerge,
-		})
+Write only the subject line, one line with no body; the body of the old message is kept as it is.`
 	}
-	return commits, nil
+	return s
 }
 
-func showDiff(sha string) (string, error) {
-	// ユニファイド差分（空白無視はしない/正確さ優先）
-	out, err := git("show", "--patch", "--unified=3", "--no-color", "--find-renames", sha)
-	if err != nil {
-		return "", err
+// enforce puts the kept part of oldMsg back into msg, whatever the model
+// did with it.
+func (m messageMode) enforce(msg, oldMsg string) string {
+	oldMsg = strings.TrimSpace(oldMsg)
+	if oldMsg == "" || !m.keepSubject() && !m.keepBody() {
+		return msg
 	}
-	return out, nil
+	subject, body, _ := strings.Cut(msg, "\n")
+	oldSubject, oldBody, _ := strings.Cut(oldMsg, "\n")
+	if m.keepSubject() {
+		subject = oldSubject
+	} else {
+		body = oldBody
+	}
+	if body = strings.TrimSpace(body); body == "" {
+		return strings.TrimSpace(subject)
+	}
+	return strings.TrimSpace(subject) + "\n\n" + body
 }
 
-func getStagedDiff() (string, error) {
-	// ステージングエリアの差分を取得
-	out, err := git("diff", "--cached", "--patch", "--unified=3", "--no-color", "--find-renames")
-	if err != nil {
-		return "", err
-	}
-	return out, nil
+// suggestRequest describes one commit-message generation.
+type suggestRequest struct {
+	Model  string
+	Diff   string
+	OldMsg string
+	Emoji  bool
+	Mode   messageMode
+	// Confidence asks the model to rate how well its message is supported
+	// by the diff.
+	Confidence bool
+	// Refine adds a second pass in which the model critiques its draft
+	// against the diff and revises it.
+	Refine bool
+	// Context is extra background placed before the diff, such as linked
+	// issue descriptions.
+	Context string
+	// Summary, if set, replaces the diff in the prompt (see summarizeForPrompt).
+	Summary string
 }
 
-// ============================
-// Utilities
-// ============================
+// planInput is one group of commits ready to be sent to the model.
+type planInput struct {
+	group  []CommitMeta
+	diff   string
+	oldMsg string
+	squash []string
+	hash   string
+	bodies []string // full original messages, read for issue refs and trailers
+	req    suggestRequest
+	// trivial is the deterministic message of a rename- or whitespace-only
+	// group, which is never sent to the model.
+	trivial string
+	timeout time.Duration // per request, scaled to the diff
+}
 
-func truncate(s string, max int) string {
-	r := []rune(s)
-	if len(r) <= max {
-		return s
-	}
-	return string(r[:max]) + "\n...[truncated]..."
+type suggestion struct {
+	Message    string
+	Confidence *float64 // nil when not requested or not reported
 }
 
-func repoTop() (string, error) {
-	out, err := git("rev-parse", "--show-toplevel")
-	if err != nil {
-		return "", err
+const refineSystemPrompt = `You review a draft Git commit message against the diff it describes.
+Critique the draft silently, checking for:
+- hallucinated changes: claims, files, or identifiers that do not appear in the diff
+- missing major changes that are in the diff but not mentioned
+- wrong scope or Conventional Commit type (e.g. "feat" for a pure refactor or fix)
+- a summary line longer than 72 characters or not in the imperative mood
+Then output only the corrected commit message (or the draft unchanged if it is already accurate), keeping the draft's style and format. Do not output the critique.`
+
+const confidenceInstruction = `
+After the commit message, add one final line "Confidence: <0.0-1.0>" rating how sure you are that the message accurately and completely describes the diff (low if the diff is truncated, ambiguous, or you had to guess the intent).`
+
+var confidenceLineRe = regexp.MustCompile(`(?i)^\W*confidence\W*:?\s*([0-9]*\.?[0-9]+)\s*(%?)\W*$`)
+
+func diffBudgetOf(ai AIClient) int {
+	if b, ok := ai.(diffBudgeter); ok {
+		return b.DiffBudget()
 	}
-	return strings.TrimSpace(out), nil
+	return defaultDiffBudget
 }
 
-func defaultHead() (string, error) {
-	out, err := git("rev-parse", "HEAD")
-	if err != nil {
-		return "", err
+// commitUserPrompt renders the old message, context, file summary and diff
+// (cut to budget bytes) of one commit.
+func commitUserPrompt(req suggestRequest, budget int) string {
+	user := fmt.Sprintf("Old message:\n\"%s\"\n\n", req.OldMsg)
+	if req.Context != "" {
+		user += strings.TrimRight(req.Context, "\n") + "\n\n"
 	}
-	return strings.TrimSpace(out), nil
+	if s := summarizeDiff(req.Diff); s != "" {
+		user += s + "\n"
+	}
+	if req.Summary != "" {
+		return user + "Change summary (written from the full diff):\n" + req.Summary
+	}
+	return user + "Diff (unified, files & hunks):\n" + truncate(req.Diff, budget)
 }
 
-func nthAncestor(head string, n int) (string, error) {
-	spec := fmt.Sprintf("%s~%d", head, n)
-	out, err := git("rev-parse", spec)
+const summarizerSystemPrompt = `You compress a Git diff into a technical change summary for someone who will write the commit message without seeing the diff.
+Write terse bullet points covering:
+- what behavior changed, and why if the diff shows it
+- the components, functions, types and files affected, by their exact names
+- added or removed APIs, flags, configuration and dependencies
+- whether it is a feature, fix, refactor, test, docs or build change
+Do not write a commit message and do not mention anything that is not in the diff. At most 25 bullets.`
+
+// summarizeForPrompt has a (cheaper) model condense a large diff, so the
+// model writing the message reads a summary of the whole change instead of
+// a truncated diff.
+func summarizeForPrompt(ctx context.Context, ai AIClient, model, diff string) (string, error) {
+	user := summarizeDiff(diff) + "\nDiff (unified, files & hunks):\n" + truncate(diff, diffBudgetOf(ai))
+	txt, err := ai.Complete(withAIRequest(ctx, aiRequest{Kind: kindSummary}), model, summarizerSystemPrompt, user)
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(out), nil
+	txt = unwrapFence(txt)
+	if txt == "" {
+		return "", errors.New("empty summary")
+	}
+	return txt, nil
 }
 
-// ============================
-// Plan command
-// ============================
-
-func cmdPlan(args []string) error {
-	fs := flag.NewFlagSet("plan", flag.ExitOnError)
-	limit := fs.Int("limit", 20, "number of commits from HEAD to include")
-	rangeExpr := fs.String("range", "", "explicit git range (e.g., <base>..<head>)")
-	model := fs.String("model", envOr("OPENAI_MODEL", "gpt-5-nano"), "LLM model")
-	allowMerges := fs.Bool("allow-merges", false, "include merge commits (not recommended)")
-	emoji := fs.Bool("emoji", false, "use emoji style commit messages")
-	outFile := fs.String("out", "plan.json", "output plan file")
-	timeout := fs.Duration("timeout", 25*time.Second, "per-commit AI timeout")
-	fs.Parse(args)
-
-	head, err := defaultHead()
+func suggest(ctx context.Context, ai AIClient, req suggestRequest) (suggestion, error) {
+	sys := commitSystemPrompt(req.Emoji) + req.Mode.instruction()
+	if req.Confidence {
+		sys += confidenceInstruction
+	}
+	user := commitUserPrompt(req, diffBudgetOf(ai))
+	ctx = withAIRequest(ctx, aiRequest{Kind: kindMessage, Confidence: req.Confidence})
+	txt, err := ai.Complete(ctx, req.Model, sys, user)
 	if err != nil {
-		return err
+		return suggestion{}, err
 	}
-	base := ""
-	if *rangeExpr == "" {
-		anc, err := nthAncestor(head, *limit)
+	if req.Refine {
+		draft := unwrapFence(txt)
+		if req.Confidence {
+			draft, _ = extractConfidence(draft)
+		}
+		rsys := refineSystemPrompt + req.Mode.instruction()
+		if req.Confidence {
+			rsys += confidenceInstruction
+		}
+		ruser := fmt.Sprintf("%s\n\nDraft commit message:\n%s", user, draft)
+		txt, err = ai.Complete(ctx, req.Model, rsys, ruser)
 		if err != nil {
-			ancOut, err2 := git("rev-list", "--max-parents=0", "HEAD")
-			if err2 != nil {
-				return fmt.Errorf("cannot compute base: %v, %v", err, err2)
-			}
-			anc = strings.TrimSpace(ancOut)
+			return suggestion{}, fmt.Errorf("refine pass: %w", err)
 		}
-		base = anc
-		*rangeExpr = fmt.Sprintf("%s..%s", base, head)
 	}
-
-	commits, err := listCommits(*rangeExpr)
-	if err != nil {
-		return err
+	var sg suggestion
+	if req.Confidence {
+		txt, sg.Confidence = extractConfidence(txt)
 	}
-	if len(commits) == 0 {
-		return errors.New("no commits in range")
+	sg.Message = unwrapFence(txt)
+	if sg.Message == "" {
+		return suggestion{}, errEmptyResponse
 	}
+	sg.Message = req.Mode.enforce(sg.Message, req.OldMsg)
+	return sg, nil
+}
+
+const batchInstruction = `
+
+You will receive several unrelated commits, each starting with a "=== Commit N ===" line. Write one message per commit, based only on that commit's own diff.
+Reply with a JSON array only, one object per commit in the same order:
+[{"commit": 1, "message": "<full commit message>", "confidence": <0.0-1.0>}]`
+
+var batchHeaderRe = regexp.MustCompile(`(?m)^=== Commit \d+ ===$`)
 
-	ai, err := NewOpenAIClient()
+// suggestBatch asks for the messages of several small commits in one
+// request. It fails unless the reply has exactly one message per commit, so
+// callers can fall back to suggest.
+func suggestBatch(ctx context.Context, ai AIClient, reqs []suggestRequest) ([]suggestion, error) {
+	budget := diffBudgetOf(ai) / len(reqs)
+	sys := commitSystemPrompt(reqs[0].Emoji) + reqs[0].Mode.instruction() + batchInstruction
+	var sb strings.Builder
+	for i, req := range reqs {
+		fmt.Fprintf(&sb, "=== Commit %d ===\n%s\n\n", i+1, commitUserPrompt(req, budget))
+	}
+	txt, err := ai.Complete(withAIRequest(ctx, aiRequest{Kind: kindBatch}), reqs[0].Model, sys, sb.String())
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var reply []struct {
+		Commit     int      `json:"commit"`
+		Message    string   `json:"message"`
+		Confidence *float64 `json:"confidence"`
 	}
+	if err := json.Unmarshal([]byte(jsonArrayRe.FindString(txt)), &reply); err != nil {
+		return nil, fmt.Errorf("cannot parse batch reply: %w", err)
+	}
+	if len(reply) != len(reqs) {
+		return nil, fmt.Errorf("batch reply has %d messages for %d commits", len(reply), len(reqs))
+	}
+	out := make([]suggestion, len(reqs))
+	for i, r := range reply {
+		msg := unwrapFence(r.Message)
+		if r.Commit != i+1 || msg == "" {
+			return nil, fmt.Errorf("batch reply entry %d is out of order or empty", i+1)
+		}
+		out[i].Message = reqs[i].Mode.enforce(msg, reqs[i].OldMsg)
+		if r.Confidence != nil && reqs[i].Confidence {
+			v := min(max(*r.Confidence, 0), 1)
+			out[i].Confidence = &v
+		}
+	}
+	return out, nil
+}
 
-	var items []PlanItem
-	for _, c := range commits {
-		if c.IsMerge && !*allowMerges {
-			log.Printf("skip merge commit %s", c.SHA)
+var jsonArrayRe = regexp.MustCompile(`(?s)\[.*\]`)
+
+// extractConfidence removes a trailing "Confidence: x" line and returns the
+// score clamped to [0, 1]; percentages are accepted.
+func extractConfidence(txt string) (string, *float64) {
+	lines := splitLines(unwrapFence(txt))
+	for i := len(lines) - 1; i >= 0 && i >= len(lines)-3; i-- {
+		m := confidenceLineRe.FindStringSubmatch(strings.TrimSpace(lines[i]))
+		if m == nil {
 			continue
 		}
-		diff, err := showDiff(c.SHA)
+		v, err := strconv.ParseFloat(m[1], 64)
 		if err != nil {
-			return err
+			break
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
-		newMsg, err := ai.SuggestMessage(ctx, *model, diff, c.Subject, *emoji)
-		cancel()
-		if err != nil {
-			return fmt.Errorf("AI failed for %s: %w", c.SHA, err)
+		if m[2] == "%" || v > 1 {
+			v /= 100
 		}
-		items = append(items, PlanItem{
-			SHA:         c.SHA,
-			OldMessage:  c.Subject,
-			NewMessage:  sanitizeMessage(newMsg),
-			AuthorName:  c.AuthorName,
-			AuthorEmail: c.AuthorEmail,
-			AuthorDate:  c.AuthorDate.Format(time.RFC3339),
-		})
-		log.Printf("planned: %s  %s  ->  %s", c.SHA[:7], truncate(c.Subject, 60), truncate(newMsg, 60))
+		v = min(max(v, 0), 1)
+		rest := append(lines[:i:i], lines[i+1:]...)
+		return strings.Join(rest, "\n"), &v
 	}
+	return txt, nil
+}
 
-	top, _ := repoTop()
-	plan := Plan{
-		RepoPath:    top,
+// ============================
+// OpenAI SDK Client (v2)
+// ============================
+
+type OpenAIClient struct {
+	client openai.Client
+	gen    GenParams
+	// requestOpts returns per-request options for a model. Azure uses it to
+	// route each model name to its deployment.
+	requestOpts func(model string) []option.RequestOption
+}
+
+func NewOpenAIClient(gen GenParams) (*OpenAIClient, error) {
+	apiKey := strings.TrimSpace(os.Getenv("OPENAI_API_KEY"))
+	if apiKey == "" {
+		return nil, errors.New("OPENAI_API_KEY is not set")
+	}
+	base := strings.TrimSpace(os.Getenv("OPENAI_API_BASE"))
+
+	var opts []option.RequestOption
+	opts = append(opts, option.WithAPIKey(apiKey), option.WithHTTPClient(httpClient))
+	if base != "" {
+		opts = append(opts, option.WithBaseURL(base))
+	}
+
+	cli := openai.NewClient(opts...)
+	return &OpenAIClient{client: cli, gen: gen}, nil
+}
+
+func (c *OpenAIClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	params := openai.ChatCompletionNewParams{
+		Model: shared.ChatModel(model),
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(system),
+			openai.UserMessage(user),
+		},
+		MaxCompletionTokens: openai.Int(4000),
+	}
+	if c.gen.Temperature != nil {
+		params.Temperature = openai.Float(*c.gen.Temperature)
+	}
+	if c.gen.TopP != nil {
+		params.TopP = openai.Float(*c.gen.TopP)
+	}
+	if c.gen.Seed != nil {
+		params.Seed = openai.Int(*c.gen.Seed)
+	}
+
+	var reqOpts []option.RequestOption
+	if c.requestOpts != nil {
+		reqOpts = c.requestOpts(model)
+	}
+	resp, err := c.client.Chat.Completions.New(ctx, params, reqOpts...)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("%w: no choices returned", errEmptyResponse)
+	}
+
+	apiUsage.add(resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+
+	// v2 SDKは Content を stringで保持（README参照）
+	return resp.Choices[0].Message.Content, nil
+}
+
+// ============================
+// Azure OpenAI
+// ============================
+
+const azureCognitiveScope = "https://cognitiveservices.azure.com"
+
+// NewAzureOpenAIClient builds an OpenAIClient that talks to an Azure OpenAI
+// resource. Models are routed to deployments via AZURE_OPENAI_DEPLOYMENTS
+// ("model=deployment,..."), falling back to AZURE_OPENAI_DEPLOYMENT and then
+// to the model name itself. Without AZURE_OPENAI_API_KEY, Azure AD bearer
+// tokens are used (AZURE_OPENAI_AD_TOKEN or the Azure CLI login).
+func NewAzureOpenAIClient(gen GenParams) (*OpenAIClient, error) {
+	endpoint := strings.TrimRight(strings.TrimSpace(os.Getenv("AZURE_OPENAI_ENDPOINT")), "/")
+	if endpoint == "" {
+		return nil, errors.New("AZURE_OPENAI_ENDPOINT is not set")
+	}
+	apiVersion := envOr("AZURE_OPENAI_API_VERSION", "2024-10-21")
+	deployments, err := parseDeploymentMap(os.Getenv("AZURE_OPENAI_DEPLOYMENTS"))
+	if err != nil {
+		return nil, err
+	}
+	defaultDeployment := strings.TrimSpace(os.Getenv("AZURE_OPENAI_DEPLOYMENT"))
+
+	opts := []option.RequestOption{
+		option.WithHTTPClient(httpClient),
+		option.WithBaseURL(endpoint + "/openai/"),
+		option.WithQuery("api-version", apiVersion),
+		// OPENAI_API_KEY from the environment must not leak into Azure requests
+		option.WithHeaderDel("authorization"),
+	}
+	if key := strings.TrimSpace(os.Getenv("AZURE_OPENAI_API_KEY")); key != "" {
+		opts = append(opts, option.WithHeader("api-key", key))
+	} else {
+		ts := &azureTokenSource{static: strings.TrimSpace(os.Getenv("AZURE_OPENAI_AD_TOKEN"))}
+		opts = append(opts, option.WithMiddleware(func(r *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+			tok, err := ts.Token(r.Context())
+			if err != nil {
+				return nil, err
+			}
+			r.Header.Set("Authorization", "Bearer "+tok)
+			return next(r)
+		}))
+	}
+
+	cli := openai.NewClient(opts...)
+	return &OpenAIClient{
+		client: cli,
+		gen:    gen,
+		requestOpts: func(model string) []option.RequestOption {
+			dep := deployments[model]
+			if dep == "" {
+				dep = defaultDeployment
+			}
+			if dep == "" {
+				dep = model
+			}
+			return []option.RequestOption{
+				option.WithBaseURL(endpoint + "/openai/deployments/" + url.PathEscape(dep) + "/"),
+			}
+		},
+	}, nil
+}
+
+// parseDeploymentMap parses "model=deployment,model2=deployment2".
+func parseDeploymentMap(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" || strings.TrimSpace(v) == "" {
+			return nil, fmt.Errorf("invalid AZURE_OPENAI_DEPLOYMENTS entry %q (want model=deployment)", pair)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
+
+// azureTokenSource hands out Azure AD tokens for the Cognitive Services
+// scope, either a static token from the environment or one obtained (and
+// cached until shortly before expiry) from `az account get-access-token`.
+type azureTokenSource struct {
+	static string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (ts *azureTokenSource) Token(ctx context.Context) (string, error) {
+	if ts.static != "" {
+		return ts.static, nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Until(ts.expires) > 5*time.Minute {
+		return ts.token, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "az", "account", "get-access-token", "--resource", azureCognitiveScope, "--output", "json")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("no AZURE_OPENAI_API_KEY or AZURE_OPENAI_AD_TOKEN, and az login token failed: %v, %s", err, stderr.String())
+	}
+	var out struct {
+		AccessToken string `json:"accessToken"`
+		ExpiresOn   int64  `json:"expires_on"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return "", fmt.Errorf("cannot parse az token output: %w", err)
+	}
+	if out.AccessToken == "" {
+		return "", errors.New("az returned an empty access token")
+	}
+	ts.token = out.AccessToken
+	ts.expires = time.Now().Add(time.Hour)
+	if out.ExpiresOn > 0 {
+		ts.expires = time.Unix(out.ExpiresOn, 0)
+	}
+	return ts.token, nil
+}
+
+// ============================
+// Google Gemini
+// ============================
+
+// GeminiClient calls the Gemini generateContent REST API directly.
+type GeminiClient struct {
+	apiKey string
+	base   string
+	gen    GenParams
+	http   *http.Client
+}
+
+func NewGeminiClient(gen GenParams) (*GeminiClient, error) {
+	apiKey := strings.TrimSpace(os.Getenv("GOOGLE_API_KEY"))
+	if apiKey == "" {
+		apiKey = strings.TrimSpace(os.Getenv("GEMINI_API_KEY"))
+	}
+	if apiKey == "" {
+		return nil, errors.New("GOOGLE_API_KEY is not set")
+	}
+	base := strings.TrimRight(envOr("GEMINI_API_BASE", "https://generativelanguage.googleapis.com/v1beta"), "/")
+	return &GeminiClient{apiKey: apiKey, base: base, gen: gen, http: httpClient}, nil
+}
+
+// DiffBudget reflects Gemini's much larger input window (1M tokens for the
+// flash models); we still cap it to keep latency and cost sane.
+func (c *GeminiClient) DiffBudget() int { return 200000 }
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiRequest struct {
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	Contents          []geminiContent `json:"contents"`
+	GenerationConfig  struct {
+		MaxOutputTokens int      `json:"maxOutputTokens"`
+		Temperature     *float64 `json:"temperature,omitempty"`
+		TopP            *float64 `json:"topP,omitempty"`
+		Seed            *int64   `json:"seed,omitempty"`
+	} `json:"generationConfig"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata struct {
+		PromptTokenCount     int64 `json:"promptTokenCount"`
+		CandidatesTokenCount int64 `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+func (c *GeminiClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	var req geminiRequest
+	req.SystemInstruction = &geminiContent{Parts: []geminiPart{{Text: system}}}
+	req.Contents = []geminiContent{{Role: "user", Parts: []geminiPart{{Text: user}}}}
+	// Gemini 2.x flash models allow up to 8192 output tokens
+	req.GenerationConfig.MaxOutputTokens = 8192
+	req.GenerationConfig.Temperature = c.gen.Temperature
+	req.GenerationConfig.TopP = c.gen.TopP
+	req.GenerationConfig.Seed = c.gen.Seed
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := fmt.Sprintf("%s/models/%s:generateContent", c.base, url.PathEscape(strings.TrimPrefix(model, "models/")))
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("x-goog-api-key", c.apiKey)
+
+	hresp, err := c.http.Do(hreq)
+	if err != nil {
+		return "", err
+	}
+	defer hresp.Body.Close()
+	raw, err := io.ReadAll(hresp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var resp geminiResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return "", fmt.Errorf("gemini: HTTP %d: %s", hresp.StatusCode, truncate(string(raw), 500))
+	}
+	if resp.Error != nil {
+		return "", fmt.Errorf("gemini: %s (%d %s)", resp.Error.Message, resp.Error.Code, resp.Error.Status)
+	}
+	if hresp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gemini: HTTP %d", hresp.StatusCode)
+	}
+	apiUsage.add(resp.UsageMetadata.PromptTokenCount, resp.UsageMetadata.CandidatesTokenCount)
+	if resp.PromptFeedback.BlockReason != "" {
+		return "", fmt.Errorf("gemini: prompt blocked by safety filter (%s)", resp.PromptFeedback.BlockReason)
+	}
+	if len(resp.Candidates) == 0 {
+		return "", fmt.Errorf("%w: no candidates returned", errEmptyResponse)
+	}
+	cand := resp.Candidates[0]
+	switch cand.FinishReason {
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return "", fmt.Errorf("gemini: response blocked by safety filter (%s)", cand.FinishReason)
+	}
+	var sb strings.Builder
+	for _, p := range cand.Content.Parts {
+		sb.WriteString(p.Text)
+	}
+	return sb.String(), nil
+}
+
+// ============================
+// AWS Bedrock
+// ============================
+
+// BedrockClient calls the Bedrock Runtime Converse API, which gives Claude
+// and Titan models a single request shape. Credentials come from the AWS
+// SDK's default chain (see loadAWSConfig), which also refreshes temporary
+// ones before they expire.
+type BedrockClient struct {
+	rt  *bedrockruntime.Client
+	gen GenParams
+}
+
+func NewBedrockClient(gen GenParams) (*BedrockClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if gen.Seed != nil {
+		slog.Warn("bedrock does not support --seed; ignoring it")
+		gen.Seed = nil
+	}
+	rt := bedrockruntime.NewFromConfig(cfg, func(o *bedrockruntime.Options) {
+		if ep := strings.TrimRight(os.Getenv("BEDROCK_ENDPOINT"), "/"); ep != "" {
+			o.BaseEndpoint = aws.String(ep)
+		}
+	})
+	return &BedrockClient{rt: rt, gen: gen}, nil
+}
+
+// loadAWSConfig resolves the region and credentials through the SDK's
+// default chain: the environment, the shared config and credentials files
+// (profiles, SSO, assumed roles, credential_process), web identity, and
+// container or instance metadata. It resolves the credentials once up
+// front, so that a missing or broken setup fails before any work is done.
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	// The SDK ignores a key ID without its secret and moves on to the next
+	// source, which would quietly sign with other credentials.
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		return aws.Config{}, errors.New("AWS_ACCESS_KEY_ID is set but AWS_SECRET_ACCESS_KEY is not")
+	}
+	// The SDK's own client, so that it can still apply AWS_CA_BUNDLE, with
+	// the proxy and TLS settings of --proxy, --ca-bundle and --client-cert.
+	hc := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		if t, ok := httpClient.Transport.(*http.Transport); ok {
+			tr.Proxy = t.Proxy
+			tr.TLSClientConfig = t.TLSClientConfig.Clone()
+		}
+	})
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithHTTPClient(hc))
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("loading AWS configuration: %w", err)
+	}
+	if cfg.Region == "" {
+		// Read by the AWS CLI, but not by the Go SDK.
+		cfg.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if cfg.Region == "" {
+		return aws.Config{}, errors.New("AWS region is not set (AWS_REGION, AWS_DEFAULT_REGION or ~/.aws/config)")
+	}
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return aws.Config{}, fmt.Errorf("no AWS credentials found: %w", err)
+	}
+	return cfg, nil
+}
+
+func (c *BedrockClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	in := &bedrockruntime.ConverseInput{ModelId: aws.String(model)}
+	maxTokens := int32(4000)
+	if strings.Contains(model, "titan") {
+		// Titan text models reject system prompts; fold the instructions into
+		// the user turn instead.
+		user = system + "\n\n" + user
+		// Titan Text Express/Lite cap output at 3072 tokens
+		maxTokens = 3072
+	} else {
+		in.System = []brtypes.SystemContentBlock{&brtypes.SystemContentBlockMemberText{Value: system}}
+	}
+	in.Messages = []brtypes.Message{{
+		Role:    brtypes.ConversationRoleUser,
+		Content: []brtypes.ContentBlock{&brtypes.ContentBlockMemberText{Value: user}},
+	}}
+	in.InferenceConfig = &brtypes.InferenceConfiguration{
+		MaxTokens:   aws.Int32(maxTokens),
+		Temperature: float32Ptr(c.gen.Temperature),
+		TopP:        float32Ptr(c.gen.TopP),
+	}
+	out, err := c.rt.Converse(ctx, in)
+	if err != nil {
+		return "", fmt.Errorf("bedrock: %w", err)
+	}
+	if u := out.Usage; u != nil {
+		apiUsage.add(int64(aws.ToInt32(u.InputTokens)), int64(aws.ToInt32(u.OutputTokens)))
+	}
+	if out.StopReason == brtypes.StopReasonGuardrailIntervened || out.StopReason == brtypes.StopReasonContentFiltered {
+		return "", fmt.Errorf("bedrock: response blocked (%s)", out.StopReason)
+	}
+	msg, ok := out.Output.(*brtypes.ConverseOutputMemberMessage)
+	if !ok {
+		return "", errEmptyResponse
+	}
+	var sb strings.Builder
+	for _, b := range msg.Value.Content {
+		if t, ok := b.(*brtypes.ContentBlockMemberText); ok {
+			sb.WriteString(t.Value)
+		}
+	}
+	return sb.String(), nil
+}
+
+func float32Ptr(f *float64) *float32 {
+	if f == nil {
+		return nil
+	}
+	return aws.Float32(float32(*f))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// ============================
+// Mock provider and fixtures
+// ============================
+
+// MockClient returns deterministic canned messages derived from the diff so
+// the plan/apply pipeline can run without network access or an API key.
+type MockClient struct{}
+
+// requestKind names the feature a Complete call is made for.
+type requestKind string
+
+const (
+	kindMessage     requestKind = "message" // a commit message (the default)
+	kindBatch       requestKind = "batch"   // several commit messages as a JSON array
+	kindSummary     requestKind = "summary"
+	kindConsistency requestKind = "consistency"
+	kindAdvise      requestKind = "advise"
+	kindTranslate   requestKind = "translate"
+	kindParaphrase  requestKind = "paraphrase"
+)
+
+// aiRequest describes a Complete call beyond its prompts. It travels in the
+// context, so clients that answer without a model (the mock) know what is
+// asked without matching on prompt wording.
+type aiRequest struct {
+	Kind       requestKind
+	Confidence bool // a trailing "Confidence: x" line is expected
+}
+
+type aiRequestKey struct{}
+
+func withAIRequest(ctx context.Context, r aiRequest) context.Context {
+	return context.WithValue(ctx, aiRequestKey{}, r)
+}
+
+func aiRequestOf(ctx context.Context) aiRequest {
+	r, _ := ctx.Value(aiRequestKey{}).(aiRequest)
+	if r.Kind == "" {
+		r.Kind = kindMessage
+	}
+	return r
+}
+
+var (
+	diffFileRe     = regexp.MustCompile(`(?m)^diff --git a/(\S+) b/(\S+)`)
+	mockFileLineRe = regexp.MustCompile(`(?m)^- (\S+) .*, \+\d+ -\d+$`)
+)
+
+func (MockClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	apiUsage.add(0, 0)
+	r := aiRequestOf(ctx)
+	if r.Kind == kindBatch {
+		return mockBatch(user), nil
+	}
+	return mockMessage(r, user), nil
+}
+
+// mockBatch answers a suggestBatch request with one mock message per commit.
+func mockBatch(user string) string {
+	type entry struct {
+		Commit     int      `json:"commit"`
+		Message    string   `json:"message"`
+		Confidence *float64 `json:"confidence,omitempty"`
+	}
+	var out []entry
+	for i, part := range batchHeaderRe.Split(user, -1)[1:] {
+		msg, conf := extractConfidence(mockMessage(aiRequest{Kind: kindMessage, Confidence: true}, part))
+		out = append(out, entry{Commit: i + 1, Message: msg, Confidence: conf})
+	}
+	data, _ := json.Marshal(out)
+	return string(data)
+}
+
+func mockMessage(r aiRequest, user string) string {
+	if r.Kind == kindTranslate || r.Kind == kindParaphrase {
+		// Both return the message as is: enough to exercise the pipeline.
+		_, msg, _ := strings.Cut(user, "Message:\n")
+		return msg
+	}
+	var files []string
+	seen := map[string]bool{}
+	for _, m := range diffFileRe.FindAllStringSubmatch(user, -1) {
+		if !seen[m[2]] {
+			seen[m[2]] = true
+			files = append(files, m[2])
+		}
+	}
+	if before, _, ok := strings.Cut(user, "Change summary"); ok && len(files) == 0 {
+		// Written from a summary: the file list is all there is.
+		for _, m := range mockFileLineRe.FindAllStringSubmatch(before, -1) {
+			files = append(files, m[1])
+		}
+	}
+	if r.Kind == kindConsistency {
+		return `{"subjects": []}`
+	}
+	if len(files) == 0 {
+		return "chore: update project files"
+	}
+	if r.Kind == kindAdvise {
+		return mockAdvice(files)
+	}
+	if r.Kind == kindSummary {
+		return "- changes " + strings.Join(files, ", ")
+	}
+
+	kind := "chore"
+	switch {
+	case allMatch(files, func(f string) bool { return strings.HasSuffix(f, ".md") || strings.HasPrefix(f, "docs/") }):
+		kind = "docs"
+	case allMatch(files, func(f string) bool { return strings.Contains(f, "_test.") || strings.Contains(f, "test/") }):
+		kind = "test"
+	}
+	subject := fmt.Sprintf("%s: update %s", kind, files[0])
+	confidence := "0.90"
+	if kind == "chore" {
+		confidence = "0.50"
+	}
+	if len(files) > 1 {
+		subject = fmt.Sprintf("%s: update %s and %d more files", kind, files[0], len(files)-1)
+	}
+	var sb strings.Builder
+	sb.WriteString(subject)
+	sb.WriteString("\n\n")
+	for _, f := range files {
+		sb.WriteString("- Update " + f + "\n")
+	}
+	if r.Confidence {
+		sb.WriteString("\nConfidence: " + confidence + "\n")
+	}
+	return sb.String()
+}
+
+// mockAdvice proposes one commit per top-level directory.
+func mockAdvice(files []string) string {
+	var adv splitAdvice
+	idx := map[string]int{}
+	for _, f := range files {
+		area := "root"
+		if dir, _, ok := strings.Cut(f, "/"); ok {
+			area = dir
+		}
+		i, ok := idx[area]
+		if !ok {
+			i = len(adv.Commits)
+			idx[area] = i
+			adv.Commits = append(adv.Commits, splitCommit{Message: "chore(" + area + "): update " + area})
+		}
+		adv.Commits[i].Files = append(adv.Commits[i].Files, f)
+	}
+	adv.Split = len(adv.Commits) > 1
+	if adv.Split {
+		adv.Reason = fmt.Sprintf("changes %d independent directories", len(adv.Commits))
+	} else {
+		adv.Commits = nil
+	}
+	data, _ := json.Marshal(adv)
+	return string(data)
+}
+
+func allMatch(ss []string, pred func(string) bool) bool {
+	for _, s := range ss {
+		if !pred(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// fixture is one recorded completion, keyed by a hash of the request.
+type fixture struct {
+	Model    string `json:"model"`
+	System   string `json:"system"`
+	User     string `json:"user"`
+	Response string `json:"response"`
+}
+
+func fixtureKey(model, system, user string) string {
+	return sha256Hex([]byte(model + "\x00" + system + "\x00" + user))[:16]
+}
+
+// recordingClient stores every completion of the wrapped client as a JSON
+// fixture in dir.
+type recordingClient struct {
+	inner AIClient
+	dir   string
+}
+
+func (c *recordingClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	txt, err := c.inner.Complete(ctx, model, system, user)
+	if err != nil {
+		return "", err
+	}
+	data, _ := json.MarshalIndent(fixture{Model: model, System: system, User: user, Response: txt}, "", "  ")
+	path := filepath.Join(c.dir, fixtureKey(model, system, user)+".json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("cannot record fixture: %w", err)
+	}
+	return txt, nil
+}
+
+// replayClient answers completions from fixtures written by recordingClient
+// and never touches the network.
+type replayClient struct {
+	dir string
+}
+
+func (c *replayClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	key := fixtureKey(model, system, user)
+	data, err := os.ReadFile(filepath.Join(c.dir, key+".json"))
+	if err != nil {
+		return "", fmt.Errorf("no recorded fixture %s in %s (re-record with --record)", key, c.dir)
+	}
+	var fx fixture
+	if err := json.Unmarshal(data, &fx); err != nil {
+		return "", fmt.Errorf("corrupt fixture %s: %w", key, err)
+	}
+	return fx.Response, nil
+}
+
+// ============================
+// Model routing
+// ============================
+
+// modelRouting sends small diffs to a cheap model and the rest to a
+// stronger one. It is parsed from "small=<model>,large=<model>".
+type modelRouting struct {
+	small, large string
+	lines        int // diffs with fewer changed lines than this are small
+}
+
+func parseModelRouting(s string, lines int) (*modelRouting, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	r := &modelRouting{lines: lines}
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		v = strings.TrimSpace(v)
+		switch {
+		case !ok || v == "":
+			return nil, fmt.Errorf("--model-routing: expected small=<model>,large=<model>, got %q", pair)
+		case k == "small":
+			r.small = v
+		case k == "large":
+			r.large = v
+		default:
+			return nil, fmt.Errorf("--model-routing: unknown size %q (use small and large)", k)
+		}
+	}
+	if r.small == "" || r.large == "" {
+		return nil, errors.New("--model-routing needs both small=<model> and large=<model>")
+	}
+	if lines <= 0 {
+		return nil, errors.New("--routing-lines must be positive")
+	}
+	return r, nil
+}
+
+// pick returns the model for a diff.
+func (r *modelRouting) pick(diff string) string {
+	if changedLines(diff) < r.lines {
+		return r.small
+	}
+	return r.large
+}
+
+func (r *modelRouting) String() string {
+	return fmt.Sprintf("small=%s,large=%s,lines=%d", r.small, r.large, r.lines)
+}
+
+// changedLines counts added and removed lines in a unified diff.
+func changedLines(diff string) int {
+	n := 0
+	for _, l := range strings.Split(diff, "\n") {
+		if (strings.HasPrefix(l, "+") || strings.HasPrefix(l, "-")) &&
+			!strings.HasPrefix(l, "+++ ") && !strings.HasPrefix(l, "--- ") {
+			n++
+		}
+	}
+	return n
+}
+
+// ============================
+// OpenAI Batch API (plan --batch-api / --collect)
+// ============================
+
+// A batch run is two invocations of plan with the same options. The first
+// runs the plan loop against batchCollector, which records each prompt and
+// answers with a placeholder, then uploads the prompts as one batch. The
+// second downloads the results and runs the loop again against
+// batchResultClient, which answers the same prompts (matched by their
+// fixture key) from the batch output.
+
+const batchPlaceholder = "chore: pending batch result\n\nConfidence: 1"
+
+type batchRequest struct {
+	key, model, system, user string
+}
+
+type batchCollector struct {
+	reqs []batchRequest
+	seen map[string]bool
+}
+
+func (c *batchCollector) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	key := fixtureKey(model, system, user)
+	if c.seen == nil {
+		c.seen = map[string]bool{}
+	}
+	if !c.seen[key] {
+		c.seen[key] = true
+		c.reqs = append(c.reqs, batchRequest{key: key, model: model, system: system, user: user})
+	}
+	return batchPlaceholder, nil
+}
+
+// submitBatch uploads the collected prompts and starts a 24h batch.
+func submitBatch(ctx context.Context, oc *OpenAIClient, reqs []batchRequest, audit *auditClient) (string, error) {
+	var buf bytes.Buffer
+	for _, r := range reqs {
+		body := map[string]any{
+			"model": r.model,
+			"messages": []map[string]string{
+				{"role": "system", "content": r.system},
+				{"role": "user", "content": r.user},
+			},
+			"max_completion_tokens": 4000,
+		}
+		if oc.gen.Temperature != nil {
+			body["temperature"] = *oc.gen.Temperature
+		}
+		if oc.gen.TopP != nil {
+			body["top_p"] = *oc.gen.TopP
+		}
+		if oc.gen.Seed != nil {
+			body["seed"] = *oc.gen.Seed
+		}
+		line, err := json.Marshal(map[string]any{"custom_id": r.key, "method": "POST", "url": "/v1/chat/completions", "body": body})
+		if err != nil {
+			return "", err
+		}
+		buf.Write(append(line, '\n'))
+		if audit != nil {
+			if err := audit.record(time.Now(), r.model, r.system, r.user, "", nil); err != nil {
+				return "", err
+			}
+		}
+	}
+	f, err := oc.client.Files.New(ctx, openai.FileNewParams{
+		File:    openai.File(&buf, "smartmsg-batch.jsonl", "application/jsonl"),
+		Purpose: openai.FilePurposeBatch,
+	})
+	if err != nil {
+		return "", fmt.Errorf("upload batch input: %w", err)
+	}
+	b, err := oc.client.Batches.New(ctx, openai.BatchNewParams{
+		CompletionWindow: openai.BatchNewParamsCompletionWindow24h,
+		Endpoint:         openai.BatchNewParamsEndpointV1ChatCompletions,
+		InputFileID:      f.ID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("create batch: %w", err)
+	}
+	return b.ID, nil
+}
+
+type batchResult struct {
+	content            string
+	prompt, completion int64
+}
+
+// batchResultClient answers from a finished batch. Requests that failed
+// inside the batch, and the aggregate consistency request (which depends on
+// the answers), go to the live client; anything else missing means the
+// options differ from the --batch-api run.
+type batchResultClient struct {
+	id      string
+	results map[string]batchResult
+	failed  map[string]bool
+	inner   AIClient
+	audit   *auditClient
+	usage   Usage // traffic answered from the batch
+}
+
+func (c *batchResultClient) DiffBudget() int { return diffBudgetOf(c.inner) }
+
+func (c *batchResultClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	key := fixtureKey(model, system, user)
+	if r, ok := c.results[key]; ok {
+		apiUsage.add(r.prompt, r.completion)
+		c.usage.Requests++
+		c.usage.PromptTokens += r.prompt
+		c.usage.CompletionTokens += r.completion
+		if c.audit != nil {
+			if err := c.audit.record(time.Now(), model, system, user, r.content, nil); err != nil {
+				return "", err
+			}
+		}
+		return r.content, nil
+	}
+	if c.failed[key] || system == consistencySystemPrompt {
+		return c.inner.Complete(ctx, model, system, user)
+	}
+	return "", fmt.Errorf("prompt %s is not in batch %s; rerun --collect with the options used for --batch-api (or plan again without batching)", key, c.id)
+}
+
+// collectBatch downloads the output of a finished batch.
+func collectBatch(ctx context.Context, oc *OpenAIClient, id string) (*batchResultClient, error) {
+	b, err := oc.client.Batches.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	switch b.Status {
+	case "completed", "expired", "cancelled":
+		// An expired or cancelled batch keeps whatever it finished; the rest
+		// is asked live.
+		if b.Status != "completed" {
+			slog.Warn("batch ended early; the rest will be asked directly", "batch", id, "status", b.Status, "completed", b.RequestCounts.Completed, "total", b.RequestCounts.Total)
+		}
+	case "failed":
+		return nil, fmt.Errorf("batch %s failed: %s", id, batchErrors(b))
+	default:
+		return nil, fmt.Errorf("batch %s is %s (%d of %d done); try again later", id, b.Status, b.RequestCounts.Completed, b.RequestCounts.Total)
+	}
+	c := &batchResultClient{id: id, results: map[string]batchResult{}, failed: map[string]bool{}}
+	for _, fileID := range []string{b.OutputFileID, b.ErrorFileID} {
+		if fileID == "" {
+			continue
+		}
+		resp, err := oc.client.Files.Content(ctx, fileID)
+		if err != nil {
+			return nil, fmt.Errorf("download batch results: %w", err)
+		}
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(make([]byte, 1<<20), 64<<20)
+		for sc.Scan() {
+			var line struct {
+				CustomID string `json:"custom_id"`
+				Response struct {
+					StatusCode int                   `json:"status_code"`
+					Body       openai.ChatCompletion `json:"body"`
+				} `json:"response"`
+			}
+			if json.Unmarshal(sc.Bytes(), &line) != nil || line.CustomID == "" {
+				continue
+			}
+			body := line.Response.Body
+			if line.Response.StatusCode != http.StatusOK || len(body.Choices) == 0 {
+				c.failed[line.CustomID] = true
+				continue
+			}
+			c.results[line.CustomID] = batchResult{
+				content:    body.Choices[0].Message.Content,
+				prompt:     body.Usage.PromptTokens,
+				completion: body.Usage.CompletionTokens,
+			}
+		}
+		resp.Body.Close()
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("read batch results: %w", err)
+		}
+	}
+	if len(c.failed) > 0 {
+		slog.Warn("requests failed inside the batch; they will be asked directly", "batch", id, "failed", len(c.failed))
+	}
+	return c, nil
+}
+
+func batchErrors(b *openai.Batch) string {
+	var msgs []string
+	for _, e := range b.Errors.Data {
+		msgs = append(msgs, e.Message)
+	}
+	if len(msgs) == 0 {
+		return "no details"
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ============================
+// Audit log
+// ============================
+
+// auditClient writes every prompt sent to the provider and what came back
+// to its own JSON file, so a security review can see exactly what left the
+// machine. Credential-shaped strings are masked in the files (the entry
+// says which kinds were found) so the log doesn't become a secret store.
+type auditClient struct {
+	inner    AIClient
+	dir      string
+	provider string
+
+	mu  sync.Mutex
+	seq int
+}
+
+type auditEntry struct {
+	Time       string         `json:"time"`
+	Provider   string         `json:"provider"`
+	Model      string         `json:"model"`
+	DurationMS int64          `json:"duration_ms"`
+	System     string         `json:"system"`
+	User       string         `json:"user"`
+	Response   string         `json:"response,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Redactions map[string]int `json:"redactions,omitempty"` // kind -> occurrences masked
+}
+
+func (c *auditClient) DiffBudget() int { return diffBudgetOf(c.inner) }
+
+func (c *auditClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	start := time.Now()
+	txt, err := c.inner.Complete(ctx, model, system, user)
+	if werr := c.record(start, model, system, user, txt, err); werr != nil {
+		// An exchange that cannot be audited must not count as done.
+		return "", werr
+	}
+	return txt, err
+}
+
+// record writes one exchange; it is also used for prompts that reach the
+// provider outside Complete, such as Batch API uploads.
+func (c *auditClient) record(start time.Time, model, system, user, txt string, err error) error {
+	e := auditEntry{
+		Time:       start.UTC().Format(time.RFC3339Nano),
+		Provider:   c.provider,
+		Model:      model,
+		DurationMS: time.Since(start).Milliseconds(),
+		Redactions: map[string]int{},
+	}
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{{&e.System, system}, {&e.User, user}, {&e.Response, txt}} {
+		*f.dst = redactSecrets(f.src, e.Redactions)
+	}
+	if err != nil {
+		e.Error = redactSecrets(err.Error(), e.Redactions)
+	}
+	c.mu.Lock()
+	c.seq++
+	name := fmt.Sprintf("%s-%04d.json", start.UTC().Format("20060102T150405.000Z"), c.seq)
+	c.mu.Unlock()
+	data, _ := json.MarshalIndent(e, "", "  ")
+	if werr := os.WriteFile(filepath.Join(c.dir, name), append(data, '\n'), 0600); werr != nil {
+		return fmt.Errorf("cannot write audit log: %w", werr)
+	}
+	return nil
+}
+
+// redactRule is one kind of sensitive string. Patterns with a group mask
+// only the group, keeping the key name readable.
+type redactRule struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+// secretPatterns match credential-shaped strings.
+var secretPatterns = []redactRule{
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{"aws-access-key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github-token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"openai-key", regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}`)},
+	{"google-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"slack-token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"jwt", regexp.MustCompile(`\beyJ[\w-]{10,}\.eyJ[\w-]{10,}\.[\w-]{10,}`)},
+	{"assigned-secret", regexp.MustCompile(`(?i)(?:password|passwd|secret|api[_-]?key|access[_-]?token|auth[_-]?token)["']?\s*[:=]\s*["']?([^\s"',;]{8,})`)},
+}
+
+// redactSecrets masks secretPatterns in s and counts what it masked.
+func redactSecrets(s string, counts map[string]int) string {
+	return redact(s, secretPatterns, "", counts)
+}
+
+// redact masks every match of rules in s, counting matches by kind. The
+// mask is replacement, or "[REDACTED:<kind>]" when that is empty.
+func redact(s string, rules []redactRule, replacement string, counts map[string]int) string {
+	for _, p := range rules {
+		s = p.re.ReplaceAllStringFunc(s, func(m string) string {
+			counts[p.kind]++
+			mask := cmp.Or(replacement, "[REDACTED:"+p.kind+"]")
+			if sub := p.re.FindStringSubmatchIndex(m); len(sub) > 2 && sub[2] >= 0 {
+				return m[:sub[2]] + mask + m[sub[3]:]
+			}
+			return mask
+		})
+	}
+	return s
+}
+
+// ============================
+// Rate limiting
+// ============================
+
+// rateLimitedClient holds each completion until it fits under the
+// requests-per-minute and tokens-per-minute caps. One limiter is shared by
+// every goroutine using the client, so the caps apply to the whole run.
+type rateLimitedClient struct {
+	inner AIClient
+	rpm   int
+	tpm   int
+
+	mu   sync.Mutex
+	sent []rateEntry // requests admitted in the last minute, oldest first
+}
+
+type rateEntry struct {
+	at     time.Time
+	tokens int
+}
+
+// completionReserve is the completion size assumed when admitting a request;
+// the prompt is estimated at ~4 characters per token.
+const completionReserve = 1000
+
+func estimateTokens(system, user string) int {
+	return (len(system)+len(user))/4 + completionReserve
+}
+
+func (c *rateLimitedClient) DiffBudget() int { return diffBudgetOf(c.inner) }
+
+// Complete waits for capacity without spending the caller's timeout on it:
+// a deadline on ctx is re-applied from the moment the request is admitted,
+// while cancellation still aborts the wait.
+func (c *rateLimitedClient) Complete(ctx context.Context, model string, system string, user string) (string, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	remaining := time.Until(deadline)
+	waited, err := c.wait(ctx, estimateTokens(system, user))
+	if err != nil {
+		return "", err
+	}
+	if hasDeadline && waited >= time.Millisecond {
+		inner, cancel := context.WithTimeout(context.WithoutCancel(ctx), remaining)
+		defer cancel()
+		stop := context.AfterFunc(ctx, func() {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				cancel()
+			}
+		})
+		defer stop()
+		ctx = inner
+	}
+	return c.inner.Complete(ctx, model, system, user)
+}
+
+// wait blocks until a request of the given size can be sent, records it and
+// returns how long it waited. Only cancellation of ctx ends the wait early.
+func (c *rateLimitedClient) wait(ctx context.Context, tokens int) (time.Duration, error) {
+	start := time.Now()
+	done := ctx.Done()
+	if c.tpm > 0 && tokens > c.tpm {
+		// A request larger than the whole budget could never be admitted;
+		// let it through alone once the window is empty.
+		tokens = c.tpm
+	}
+	for {
+		c.mu.Lock()
+		now := time.Now()
+		for len(c.sent) > 0 && now.Sub(c.sent[0].at) >= time.Minute {
+			c.sent = c.sent[1:]
+		}
+		used := 0
+		for _, e := range c.sent {
+			used += e.tokens
+		}
+		okRPM := c.rpm <= 0 || len(c.sent) < c.rpm
+		okTPM := c.tpm <= 0 || used+tokens <= c.tpm
+		if okRPM && okTPM {
+			c.sent = append(c.sent, rateEntry{at: now, tokens: tokens})
+			c.mu.Unlock()
+			return now.Sub(start), nil
+		}
+		// Sleep until the oldest entry leaves the window; that is the
+		// earliest moment either cap can free up.
+		delay := time.Minute - now.Sub(c.sent[0].at)
+		c.mu.Unlock()
+		slog.Info("rate limit reached, waiting", "delay", delay.Round(time.Second))
+		select {
+		case <-done:
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return 0, ctx.Err()
+			}
+			done = nil // deadline passed; keep waiting, see Complete
+		case <-time.After(delay):
+		}
+	}
+}
+
+// ============================
+// Provider selection
+// ============================
+
+// defaultModel returns the model used when --model is not given.
+func defaultModel(provider string) string {
+	switch strings.ToLower(strings.TrimSpace(provider)) {
+	case "gemini":
+		return envOr("GEMINI_MODEL", "gemini-2.0-flash")
+	case "bedrock":
+		return envOr("BEDROCK_MODEL", "anthropic.claude-3-5-haiku-20241022-v1:0")
+	case "mock":
+		return "mock"
+	default:
+		return envOr("OPENAI_MODEL", "gpt-5-nano")
+	}
+}
+
+// providerName is the canonical spelling of a --provider value.
+func providerName(provider string) string {
+	if p := strings.ToLower(strings.TrimSpace(provider)); p != "" {
+		return p
+	}
+	return "openai"
+}
+
+func newAIClient(provider string, gen GenParams) (AIClient, error) {
+	switch providerName(provider) {
+	case "openai":
+		return NewOpenAIClient(gen)
+	case "azure":
+		return NewAzureOpenAIClient(gen)
+	case "gemini":
+		return NewGeminiClient(gen)
+	case "bedrock":
+		return NewBedrockClient(gen)
+	case "mock":
+		return MockClient{}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q (want openai, azure, gemini, bedrock or mock)", provider)
+	}
+}
+
+// aiFlags holds the provider, model and sampling flags shared by every
+// command that talks to a model.
+type aiFlags struct {
+	provider string
+	model    string
+	gen      GenParams
+	record   string
+	replay   string
+	rpm      int
+	tpm      int
+	audit    string
+	net      netOptions
+}
+
+// netOptions are the HTTP transport settings; see newHTTPClient.
+type netOptions struct {
+	proxy, caBundle, clientCert, clientKey string
+}
+
+func (a *aiFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&a.model, "model", "", "LLM model (default: $OPENAI_MODEL, $GEMINI_MODEL, $BEDROCK_MODEL or the provider default; Azure: mapped to a deployment)")
+	// The provider is kept lowercased so every check of it agrees with
+	// newAIClient, which accepts any case.
+	a.provider = providerName(envOr("SMARTMSG_PROVIDER", "openai"))
+	fs.Func("provider", "AI provider: openai, azure, gemini, bedrock or mock (default $SMARTMSG_PROVIDER or openai)", func(v string) error {
+		a.provider = providerName(v)
+		return nil
+	})
+	fs.StringVar(&a.record, "record", "", "record every AI response as a fixture in this directory")
+	fs.StringVar(&a.replay, "replay", "", "answer from fixtures in this directory instead of calling the provider")
+	fs.StringVar(&a.audit, "audit-log", os.Getenv("SMARTMSG_AUDIT_LOG"), "write every prompt and response (secrets masked) as a timestamped JSON file in this directory")
+	fs.StringVar(&a.net.proxy, "proxy", os.Getenv("SMARTMSG_PROXY"), "HTTP(S) proxy URL for AI requests (default: $HTTPS_PROXY/$NO_PROXY)")
+	fs.StringVar(&a.net.caBundle, "ca-bundle", os.Getenv("SMARTMSG_CA_BUNDLE"), "PEM file with extra root CAs to trust (e.g. a corporate TLS-inspecting proxy)")
+	fs.StringVar(&a.net.clientCert, "client-cert", os.Getenv("SMARTMSG_CLIENT_CERT"), "PEM client certificate for mutual TLS (may include the key)")
+	fs.StringVar(&a.net.clientKey, "client-key", os.Getenv("SMARTMSG_CLIENT_KEY"), "PEM private key for --client-cert")
+	fs.IntVar(&a.rpm, "rpm", 0, "client-side cap on AI requests per minute (0: unlimited)")
+	fs.IntVar(&a.tpm, "tpm", 0, "client-side cap on estimated AI tokens per minute (0: unlimited)")
+	fs.Func("temperature", "sampling temperature 0-2 (provider default if unset)", func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 2 {
+			return fmt.Errorf("must be a number between 0 and 2")
+		}
+		a.gen.Temperature = &f
+		return nil
+	})
+	fs.Func("top-p", "nucleus sampling 0-1 (provider default if unset)", func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("must be a number between 0 and 1")
+		}
+		a.gen.TopP = &f
+		return nil
+	})
+	fs.Func("seed", "sampling seed for reproducible output (where the provider supports it)", func(v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		a.gen.Seed = &n
+		return nil
+	})
+}
+
+// auditLog returns the --audit-log writer, or nil without one.
+func (a *aiFlags) auditLog() (*auditClient, error) {
+	if a.audit == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(a.audit, 0700); err != nil {
+		return nil, err
+	}
+	return &auditClient{dir: a.audit, provider: a.provider}, nil
+}
+
+// client fills in the default model and builds the provider client.
+func (a *aiFlags) client() (AIClient, error) {
+	if a.model == "" {
+		a.model = defaultModel(a.provider)
+	}
+	if a.replay != "" {
+		if a.record != "" {
+			return nil, errors.New("--record and --replay are mutually exclusive")
+		}
+		return &loggingClient{inner: &replayClient{dir: a.replay}, provider: "replay"}, nil
+	}
+	if a.net != (netOptions{}) {
+		hc, err := newHTTPClient(a.net.proxy, a.net.caBundle, a.net.clientCert, a.net.clientKey)
+		if err != nil {
+			return nil, err
+		}
+		httpClient = hc
+	}
+	ai, err := newAIClient(a.provider, a.gen)
+	if err != nil {
+		return nil, err
+	}
+	ai = &loggingClient{inner: ai, provider: a.provider}
+	if audit, err := a.auditLog(); err != nil {
+		return nil, err
+	} else if audit != nil {
+		audit.inner = ai
+		ai = audit
+	}
+	if a.record != "" {
+		if err := os.MkdirAll(a.record, 0755); err != nil {
+			return nil, err
+		}
+		ai = &recordingClient{inner: ai, dir: a.record}
+	}
+	if a.rpm > 0 || a.tpm > 0 {
+		ai = &rateLimitedClient{inner: ai, rpm: a.rpm, tpm: a.tpm}
+	}
+	return ai, nil
+}
+
+// ============================
+// HTTP transport (proxy, CA, mTLS)
+// ============================
+
+// httpClient is shared by every provider and the issue fetcher. aiFlags
+// replaces it when proxy or TLS settings are given.
+var httpClient = http.DefaultClient
+
+// newHTTPClient builds a client for corporate networks: an explicit proxy
+// (otherwise HTTPS_PROXY/NO_PROXY apply as usual), extra root CAs appended
+// to the system pool, and an optional client certificate for mutual TLS.
+// certFile may hold the key too, in which case keyFile can be empty.
+func newHTTPClient(proxy, caBundle, certFile, keyFile string) (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	if caBundle != "" || certFile != "" {
+		tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s: no PEM certificates found", caBundle)
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	} else if keyFile != "" {
+		return nil, errors.New("--client-key needs --client-cert")
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// ============================
+// Config files
+// ============================
+
+// Options can be given defaults in YAML config files, keyed by flag name:
+// top-level keys apply to every subcommand that has the flag, and a mapping
+// named after a subcommand applies to that subcommand only. The repository's
+// .smartmsg.yaml overrides the user's config; environment variables behind a
+// flag override both, and command-line flags override everything.
+//
+//	provider: azure
+//	proxy: http://proxy.corp:8080
+//	plan:
+//	  limit: 50
+
+const repoConfigFile = ".smartmsg.yaml"
+
+// flagEnv names the environment variable read for a flag's default.
+var flagEnv = map[string]string{
+	"provider":     "SMARTMSG_PROVIDER",
+	"audit-log":    "SMARTMSG_AUDIT_LOG",
+	"proxy":        "SMARTMSG_PROXY",
+	"ca-bundle":    "SMARTMSG_CA_BUNDLE",
+	"client-cert":  "SMARTMSG_CLIENT_CERT",
+	"client-key":   "SMARTMSG_CLIENT_KEY",
+	"notify-url":   "SMARTMSG_NOTIFY_URL",
+	"notify-slack": "SMARTMSG_NOTIFY_SLACK",
+}
+
+// userOnlyKeys decide where requests, credentials and prompts go, where
+// the answers come from, or which local files end up in a prompt, so a
+// cloned repository must not be able to set them.
+var userOnlyKeys = map[string]bool{
+	"proxy": true, "ca-bundle": true, "client-cert": true, "client-key": true,
+	"notify-url": true, "notify-slack": true,
+	"audit-log": true, "record": true, "replay": true,
+	"repo-context": true, "context-file": true,
+}
+
+// repoFileKeys name files that are sent to the AI provider or written to.
+// A repository's config may only point them inside its own work tree, so
+// a cloned repository cannot have ../../.aws/credentials put in a prompt,
+// or ~/.bashrc overwritten by the next plan.
+var repoFileKeys = map[string]bool{
+	"diff-file": true, "out": true, "plans-dir": true, "report": true,
+}
+
+// inWorkTree resolves a path from the repository's config against the top
+// of the work tree, following symlinks, and refuses one that leads outside.
+// A path still to be created is judged by its nearest existing parent.
+func inWorkTree(p string) (string, error) {
+	top, err := repoTop()
+	if err != nil {
+		return "", errors.New("needs a work tree")
+	}
+	if top, err = filepath.EvalSymlinks(top); err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(top, p)
+	}
+	real, rest := p, ""
+	for {
+		r, err := filepath.EvalSymlinks(real)
+		if err == nil {
+			real = filepath.Join(r, rest)
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) || filepath.Dir(real) == real {
+			return "", err
+		}
+		real, rest = filepath.Dir(real), filepath.Join(filepath.Base(real), rest)
+	}
+	if rel, err := filepath.Rel(top, real); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the repository", p)
+	}
+	return real, nil
+}
+
+func userConfigPath() string {
+	if p := os.Getenv("SMARTMSG_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "git-smartmsg", "config.yaml")
+}
+
+// parseFlags applies config-file defaults to fs and then parses args.
+// While collectFlags is set it only hands fs over and returns
+// errFlagsCollected, so completion and man can list a command's flags by
+// calling it without running it.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if collectFlags != nil {
+		collectFlags(fs)
+		return errFlagsCollected
+	}
+	if path := userConfigPath(); path != "" {
+		if err := applyConfig(fs, path, true); err != nil {
+			return err
+		}
+	}
+	b, path, err := readRepoFile(repoConfigFile)
+	if err == nil {
+		err = applyConfigData(fs, path, b, false)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return fs.Parse(args)
+}
+
+func applyConfig(fs *flag.FlagSet, path string, trusted bool) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return applyConfigData(fs, path, b, trusted)
+}
+
+func applyConfigData(fs *flag.FlagSet, path string, b []byte, trusted bool) error {
+	v, err := parseYAML(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	cfg, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: expected a mapping of option names", path)
+	}
+	set := func(key string, val any, scoped bool) error {
+		name := strings.ReplaceAll(key, "_", "-")
+		if fs.Lookup(name) == nil {
+			if scoped {
+				return fmt.Errorf("%s: %s: unknown option %q", path, fs.Name(), key)
+			}
+			return nil // meant for another subcommand
+		}
+		if !trusted && userOnlyKeys[name] {
+			return fmt.Errorf("%s: %q can only be set in %s or the environment", path, key, userConfigPath())
+		}
+		if env := flagEnv[name]; env != "" && os.Getenv(env) != "" {
+			return nil
+		}
+		var s string
+		switch val := val.(type) {
+		case map[string]any, []any:
+			return fmt.Errorf("%s: %s: expected a single value", path, key)
+		case nil:
+			return nil
+		default:
+			s = fmt.Sprint(val)
+		}
+		if !trusted && repoFileKeys[name] && s != "" {
+			p, err := inWorkTree(s)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+			s = p
+		}
+		if err := fs.Set(name, s); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		return nil
+	}
+	for key, val := range cfg {
+		if sub, ok := val.(map[string]any); ok && fs.Lookup(key) == nil {
+			if key != fs.Name() {
+				continue
+			}
+			for k, v := range sub {
+				if err := set(k, v, true); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := set(key, val, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================
+// Git helpers
+// ============================
+
+func git(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err := cmd.Run()
+	slog.Debug("git", "args", strings.Join(args, " "), "took", time.Since(start).Round(time.Microsecond), "ok", err == nil)
+	if err != nil {
+		return "", fmt.Errorf("git %v failed: %v, %s", args, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// gitEnv returns the process environment with the given KEY=value entries
+// replacing any existing ones. Keys are matched case-insensitively on
+// Windows, where the environment is, so a stale "Git_Author_Date" cannot
+// shadow the override.
+func gitEnv(overrides ...string) []string {
+	same := func(a, b string) bool { return a == b }
+	if runtime.GOOS == "windows" {
+		same = strings.EqualFold
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		overridden := false
+		for _, o := range overrides {
+			if ok, _, _ := strings.Cut(o, "="); k != "" && same(k, ok) {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			env = append(env, kv)
+		}
+	}
+	return append(env, overrides...)
+}
+
+func ensureCleanWorktree() error {
+	out, err := git("status", "--porcelain")
+	if err != nil {
+		return err
+	}
+
+	// Filter out plan.json and other working files
+	lines := splitLines(strings.TrimSpace(out))
+	var filteredLines []string
+
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Extract filename from git status --porcelain output
+		// Format: "XY filename" where XY are status codes
+		if len(line) >= 3 {
+			filename := strings.TrimSpace(line[2:])
+			// Ignore plan files
+			if filename != "plan.json" && filename != "plan.yaml" && filename != "plan.yml" {
+				filteredLines = append(filteredLines, line)
+			}
+		}
+	}
+
+	if len(filteredLines) > 0 {
+		return errors.New("worktree is not clean; commit/stash first")
+	}
+	return nil
+}
+
+type CommitMeta struct {
+	SHA         string
+	Subject     string
+	AuthorName  string
+	AuthorEmail string
+	AuthorDate  time.Time
+	IsMerge     bool
+}
+
+func listCommits(rangeExpr string) ([]CommitMeta, error) {
+	// %H SHA, %s subject, %an, %ae, %ad (ISO8601), %P parents
+	format := "%H%x1f%s%x1f%an%x1f%ae%x1f%aI%x1f%P%x1e"
+	out, err := git("log", "--reverse", "--format="+format, rangeExpr)
+	if err != nil {
+		return nil, err
+	}
+	var commits []CommitMeta
+	records := strings.Split(strings.TrimSuffix(out, "\x1e"), "\x1e")
+	for _, rec := range records {
+		if strings.TrimSpace(rec) == "" {
+			continue
+		}
+		parts := strings.Split(rec, "\x1f")
+		if len(parts) < 6 {
+			continue
+		}
+		dt, _ := time.Parse(time.RFC3339, parts[4])
+
+		parents := strings.Fields(parts[5])
+		isMerge := len(parents) > 1
+
+		commits = append(commits, CommitMeta{
+			SHA:         strings.TrimSpace(parts[0]),
+			Subject:     parts[1],
+			AuthorName:  parts[2],
+			AuthorEmail: parts[3],
+			AuthorDate:  dt,
+			IsMerge:     isMerge,
+		})
+	}
+	return commits, nil
+}
+
+var wipSubjectRe = regexp.MustCompile(`(?i)^(wip\b|fixup!|squash!|amend!|tmp\b|temp\b|oops|typo|fix typo|minor|\.+$|-$)`)
+
+// squashGroups clusters runs of consecutive tiny commits (few changed lines,
+// or a wip/fixup-style subject) that touch overlapping files. Merges and
+// larger commits always stand alone.
+func squashGroups(commits []CommitMeta, tinyLines int) ([][]CommitMeta, error) {
+	var groups [][]CommitMeta
+	var files map[string]bool // files touched by the open group
+	for _, c := range commits {
+		out, err := git("show", "--numstat", "--format=", c.SHA)
+		if err != nil {
+			return nil, err
+		}
+		touched := map[string]bool{}
+		lines := 0
+		for _, l := range splitLines(strings.TrimSpace(out)) {
+			parts := strings.SplitN(l, "\t", 3)
+			if len(parts) < 3 {
+				continue
+			}
+			add, _ := strconv.Atoi(parts[0]) // "-" for binary files
+			del, _ := strconv.Atoi(parts[1])
+			lines += add + del
+			touched[parts[2]] = true
+		}
+		tiny := !c.IsMerge && (lines <= tinyLines || wipSubjectRe.MatchString(c.Subject))
+		overlaps := false
+		for f := range touched {
+			overlaps = overlaps || files[f]
+		}
+		if n := len(groups); tiny && overlaps && n > 0 {
+			groups[n-1] = append(groups[n-1], c)
+			for f := range touched {
+				files[f] = true
+			}
+			continue
+		}
+		groups = append(groups, []CommitMeta{c})
+		files = nil
+		if tiny {
+			files = touched
+		}
+	}
+	return groups, nil
+}
+
+// groupDiff is the combined diff of a run of consecutive commits.
+func groupDiff(g []CommitMeta, funcContext bool) (string, error) {
+	if len(g) == 1 {
+		return showDiff(g[0].SHA, funcContext)
+	}
+	first, last := g[0].SHA, g[len(g)-1].SHA
+	if _, err := git("rev-parse", "--verify", "--quiet", first+"^"); err != nil {
+		// Root commit: no parent to diff against, so show each in turn.
+		var sb strings.Builder
+		for _, c := range g {
+			d, err := showDiff(c.SHA, funcContext)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(d)
+		}
+		return sb.String(), nil
+	}
+	out, err := git(append(append([]string{"diff"}, diffArgs(funcContext)...), first+"^", last)...)
+	if err != nil {
+		return "", err
+	}
+	return promptDiff(out), nil
+}
+
+var (
+	diffHunkHeaderRe = regexp.MustCompile(`^@@ [^@]* @@`)
+	diffIndexLineRe  = regexp.MustCompile(`^index [0-9a-f]+\.\.[0-9a-f]+`)
+)
+
+// diffHash fingerprints a diff by its content only: the commit header, blob
+// ids and hunk line numbers are dropped, so a cherry-picked duplicate or a
+// formatting commit repeated elsewhere in history hashes the same.
+func diffHash(diff string) string {
+	if i := strings.Index(diff, "diff --git "); i > 0 {
+		diff = diff[i:]
+	}
+	h := sha256.New()
+	for _, l := range strings.Split(diff, "\n") {
+		switch {
+		case diffIndexLineRe.MatchString(l):
+			continue
+		case strings.HasPrefix(l, "@@"):
+			l = diffHunkHeaderRe.ReplaceAllString(l, "@@")
+		}
+		io.WriteString(h, l+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// diffArgs are the common diff options; funcContext widens each hunk to the
+// whole enclosing function (-W) so the model sees where the change lives.
+func diffArgs(funcContext bool) []string {
+	args := []string{"--patch", "--unified=3", "--no-color", "--find-renames"}
+	if funcContext {
+		args = append(args, "--function-context")
+	}
+	return args
+}
+
+func showDiff(sha string, funcContext bool) (string, error) {
+	// ユニファイド差分（空白無視はしない/正確さ優先）
+	out, err := git(append(append([]string{"show"}, diffArgs(funcContext)...), sha)...)
+	if err != nil {
+		return "", err
+	}
+	return promptDiff(out), nil
+}
+
+func getStagedDiff(funcContext bool) (string, error) {
+	// ステージングエリアの差分を取得
+	out, err := git(append([]string{"diff", "--cached"}, diffArgs(funcContext)...)...)
+	if err != nil {
+		return "", err
+	}
+	return promptDiff(out), nil
+}
+
+// ============================
+// Prompt exclusions (.smartmsgignore)
+// ============================
+
+// ignoreFile lists, in gitignore syntax, paths whose changes are kept out
+// of every prompt. It is read from the repository root so the whole team
+// shares it; apply still commits those paths as usual.
+const ignoreFile = ".smartmsgignore"
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+type ignoreList []ignoreRule
+
+// parseIgnore reads gitignore patterns: '#' comments, '!' to re-include,
+// a trailing '/' for directories only, and a leading or inner '/' to anchor
+// the pattern at the root. '*', '?', '[...]' and '**' work as in git.
+func parseIgnore(text string) ignoreList {
+	var l ignoreList
+	for _, line := range splitLines(text) {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:] // \# and \! stand for themselves
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		prefix := `^(?:.*/)?`
+		if anchored {
+			prefix = `^`
+		}
+		re, err := regexp.Compile(prefix + globRegexp(line) + `$`)
+		if err != nil {
+			slog.Warn("ignoring bad pattern", "file", ignoreFile, "pattern", line)
+			continue
+		}
+		r.re = re
+		l = append(l, r)
+	}
+	return l
+}
+
+// globRegexp translates one gitignore glob into a regular expression over
+// slash-separated paths.
+func globRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString(`(?:.*/)?`)
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(`.*`)
+			i++
+		case c == '*':
+			sb.WriteString(`[^/]*`)
+		case c == '?':
+			sb.WriteString(`[^/]`)
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// match reports whether path is excluded. As in git, the last matching
+// pattern decides, and nothing under an excluded directory can be
+// re-included.
+func (l ignoreList) match(path string) bool {
+	parts := strings.Split(path, "/")
+	for i := 1; i <= len(parts); i++ {
+		sub, isDir := strings.Join(parts[:i], "/"), i < len(parts)
+		excluded := false
+		for _, r := range l {
+			if (!r.dirOnly || isDir) && r.re.MatchString(sub) {
+				excluded = !r.negate
+			}
+		}
+		if excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// promptIgnore is the repository's ignoreList, read once. Without a work
+// tree the committed file at HEAD is used.
+var promptIgnore = sync.OnceValue(func() ignoreList {
+	b, _, err := readRepoFile(ignoreFile)
+	if err != nil {
+		return nil
+	}
+	return parseIgnore(string(b))
+})
+
+// promptDiff drops the file sections of diff whose old or new path is
+// excluded by .smartmsgignore. Anything before the first section (the
+// commit header of git show) is kept.
+func promptDiff(diff string) string {
+	ignore := promptIgnore()
+	if len(ignore) == 0 {
+		return diff
+	}
+	var sb strings.Builder
+	skip, dropped, kept := false, 0, 0
+	for _, l := range strings.SplitAfter(diff, "\n") {
+		if m := diffFileRe.FindStringSubmatch(strings.TrimSuffix(l, "\n")); m != nil {
+			skip = ignore.match(m[1]) || ignore.match(m[2])
+			if skip {
+				dropped++
+			} else {
+				kept++
+			}
+		}
+		if !skip {
+			sb.WriteString(l)
+		}
+	}
+	if dropped > 0 && kept == 0 {
+		sb.WriteString("(All changes in this commit are in paths excluded by " + ignoreFile + "; their content is not shown.)\n")
+	}
+	return sb.String()
+}
+
+// ============================
+// Trivial commits (rename / format only)
+// ============================
+
+// whitespaceSignificant are files where indentation or spacing changes
+// meaning, so a whitespace-only diff in them is not a reformat.
+var whitespaceSignificant = regexp.MustCompile(`(?i)(\.(py|pyi|ya?ml|mk|haml|pug|sass|styl|coffee)|(^|/)(GNU)?makefile)$`)
+
+// trivialMessage writes the message for a commit that only renames files
+// (100% similar) or only changes whitespace, or returns "" for anything
+// else. spaceOnly says the change is empty under -w --ignore-blank-lines.
+func trivialMessage(diff string, spaceOnly, emoji bool) string {
+	files := parseDiffFiles(diff)
+	if len(files) == 0 {
+		return ""
+	}
+	renames, reformats := true, spaceOnly
+	allGo := true
+	for _, f := range files {
+		if f.Status != "renamed" || f.Similarity != "100%" {
+			renames = false
+		}
+		if f.Status != "modified" || f.Binary || f.Submodule || f.Added+f.Deleted == 0 || whitespaceSignificant.MatchString(f.Path) {
+			reformats = false
+		}
+		allGo = allGo && strings.HasSuffix(f.Path, ".go")
+	}
+
+	var subject string
+	var body []string
+	switch {
+	case renames:
+		verb := "rename"
+		if filepath.Base(files[0].OldPath) == filepath.Base(files[0].Path) {
+			verb = "move"
+		}
+		if len(files) == 1 {
+			subject = fmt.Sprintf("%s %s to %s", verb, files[0].OldPath, files[0].Path)
+			if len(subject) > 62 {
+				subject = fmt.Sprintf("%s %s to %s", verb, filepath.Base(files[0].OldPath), files[0].Path)
+			}
+		} else {
+			subject = fmt.Sprintf("rename %d files", len(files))
+			dir := filepath.Dir(files[0].Path)
+			for _, f := range files {
+				if filepath.Dir(f.Path) != dir || filepath.Base(f.Path) != filepath.Base(f.OldPath) {
+					dir = ""
+				}
+			}
+			if dir != "" {
+				subject = fmt.Sprintf("move %d files to %s/", len(files), dir)
+			}
+			for _, f := range files {
+				body = append(body, fmt.Sprintf("- %s -> %s", f.OldPath, f.Path))
+			}
+		}
+		if emoji {
+			subject = "🎨 " + strings.ToUpper(subject[:1]) + subject[1:]
+		} else {
+			subject = "refactor: " + subject
+		}
+	case reformats:
+		subject = "reformat " + files[0].Path
+		if len(files) > 1 {
+			subject = fmt.Sprintf("reformat %d files", len(files))
+			for _, f := range files {
+				body = append(body, "- "+f.Path)
+			}
+		}
+		if allGo {
+			subject += " with gofmt"
+		}
+		if emoji {
+			subject = "🎨 " + strings.ToUpper(subject[:1]) + subject[1:]
+		} else {
+			subject = "style: " + subject
+		}
+	default:
+		return ""
+	}
+	if len(body) > 20 {
+		body = append(body[:20], fmt.Sprintf("- ... and %d more", len(body)-20))
+	}
+	if len(body) == 0 {
+		return subject
+	}
+	return subject + "\n\n" + strings.Join(body, "\n")
+}
+
+// spaceOnlyChange reports whether a group changes nothing but whitespace
+// and blank lines. Root commits never qualify.
+func spaceOnlyChange(g []CommitMeta) bool {
+	_, err := git("diff", "--quiet", "-w", "--ignore-blank-lines", g[0].SHA+"^", g[len(g)-1].SHA)
+	return err == nil
+}
+
+// ============================
+// Revert commits
+// ============================
+
+var (
+	revertBodyRe    = regexp.MustCompile(`(?m)^This reverts commit ([0-9a-f]{7,40})\.?\s*$`)
+	revertSubjectRe = regexp.MustCompile(`^Revert "(.+)"$`)
+)
+
+// revertedCommit finds the commit c reverts: the SHA named by git revert's
+// "This reverts commit" line, an earlier planned commit whose subject the
+// `Revert "..."` subject quotes, or one whose diff is exactly c's inverse.
+// It returns the full SHA, or "".
+func revertedCommit(c CommitMeta, body string, funcContext bool, items []PlanItem, byHash map[string]int) string {
+	if m := revertBodyRe.FindStringSubmatch(body); m != nil {
+		if sha, err := revParse(m[1] + "^{commit}"); err == nil {
+			return sha
+		}
+	}
+	if m := revertSubjectRe.FindStringSubmatch(c.Subject); m != nil {
+		for _, it := range items {
+			if firstLine(it.OldMessage) == m[1] {
+				return it.SHA
+			}
+		}
+	}
+	if len(byHash) == 0 {
+		return ""
+	}
+	// -R swaps the a/ and b/ prefixes too; pre-swap them so the paths
+	// read as in a forward diff.
+	inverse, err := git(append(append([]string{"show", "-R", "--src-prefix=b/", "--dst-prefix=a/"}, diffArgs(funcContext)...), c.SHA)...)
+	if err != nil {
+		return ""
+	}
+	if j, ok := byHash[diffHash(promptDiff(inverse))]; ok {
+		return items[j].SHA
+	}
+	return ""
+}
+
+// revertMessage describes a revert of sha by the reverted commit's (new)
+// subject. Any reason the original revert message gave is kept below the
+// "This reverts commit" line; apply swaps in sha's rewritten SHA.
+func revertMessage(sha, body string, items []PlanItem, emoji bool) string {
+	subject := ""
+	for _, it := range items {
+		if it.SHA == sha {
+			subject = firstLine(cmp.Or(strings.TrimSpace(it.NewMessage), it.OldMessage))
+		}
+	}
+	if subject == "" {
+		out, _ := git("log", "-1", "--format=%s", sha)
+		subject = strings.TrimSpace(out)
+	}
+	if emoji {
+		subject = fmt.Sprintf("⏪ Revert %q", subject)
+	} else {
+		_, desc := splitSubject(subject)
+		subject = "revert: " + desc
+	}
+	msg := subject + "\n\nThis reverts commit " + sha + "."
+	// Keep what the author wrote besides git's template lines.
+	_, rest, _ := strings.Cut(strings.TrimSpace(body), "\n")
+	if reason := strings.TrimSpace(revertBodyRe.ReplaceAllString(rest, "")); reason != "" {
+		msg += "\n\n" + reason
+	}
+	return msg
+}
+
+// ============================
+// Diff summaries
+// ============================
+
+// fileChange is the per-file header information prepended to the prompt so
+// the model knows what each hunk belongs to before reading it.
+type fileChange struct {
+	Path       string
+	OldPath    string
+	Status     string
+	Similarity string
+	Binary     bool
+	Added      int
+	Deleted    int
+	// OldBlob/NewBlob are the (abbreviated) blob ids from the index line;
+	// for submodules they are the gitlink commits.
+	OldBlob string
+	NewBlob string
+	// Submodule is set for gitlink (mode 160000) changes.
+	Submodule bool
+}
+
+var diffIndexRe = regexp.MustCompile(`^index ([0-9a-f]+)\.\.([0-9a-f]+)(?: (\d+))?$`)
+
+var binaryKinds = map[string]string{
+	".png": "image", ".jpg": "image", ".jpeg": "image", ".gif": "image", ".webp": "image",
+	".ico": "image", ".bmp": "image", ".tif": "image", ".tiff": "image", ".avif": "image",
+	".ttf": "font", ".otf": "font", ".woff": "font", ".woff2": "font",
+	".zip": "archive", ".tar": "archive", ".gz": "archive", ".tgz": "archive", ".jar": "archive",
+	".pdf": "document", ".mp3": "audio", ".wav": "audio", ".mp4": "video", ".mov": "video",
+}
+
+var extLanguages = map[string]string{
+	".go": "Go", ".py": "Python", ".js": "JavaScript", ".mjs": "JavaScript", ".jsx": "JavaScript",
+	".ts": "TypeScript", ".tsx": "TypeScript", ".rb": "Ruby", ".rs": "Rust", ".java": "Java",
+	".kt": "Kotlin", ".swift": "Swift", ".c": "C", ".h": "C", ".cc": "C++", ".cpp": "C++",
+	".hpp": "C++", ".cs": "C#", ".php": "PHP", ".sh": "Shell", ".bash": "Shell", ".sql": "SQL",
+	".html": "HTML", ".css": "CSS", ".scss": "SCSS", ".md": "Markdown", ".json": "JSON",
+	".yaml": "YAML", ".yml": "YAML", ".toml": "TOML", ".xml": "XML", ".proto": "Protobuf",
+}
+
+var nameLanguages = map[string]string{
+	"Makefile": "Makefile", "Dockerfile": "Dockerfile", "go.mod": "Go module", "go.sum": "Go module",
+}
+
+func languageOf(path string) string {
+	base := filepath.Base(path)
+	if l, ok := nameLanguages[base]; ok {
+		return l
+	}
+	return extLanguages[strings.ToLower(filepath.Ext(base))]
+}
+
+// parseDiffFiles walks a unified diff (as printed by git show/diff) and
+// collects one fileChange per "diff --git" section.
+func parseDiffFiles(diff string) []fileChange {
+	var files []fileChange
+	var cur *fileChange
+	inHunk := false
+	for _, l := range strings.Split(diff, "\n") {
+		if m := diffFileRe.FindStringSubmatch(l); m != nil {
+			files = append(files, fileChange{Path: m[2], OldPath: m[1], Status: "modified"})
+			cur = &files[len(files)-1]
+			inHunk = false
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		switch {
+		case inHunk && cur.Submodule && strings.HasPrefix(l, "-Subproject commit "):
+			cur.OldBlob = strings.TrimSpace(strings.TrimPrefix(l, "-Subproject commit "))
+		case inHunk && cur.Submodule && strings.HasPrefix(l, "+Subproject commit "):
+			cur.NewBlob = strings.TrimSpace(strings.TrimPrefix(l, "+Subproject commit "))
+		case inHunk && strings.HasPrefix(l, "+"):
+			cur.Added++
+		case inHunk && strings.HasPrefix(l, "-"):
+			cur.Deleted++
+		case strings.HasPrefix(l, "@@"):
+			inHunk = true
+		case inHunk:
+		case strings.HasPrefix(l, "new file mode"):
+			cur.Status = "added"
+			cur.Submodule = strings.HasSuffix(l, " 160000")
+		case strings.HasPrefix(l, "deleted file mode"):
+			cur.Status = "deleted"
+			cur.Submodule = strings.HasSuffix(l, " 160000")
+		case strings.HasPrefix(l, "rename from "):
+			cur.Status = "renamed"
+			cur.OldPath = strings.TrimPrefix(l, "rename from ")
+		case strings.HasPrefix(l, "rename to "):
+			cur.Path = strings.TrimPrefix(l, "rename to ")
+		case strings.HasPrefix(l, "copy from "):
+			cur.Status = "copied"
+			cur.OldPath = strings.TrimPrefix(l, "copy from ")
+		case strings.HasPrefix(l, "similarity index "):
+			cur.Similarity = strings.TrimPrefix(l, "similarity index ")
+		case strings.HasPrefix(l, "Binary files ") || l == "GIT binary patch":
+			cur.Binary = true
+		default:
+			if m := diffIndexRe.FindStringSubmatch(l); m != nil {
+				cur.OldBlob, cur.NewBlob = m[1], m[2]
+				if m[3] == "160000" {
+					cur.Submodule = true
+				}
+			}
+		}
+	}
+	return files
+}
+
+// summarizeDiff renders the per-file header: path, language, status and
+// line counts, with rename sources.
+func summarizeDiff(diff string) string {
+	files := parseDiffFiles(diff)
+	if len(files) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Files changed (%d):\n", len(files))
+	for _, f := range files {
+		sb.WriteString("- " + f.Path)
+		if lang := languageOf(f.Path); lang != "" {
+			sb.WriteString(" [" + lang + "]")
+		}
+		// Binary files and submodules get a description in place of the
+		// status and line counts, which say nothing useful about them.
+		switch {
+		case f.Submodule:
+			sb.WriteString(" " + describeSubmodule(f))
+		case f.Binary:
+			sb.WriteString(" " + describeBinary(f))
+		default:
+			sb.WriteString(" " + f.Status)
+		}
+		if f.Status == "renamed" || f.Status == "copied" {
+			sb.WriteString(" from " + f.OldPath)
+			if f.Similarity != "" {
+				sb.WriteString(" (" + f.Similarity + " similar)")
+			}
+		}
+		if !f.Submodule && !f.Binary {
+			fmt.Fprintf(&sb, ", +%d -%d", f.Added, f.Deleted)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// describeBinary names the kind of asset and, when the blobs are available,
+// how its size changed; a binary diff otherwise carries no information.
+func describeBinary(f fileChange) string {
+	kind := binaryKinds[strings.ToLower(filepath.Ext(f.Path))]
+	if kind == "" {
+		kind = "binary file"
+	}
+	verb := map[string]string{"added": "added", "deleted": "removed", "renamed": "renamed", "copied": "copied"}[f.Status]
+	if verb == "" {
+		verb = "updated"
+	}
+	desc := verb + " " + kind
+	oldSize, newSize := blobSize(f.OldBlob), blobSize(f.NewBlob)
+	switch {
+	case oldSize >= 0 && newSize >= 0:
+		desc += fmt.Sprintf(" (%s -> %s)", humanBytes(oldSize), humanBytes(newSize))
+	case newSize >= 0:
+		desc += fmt.Sprintf(" (%s)", humanBytes(newSize))
+	case oldSize >= 0:
+		desc += fmt.Sprintf(" (was %s)", humanBytes(oldSize))
+	}
+	return desc
+}
+
+// describeSubmodule reports a gitlink change as a submodule bump, counting
+// and listing the upstream commits when the submodule is checked out.
+func describeSubmodule(f fileChange) string {
+	short := func(s string) string { return s[:min(len(s), 7)] }
+	switch {
+	case isZeroSHA(f.OldBlob) || f.Status == "added":
+		return "added submodule at " + short(f.NewBlob)
+	case isZeroSHA(f.NewBlob) || f.Status == "deleted":
+		return "removed submodule (was " + short(f.OldBlob) + ")"
+	}
+	desc := fmt.Sprintf("bumped submodule from %s to %s", short(f.OldBlob), short(f.NewBlob))
+	top, err := repoTop()
+	if err != nil {
+		return desc
+	}
+	dir := filepath.Join(top, f.Path)
+	rng := f.OldBlob + ".." + f.NewBlob
+	out, err := git("-C", dir, "log", "--format=%s", rng)
+	if err != nil {
+		return desc
+	}
+	subjects := splitLines(strings.TrimSpace(out))
+	if len(subjects) == 1 && subjects[0] == "" {
+		return desc
+	}
+	desc += fmt.Sprintf(" with %d upstream commits", len(subjects))
+	if len(subjects) > 5 {
+		subjects = append(subjects[:5], "...")
+	}
+	return desc + ": " + strings.Join(subjects, "; ")
+}
+
+func isZeroSHA(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+// blobSize returns the size of a blob, or -1 if it is absent or unknown.
+func blobSize(id string) int64 {
+	if isZeroSHA(id) {
+		return -1
+	}
+	out, err := git("cat-file", "-s", id)
+	if err != nil {
+		return -1
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+func humanBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// resolveRange turns --range, or the last limit commits, into the planned
+// base and head, and rewrites *rangeExpr to base..head when it was empty.
+// base is empty for range forms other than A..B.
+func resolveRange(rangeExpr *string, limit int, shallow map[string]bool) (base, head, headRef string, err error) {
+	head, err = defaultHead()
+	if err != nil {
+		return "", "", "", err
+	}
+	headRef = refOf("HEAD")
+	if *rangeExpr == "" {
+		anc, err := nthAncestor(head, limit)
+		if err != nil && len(shallow) > 0 {
+			return "", "", "", fmt.Errorf("this shallow clone has fewer than %d commits of history.\n"+
+				"Fetch more first: rerun with --unshallow or --fetch-depth=%d, or run `git fetch --unshallow`", limit+1, limit+1)
+		}
+		if err != nil {
+			ancOut, err2 := git("rev-list", "--max-parents=0", "HEAD")
+			if err2 != nil {
+				return "", "", "", fmt.Errorf("cannot compute base: %v, %v", err, err2)
+			}
+			anc = strings.TrimSpace(ancOut)
+		}
+		base = anc
+		*rangeExpr = fmt.Sprintf("%s..%s", base, head)
+	} else if l, r, ok := strings.Cut(*rangeExpr, ".."); ok && !strings.HasPrefix(r, ".") && l != "" {
+		// Record the real endpoints of an explicit A..B range.
+		if r == "" {
+			r = "HEAD"
+		}
+		if base, err = revParse(l); err != nil {
+			return "", "", "", err
+		}
+		if head, err = revParse(r); err != nil {
+			return "", "", "", err
+		}
+		headRef = refOf(r)
+	}
+	if base != "" {
+		if err := checkRange(base, head); err != nil {
+			return "", "", "", err
+		}
+	}
+	return base, head, headRef, nil
+}
+
+// prepareHistory checks for shallow and partial clones, which are common in
+// CI. A shallow clone is deepened first when asked; the returned set holds
+// the remaining shallow boundary commits, whose diffs cannot be trusted.
+// Partial clones work but fetch blobs lazily, so they only get a warning.
+func prepareHistory(unshallow bool, depth int) (map[string]bool, error) {
+	out, err := git("rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(out) == "true" {
+		switch {
+		case unshallow:
+			slog.Info("shallow clone: fetching full history")
+			if _, err := git("fetch", "--unshallow"); err != nil {
+				return nil, err
+			}
+		case depth > 0:
+			slog.Info("shallow clone: fetching history", "depth", depth)
+			if _, err := git("fetch", fmt.Sprintf("--depth=%d", depth)); err != nil {
+				return nil, err
+			}
+		}
+	} else if unshallow || depth > 0 {
+		slog.Info("not a shallow clone; --unshallow/--fetch-depth ignored")
+	}
+	if pc, _ := git("config", "--get", "extensions.partialClone"); strings.TrimSpace(pc) != "" {
+		slog.Warn("partial clone: missing blobs are fetched on demand for each diff, which needs network access and may be slow", "promisor", strings.TrimSpace(pc))
+	}
+
+	path, err := git("rev-parse", "--git-path", "shallow")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(strings.TrimSpace(path))
+	if err != nil {
+		return nil, nil // not shallow (any more)
+	}
+	shallow := map[string]bool{}
+	for _, l := range splitLines(strings.TrimSpace(string(data))) {
+		shallow[strings.TrimSpace(l)] = true
+	}
+	return shallow, nil
+}
+
+// ============================
+// Issue context (GitHub / Jira)
+// ============================
+
+var (
+	ghIssueRe   = regexp.MustCompile(`(?:\b([\w.-]+/[\w.-]+))?#(\d+)\b|\bGH-(\d+)\b`)
+	jiraIssueRe = regexp.MustCompile(`\b([A-Z][A-Z0-9]+-\d+)\b`)
+	ghRemoteRe  = regexp.MustCompile(`github\.com[:/]([\w.-]+/[\w.-]+?)(?:\.git)?/?$`)
+)
+
+// issueFetcher looks up issues referenced by commit messages and branch
+// names so the prompt can say why a change was made. Lookups are cached for
+// the run and failures only cost the context, never the commit.
+type issueFetcher struct {
+	http   *http.Client
+	ghRepo string // owner/name of the origin remote on GitHub, if any
+	cache  map[string]string
+	// jiraProjects are the Jira project keys from JIRA_PROJECTS. Only their
+	// keys are looked up, since the key pattern also matches UTF-8, SHA-256
+	// and the like.
+	jiraProjects map[string]bool
+}
+
+func newIssueFetcher() *issueFetcher {
+	f := &issueFetcher{http: httpClient, cache: map[string]string{}, jiraProjects: map[string]bool{}}
+	for _, p := range strings.Split(os.Getenv("JIRA_PROJECTS"), ",") {
+		if p = strings.ToUpper(strings.TrimSpace(p)); p != "" {
+			f.jiraProjects[p] = true
+		}
+	}
+	if os.Getenv("JIRA_BASE_URL") != "" && len(f.jiraProjects) == 0 {
+		slog.Warn("JIRA_PROJECTS is not set; Jira issues are not looked up")
+	}
+	if out, err := git("remote", "get-url", "origin"); err == nil {
+		if m := ghRemoteRe.FindStringSubmatch(strings.TrimSpace(out)); m != nil {
+			f.ghRepo = m[1]
+		}
+	}
+	return f
+}
+
+// context returns a prompt section describing every issue referenced in
+// texts, or "" if there are none (or none could be fetched).
+func (f *issueFetcher) context(ctx context.Context, texts ...string) string {
+	var refs []string
+	seen := map[string]bool{}
+	add := func(r string) {
+		if !seen[r] {
+			seen[r] = true
+			refs = append(refs, r)
+		}
+	}
+	for _, t := range texts {
+		for _, m := range ghIssueRe.FindAllStringSubmatch(t, -1) {
+			repo, num := m[1], m[2]
+			if num == "" {
+				num = m[3]
+			}
+			if repo == "" {
+				repo = f.ghRepo
+			}
+			if repo != "" {
+				add("gh:" + repo + "#" + num)
+			}
+		}
+		if os.Getenv("JIRA_BASE_URL") != "" {
+			for _, m := range jiraIssueRe.FindAllStringSubmatch(t, -1) {
+				if project, _, _ := strings.Cut(m[1], "-"); f.jiraProjects[project] {
+					add("jira:" + m[1])
+				}
+			}
+		}
+	}
+	var sb strings.Builder
+	for _, r := range refs {
+		desc, ok := f.cache[r]
+		if !ok {
+			var err error
+			if desc, err = f.fetch(ctx, r); err != nil {
+				slog.Warn("cannot fetch issue", "issue", strings.SplitN(r, ":", 2)[1], "err", err)
+			}
+			f.cache[r] = desc
+		}
+		if desc != "" {
+			sb.WriteString(desc + "\n")
+		}
+	}
+	if sb.Len() == 0 {
+		return ""
+	}
+	return "Linked issues (use them to explain why; do not copy details the diff does not support):\n" + sb.String()
+}
+
+func (f *issueFetcher) fetch(ctx context.Context, ref string) (string, error) {
+	kind, id, _ := strings.Cut(ref, ":")
+	var endpoint string
+	hdr := http.Header{}
+	switch kind {
+	case "gh":
+		repo, num, _ := strings.Cut(id, "#")
+		endpoint = strings.TrimRight(envOr("GITHUB_API_URL", "https://api.github.com"), "/") + "/repos/" + repo + "/issues/" + num
+		hdr.Set("Accept", "application/vnd.github+json")
+		if tok := envOr("GITHUB_TOKEN", os.Getenv("GH_TOKEN")); tok != "" {
+			hdr.Set("Authorization", "Bearer "+tok)
+		}
+	case "jira":
+		endpoint = strings.TrimRight(os.Getenv("JIRA_BASE_URL"), "/") + "/rest/api/2/issue/" + url.PathEscape(id) + "?fields=summary,description"
+		switch {
+		case os.Getenv("JIRA_EMAIL") != "" && os.Getenv("JIRA_API_TOKEN") != "":
+			hdr.Set("Authorization", "Basic "+basicAuth(os.Getenv("JIRA_EMAIL"), os.Getenv("JIRA_API_TOKEN")))
+		case os.Getenv("JIRA_TOKEN") != "":
+			hdr.Set("Authorization", "Bearer "+os.Getenv("JIRA_TOKEN"))
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = hdr
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var title, body string
+	switch kind {
+	case "gh":
+		var is struct {
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&is); err != nil {
+			return "", err
+		}
+		title, body = is.Title, is.Body
+	case "jira":
+		var is struct {
+			Fields struct {
+				Summary     string `json:"summary"`
+				Description string `json:"description"`
+			} `json:"fields"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&is); err != nil {
+			return "", err
+		}
+		title, body = is.Fields.Summary, is.Fields.Description
+	}
+	desc := fmt.Sprintf("- %s: %s", id, strings.TrimSpace(title))
+	if b := strings.TrimSpace(body); b != "" {
+		desc += "\n  " + strings.ReplaceAll(truncate(b, 1500), "\n", "\n  ")
+	}
+	return desc, nil
+}
+
+func basicAuth(user, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
+
+// ============================
+// Repository context (--repo-context / --context-file)
+// ============================
+
+// repoContextBudget caps each part of the repository context in runes, so
+// it never crowds out the diff.
+const repoContextBudget = 1500
+
+var mdHeadingRe = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+
+// repoContext returns a prompt section describing the project, so the model
+// can name components the way the project does rather than guessing from
+// paths. file replaces the gathered context with hand-written text.
+func repoContext(auto bool, file string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return "Repository context:\n" + truncate(strings.TrimSpace(string(data)), 3*repoContextBudget) + "\n\n", nil
+	}
+	if !auto {
+		return "", nil
+	}
+	var parts []string
+	if s := readmeIntro(); s != "" {
+		parts = append(parts, "About the project (README):\n"+s)
+	}
+	if s := commitGuidelines(); s != "" {
+		parts = append(parts, "Commit guidelines (CONTRIBUTING):\n"+s)
+	}
+	if s := shallowTree(); s != "" {
+		parts = append(parts, "Layout:\n"+s)
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+	return "Repository context:\n" + strings.Join(parts, "\n\n") + "\n\n", nil
+}
+
+// withRepoContext puts the repository context ahead of the rest of a
+// prompt's context.
+func withRepoContext(rest string, auto bool, file string) (string, error) {
+	rc, err := repoContext(auto, file)
+	return rc + rest, err
+}
+
+// readmeIntro is the README's first section: everything before its second
+// heading, without badges and HTML. The shortest README name wins, so
+// README.md is preferred over translations such as README.ja.md.
+func readmeIntro() string {
+	var names []string
+	if top, err := repoTop(); err == nil {
+		entries, _ := os.ReadDir(top)
+		for _, e := range entries {
+			if !e.IsDir() {
+				names = append(names, e.Name())
+			}
+		}
+	} else if out, err := git("ls-tree", "--name-only", "HEAD"); err == nil {
+		names = splitLines(strings.TrimSpace(out))
+	}
+	var readme string
+	for _, n := range names {
+		name := strings.ToLower(n)
+		if name != "readme" && !strings.HasPrefix(name, "readme.") {
+			continue
+		}
+		if readme == "" || len(n) < len(readme) {
+			readme = n
+		}
+	}
+	if readme == "" {
+		return ""
+	}
+	data, _, err := readRepoFile(readme)
+	if err != nil {
+		return ""
+	}
+	var keep []string
+	headings := 0
+	for _, l := range splitLines(string(data)) {
+		t := strings.TrimSpace(l)
+		if mdHeadingRe.MatchString(t) {
+			if headings++; headings > 1 {
+				break
+			}
+		}
+		if strings.HasPrefix(t, "[![") || strings.HasPrefix(t, "<") {
+			continue
+		}
+		keep = append(keep, l)
+	}
+	return truncate(strings.TrimSpace(strings.Join(keep, "\n")), repoContextBudget)
+}
+
+// commitGuidelines is the section of CONTRIBUTING whose heading mentions
+// commits, up to the next heading of the same or a higher level.
+func commitGuidelines() string {
+	for _, name := range []string{"CONTRIBUTING.md", ".github/CONTRIBUTING.md", "docs/CONTRIBUTING.md"} {
+		data, _, err := readRepoFile(name)
+		if err != nil {
+			continue
+		}
+		var keep []string
+		level := 0
+		for _, l := range splitLines(string(data)) {
+			if m := mdHeadingRe.FindStringSubmatch(strings.TrimSpace(l)); m != nil {
+				if level > 0 && len(m[1]) <= level {
+					break
+				}
+				if level == 0 && strings.Contains(strings.ToLower(m[2]), "commit") {
+					level = len(m[1])
+				}
+			}
+			if level > 0 {
+				keep = append(keep, l)
+			}
+		}
+		return truncate(strings.TrimSpace(strings.Join(keep, "\n")), repoContextBudget)
+	}
+	return ""
+}
+
+// shallowTree lists HEAD's top-level entries and the directories one level
+// below them.
+func shallowTree() string {
+	out, err := git("ls-tree", "-r", "-d", "--name-only", "HEAD")
+	if err != nil {
+		return ""
+	}
+	files, _ := git("ls-tree", "--name-only", "HEAD")
+	dirs := map[string]bool{}
+	var entries []string
+	for _, d := range splitLines(strings.TrimSpace(out)) {
+		if d != "" && strings.Count(d, "/") <= 1 {
+			dirs[d] = true
+			entries = append(entries, d+"/")
+		}
+	}
+	for _, f := range splitLines(strings.TrimSpace(files)) {
+		if f != "" && !dirs[f] {
+			entries = append(entries, f)
+		}
+	}
+	slices.Sort(entries)
+	if len(entries) > 120 {
+		entries = append(entries[:120], "...")
+	}
+	return truncate(strings.Join(entries, "\n"), repoContextBudget)
+}
+
+// ============================
+// Utilities
+// ============================
+
+func truncate(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max]) + "\n...[truncated]..."
+}
+
+func repoTop() (string, error) {
+	out, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// repoPath is the directory a plan records as its repository: the top of
+// the work tree, or the git directory itself in a bare repository.
+func repoPath() (string, error) {
+	if top, err := repoTop(); err == nil {
+		return top, nil
+	}
+	out, err := git("rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func bareRepo() bool {
+	out, err := git("rev-parse", "--is-bare-repository")
+	return err == nil && strings.TrimSpace(out) == "true"
+}
+
+// readRepoFile reads a file at the root of the repository. Without a work
+// tree, as on a server-side mirror, the version committed at HEAD is read
+// instead. name is the path or HEAD:path, for error messages. A symlink
+// leading out of the work tree is refused, so a cloned repository cannot
+// have a local file read as its README or config.
+func readRepoFile(file string) (data []byte, name string, err error) {
+	if top, err := repoTop(); err == nil {
+		path := filepath.Join(top, file)
+		real, err := inWorkTree(path)
+		if err != nil {
+			return nil, path, err
+		}
+		data, err := os.ReadFile(real)
+		return data, path, err
+	}
+	name = "HEAD:" + filepath.ToSlash(file)
+	out, err := git("show", name)
+	if err != nil {
+		return nil, name, os.ErrNotExist
+	}
+	return []byte(out), name, nil
+}
+
+// hookPath is the file git runs as the named hook; git resolves
+// core.hooksPath for us.
+func hookPath(name string) (string, error) {
+	out, err := git("rev-parse", "--git-path", "hooks/"+name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(strings.TrimSpace(out))
+}
+
+func defaultHead() (string, error) {
+	out, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// refOf is the full name of the ref rev names, such as refs/heads/main,
+// "HEAD" for a detached HEAD, or "" when rev is a fixed commit.
+func refOf(rev string) string {
+	out, _ := git("rev-parse", "--symbolic-full-name", rev)
+	return strings.TrimSpace(firstLine(out))
+}
+
+func revParse(rev string) (string, error) {
+	out, err := git("rev-parse", "--verify", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown revision %q", rev)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func isAncestor(a, b string) bool {
+	_, err := git("merge-base", "--is-ancestor", a, b)
+	return err == nil
+}
+
+// checkRange verifies base..head is a sane range to rewrite: base must be an
+// ancestor of head, or the range would sweep in unrelated history. It also
+// warns about side-branch commits off the first-parent chain, commits that
+// are already on a remote branch, and an upstream that has moved on.
+func checkRange(base, head string) error {
+	if !isAncestor(base, head) {
+		return fmt.Errorf("base %s is not an ancestor of head %s; the range would include unrelated history", base[:7], head[:7])
+	}
+	rng := base + ".." + head
+	all, _ := git("rev-list", "--count", rng)
+	first, _ := git("rev-list", "--count", "--first-parent", rng)
+	if a, f := strings.TrimSpace(all), strings.TrimSpace(first); a != f {
+		slog.Warn("range is not linear; commits from merged side branches will be flattened", "merged", mustAtoi(a)-mustAtoi(f), "commits", a)
+	}
+	oldest, _ := git("rev-list", "--reverse", "--first-parent", rng)
+	if o := strings.TrimSpace(firstLine(oldest)); o != "" {
+		if refs, _ := git("for-each-ref", "--format=%(refname:short)", "--contains", o, "refs/remotes"); strings.TrimSpace(refs) != "" {
+			slog.Warn("commit is already published; publishing the rewrite needs a force-push", "sha", o[:7], "refs", strings.Join(strings.Fields(refs), ","))
+		}
+	}
+	if n, err := git("rev-list", "--count", head+"..@{upstream}"); err == nil && strings.TrimSpace(n) != "0" {
+		slog.Warn("the upstream branch has commits not in the range; pull or rebase before rewriting, or the result will diverge", "missing", strings.TrimSpace(n), "head", head[:7])
+	}
+	return nil
+}
+
+func mustAtoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// checkPlanHead refuses a plan whose head is no longer the tip of ref: new
+// commits on top would be left out of the rewritten branch, and a head
+// that is gone means the branch was rewritten or switched since planning.
+// apply checks the ref the plan was made from (plan.HeadRef: the branch
+// checked out, or the right-hand side of --range), so it works from any
+// checkout; rebase checks HEAD, which it rewrites in place. An empty ref,
+// a range ending at a fixed commit, cannot go stale.
+func checkPlanHead(plan Plan, ref string) error {
+	if ref == "" {
+		return nil
+	}
+	if !shaRe.MatchString(plan.Head) {
+		return errors.New("the plan has no head to check the branch against. Re-run plan, or pass --allow-stale to apply anyway")
+	}
+	name := strings.TrimPrefix(ref, "refs/heads/")
+	cur, err := revParse(ref)
+	if err != nil {
+		return fmt.Errorf("%s, which the plan was made from, no longer exists.\n"+
+			"Re-run plan, or pass --allow-stale to apply anyway", name)
+	}
+	if cur == plan.Head {
+		return nil
+	}
+	if !isAncestor(plan.Head, cur) {
+		return fmt.Errorf("%s (%s) does not contain the plan's head %s; the branch was rewritten since planning.\n"+
+			"Re-run plan, or pass --allow-stale to apply anyway", name, cur[:7], plan.Head[:7])
+	}
+	n, _ := git("rev-list", "--count", plan.Head+".."+cur)
+	if plan.Partial {
+		slog.Info("partial plan: later commits are left as they are", "commits", strings.TrimSpace(n), "after", plan.Head[:7])
+		return nil
+	}
+	return fmt.Errorf("%s moved %s commit(s) past the plan's head %s; they would be missing from the rewritten branch.\n"+
+		"Re-run plan, or pass --allow-stale to apply anyway", name, strings.TrimSpace(n), plan.Head[:7])
+}
+
+func nthAncestor(head string, n int) (string, error) {
+	spec := fmt.Sprintf("%s~%d", head, n)
+	out, err := git("rev-parse", spec)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// ============================
+// Plan files
+// ============================
+
+// planVersion is the plan schema version written by this binary. Bump it
+// whenever a field changes meaning, and teach migratePlan how to upgrade.
+const planVersion = 1
+
+var shaRe = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// isYAMLPath reports whether a plan path should be read and written as YAML.
+func isYAMLPath(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// loadPlan reads a plan strictly: unknown fields, unsupported versions and
+// malformed items are rejected up front instead of failing mid-apply.
+func loadPlan(path string) (Plan, error) {
+	var plan Plan
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return plan, err
+	}
+	if isYAMLPath(path) {
+		if b, err = yamlToJSON(b); err != nil {
+			return plan, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&plan); err != nil {
+		return plan, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := migratePlan(&plan); err != nil {
+		return plan, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validatePlan(plan); err != nil {
+		return plan, fmt.Errorf("%s: invalid plan:\n%w", path, err)
+	}
+	return plan, nil
+}
+
+func savePlan(path string, plan Plan) error {
+	plan.Version = planVersion
+	// Type and scope follow the message through edits.
+	plan.Items = slices.Clone(plan.Items)
+	for i := range plan.Items {
+		it := &plan.Items[i]
+		it.Type, it.Scope = "", ""
+		if m := policySubjectRe.FindStringSubmatch(firstLine(cmp.Or(strings.TrimSpace(it.NewMessage), it.OldMessage))); m != nil {
+			it.Type, it.Scope = m[1], m[2]
+		}
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if isYAMLPath(path) {
+		if data, err = jsonToYAML(data); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// migratePlan upgrades older plan formats in memory.
+func migratePlan(plan *Plan) error {
+	switch {
+	case plan.Version > planVersion:
+		return fmt.Errorf("plan version %d is newer than this git-smartmsg supports (%d); upgrade git-smartmsg", plan.Version, planVersion)
+	case plan.Version == 0:
+		// Plans written before versioning have the same fields as version 1.
+		slog.Info("plan has no version field; re-run plan to upgrade the file", "assumed_version", planVersion)
+		plan.Version = planVersion
+	}
+	return nil
+}
+
+// validatePlan checks a plan's structure without touching the repository.
+func validatePlan(plan Plan) error {
+	var errs []error
+	// apply and rebase check the branch against head, so it is required.
+	switch {
+	case plan.Head == "":
+		errs = append(errs, errors.New("head: missing"))
+	case !shaRe.MatchString(plan.Head):
+		errs = append(errs, fmt.Errorf("head: malformed SHA %q", plan.Head))
+	}
+	if plan.RepoID != "" && !shaRe.MatchString(plan.RepoID) {
+		errs = append(errs, fmt.Errorf("repo_id: malformed SHA %q", plan.RepoID))
+	}
+	if plan.Base != "" && !shaRe.MatchString(plan.Base) {
+		errs = append(errs, fmt.Errorf("base: malformed SHA %q", plan.Base))
+	}
+	if plan.CreatedAt != "" {
+		if _, err := time.Parse(time.RFC3339, plan.CreatedAt); err != nil {
+			errs = append(errs, fmt.Errorf("created_at: malformed date %q", plan.CreatedAt))
+		}
+	}
+	if len(plan.Items) == 0 {
+		errs = append(errs, errors.New("items: plan has no items"))
+	}
+	seen := map[string]int{}
+	for i, it := range plan.Items {
+		switch {
+		case it.SHA == "":
+			errs = append(errs, fmt.Errorf("items[%d].sha: missing", i))
+		case !shaRe.MatchString(it.SHA):
+			errs = append(errs, fmt.Errorf("items[%d].sha: malformed SHA %q", i, it.SHA))
+		default:
+			if j, dup := seen[it.SHA]; dup {
+				errs = append(errs, fmt.Errorf("items[%d].sha: duplicate of items[%d]", i, j))
+			}
+			seen[it.SHA] = i
+		}
+		for _, s := range it.Squash {
+			if !shaRe.MatchString(s) {
+				errs = append(errs, fmt.Errorf("items[%d].squash: malformed SHA %q", i, s))
+			} else if j, dup := seen[s]; dup {
+				errs = append(errs, fmt.Errorf("items[%d].squash: %s already used by items[%d]", i, s[:7], j))
+			} else {
+				seen[s] = i
+			}
+		}
+		if _, err := time.Parse(time.RFC3339, it.AuthorDate); err != nil {
+			errs = append(errs, fmt.Errorf("items[%d].author_date: malformed date %q", i, it.AuthorDate))
+		}
+		if strings.TrimSpace(it.AuthorName) == "" || strings.TrimSpace(it.AuthorEmail) == "" {
+			errs = append(errs, fmt.Errorf("items[%d]: missing author name or email", i))
+		}
+		if strings.TrimSpace(it.NewMessage) == "" && strings.TrimSpace(it.OldMessage) == "" {
+			errs = append(errs, fmt.Errorf("items[%d]: both old_message and new_message are empty", i))
+		}
+		switch it.Status {
+		case "", statusOK, statusTimeout, statusRateLimited, statusAuth, statusEmpty, statusAPIError:
+		default:
+			errs = append(errs, fmt.Errorf("items[%d].status: unknown status %q", i, it.Status))
+		}
+	}
+	for i, t := range plan.Tags {
+		if t.Name == "" {
+			errs = append(errs, fmt.Errorf("tags[%d].name: missing", i))
+		}
+		if !shaRe.MatchString(t.Target) {
+			errs = append(errs, fmt.Errorf("tags[%d].target: malformed SHA %q", i, t.Target))
+		} else if _, ok := seen[t.Target]; !ok {
+			errs = append(errs, fmt.Errorf("tags[%d].target: %s is not a commit of the plan", i, t.Target[:7]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// repoFingerprint identifies a repository by the root commit of rev's
+// history (the smallest SHA if there are several), which survives clones,
+// moves and renames.
+func repoFingerprint(rev string) string {
+	out, err := git("rev-list", "--max-parents=0", rev)
+	if err != nil {
+		return ""
+	}
+	roots := strings.Fields(out)
+	if len(roots) == 0 {
+		return ""
+	}
+	return slices.Min(roots)
+}
+
+// checkPlanCommits verifies that the plan belongs to the current repository
+// and that every commit in it exists here.
+func checkPlanCommits(plan Plan) error {
+	if plan.RepoID != "" {
+		if _, err := git("cat-file", "-e", plan.RepoID+"^{commit}"); err != nil {
+			top, _ := repoPath()
+			return fmt.Errorf("the plan belongs to a different repository: its root commit %s is not in %s (planned in %s)",
+				plan.RepoID[:7], cmp.Or(top, "the current directory"), cmp.Or(plan.RepoPath, "an unknown path"))
+		}
+	}
+	if plan.Head != "" {
+		if _, err := git("cat-file", "-e", plan.Head+"^{commit}"); err != nil {
+			return fmt.Errorf("the plan's head %s is not in this repository; history was rewritten and pruned since planning. Re-run plan", plan.Head[:7])
+		}
+	}
+	var errs []error
+	for i, it := range plan.Items {
+		for _, sha := range append([]string{it.SHA}, it.Squash...) {
+			if _, err := git("cat-file", "-e", sha+"^{commit}"); err != nil {
+				errs = append(errs, fmt.Errorf("items[%d]: commit %s not found in this repository", i, sha[:7]))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func cmdPlanValidate(args []string) error {
+	fs := flag.NewFlagSet("plan validate", flag.ExitOnError)
+	inFile := fs.String("in", "plan.json", "plan file path")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		*inFile = fs.Arg(0)
+	}
+
+	plan, err := loadPlan(*inFile)
+	if err != nil {
+		return err
+	}
+	if _, err := repoPath(); err == nil {
+		if err := checkPlanCommits(plan); err != nil {
+			return fmt.Errorf("%s: %w", *inFile, err)
+		}
+	}
+	fmt.Printf("%s: OK (version %d, %d items)\n", *inFile, plan.Version, len(plan.Items))
+	return nil
+}
+
+// cmdPlanDiff shows which suggestions changed between two plan files.
+func cmdPlanDiff(args []string) error {
+	fs := flag.NewFlagSet("plan diff", flag.ExitOnError)
+	all := fs.Bool("all", false, "also list unchanged items")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: plan diff [--all] <old-plan> <new-plan>")
+	}
+	oldPath, newPath := fs.Arg(0), fs.Arg(1)
+	a, err := loadPlan(oldPath)
+	if err != nil {
+		return err
+	}
+	b, err := loadPlan(newPath)
+	if err != nil {
+		return err
+	}
+
+	inA := map[string]PlanItem{}
+	for _, it := range a.Items {
+		inA[it.SHA] = it
+	}
+	inB := map[string]bool{}
+	changed, same, added, removed := 0, 0, 0, 0
+	for _, nb := range b.Items {
+		inB[nb.SHA] = true
+		na, ok := inA[nb.SHA]
+		switch {
+		case !ok:
+			added++
+			fmt.Printf("+ %s  %s  (only in %s)\n", nb.SHA[:7], firstLine(nb.OldMessage), newPath)
+			printIndented("    ", nb.NewMessage)
+		case na.NewMessage == nb.NewMessage:
+			same++
+			if *all {
+				fmt.Printf("  %s  %s\n", nb.SHA[:7], firstLine(nb.NewMessage))
+			}
+		default:
+			changed++
+			fmt.Printf("~ %s  %s\n", nb.SHA[:7], firstLine(nb.OldMessage))
+			for _, l := range diffLines(splitLines(na.NewMessage), splitLines(nb.NewMessage)) {
+				fmt.Println("    " + l)
+			}
+		}
+	}
+	for _, na := range a.Items {
+		if !inB[na.SHA] {
+			removed++
+			fmt.Printf("- %s  %s  (only in %s)\n", na.SHA[:7], firstLine(na.OldMessage), oldPath)
+		}
+	}
+	if a.Model != b.Model {
+		fmt.Printf("\nmodel: %s -> %s\n", a.Model, b.Model)
+	}
+	fmt.Printf("\n%d changed, %d unchanged, %d added, %d removed\n", changed, same, added, removed)
+	return nil
+}
+
+// showRow is one line of plan show: a commit of the original range (or,
+// with --graph, a line of graph edges only) and what becomes of it.
+type showRow struct {
+	graph   string // git log --graph drawing before the commit
+	sha     string // empty on edge-only lines
+	subject string
+	parents []string
+}
+
+// cmdPlanShow prints the commits of a plan, newest first as in git log,
+// with each original subject next to the one it is rewritten to. --graph
+// draws the original history alongside the rewritten, linear one, and
+// --format dot writes both as a Graphviz graph.
+func cmdPlanShow(args []string) error {
+	fs := flag.NewFlagSet("plan show", flag.ExitOnError)
+	inFile := fs.String("in", "plan.json", "plan file path")
+	graph := fs.Bool("graph", false, "draw the range's commit graph before and after the rewrite")
+	format := fs.String("format", "text", "output format: text, or dot for Graphviz (always a graph)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		*inFile = fs.Arg(0)
+	}
+	switch *format {
+	case "text", "dot":
+	default:
+		return fmt.Errorf("--format must be text or dot, got %q", *format)
+	}
+	plan, err := loadPlan(*inFile)
+	if err != nil {
+		return err
+	}
+	if len(plan.Items) == 0 {
+		return fmt.Errorf("%s has no items", *inFile)
+	}
+	if *graph || *format == "dot" {
+		if err := checkPlanCommits(plan); err != nil {
+			return fmt.Errorf("--graph needs the plan's repository: %w", err)
+		}
+	}
+
+	var rows []showRow
+	if *graph || *format == "dot" {
+		rng := cmp.Or(plan.Head, plan.Items[len(plan.Items)-1].lastSHA())
+		if plan.Base != "" {
+			rng = plan.Base + ".." + rng
+		}
+		logArgs := []string{"log", "--topo-order", "--format=%x00%H%x00%P%x00%s", rng}
+		if *format == "text" {
+			logArgs = append(logArgs, "--graph")
+		}
+		out, err := git(logArgs...)
+		if err != nil {
+			return err
+		}
+		for _, l := range splitLines(strings.TrimRight(out, "\n")) {
+			g, rest, ok := strings.Cut(l, "\x00")
+			if !ok {
+				rows = append(rows, showRow{graph: g})
+				continue
+			}
+			f := strings.SplitN(rest, "\x00", 3)
+			if len(f) < 3 {
+				continue
+			}
+			rows = append(rows, showRow{graph: g, sha: f[0], parents: strings.Fields(f[1]), subject: f[2]})
+		}
+	} else {
+		for i := len(plan.Items) - 1; i >= 0; i-- {
+			it := plan.Items[i]
+			shas := append([]string{it.SHA}, it.Squash...)
+			subjects := splitLines(it.OldMessage)
+			for k := len(shas) - 1; k >= 0; k-- {
+				subject := firstLine(it.OldMessage)
+				if len(subjects) == len(shas) {
+					subject = subjects[k]
+				}
+				rows = append(rows, showRow{sha: shas[k], subject: subject})
+			}
+		}
+	}
+	if *format == "dot" {
+		fmt.Print(planDot(plan, rows))
+		return nil
+	}
+
+	items := map[string]*PlanItem{} // by every original SHA
+	for i := range plan.Items {
+		for _, sha := range append([]string{plan.Items[i].SHA}, plan.Items[i].Squash...) {
+			items[sha] = &plan.Items[i]
+		}
+	}
+	tags := map[string][]string{}
+	for _, t := range plan.Tags {
+		tags[t.Target] = append(tags[t.Target], t.Name)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "before\tafter")
+	for _, r := range rows {
+		if r.sha == "" {
+			fmt.Fprintln(w, r.graph)
+			continue
+		}
+		left := r.graph + r.sha[:7] + "  " + truncateRunes(r.subject, 50)
+		if t := tags[r.sha]; len(t) > 0 {
+			left += " (tag: " + strings.Join(t, ", ") + ")"
+		}
+		it := items[r.sha]
+		var right string
+		var notes []string
+		switch {
+		case it == nil:
+			right = "  (not in plan)"
+		case it.SHA != r.sha:
+			right = "  ↳ squashed into " + it.SHA[:7]
+		default:
+			right = "* " + truncateRunes(firstLine(cmp.Or(it.NewMessage, it.OldMessage)), 60)
+			if firstLine(it.NewMessage) == firstLine(it.OldMessage) {
+				notes = append(notes, "unchanged")
+			}
+			if it.failed() {
+				notes = append(notes, "FAILED: "+it.Status)
+			}
+			if it.NeedsReview {
+				notes = append(notes, "needs review")
+			}
+			if it.RepeatOf != "" {
+				notes = append(notes, "repeat of "+it.RepeatOf[:7])
+			}
+		}
+		if len(notes) > 0 {
+			right += "  [" + strings.Join(notes, ", ") + "]"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", left, right)
+	}
+	if plan.Base != "" {
+		fmt.Fprintf(w, "o %s  (base)\to %s  (base)\n", plan.Base[:7], plan.Base[:7])
+	}
+	return w.Flush()
+}
+
+// truncateRunes shortens s to max runes, marking the cut with an ellipsis.
+func truncateRunes(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max-1]) + "…"
+}
+
+// planDot renders the original commits and the rewritten series as two
+// Graphviz clusters, with a dashed edge from every original commit to the
+// commit it becomes.
+func planDot(plan Plan, rows []showRow) string {
+	q := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+	}
+	var b strings.Builder
+	b.WriteString("digraph plan {\n\trankdir=BT;\n\tnode [shape=box, fontname=\"monospace\"];\n")
+	// Declared first, so that it belongs to neither cluster.
+	if plan.Base != "" {
+		fmt.Fprintf(&b, "\tbase [label=%s, shape=ellipse];\n", q(plan.Base[:7]+"\n(base)"))
+	}
+	b.WriteString("\tsubgraph cluster_before {\n\t\tlabel=\"before\";\n")
+	inRange := map[string]bool{}
+	for _, r := range rows {
+		inRange[r.sha] = true
+	}
+	for _, r := range rows {
+		fmt.Fprintf(&b, "\t\t%s [label=%s];\n", q("old_"+r.sha), q(r.sha[:7]+"\n"+truncateRunes(r.subject, 50)))
+		for _, p := range r.parents {
+			if inRange[p] {
+				fmt.Fprintf(&b, "\t\t%s -> %s;\n", q("old_"+r.sha), q("old_"+p))
+			} else if p == plan.Base {
+				fmt.Fprintf(&b, "\t\t%s -> base;\n", q("old_"+r.sha))
+			}
+		}
+	}
+	b.WriteString("\t}\n\tsubgraph cluster_after {\n\t\tlabel=\"after\";\n")
+	prev := "base"
+	for _, it := range plan.Items {
+		label := firstLine(cmp.Or(it.NewMessage, it.OldMessage))
+		style := ""
+		switch {
+		case it.failed():
+			style = `, color="red"`
+		case it.NeedsReview:
+			style = `, color="orange"`
+		}
+		fmt.Fprintf(&b, "\t\t%s [label=%s%s];\n", q("new_"+it.SHA), q(truncateRunes(label, 50)), style)
+		if plan.Base != "" || prev != "base" {
+			fmt.Fprintf(&b, "\t\t%s -> %s;\n", q("new_"+it.SHA), q(prev))
+		}
+		prev = "new_" + it.SHA
+	}
+	b.WriteString("\t}\n")
+	for _, it := range plan.Items {
+		for _, sha := range append([]string{it.SHA}, it.Squash...) {
+			if inRange[sha] {
+				fmt.Fprintf(&b, "\t%s -> %s [style=dashed, constraint=false];\n", q("old_"+sha), q("new_"+it.SHA))
+			}
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(splitLines(s)[0])
+}
+
+func printIndented(prefix, s string) {
+	for _, l := range splitLines(s) {
+		fmt.Println(prefix + l)
+	}
+}
+
+// diffLines is a small LCS line diff; messages are short so O(n*m) is fine.
+// Lines are prefixed with "  ", "- " or "+ ".
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
+
+// ============================
+// YAML
+// ============================
+
+// YAML is converted to JSON and back so the plan keeps a single (strict)
+// decoding path.
+
+// jsonToYAML renders JSON as block-style YAML, keeping key order.
+func jsonToYAML(data []byte) ([]byte, error) {
+	// JSON is YAML, and a node tree keeps the keys in order.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	blockStyle(&doc)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// blockStyle drops the flow and quoting styles a JSON document is read
+// with, so collections are written as blocks, multi-line strings as literal
+// block scalars, and scalars are quoted only where YAML needs it. yaml.v3
+// loses a literal's leading line breaks, so those strings stay quoted.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" && strings.HasPrefix(n.Value, "\n") {
+		n.Style = yaml.DoubleQuotedStyle
+	}
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// yamlToJSON parses YAML and re-encodes it as JSON.
+func yamlToJSON(data []byte) ([]byte, error) {
+	v, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// parseYAML decodes a YAML document into maps, slices and scalars. An empty
+// document is an empty mapping.
+func parseYAML(data []byte) (any, error) {
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return map[string]any{}, nil
+	}
+	return v, checkYAMLKeys(v)
+}
+
+// checkYAMLKeys rejects mappings with keys that are not strings (yaml.v3
+// decodes those as map[any]any), which have no JSON or option equivalent.
+func checkYAMLKeys(v any) error {
+	switch v := v.(type) {
+	case map[any]any:
+		for k := range v {
+			if _, ok := k.(string); !ok {
+				return fmt.Errorf("mapping key %v is not a string", k)
+			}
+		}
+	case map[string]any:
+		for _, c := range v {
+			if err := checkYAMLKeys(c); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, c := range v {
+			if err := checkYAMLKeys(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ============================
+// Plan command
+// ============================
+
+func cmdPlan(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "validate":
+			return cmdPlanValidate(args[1:])
+		case "diff":
+			return cmdPlanDiff(args[1:])
+		case "show":
+			return cmdPlanShow(args[1:])
+		}
+	}
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	limit := fs.Int("limit", 20, "number of commits from HEAD to include")
+	rangeExpr := fs.String("range", "", "explicit git range (e.g., <base>..<head>)")
+	var af aiFlags
+	af.register(fs)
+	var lr lengthRules
+	lr.register(fs)
+	var mode messageMode
+	mode.register(fs)
+	allowMerges := fs.Bool("allow-merges", false, "include merge commits (not recommended)")
+	emoji := fs.Bool("emoji", false, "use emoji style commit messages")
+	outFile := fs.String("out", "plan.json", "output plan file (.json, or .yaml/.yml for YAML)")
+	timeout := fs.Duration("timeout", 25*time.Second, "per-commit AI timeout (for small diffs, with --adaptive-timeout)")
+	adaptiveTimeout := fs.Bool("adaptive-timeout", true, "give commits with large diffs a longer timeout, up to 4x --timeout")
+	timeoutRetries := fs.Int("timeout-retries", 1, "ask again this many times, with twice the timeout, when a commit's request times out")
+	deadline := fs.Duration("deadline", 0, "stop planning after this long in total and write a partial plan of the commits done so far (0: no limit)")
+	minConfidence := fs.Float64("min-confidence", 0, "flag suggestions below this self-reported confidence (0-1) as needs_review")
+	reprompt := fs.Bool("reprompt", false, "regenerate once when a suggestion is below --min-confidence, keeping the better one")
+	refine := fs.Bool("refine", false, "add a self-critique pass that checks each message against the diff and revises it")
+	unshallow := fs.Bool("unshallow", false, "in a shallow clone, fetch the full history before planning")
+	fetchDepth := fs.Int("fetch-depth", 0, "in a shallow clone, deepen history to this many commits before planning")
+	funcContext := fs.Bool("function-context", false, "show whole enclosing functions around each hunk (git show -W); falls back to the plain diff if it exceeds the model's budget")
+	guard := fs.Bool("guard", true, "flag messages that mention files or identifiers not found in the diff as needs_review")
+	stripUnverified := fs.Bool("strip-unverified", false, "with --guard, also drop body lines that mention something not found in the diff")
+	issueContext := fs.Bool("issue-context", false, "fetch GitHub/Jira issues referenced by each commit or the branch name and add them to the prompt")
+	detectTrivial := fs.Bool("detect-trivial", true, "write messages for rename-only, whitespace-only and revert commits without calling the AI")
+	repoCtxFlag := fs.Bool("repo-context", false, "add the README intro, CONTRIBUTING commit guidelines and a shallow file tree to the prompt")
+	contextFile := fs.String("context-file", "", "add this file's text to the prompt as repository context (replaces --repo-context)")
+	dedup := fs.Bool("dedup", true, "reuse the message of an earlier commit with an identical diff instead of calling the model again")
+	consolidate := fs.Bool("consolidate", false, "group runs of tiny consecutive commits touching the same files into one squashed item")
+	routing := fs.String("model-routing", "", "route each commit by diff size, e.g. small=gpt-5-nano,large=gpt-5")
+	routingLines := fs.Int("routing-lines", 200, "with --model-routing, diffs with fewer changed lines than this use the small model")
+	consistency := fs.String("consistency", "off", "after planning, harmonise subjects across the plan: off, basic (deterministic), or ai (one extra request)")
+	batchAPI := fs.Bool("batch-api", false, "submit all prompts as one OpenAI Batch API job instead of planning now (collect later with --collect)")
+	collect := fs.String("collect", "", "build the plan from a finished OpenAI batch `id`; pass the same options as for --batch-api")
+	summarizer := fs.String("summarizer-model", "", "condense large diffs with this (cheaper) model first and write the message from its summary")
+	summarizeLines := fs.Int("summarize-lines", 200, "with --summarizer-model, summarize diffs with at least this many changed lines")
+	batchSize := fs.Int("batch-size", 1, "pack up to this many small commits into one AI request (falls back to one request per commit if the reply can't be parsed)")
+	tinyLines := fs.Int("tiny-lines", 20, "with --consolidate, commits changing at most this many lines (or with wip/fixup subjects) count as tiny")
+	var nt notifier
+	nt.register(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := mode.check(); err != nil {
+		return err
+	}
+	switch *consistency {
+	case "off", "basic", "ai":
+	default:
+		return fmt.Errorf("--consistency must be off, basic or ai, got %q", *consistency)
+	}
+	router, err := parseModelRouting(*routing, *routingLines)
+	if err != nil {
+		return err
+	}
+	if *batchSize > 1 && *refine {
+		return errors.New("--batch-size cannot be combined with --refine")
+	}
+	if *batchAPI || *collect != "" {
+		switch {
+		case *batchAPI && *collect != "":
+			return errors.New("--batch-api and --collect are mutually exclusive")
+		case af.provider != "openai":
+			return errors.New("--batch-api and --collect need --provider openai")
+		case *refine || *batchSize > 1 || *summarizer != "":
+			return errors.New("--batch-api and --collect cannot be combined with --refine, --batch-size or --summarizer-model")
+		}
+	}
+	unlock, err := lockRepo("plan")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	shallow, err := prepareHistory(*unshallow, *fetchDepth)
+	if err != nil {
+		return err
+	}
+	base, head, headRef, err := resolveRange(rangeExpr, *limit, shallow)
+	if err != nil {
+		return err
+	}
+
+	commits, err := listCommits(*rangeExpr)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return errors.New("no commits in range")
+	}
+	nt.summary.Commits = len(commits)
+	for _, c := range commits {
+		if shallow[c.SHA] {
+			return fmt.Errorf("commit %s is at the shallow clone boundary, so its parent is missing and its diff would show the whole tree.\n"+
+				"Fetch more history first: rerun with --unshallow or --fetch-depth=%d, or run `git fetch --unshallow`", c.SHA[:7], len(commits)+1)
+		}
+	}
+
+	ai, err := af.client()
+	if err != nil {
+		return err
+	}
+	var (
+		batchOC    *OpenAIClient
+		batchAudit *auditClient
+		collector  *batchCollector
+		results    *batchResultClient
+	)
+	if *batchAPI || *collect != "" {
+		if batchOC, err = NewOpenAIClient(af.gen); err != nil {
+			return err
+		}
+		if batchAudit, err = af.auditLog(); err != nil {
+			return err
+		}
+		if *batchAPI {
+			collector = &batchCollector{}
+			ai = collector
+		} else {
+			ctx, cancel := context.WithTimeout(rootCtx, 5*time.Minute)
+			results, err = collectBatch(ctx, batchOC, *collect)
+			cancel()
+			if err != nil {
+				return err
+			}
+			results.inner, results.audit = ai, batchAudit
+			ai = results
+		}
+	}
+
+	groups := make([][]CommitMeta, len(commits))
+	for i, c := range commits {
+		groups[i] = []CommitMeta{c}
+	}
+	if *consolidate {
+		if groups, err = squashGroups(commits, *tinyLines); err != nil {
+			return err
+		}
+	}
+
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	lr = mode.lengthRules(lr.withPolicy(policy))
+
+	repoCtx, err := repoContext(*repoCtxFlag, *contextFile)
+	if err != nil {
+		return err
+	}
+
+	var issues *issueFetcher
+	var branchName string
+	if *issueContext {
+		issues = newIssueFetcher()
+		out, _ := git("symbolic-ref", "--quiet", "--short", "HEAD")
+		branchName = strings.TrimSpace(out)
+	}
+
+	started := time.Now()
+	// runCtx ends at Ctrl-C or at the --deadline; either way the commits
+	// planned so far are written as a partial plan.
+	runCtx := rootCtx
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(rootCtx, *deadline)
+		defer cancel()
+	}
+	usageByModel := map[string]Usage{}
+	// addUsage charges the traffic since before to model.
+	addUsage := func(model string, before Usage) {
+		u, after := usageByModel[model], apiUsage.snapshot()
+		u.Requests += after.Requests - before.Requests
+		u.PromptTokens += after.PromptTokens - before.PromptTokens
+		u.CompletionTokens += after.CompletionTokens - before.CompletionTokens
+		usageByModel[model] = u
+	}
+	// prepare gathers what is needed to ask for one group's message. Inputs
+	// are cached because batching looks ahead of the main loop.
+	prepared := map[string]*planInput{}
+	prepare := func(g []CommitMeta) (*planInput, error) {
+		c := g[0]
+		if in, ok := prepared[c.SHA]; ok {
+			return in, nil
+		}
+		diff, err := groupDiff(g, *funcContext)
+		if err != nil {
+			return nil, err
+		}
+		if *funcContext && len(diff) > diffBudgetOf(ai) {
+			if diff, err = groupDiff(g, false); err != nil {
+				return nil, err
+			}
+		}
+		in := &planInput{group: g, diff: diff, hash: diffHash(diff), timeout: commitTimeout(*timeout, diff, *adaptiveTimeout)}
+		if *detectTrivial && !mode.keepsOld() {
+			in.trivial = trivialMessage(diff, spaceOnlyChange(g), *emoji)
+			if in.trivial != "" && !policy.ruleBased(in.trivial) {
+				in.trivial = ""
+			}
+		}
+		var subjects []string
+		for _, gc := range g {
+			subjects = append(subjects, gc.Subject)
+			if gc.SHA != c.SHA {
+				in.squash = append(in.squash, gc.SHA)
+			}
+		}
+		in.oldMsg = strings.Join(subjects, "\n")
+		if issues != nil || policy != nil || mode.keepsOld() {
+			for _, gc := range g {
+				body, _ := git("log", "-1", "--format=%B", gc.SHA)
+				in.bodies = append(in.bodies, body)
+			}
+		}
+		model := af.model
+		if router != nil {
+			model = router.pick(diff)
+		}
+		in.req = suggestRequest{Model: model, Diff: diff, OldMsg: in.oldMsg, Emoji: *emoji, Mode: mode, Confidence: true, Refine: *refine}
+		if mode.keepsOld() {
+			// Polishing needs the whole message, not just the subjects.
+			var old []string
+			for _, b := range in.bodies {
+				old = append(old, strings.TrimSpace(b))
+			}
+			in.req.OldMsg = strings.Join(old, "\n\n")
+		}
+		if issues != nil {
+			ctx, cancel := context.WithTimeout(runCtx, *timeout)
+			in.req.Context = issues.context(ctx, append([]string{branchName}, in.bodies...)...)
+			cancel()
+		}
+		in.req.Context = repoCtx + in.req.Context
+		if policy != nil {
+			in.req.Context = policy.instructions() + in.req.Context
+		}
+		prepared[c.SHA] = in
+		return in, nil
+	}
+
+	var items []PlanItem
+	defer func() {
+		nt.summary.Processed = len(items)
+		for _, it := range items {
+			nt.summary.NeedsReview += boolInt(it.NeedsReview)
+			nt.summary.Failed += boolInt(it.failed())
+		}
+	}()
+	byHash := map[string]int{}         // diff hash -> index in items
+	batched := map[string]suggestion{} // answers from --batch-size requests, by group head SHA
+	// repeatBase is, by diff hash, what a repeat of that diff starts from:
+	// the message before the commit's own trailers were carried in, and the
+	// old message the model saw.
+	repeatBase := map[string]struct{ msg, prompt string }{}
+	for gi, g := range groups {
+		c := g[0]
+		if c.IsMerge && !*allowMerges {
+			slog.Info("skip merge commit", "sha", c.SHA[:7])
+			continue
+		}
+		in, err := prepare(g)
+		if err != nil {
+			return err
+		}
+		diff, oldMsg, squash, hash, bodies, req := in.diff, in.oldMsg, in.squash, in.hash, in.bodies, in.req
+		model := req.Model
+		// planRule records a message written without the model.
+		planRule := func(msg, reverts string) {
+			one := 1.0
+			item := PlanItem{
+				SHA:         c.SHA,
+				OldMessage:  oldMsg,
+				NewMessage:  lr.apply(msg),
+				AuthorName:  c.AuthorName,
+				AuthorEmail: c.AuthorEmail,
+				AuthorDate:  c.AuthorDate.Format(time.RFC3339),
+				Confidence:  &one,
+				Squash:      squash,
+				DiffHash:    hash,
+				Reverts:     reverts,
+				Status:      statusOK,
+			}
+			repeatBase[hash] = struct{ msg, prompt string }{item.NewMessage, req.OldMsg}
+			if policy != nil {
+				item.NewMessage = policy.carryTrailers(item.NewMessage, strings.Join(bodies, "\n"))
+			}
+			byHash[hash] = len(items)
+			items = append(items, item)
+			slog.Info("planned", "sha", c.SHA[:7], "old", truncate(c.Subject, 60), "new", firstLine(msg), "ai", false)
+		}
+		// Reverts are recognized before --dedup, which would otherwise give
+		// the revert of a revert the original commit's message.
+		if *detectTrivial && len(g) == 1 && !c.IsMerge {
+			body, _ := git("log", "-1", "--format=%B", c.SHA)
+			if reverted := revertedCommit(c, body, *funcContext, items, byHash); reverted != "" {
+				msg := revertMessage(reverted, body, items, *emoji)
+				if policy.ruleBased(msg) {
+					planRule(msg, reverted)
+					continue
+				}
+			}
+		}
+		// Outside rewrite mode a message depends on the whole old one too.
+		base, planned := repeatBase[hash]
+		if j, ok := byHash[hash]; ok && planned && *dedup && (!mode.keepsOld() || base.prompt == req.OldMsg) {
+			orig := items[j]
+			item := PlanItem{
+				SHA:         c.SHA,
+				OldMessage:  oldMsg,
+				NewMessage:  base.msg,
+				AuthorName:  c.AuthorName,
+				AuthorEmail: c.AuthorEmail,
+				AuthorDate:  c.AuthorDate.Format(time.RFC3339),
+				Confidence:  orig.Confidence,
+				NeedsReview: orig.NeedsReview && len(orig.ReviewNotes) == 0,
+				Squash:      squash,
+				DiffHash:    hash,
+				RepeatOf:    orig.SHA,
+				Status:      statusOK,
+			}
+			for _, n := range orig.ReviewNotes {
+				if !strings.HasPrefix(n, "policy: ") {
+					flagForReview(&item, n)
+				}
+			}
+			// The policy's trailers come from this commit, not the one it
+			// repeats; so does its Change-Id, which apply puts back.
+			if policy != nil {
+				item.NewMessage = policy.carryTrailers(item.NewMessage, strings.Join(bodies, "\n"))
+				for _, v := range policy.check(item.NewMessage) {
+					slog.Warn("policy violation", "sha", c.SHA[:7], "rule", v)
+					flagForReview(&item, "policy: "+v)
+				}
+			}
+			items = append(items, item)
+			slog.Info("planned", "sha", c.SHA[:7], "repeat_of", orig.SHA[:7])
+			continue
+		}
+		if in.trivial != "" {
+			planRule(in.trivial, "")
+			continue
+		}
+		if runCtx.Err() != nil {
+			break
+		}
+		_, done := batched[c.SHA]
+		if !done && *batchSize > 1 && len(diff) <= diffBudgetOf(ai) / *batchSize {
+			// Pack this commit and the next small ones for the same model
+			// into one request; anything that doesn't fit is asked alone.
+			batch := []*planInput{in}
+			seen := map[string]bool{hash: true}
+			for _, ng := range groups[gi+1 : min(len(groups), gi+1+2**batchSize)] {
+				if len(batch) == *batchSize {
+					break
+				}
+				if ng[0].IsMerge && !*allowMerges {
+					continue
+				}
+				nin, err := prepare(ng)
+				if err != nil {
+					return err
+				}
+				_, repeat := byHash[nin.hash]
+				if (repeat || seen[nin.hash]) && *dedup || nin.trivial != "" || nin.req.Model != model || len(nin.diff) > diffBudgetOf(ai) / *batchSize {
+					continue
+				}
+				seen[nin.hash] = true
+				batch = append(batch, nin)
+			}
+			if len(batch) > 1 {
+				reqs := make([]suggestRequest, len(batch))
+				for k, b := range batch {
+					reqs[k] = b.req
+				}
+				before := apiUsage.snapshot()
+				var limit time.Duration
+				for _, b := range batch {
+					limit += b.timeout
+				}
+				ctx, cancel := context.WithTimeout(runCtx, limit)
+				sgs, err := suggestBatch(ctx, ai, reqs)
+				cancel()
+				addUsage(model, before)
+				if err != nil {
+					if runCtx.Err() != nil {
+						break
+					}
+					slog.Warn("batched request failed; asking one by one", "commits", len(batch), "err", err)
+				} else {
+					slog.Info("batched commits in one request", "commits", len(batch))
+					for k, b := range batch {
+						batched[b.group[0].SHA] = sgs[k]
+					}
+				}
+			}
+		}
+		sg, ok := batched[c.SHA]
+		if !ok && *summarizer != "" && changedLines(diff) >= *summarizeLines {
+			before := apiUsage.snapshot()
+			ctx, cancel := context.WithTimeout(runCtx, in.timeout)
+			summary, err := summarizeForPrompt(ctx, ai, *summarizer, diff)
+			cancel()
+			addUsage(*summarizer, before)
+			if err != nil {
+				if runCtx.Err() != nil {
+					break
+				}
+				slog.Warn("summarizing failed; using the diff", "sha", c.SHA[:7], "err", err)
+			} else {
+				req.Summary = summary
+			}
+		}
+		before := apiUsage.snapshot()
+		if !ok {
+			// A timeout is often a slow moment rather than a prompt the
+			// model can't answer, so it is worth another, longer try.
+			limit := in.timeout
+			for try := 0; ; try++ {
+				ctx, cancel := context.WithTimeout(runCtx, limit)
+				sg, err = suggest(ctx, ai, req)
+				cancel()
+				if err == nil || runCtx.Err() != nil || try == *timeoutRetries || classifyError(err) != statusTimeout {
+					break
+				}
+				limit *= 2
+				slog.Warn("AI request timed out; retrying", "sha", c.SHA[:7], "timeout", limit)
+			}
+			if err != nil {
+				if runCtx.Err() != nil {
+					break
+				}
+				status := classifyError(err)
+				if status == statusAuth {
+					// Every other request would fail the same way.
+					return fmt.Errorf("AI failed for %s: %w", c.SHA, err)
+				}
+				addUsage(model, before)
+				slog.Warn("AI failed; keeping the original message", "sha", c.SHA[:7], "status", status, "err", err)
+				if bodies == nil {
+					for _, gc := range g {
+						body, _ := git("log", "-1", "--format=%B", gc.SHA)
+						bodies = append(bodies, body)
+					}
+				}
+				var orig []string
+				for _, b := range bodies {
+					orig = append(orig, strings.TrimSpace(b))
+				}
+				items = append(items, PlanItem{
+					SHA:         c.SHA,
+					OldMessage:  oldMsg,
+					NewMessage:  strings.Join(orig, "\n\n"),
+					AuthorName:  c.AuthorName,
+					AuthorEmail: c.AuthorEmail,
+					AuthorDate:  c.AuthorDate.Format(time.RFC3339),
+					Squash:      squash,
+					DiffHash:    hash,
+					Model:       model,
+					Status:      status,
+					Error:       err.Error(),
+				})
+				continue
+			}
+		}
+		if collector != nil {
+			// Only the prompt matters now; keep the item so later repeats
+			// of this diff aren't submitted again.
+			repeatBase[hash] = struct{ msg, prompt string }{"", req.OldMsg}
+			byHash[hash] = len(items)
+			items = append(items, PlanItem{SHA: c.SHA, DiffHash: hash})
+			continue
+		}
+		if *reprompt && lowConfidence(sg.Confidence, *minConfidence) {
+			slog.Info("low confidence, re-prompting", "sha", c.SHA[:7])
+			ctx, cancel := context.WithTimeout(runCtx, in.timeout)
+			retry, err := suggest(ctx, ai, req)
+			cancel()
+			if err == nil && confidenceOf(retry.Confidence) > confidenceOf(sg.Confidence) {
+				sg = retry
+			}
+		}
+		addUsage(model, before)
+		newMsg := sg.Message
+		item := PlanItem{
+			SHA:         c.SHA,
+			OldMessage:  oldMsg,
+			NewMessage:  lr.apply(sanitizeMessage(newMsg)),
+			AuthorName:  c.AuthorName,
+			AuthorEmail: c.AuthorEmail,
+			AuthorDate:  c.AuthorDate.Format(time.RFC3339),
+			Confidence:  sg.Confidence,
+			Squash:      squash,
+			DiffHash:    hash,
+			Model:       model,
+			DiffSummary: req.Summary,
+			Status:      statusOK,
+		}
+		if s := firstLine(sanitizeMessage(newMsg)); firstLine(item.NewMessage) != s {
+			flagForReview(&item, fmt.Sprintf("subject shortened to %d characters", lr.subjectMax))
+		}
+		if lowConfidence(sg.Confidence, *minConfidence) {
+			if sg.Confidence == nil {
+				flagForReview(&item, "model reported no confidence score")
+			} else {
+				flagForReview(&item, fmt.Sprintf("confidence %.2f below %.2f", *sg.Confidence, *minConfidence))
+			}
+		}
+		if *guard {
+			if missing, stripped := unverifiedClaims(item.NewMessage, diff, req.OldMsg); len(missing) > 0 {
+				if *stripUnverified {
+					item.NewMessage = stripped
+				}
+				flagForReview(&item, "not found in diff: "+strings.Join(missing, ", "))
+			}
+		}
+		repeatBase[hash] = struct{ msg, prompt string }{item.NewMessage, req.OldMsg}
+		if policy != nil {
+			item.NewMessage = policy.carryTrailers(item.NewMessage, strings.Join(bodies, "\n"))
+			for _, v := range policy.check(item.NewMessage) {
+				slog.Warn("policy violation", "sha", c.SHA[:7], "rule", v)
+				flagForReview(&item, "policy: "+v)
+			}
+		}
+		byHash[hash] = len(items)
+		items = append(items, item)
+		if len(squash) > 0 {
+			slog.Info("planned", "sha", c.SHA[:7], "squashed", len(squash), "new", truncate(firstLine(newMsg), 60))
+		} else {
+			slog.Info("planned", "sha", c.SHA[:7], "old", truncate(c.Subject, 60), "new", truncate(firstLine(newMsg), 60))
+		}
+	}
+
+	if collector != nil {
+		if rootCtx.Err() != nil {
+			return errors.New("interrupted; no batch was submitted")
+		}
+		ctx, cancel := context.WithTimeout(rootCtx, 5*time.Minute)
+		id, err := submitBatch(ctx, batchOC, collector.reqs, batchAudit)
+		cancel()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Submitted batch %s (%d requests for %d commits).\n", id, len(collector.reqs), len(commits))
+		fmt.Printf("When it has finished (within 24h), build the plan by rerunning this command with --collect %s instead of --batch-api.\n", id)
+		return nil
+	}
+
+	for i := range items {
+		if in, ok := prepared[items[i].SHA]; ok {
+			items[i].annotate(in.diff)
+		}
+	}
+
+	if *consistency != "off" && len(items) > 0 && runCtx.Err() == nil {
+		ctx, cancel := context.WithTimeout(runCtx, *timeout)
+		model := af.model
+		if router != nil {
+			model = router.large
+		}
+		before := apiUsage.snapshot()
+		err := consistencyPass(ctx, ai, model, *consistency, items, policy)
+		cancel()
+		addUsage(model, before)
+		if err != nil {
+			return err
+		}
+	}
+
+	top, _ := repoPath()
+	plan := Plan{
+		RepoPath:    top,
+		RepoID:      repoFingerprint(head),
+		Base:        base,
+		Head:        head,
+		HeadRef:     headRef,
+		CreatedAt:   time.Now().Format(time.RFC3339),
+		Model:       af.model,
+		Provider:    af.provider,
+		GenParams:   af.gen,
+		Refine:      *refine,
+		ElapsedSec:  time.Since(started).Round(time.Millisecond).Seconds(),
+		AllowMerges: *allowMerges,
+		Items:       items,
+	}
+	if mode.mode != modeRewrite {
+		plan.Mode = mode.mode
+	}
+	if mode.generate != generateBoth {
+		plan.Generate = mode.generate
+	}
+	if plan.Tags, err = rangeTags(items); err != nil {
+		return err
+	}
+	if u := apiUsage.snapshot(); u.Requests > 0 {
+		plan.Usage = &u
+	}
+	if router != nil {
+		plan.ModelRouting = router.String()
+		plan.UsageByModel = usageByModel
+	}
+	if results != nil {
+		plan.BatchID = results.id
+		plan.BatchUsage = &results.usage
+	}
+	nt.summary.CostUSD = computeStats(plan, -1, -1).CostUSD
+	if runCtx.Err() != nil {
+		// Keep what was planned so far. Ending the plan at the last planned
+		// commit keeps it consistent: apply rewrites base..head only.
+		stopped := "interrupted"
+		if rootCtx.Err() == nil {
+			stopped = fmt.Sprintf("deadline of %s reached", *deadline)
+		}
+		if len(items) == 0 {
+			return fmt.Errorf("%s before any commit was planned", stopped)
+		}
+		plan.Partial = true
+		plan.Head = items[len(items)-1].lastSHA()
+		if err := savePlan(*outFile, plan); err != nil {
+			return err
+		}
+		nt.summary.Output = *outFile
+		return fmt.Errorf("%s: wrote partial plan %s (%d of %d commits, up to %s)", stopped, *outFile, len(items), len(commits), plan.Head[:7])
+	}
+	if err := savePlan(*outFile, plan); err != nil {
+		return err
+	}
+	nt.summary.Output = *outFile
+	if policy != nil {
+		if err := checkPlanPolicy(policy, plan); err != nil {
+			return fmt.Errorf("wrote %s, but apply will refuse it: %w", *outFile, err)
+		}
+	}
+	if failures := failedItems(plan); len(failures) > 0 {
+		return fmt.Errorf("wrote %s, but no message could be generated for %d of %d item(s); write them with `git-smartmsg edit`, or apply with --force-partial to keep their original messages:\n%s",
+			*outFile, len(failures), len(items), strings.Join(failures, "\n"))
+	}
+	fmt.Printf("Wrote %s (%d messages)\n", *outFile, len(items))
+	return nil
+}
+
+// failedItems describes the items of plan that have no generated message.
+func failedItems(plan Plan) []string {
+	var out []string
+	for _, it := range plan.Items {
+		if it.failed() {
+			out = append(out, fmt.Sprintf("  %s  %s: %s", it.SHA[:7], it.Status, firstLine(it.Error)))
+		}
+	}
+	return out
+}
+
+func lowConfidence(c *float64, min float64) bool {
+	return min > 0 && confidenceOf(c) < min
+}
+
+func confidenceOf(c *float64) float64 {
+	if c == nil {
+		return -1
+	}
+	return *c
+}
+
+// flagForReview marks an item so apply won't use it until a human has
+// looked at it.
+func flagForReview(it *PlanItem, note string) {
+	it.NeedsReview = true
+	it.ReviewNotes = append(it.ReviewNotes, note)
+}
+
+// Item statuses. Everything but statusOK is a failure to get a message.
+const (
+	statusOK          = "ok"
+	statusTimeout     = "timeout"
+	statusRateLimited = "rate_limited"
+	statusAuth        = "auth"
+	statusEmpty       = "empty_response"
+	statusAPIError    = "api_error"
+)
+
+var errEmptyResponse = errors.New("empty response")
+
+var httpStatusRe = regexp.MustCompile(`\bHTTP (\d{3})\b`)
+
+// classifyError names the kind of failure behind an AI error, for the
+// status field of plan items.
+func classifyError(err error) string {
+	code := 0
+	var apiErr *openai.Error
+	var awsErr interface{ HTTPStatusCode() int } // AWS SDK response errors
+	if errors.As(err, &apiErr) {
+		code = apiErr.StatusCode
+	} else if errors.As(err, &awsErr) {
+		code = awsErr.HTTPStatusCode()
+	} else if m := httpStatusRe.FindStringSubmatch(err.Error()); m != nil {
+		code, _ = strconv.Atoi(m[1])
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return statusTimeout
+	case errors.Is(err, errEmptyResponse):
+		return statusEmpty
+	case code == http.StatusTooManyRequests:
+		return statusRateLimited
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return statusAuth
+	}
+	return statusAPIError
+}
+
+// timeoutStep is how much diff earns another half of the base timeout
+// under --adaptive-timeout: the model reads the whole prompt before it
+// writes anything, so large diffs take longer to answer.
+const timeoutStep = 8 << 10
+
+// commitTimeout is the timeout for a request about diff: base, scaled up
+// with the diff's size when adaptive, to at most four times base.
+func commitTimeout(base time.Duration, diff string, adaptive bool) time.Duration {
+	if !adaptive {
+		return base
+	}
+	return min(base+base*time.Duration(len(diff)/timeoutStep)/2, 4*base)
+}
+
+// sanitizeMessage cleans up a model's reply into a commit message. It only
+// removes what is clearly wrapping, not content: a code fence around the
+// whole reply, a Markdown heading marker or bold around the subject, and
+// invisible characters. Backticks, '#' and emoji inside the message are
+// kept as written.
+func sanitizeMessage(s string) string {
+	s = unwrapFence(normalizeText(s))
+	lines := splitLines(s)
+	first := strings.TrimSpace(lines[0])
+	first = mdHeadingPrefixRe.ReplaceAllString(first, "")
+	if m := wrappedSubjectRe.FindStringSubmatch(first); m != nil {
+		first = strings.TrimSpace(m[2])
+	}
+	first = bracketTypeRe.ReplaceAllString(first, "$1:")
+	if first == "" {
+		return "chore: update"
+	}
+
+	// Body: no trailing blanks on a line and at most one empty line in a
+	// row; fenced code keeps its blank lines.
+	var body []string
+	fenced, blank := false, false
+	for _, l := range lines[1:] {
+		l = strings.TrimRight(l, " \t")
+		if strings.HasPrefix(strings.TrimSpace(l), "```") {
+			fenced = !fenced
+		}
+		if l == "" && !fenced {
+			if blank || len(body) == 0 {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		body = append(body, l)
+	}
+	msg := first
+	if rest := strings.TrimRight(strings.Join(body, "\n"), "\n"); rest != "" {
+		msg += "\n\n" + rest
+	}
+	return msg
+}
+
+var (
+	mdHeadingPrefixRe = regexp.MustCompile(`^#{1,6}\s+`)
+	// A subject wrapped whole in **bold**, `code` or quotes.
+	wrappedSubjectRe = regexp.MustCompile("^(\\*\\*|`|\"|“)([^*`\"“”]+)(\\*\\*|`|\"|”)$")
+	bracketTypeRe    = regexp.MustCompile(`^\[(feat|fix|docs|style|refactor|perf|test|chore)\]\s*:`)
+	fenceOpenRe      = regexp.MustCompile("^```[\\w+-]*\\s*$")
+)
+
+// unwrapFence returns s without surrounding whitespace and without a code
+// fence (or single backticks) enclosing the whole of it. Backticks that
+// belong to the message, like a trailing `identifier`, are untouched.
+func unwrapFence(s string) string {
+	s = strings.TrimSpace(s)
+	lines := splitLines(s)
+	if n := len(lines); n >= 2 && fenceOpenRe.MatchString(strings.TrimSpace(lines[0])) && strings.TrimSpace(lines[n-1]) == "```" {
+		return strings.TrimSpace(strings.Join(lines[1:n-1], "\n"))
+	}
+	if len(lines) == 1 && len(s) > 2 && strings.HasPrefix(s, "`") && strings.HasSuffix(s, "`") && strings.Count(s, "`") == 2 {
+		return strings.TrimSpace(s[1 : len(s)-1])
+	}
+	return s
+}
+
+// normalizeText makes model output safe to commit: valid UTF-8, LF line
+// endings, no zero-width or byte-order-mark characters (the zero-width
+// joiner and variation selectors that hold emoji together are kept), plain
+// spaces for no-break spaces, and combining accents and kana voicing marks
+// composed onto their letters, as NFC would for the common cases.
+func normalizeText(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	var sb strings.Builder
+	var prev rune = -1
+	for _, r := range s {
+		switch r {
+		case '\u200b', '\u2060', '\ufeff', '\u00ad': // zero-width space, word joiner, BOM, soft hyphen
+			continue
+		case '\u00a0', '\u202f': // no-break spaces
+			r = ' '
+		case '\r':
+			r = '\n'
+		}
+		if c, ok := composeTable[[2]rune{prev, r}]; ok {
+			prev = c
+			continue
+		}
+		if prev >= 0 {
+			sb.WriteRune(prev)
+		}
+		prev = r
+	}
+	if prev >= 0 {
+		sb.WriteRune(prev)
+	}
+	return sb.String()
+}
+
+// composeTable maps a letter and a following combining mark to the
+// precomposed character, for Latin accents and Japanese (han)dakuten.
+var composeTable = func() map[[2]rune]rune {
+	t := map[[2]rune]rune{}
+	add := func(mark rune, bases, composed string) {
+		b, c := []rune(bases), []rune(composed)
+		for i := range b {
+			t[[2]rune{b[i], mark}] = c[i]
+		}
+	}
+	add('\u0300', "aeiouAEIOU", "àèìòùÀÈÌÒÙ")
+	add('\u0301', "aeiouyAEIOUYcnszCNSZ", "áéíóúýÁÉÍÓÚÝćńśźĆŃŚŹ")
+	add('\u0302', "aeiouAEIOU", "âêîôûÂÊÎÔÛ")
+	add('\u0303', "anoANO", "ãñõÃÑÕ")
+	add('\u0308', "aeiouyAEIOU", "äëïöüÿÄËÏÖÜ")
+	add('\u030a', "aA", "åÅ")
+	add('\u030c', "cszrCSZR", "čšžřČŠŽŘ")
+	add('\u0327', "cC", "çÇ")
+	add('\u3099', "かきくけこさしすせそたちつてとはひふへほうカキクケコサシスセソタチツテトハヒフヘホウワヰヱヲ",
+		"がぎぐげござじずぜぞだぢづでどばびぶべぼゔガギグゲゴザジズゼゾダヂヅデドバビブベボヴヷヸヹヺ")
+	add('\u309a', "はひふへほハヒフヘホ", "ぱぴぷぺぽパピプペポ")
+	return t
+}()
+
+var trailerLineRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*: \S`)
+
+// lengthRules are --subject-max and --body-wrap, applied to generated
+// messages after the fact rather than left to the model.
+type lengthRules struct {
+	subjectMax int
+	bodyWrap   int
+}
+
+func (r *lengthRules) register(fs *flag.FlagSet) {
+	fs.IntVar(&r.subjectMax, "subject-max", 72, "shorten longer subject lines at a word boundary (0: no limit)")
+	fs.IntVar(&r.bodyWrap, "body-wrap", 72, "hard-wrap body lines at this column (0: leave them as generated)")
+}
+
+// withPolicy tightens the limits to the commit policy's, so messages are
+// made to pass its subject_max and max_body_width checks.
+func (r lengthRules) withPolicy(p *Policy) lengthRules {
+	if p == nil {
+		return r
+	}
+	tighten := func(v, limit int) int {
+		if limit > 0 && (v == 0 || limit < v) {
+			return limit
+		}
+		return v
+	}
+	return lengthRules{subjectMax: tighten(r.subjectMax, p.SubjectMax), bodyWrap: tighten(r.bodyWrap, p.MaxBodyWidth)}
+}
+
+var listMarkerRe = regexp.MustCompile(`^(\s*)([-*+]|\d+[.)])\s+`)
+
+// apply shortens the subject and wraps the body. Code blocks, indented
+// lines and the trailer block are left alone, and a word longer than the
+// width (a URL, say) gets a line of its own rather than being split.
+func (r lengthRules) apply(msg string) string {
+	lines := splitLines(msg)
+	if r.subjectMax > 0 {
+		lines[0] = shortenSubject(lines[0], r.subjectMax)
+	}
+	if r.bodyWrap <= 0 || len(lines) == 1 {
+		return strings.Join(lines, "\n")
+	}
+	trailersFrom := len(lines)
+	for i := len(lines) - 1; i > 0 && strings.TrimSpace(lines[i]) != ""; i-- {
+		if !trailerLineRe.MatchString(lines[i]) {
+			trailersFrom = len(lines)
+			break
+		}
+		trailersFrom = i
+	}
+	out := []string{lines[0]}
+	fenced := false
+	for i, l := range lines[1:] {
+		if strings.HasPrefix(strings.TrimSpace(l), "```") {
+			fenced = !fenced
+		}
+		if fenced || i+1 >= trailersFrom || strings.HasPrefix(l, "    ") || strings.HasPrefix(l, "\t") || utf8.RuneCountInString(l) <= r.bodyWrap {
+			out = append(out, l)
+			continue
+		}
+		out = append(out, wrapLine(l, r.bodyWrap)...)
+	}
+	return strings.Join(out, "\n")
+}
+
+// shortenSubject cuts s to max runes at the last word boundary, dropping
+// punctuation left dangling at the end. CJK text has no spaces, so its
+// commas, full stops and opening brackets count as boundaries too.
+func shortenSubject(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	cut := string(r[:max])
+	if i := strings.LastIndexAny(cut, " 、，。；：（「『"); i >= 0 && utf8.RuneCountInString(cut[:i]) > max/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,;:-–(、，。；：（「『")
+}
+
+// wrapLine breaks one long line at spaces; continuation lines of a list
+// item are indented to align with its text.
+func wrapLine(l string, width int) []string {
+	lead := l[:len(l)-len(strings.TrimLeft(l, " "))]
+	indent := lead
+	if m := listMarkerRe.FindString(l); m != "" {
+		indent = strings.Repeat(" ", utf8.RuneCountInString(m))
+	}
+	var out []string
+	cur := ""
+	for _, w := range strings.Fields(l) {
+		switch {
+		case cur == "":
+			cur = lead + w
+		case utf8.RuneCountInString(cur)+1+utf8.RuneCountInString(w) > width:
+			out = append(out, cur)
+			cur = indent + w
+		default:
+			cur += " " + w
+		}
+	}
+	return append(out, cur)
+}
+
+// appendTrailers adds "Key: value" trailers to msg, joining an existing
+// trailer block instead of starting a new paragraph.
+func appendTrailers(msg string, trailers ...string) string {
+	msg = strings.TrimRight(msg, " \n")
+	lines := splitLines(msg)
+	i := len(lines)
+	for i > 0 && strings.TrimSpace(lines[i-1]) != "" {
+		i--
+	}
+	inBlock := i > 0 && i < len(lines)
+	for _, l := range lines[i:] {
+		if !trailerLineRe.MatchString(l) {
+			inBlock = false
+		}
+	}
+	if inBlock {
+		return msg + "\n" + strings.Join(trailers, "\n")
+	}
+	return msg + "\n\n" + strings.Join(trailers, "\n")
+}
+
+func splitLines(s string) []string {
+	return regexp.MustCompile(`\r?\n`).Split(s, -1)
+}
+
+func envOr(k, def string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return def
+}
+
+// ============================
+// Consistency pass
+// ============================
+
+// Subjects are generated one commit at a time, so a plan can drift between
+// tenses and spellings or give two commits the same subject. The pass below
+// only touches subject lines; it never reorders commits, since that would
+// change what each commit's diff is.
+
+const consistencySystemPrompt = `You edit the subject lines of a series of Git commits so they read as one consistent history.
+The subjects are listed oldest first as "N. subject", followed by the commit's original subject in brackets for reference.
+- Use the same tense and mood everywhere (imperative present: "add", not "added" or "adds").
+- Use the same term and spelling for the same thing across commits.
+- Make identical subjects distinct by what each commit changed; never merge or drop commits.
+- Read them as a narrative: a later commit must not claim to "add" what an earlier one already added.
+- Keep each subject's prefix (type, scope, emoji), its meaning, and a length of at most 72 characters.
+Reply with JSON only, listing just the subjects you changed: {"subjects": [{"n": 1, "subject": "..."}]}`
+
+type consistencyReply struct {
+	Subjects []struct {
+		N       int    `json:"n"`
+		Subject string `json:"subject"`
+	} `json:"subjects"`
+}
+
+// imperativeVerbs are the verbs whose other forms are rewritten to the
+// imperative by the deterministic pass.
+var imperativeVerbs = []string{
+	"add", "adjust", "allow", "avoid", "bump", "change", "clean", "clarify", "convert", "correct",
+	"create", "delete", "deprecate", "disable", "document", "drop", "enable", "ensure", "extract",
+	"fix", "handle", "implement", "improve", "introduce", "merge", "move", "optimize", "prevent",
+	"refactor", "reduce", "remove", "rename", "replace", "restore", "revert", "simplify", "skip",
+	"split", "support", "update", "upgrade", "use",
+}
+
+var verbForms = func() map[string]string {
+	m := map[string]string{}
+	for _, v := range imperativeVerbs {
+		stem := v
+		switch {
+		case strings.HasSuffix(v, "y"):
+			m[v[:len(v)-1]+"ies"] = v
+			m[v[:len(v)-1]+"ied"] = v
+		case strings.HasSuffix(v, "e"):
+			stem = v[:len(v)-1]
+			m[v+"s"] = v
+			m[v+"d"] = v
+		case strings.HasSuffix(v, "x"), strings.HasSuffix(v, "sh"), strings.HasSuffix(v, "ch"):
+			m[v+"es"] = v
+			m[v+"ed"] = v
+		default:
+			m[v+"s"] = v
+			m[v+"ed"] = v
+		}
+		m[stem+"ing"] = v
+	}
+	for form, v := range map[string]string{"dropped": "drop", "dropping": "drop", "skipped": "skip", "skipping": "skip", "splitting": "split", "splits": "split"} {
+		m[form] = v
+	}
+	return m
+}()
+
+// splitSubject separates a subject into its prefix ("feat(api): ", an emoji)
+// and the description after it.
+func splitSubject(s string) (prefix, desc string) {
+	if m := policySubjectRe.FindStringSubmatch(s); m != nil {
+		return s[:len(s)-len(m[3])], m[3]
+	}
+	if r, size := utf8.DecodeRuneInString(s); r > unicode.MaxASCII && !unicode.IsLetter(r) {
+		if i := strings.IndexByte(s, ' '); i >= size {
+			return s[:i+1], s[i+1:]
+		}
+	}
+	return "", s
+}
+
+func setSubject(msg, subject string) string {
+	_, rest, found := strings.Cut(msg, "\n")
+	if !found {
+		return subject
+	}
+	return subject + "\n" + rest
+}
+
+// normalizeSubjects applies the deterministic fixes: imperative mood for
+// known verbs, the majority case for the first letter of the description,
+// and the majority spelling of words that differ only in case.
+func normalizeSubjects(subjects []string) []string {
+	out := slices.Clone(subjects)
+	upper, lower := 0, 0
+	spellings := map[string]map[string]int{}
+	for i, s := range out {
+		prefix, desc := splitSubject(s)
+		words := strings.Fields(desc)
+		if len(words) == 0 {
+			continue
+		}
+		if v, ok := verbForms[strings.ToLower(words[0])]; ok {
+			if r, _ := utf8.DecodeRuneInString(words[0]); unicode.IsUpper(r) {
+				v = strings.ToUpper(v[:1]) + v[1:]
+			}
+			desc = v + desc[len(words[0]):]
+			out[i] = prefix + desc
+		}
+		if r, _ := utf8.DecodeRuneInString(desc); unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+		for _, w := range words[1:] {
+			w = strings.Trim(w, ".,;:()\"'`")
+			if len(w) < 3 {
+				continue
+			}
+			k := strings.ToLower(w)
+			if spellings[k] == nil {
+				spellings[k] = map[string]int{}
+			}
+			spellings[k][w]++
+		}
+	}
+	preferred := map[string]string{}
+	for k, forms := range spellings {
+		if len(forms) < 2 {
+			continue
+		}
+		best := ""
+		for f, n := range forms {
+			if best == "" || n > forms[best] || n == forms[best] && f < best {
+				best = f
+			}
+		}
+		preferred[k] = best
+	}
+	for i, s := range out {
+		prefix, desc := splitSubject(s)
+		words := strings.Fields(desc)
+		for j, w := range words {
+			if j == 0 {
+				continue
+			}
+			core := strings.Trim(w, ".,;:()\"'`")
+			if p, ok := preferred[strings.ToLower(core)]; ok && core != p {
+				words[j] = strings.Replace(w, core, p, 1)
+			}
+		}
+		if len(words) > 0 && upper != lower {
+			r, size := utf8.DecodeRuneInString(words[0])
+			if upper > lower {
+				words[0] = string(unicode.ToUpper(r)) + words[0][size:]
+			} else if !strings.ContainsFunc(words[0][size:], unicode.IsUpper) {
+				// Leave acronyms and identifiers such as "README" alone.
+				words[0] = string(unicode.ToLower(r)) + words[0][size:]
+			}
+		}
+		if len(words) > 0 {
+			out[i] = prefix + strings.Join(words, " ")
+		}
+	}
+	return out
+}
+
+// consistencyPass harmonises the subjects of a finished plan. mode is
+// "basic" (deterministic only) or "ai" (one aggregate model call first).
+// Items repeating another item follow it, and a change that would break the
+// commit policy is not taken. Subjects that are still identical afterwards
+// are flagged for review.
+func consistencyPass(ctx context.Context, ai AIClient, model, mode string, items []PlanItem, policy *Policy) error {
+	var idx []int // items that own their message
+	for i, it := range items {
+		if it.RepeatOf == "" {
+			idx = append(idx, i)
+		}
+	}
+	subjects := make([]string, len(idx))
+	for k, i := range idx {
+		subjects[k] = firstLine(items[i].NewMessage)
+	}
+
+	if mode == "ai" && len(idx) > 1 {
+		var sb strings.Builder
+		for k, i := range idx {
+			fmt.Fprintf(&sb, "%d. %s  [%s]\n", k+1, subjects[k], firstLine(items[i].OldMessage))
+		}
+		txt, err := ai.Complete(withAIRequest(ctx, aiRequest{Kind: kindConsistency}), model, consistencySystemPrompt, sb.String())
+		if err != nil {
+			return fmt.Errorf("consistency pass: %w", err)
+		}
+		var reply consistencyReply
+		if err := json.Unmarshal([]byte(jsonObjectRe.FindString(txt)), &reply); err != nil {
+			return fmt.Errorf("consistency pass: cannot parse model reply: %w", err)
+		}
+		for _, s := range reply.Subjects {
+			if s.N >= 1 && s.N <= len(subjects) && strings.TrimSpace(s.Subject) != "" {
+				subjects[s.N-1] = strings.TrimSpace(firstLine(s.Subject))
+			}
+		}
+	}
+	subjects = normalizeSubjects(subjects)
+
+	bySHA := map[string]int{}
+	for k, i := range idx {
+		it := &items[i]
+		bySHA[it.SHA] = i
+		if subjects[k] == firstLine(it.NewMessage) {
+			continue
+		}
+		msg := setSubject(it.NewMessage, subjects[k])
+		if policy != nil && len(policy.check(msg)) > len(policy.check(it.NewMessage)) {
+			continue
+		}
+		slog.Info("consistency: subject rewritten", "sha", it.SHA[:7], "old", firstLine(it.NewMessage), "new", subjects[k])
+		it.NewMessage = msg
+	}
+	for i := range items {
+		if j, ok := bySHA[items[i].RepeatOf]; ok {
+			items[i].NewMessage = items[j].NewMessage
+		}
+	}
+
+	first := map[string]string{}
+	for _, i := range idx {
+		it := &items[i]
+		s := strings.ToLower(firstLine(it.NewMessage))
+		if sha, dup := first[s]; dup {
+			flagForReview(it, "same subject as "+sha[:7])
+			slog.Info("consistency: duplicate subject", "sha", it.SHA[:7], "same_as", sha[:7])
+		} else {
+			first[s] = it.SHA
+		}
+	}
+	return nil
+}
+
+// ============================
+// Hallucination guard
+// ============================
+
+// claim patterns: things a message can mention that must be traceable to the
+// diff. Ordinary prose is not checked.
+var (
+	claimCodeRe  = regexp.MustCompile("`([^`\n]+)`")
+	claimPathRe  = regexp.MustCompile(`(?:^|[\s(])((?:[\w.-]+/)*[\w-][\w.-]*\.[A-Za-z][A-Za-z0-9]{0,7})\b`)
+	claimIdentRe = regexp.MustCompile(`\b([a-z][a-z0-9]+[A-Z][A-Za-z0-9]*|[A-Za-z][A-Za-z0-9]*_[A-Za-z0-9_]+|[A-Za-z_][A-Za-z0-9_.]*\(\))`)
+)
+
+// claimStopwords are tokens that look like identifiers or file names but are
+// ordinary words in commit messages.
+var claimStopwords = map[string]bool{
+	"e.g": true, "i.e": true, "etc.": true, "vs.": true,
+	"macos": true, "ipados": true, "watchos": true, "tvos": true,
+}
+
+// diffIndex is the part of a unified diff claims are checked against: the
+// touched paths and the raw text, lowercased.
+type diffIndex struct {
+	files []string
+	text  string
+}
+
+var diffRenameRe = regexp.MustCompile(`(?m)^(?:rename|copy) (?:from|to) (.+)$`)
+
+func indexDiff(diff string) diffIndex {
+	var idx diffIndex
+	seen := map[string]bool{}
+	add := func(f string) {
+		f = strings.ToLower(f)
+		if !seen[f] {
+			seen[f] = true
+			idx.files = append(idx.files, f)
+		}
+	}
+	for _, m := range diffFileRe.FindAllStringSubmatch(diff, -1) {
+		add(m[1])
+		add(m[2])
+	}
+	for _, m := range diffRenameRe.FindAllStringSubmatch(diff, -1) {
+		add(m[1])
+	}
+	idx.text = strings.ToLower(diff)
+	return idx
+}
+
+// has reports whether a claimed path or identifier appears in the diff.
+// Paths may be given in full, as a suffix, or by base name.
+func (d diffIndex) has(claim string) bool {
+	c := strings.ToLower(strings.TrimSuffix(claim, "()"))
+	for _, f := range d.files {
+		if f == c || strings.HasSuffix(f, "/"+c) || filepath.Base(f) == c {
+			return true
+		}
+	}
+	return strings.Contains(d.text, c)
+}
+
+// messageClaims extracts the checkable tokens from one line of a message.
+func messageClaims(line string) []string {
+	var out []string
+	seen := map[string]bool{}
+	add := func(s string) {
+		s = strings.Trim(s, ".,:;'\"")
+		if len(s) < 3 || seen[s] || claimStopwords[strings.ToLower(s)] {
+			return
+		}
+		seen[s] = true
+		out = append(out, s)
+	}
+	for _, m := range claimCodeRe.FindAllStringSubmatch(line, -1) {
+		// Only single tokens; a code span holding an expression or a
+		// sentence is too loose to check.
+		if !strings.ContainsAny(strings.TrimSpace(m[1]), " \t") {
+			add(strings.TrimSpace(m[1]))
+		}
+	}
+	line = claimCodeRe.ReplaceAllString(line, " ")
+	for _, m := range claimPathRe.FindAllStringSubmatch(line, -1) {
+		add(m[1])
+	}
+	for _, m := range claimIdentRe.FindAllStringSubmatch(line, -1) {
+		add(m[1])
+	}
+	return out
+}
+
+// unverifiedClaims returns the tokens in msg that do not appear in the diff,
+// and the message with every body line containing one removed. The subject
+// line is never dropped; an unverifiable subject can only be flagged.
+// Names that the old message already used are the author's, not the
+// model's, so they count as verified; lines kept from it word for word (by
+// --mode polish or keep-subject, or --generate) are therefore never dropped.
+func unverifiedClaims(msg, diff, old string) ([]string, string) {
+	idx := indexDiff(diff)
+	oldIdx := diffIndex{text: strings.ToLower(old)}
+	var missing []string
+	seen := map[string]bool{}
+	lines := splitLines(msg)
+	kept := lines[:0:0]
+	for i, l := range lines {
+		bad := false
+		// The Conventional Commit scope names an area, not a path.
+		if i == 0 {
+			l = ccTypeRe.ReplaceAllString(l, "")
+		}
+		for _, c := range messageClaims(l) {
+			if idx.has(c) || oldIdx.has(c) {
+				continue
+			}
+			bad = true
+			if !seen[c] {
+				seen[c] = true
+				missing = append(missing, c)
+			}
+		}
+		if bad && i > 0 {
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+	return missing, strings.TrimRight(strings.Join(kept, "\n"), "\n ")
+}
+
+// ============================
+// Commit policy (.smartmsg-policy.yaml)
+// ============================
+
+// policyFiles are looked up at the repository root, first match wins.
+var policyFiles = []string{".smartmsg-policy.yaml", ".smartmsg-policy.yml"}
+
+// Policy holds mandatory message rules shared by a team. Generated messages
+// are checked against it at plan time and again at apply time, so a plan
+// edited by hand cannot slip past it.
+type Policy struct {
+	Types            []string `json:"types,omitempty"`             // allowed Conventional Commit types
+	Scopes           []string `json:"scopes,omitempty"`            // allowed scopes
+	RequireScope     bool     `json:"require_scope,omitempty"`     // every subject needs a (scope)
+	RequiredTrailers []string `json:"required_trailers,omitempty"` // e.g. Signed-off-by
+	ForbiddenWords   []string `json:"forbidden_words,omitempty"`   // case-insensitive, whole words
+	SubjectCase      string   `json:"subject_case,omitempty"`      // lower or sentence
+	SubjectMax       int      `json:"subject_max,omitempty"`       // max subject length in characters
+	MaxBodyWidth     int      `json:"max_body_width,omitempty"`    // max body line length in characters
+	Language         string   `json:"language,omitempty"`          // language messages are written in, e.g. Japanese
+
+	path      string
+	forbidden []forbiddenWord // ForbiddenWords compiled by compile
+}
+
+type forbiddenWord struct {
+	word string
+	re   *regexp.Regexp
+}
+
+// compile builds the ForbiddenWords patterns, once per policy rather than
+// on every check. A word is whole when no letter, digit or underscore
+// touches it, except Chinese and Japanese characters, which are written
+// without spaces between words. \b is not used: it never matches after a
+// word ending in punctuation, such as C++, and only knows ASCII letters.
+func (p *Policy) compile() {
+	const edge = `[^\p{L}\p{N}_]|[\p{Han}\p{Hiragana}\p{Katakana}]`
+	p.forbidden = nil
+	for _, w := range p.ForbiddenWords {
+		re := regexp.MustCompile(`(?i)(?:^|` + edge + `)` + regexp.QuoteMeta(w) + `(?:$|` + edge + `)`)
+		p.forbidden = append(p.forbidden, forbiddenWord{w, re})
+	}
+}
+
+var policySubjectRe = regexp.MustCompile(`^(?:\S+\s+)?([a-z]+)(?:\(([^)]*)\))?!?:\s+(.*)$`)
+
+// loadPolicy reads the policy of the current repository; it returns nil
+// when the repository has none.
+func loadPolicy() (*Policy, error) {
+	for _, name := range policyFiles {
+		b, path, err := readRepoFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b, err = yamlToJSON(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		p := &Policy{path: path}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(p); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		switch p.SubjectCase {
+		case "", "lower", "sentence":
+		default:
+			return nil, fmt.Errorf("%s: subject_case must be lower or sentence, got %q", path, p.SubjectCase)
+		}
+		p.compile()
+		return p, nil
+	}
+	return nil, nil
+}
+
+// instructions restates the policy for the prompt, so the model gets it
+// right the first time instead of only being caught afterwards.
+func (p *Policy) instructions() string {
+	var rules []string
+	if len(p.Types) > 0 {
+		rules = append(rules, "the subject must be \"type(scope): description\" with type one of: "+strings.Join(p.Types, ", "))
+	}
+	if len(p.Scopes) > 0 {
+		rules = append(rules, "the scope must be one of: "+strings.Join(p.Scopes, ", "))
+	}
+	if p.RequireScope {
+		rules = append(rules, "a scope is required")
+	}
+	switch p.SubjectCase {
+	case "lower":
+		rules = append(rules, "the description starts with a lowercase letter")
+	case "sentence":
+		rules = append(rules, "the description starts with a capital letter")
+	}
+	if p.SubjectMax > 0 {
+		rules = append(rules, fmt.Sprintf("the subject is at most %d characters", p.SubjectMax))
+	}
+	if p.MaxBodyWidth > 0 {
+		rules = append(rules, fmt.Sprintf("body lines are wrapped at %d characters", p.MaxBodyWidth))
+	}
+	if len(p.ForbiddenWords) > 0 {
+		rules = append(rules, "never use these words: "+strings.Join(p.ForbiddenWords, ", "))
+	}
+	if p.Language != "" {
+		rules = append(rules, "write the subject and body in "+p.Language+"; keep the Conventional Commit type, scope, identifiers and trailers as they are")
+	}
+	if len(rules) == 0 {
+		return ""
+	}
+	return "Repository commit policy (mandatory):\n- " + strings.Join(rules, "\n- ") + "\n"
+}
+
+// carryTrailers copies required trailers that the original message had but
+// the new one lacks, since the model cannot know values like sign-offs.
+func (p *Policy) carryTrailers(msg, old string) string {
+	var add []string
+	for _, key := range p.RequiredTrailers {
+		if hasTrailer(msg, key) {
+			continue
+		}
+		for _, l := range splitLines(old) {
+			if k, _, ok := strings.Cut(l, ":"); ok && strings.EqualFold(k, key) && trailerLineRe.MatchString(l) {
+				add = append(add, strings.TrimSpace(l))
+			}
+		}
+	}
+	if len(add) == 0 {
+		return msg
+	}
+	return appendTrailers(msg, add...)
+}
+
+func hasTrailer(msg, key string) bool {
+	lines := splitLines(strings.TrimRight(msg, " \n"))
+	for i := len(lines) - 1; i > 0 && strings.TrimSpace(lines[i]) != ""; i-- {
+		if k, _, ok := strings.Cut(lines[i], ":"); ok && strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleBased reports whether a message written without the model (rename,
+// whitespace and revert subjects, which are always English) may be used.
+func (p *Policy) ruleBased(msg string) bool {
+	return p == nil || englishLanguage(p.Language) && len(p.check(msg)) == 0
+}
+
+// englishLanguage reports whether a policy language means English, the
+// default when none is set.
+func englishLanguage(lang string) bool {
+	switch strings.ToLower(strings.TrimSpace(lang)) {
+	case "", "english", "en":
+		return true
+	}
+	return false
+}
+
+// check lists every rule msg breaks.
+func (p *Policy) check(msg string) []string {
+	var out []string
+	lines := splitLines(strings.TrimRight(msg, " \n"))
+	subject := strings.TrimSpace(lines[0])
+	m := policySubjectRe.FindStringSubmatch(subject)
+	if m == nil && (len(p.Types) > 0 || len(p.Scopes) > 0 || p.RequireScope) {
+		out = append(out, fmt.Sprintf("subject %q is not \"type(scope): description\"", truncate(subject, 40)))
+	}
+	desc := subject
+	if m != nil {
+		typ, scope := m[1], m[2]
+		desc = m[3]
+		if len(p.Types) > 0 && !slices.Contains(p.Types, typ) {
+			out = append(out, fmt.Sprintf("type %q is not allowed (allowed: %s)", typ, strings.Join(p.Types, ", ")))
+		}
+		if scope == "" && p.RequireScope {
+			out = append(out, "subject has no scope")
+		}
+		if scope != "" && len(p.Scopes) > 0 && !slices.Contains(p.Scopes, scope) {
+			out = append(out, fmt.Sprintf("scope %q is not allowed (allowed: %s)", scope, strings.Join(p.Scopes, ", ")))
+		}
+	}
+	// Only cased letters have a case to check; CJK text passes either rule.
+	if r, _ := utf8.DecodeRuneInString(desc); unicode.IsUpper(r) || unicode.IsLower(r) {
+		switch {
+		case p.SubjectCase == "lower" && !unicode.IsLower(r):
+			out = append(out, "subject description must start lowercase")
+		case p.SubjectCase == "sentence" && !unicode.IsUpper(r):
+			out = append(out, "subject description must start with a capital letter")
+		}
+	}
+	if n := utf8.RuneCountInString(subject); p.SubjectMax > 0 && n > p.SubjectMax {
+		out = append(out, fmt.Sprintf("subject is %d characters (max %d)", n, p.SubjectMax))
+	}
+	if p.MaxBodyWidth > 0 {
+		// Trailers must stay on one line, so only the text above them counts.
+		text, _ := splitTrailerBlock(msg)
+		for i, l := range splitLines(text)[1:] {
+			// A line without spaces (a URL, a path) cannot be wrapped.
+			if n := utf8.RuneCountInString(l); n > p.MaxBodyWidth && strings.ContainsAny(strings.TrimSpace(l), " \t") {
+				out = append(out, fmt.Sprintf("line %d is %d characters (max %d)", i+2, n, p.MaxBodyWidth))
+			}
+		}
+	}
+	for _, f := range p.forbidden {
+		if f.re.MatchString(msg) {
+			out = append(out, fmt.Sprintf("contains forbidden word %q", f.word))
+		}
+	}
+	for _, key := range p.RequiredTrailers {
+		if !hasTrailer(msg, key) {
+			out = append(out, "missing required trailer "+key)
+		}
+	}
+	return out
+}
+
+// checkPlanPolicy validates the message apply would commit for every item.
+// Messages left as they were are not the rewrite's doing, and neither are
+// scrub plans, which only redact old messages, so neither is held to a
+// policy written after them.
+func checkPlanPolicy(p *Policy, plan Plan) error {
+	if plan.Scrub {
+		return nil
+	}
+	var errs []error
+	for _, it := range plan.Items {
+		if it.failed() {
+			continue // not generated; apply keeps the original only with --force-partial
+		}
+		if strings.TrimSpace(it.NewMessage) == strings.TrimSpace(it.OldMessage) {
+			continue
+		}
+		msg := it.NewMessage
+		if strings.TrimSpace(msg) == "" {
+			msg = it.OldMessage
+		}
+		for _, v := range p.check(msg) {
+			errs = append(errs, fmt.Errorf("  %s  %s", it.SHA[:7], v))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d policy violation(s) against %s; fix the messages with `git-smartmsg edit`:\n%w", len(errs), p.path, errors.Join(errs...))
+	}
+	return nil
+}
+
+// ============================
+// Repository lock
+// ============================
+
+// forceUnlock is the global --force-unlock: take over the repository lock
+// even if its holder still seems to be running.
+var forceUnlock bool
+
+// lockStaleAfter is how old a lock taken on another host (whose process
+// cannot be checked) must be before it is considered abandoned.
+const lockStaleAfter = 24 * time.Hour
+
+// repoLock is the content of the lock file.
+type repoLock struct {
+	PID     int    `json:"pid"`
+	Host    string `json:"host"`
+	Command string `json:"command"`
+	Started string `json:"started"`
+	ID      string `json:"id"` // random, so every lock file's content is its own
+}
+
+// lockRepo takes the repository-wide lock for command, so that two runs
+// (a CI job and a person, say) cannot interleave cherry-picks or write the
+// same plan at once. The lock lives in the common git directory, shared by
+// every worktree. A lock whose process has exited, or that was taken on
+// another host more than lockStaleAfter ago, is stale and taken over.
+// Outside a repository there is nothing to lock. The returned func
+// releases the lock, unless another run has taken it over since.
+func lockRepo(command string) (func(), error) {
+	out, err := git("rev-parse", "--git-common-dir")
+	if err != nil {
+		return func() {}, nil
+	}
+	path, err := filepath.Abs(filepath.Join(strings.TrimSpace(out), "smartmsg.lock"))
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	me := repoLock{PID: os.Getpid(), Host: host, Command: command, Started: time.Now().Format(time.RFC3339), ID: rand.Text()}
+	data, _ := json.Marshal(me)
+	data = append(data, '\n')
+	for try := 0; ; try++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() {
+				if ok, _ := removeIfSame(path, data); !ok {
+					slog.Warn("the repository lock was taken over by another run; leaving it", "lock", path)
+				}
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("cannot lock the repository: %w", err)
+		}
+		var held repoLock
+		b, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			try-- // released meanwhile
+			continue
+		}
+		_ = json.Unmarshal(b, &held)
+		// A lock seen again after taking one over belongs to a run that
+		// took it over first.
+		if try > 0 || !forceUnlock && !held.stale(host) {
+			return nil, fmt.Errorf("another git-smartmsg %s (pid %d on %s, started %s) is running in this repository; wait for it to finish, or pass --force-unlock if it is gone (lock: %s)",
+				cmp.Or(held.Command, "command"), held.PID, cmp.Or(held.Host, "an unknown host"), cmp.Or(held.Started, "at an unknown time"), path)
+		}
+		if forceUnlock {
+			slog.Warn("removing the repository lock (--force-unlock)", "lock", path, "pid", held.PID, "command", held.Command)
+		} else {
+			slog.Warn("removing a stale repository lock", "lock", path, "pid", held.PID, "host", held.Host, "started", held.Started)
+		}
+		// Another run may have taken the stale lock over since it was read;
+		// its fresh lock is left alone, and the retry reports it as held.
+		if _, err := removeIfSame(path, b); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// removeIfSame removes the file at path only if it still holds want. The
+// file is first renamed away, which only one run can do, and put back if
+// its content turns out to be another's.
+func removeIfSame(path string, want []byte) (bool, error) {
+	tmp := fmt.Sprintf("%s.%d.%s", path, os.Getpid(), rand.Text())
+	if err := os.Rename(path, tmp); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	got, err := os.ReadFile(tmp)
+	if err == nil && bytes.Equal(got, want) {
+		return true, os.Remove(tmp)
+	}
+	// Not ours: restore it, unless a new lock was taken in the meantime.
+	if err := os.Link(tmp, path); err != nil && !errors.Is(err, os.ErrExist) {
+		// No hard links on this file system.
+		return false, os.Rename(tmp, path)
+	}
+	return false, os.Remove(tmp)
+}
+
+// stale reports whether the lock's holder is gone. On this host that is
+// whether its process still exists; elsewhere only its age can tell.
+func (l repoLock) stale(host string) bool {
+	if l.PID > 0 && l.Host == host {
+		return !processAlive(l.PID)
+	}
+	started, err := time.Parse(time.RFC3339, l.Started)
+	return err != nil || time.Since(started) > lockStaleAfter
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true // FindProcess already fails there for exited processes
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// ============================
+// Apply command (linear history only)
+// ============================
+
+// enterPlanRepo switches to the repository the plan was generated in unless
+// -C was given explicitly. A RepoPath that no longer exists (e.g. a plan
+// copied from another machine) falls back to the current repository.
+func enterPlanRepo(plan Plan) error {
+	if repoFlag != "" || plan.RepoPath == "" {
+		if top, err := repoPath(); err == nil && plan.RepoPath != "" && !sameDir(top, plan.RepoPath) {
+			slog.Warn("plan was generated in another checkout", "plan_repo", plan.RepoPath, "applying_to", top)
+		}
+		return nil
+	}
+	if top, err := repoPath(); err == nil && sameDir(top, plan.RepoPath) {
+		return nil
+	}
+	if fi, err := os.Stat(plan.RepoPath); err != nil || !fi.IsDir() {
+		slog.Warn("plan repo_path not found; applying to the current repository", "repo_path", plan.RepoPath)
+		return nil
+	}
+	slog.Info("switching to plan repository", "repo_path", plan.RepoPath)
+	return os.Chdir(plan.RepoPath)
+}
+
+func sameDir(a, b string) bool {
+	// git prints C:/x/y on Windows; Clean turns the slashes around.
+	ra, err1 := filepath.EvalSymlinks(a)
+	rb, err2 := filepath.EvalSymlinks(b)
+	if err1 != nil || err2 != nil {
+		ra, rb = filepath.Clean(a), filepath.Clean(b)
+	}
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(ra, rb)
+	}
+	return ra == rb
+}
+
+func cmdApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	inFile := fs.String("in", "plan.json", "plan file path (.json or .yaml/.yml)")
+	newBranch := fs.String("branch", "", "new branch to create (required)")
+	allowMerges := fs.Bool("allow-merges", false, "attempt to preserve merge commits (best-effort; otherwise abort)")
+	keepFooter := fs.Bool("keep-original-footer", false, "append Original-Message and Original-Commit trailers to each rewritten commit")
+	includeUnreviewed := fs.Bool("include-unreviewed", false, "apply items still flagged needs_review")
+	forcePartial := fs.Bool("force-partial", false, "apply a plan with failed items, keeping their original messages")
+	cont := fs.Bool("continue", false, "resume an interrupted apply")
+	abort := fs.Bool("abort", false, "forget an interrupted apply")
+	retagFlag := fs.Bool("retag", true, "recreate tags on commits in the range on the rewritten commits (the originals are kept under "+originalTagsRef+")")
+	signTags := fs.Bool("sign-tags", false, "with --retag, re-sign recreated tags that were signed, with your key (git tag -s)")
+	onto := fs.String("onto", "", "replay the rewritten commits onto this `ref` (e.g. origin/main) instead of their original base, like git rebase --onto")
+	detached := fs.Bool("detached-worktree", false, "rewrite in a temporary worktree and only create the branch at the end (no clean checkout needed)")
+	postRewrite := fs.Bool("post-rewrite", true, "run the post-rewrite hook with the old and new SHAs when done, as git rebase does")
+	backend := fs.String("backend", "", "how commits are rewritten: cherry-pick (in the checkout) or commit-tree (reuses each commit's tree and never touches the checkout; the default in a bare repository)")
+	verify := fs.Bool("verify", false, "run pre-commit and commit-msg hooks for each rewritten commit (default: --no-verify)")
+	empty := fs.String("empty", "drop", "commits whose changes are already applied or that were empty: drop, keep, or ask")
+	allowStale := fs.Bool("allow-stale", false, "apply even if HEAD has moved since the plan was created")
+	checkout := fs.Bool("checkout", true, "switch to the new branch when done (false: create it and stay where you are)")
+	authorMapFile := fs.String("author-map", "", "rewrite author identities with a .mailmap-format file")
+	var nt notifier
+	nt.register(fs)
+	interactive := fs.Bool("interactive", false, "show each old and new message with a diffstat and ask y/n/e/q before committing it")
+	dateMode := fs.String("date-mode", "preserve", "dates of rewritten commits: preserve (author date for both), committer-now (you and now as committer, like git rebase), or author-now (both dates now)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *cont || *abort {
+		unlock, err := lockRepo("apply")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		return resumeApply(*abort)
+	}
+	if path, err := applyStatePath(); err == nil {
+		if _, err := os.Stat(path); err == nil {
+			return errors.New("an interrupted apply is pending; use --continue or --abort")
+		}
+	}
+	if *newBranch == "" {
+		return errors.New("--branch is required")
+	}
+	switch *empty {
+	case "drop", "keep", "ask":
+	default:
+		return fmt.Errorf("--empty must be drop, keep or ask, got %q", *empty)
+	}
+	switch *dateMode {
+	case "preserve", "committer-now", "author-now":
+	default:
+		return fmt.Errorf("--date-mode must be preserve, committer-now or author-now, got %q", *dateMode)
+	}
+	if *backend == "" {
+		*backend = "cherry-pick"
+		if bareRepo() {
+			*backend = "commit-tree"
+		}
+	}
+	switch *backend {
+	case "cherry-pick":
+		if bareRepo() {
+			return errors.New("the cherry-pick backend needs a work tree; use --backend commit-tree in a bare repository")
+		}
+	case "commit-tree":
+		// Nothing is picked or checked out, so there is no conflict to
+		// resolve, no hook to run and nothing to review in between.
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{{"--onto", *onto != ""}, {"--detached-worktree", *detached}, {"--interactive", *interactive}, {"--verify", *verify}} {
+			if f.set {
+				return fmt.Errorf("%s needs the cherry-pick backend; the commit-tree backend only reuses the original trees", f.name)
+			}
+		}
+	default:
+		return fmt.Errorf("--backend must be cherry-pick or commit-tree, got %q", *backend)
+	}
+
+	planPath, _ := filepath.Abs(*inFile)
+	plan, err := loadPlan(*inFile)
+	if err != nil {
+		return err
+	}
+	if err := enterPlanRepo(plan); err != nil {
+		return err
+	}
+	unlock, err := lockRepo("apply")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := checkPlanCommits(plan); err != nil {
+		return err
+	}
+	// The policy is enforced even for reviewed and hand-edited items.
+	if policy, err := loadPolicy(); err != nil {
+		return err
+	} else if policy != nil {
+		if err := checkPlanPolicy(policy, plan); err != nil {
+			return err
+		}
+	}
+	if !*allowStale {
+		if err := checkPlanHead(plan, plan.HeadRef); err != nil {
+			return err
+		}
+	}
+	if !*includeUnreviewed {
+		var pending []string
+		for _, it := range plan.Items {
+			if it.NeedsReview {
+				pending = append(pending, fmt.Sprintf("  %s  %s (%s)", it.SHA[:7], firstLine(it.NewMessage), strings.Join(it.ReviewNotes, "; ")))
+			}
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d item(s) need review; run `git-smartmsg edit` and delete their REVIEW lines, or pass --include-unreviewed:\n%s",
+				len(pending), strings.Join(pending, "\n"))
+		}
+	}
+	if failures := failedItems(plan); len(failures) > 0 && !*forcePartial {
+		return fmt.Errorf("%d item(s) have no generated message; write them with `git-smartmsg edit`, or pass --force-partial to keep their original messages:\n%s",
+			len(failures), strings.Join(failures, "\n"))
+	}
+
+	// 起点
+	base := plan.Base
+	if strings.TrimSpace(base) == "" {
+		first := plan.Items[0].SHA
+		parent, err := git("rev-parse", first+"^")
+		if err != nil {
+			return fmt.Errorf("cannot determine base: %w", err)
+		}
+		base = strings.TrimSpace(parent)
+	}
+	if *onto != "" {
+		out, err := git("rev-parse", "--verify", "--quiet", *onto+"^{commit}")
+		if err != nil {
+			return fmt.Errorf("--onto: %q is not a commit", *onto)
+		}
+		base = strings.TrimSpace(out)
+	}
+	if _, err := git("rev-parse", "--verify", "--quiet", "refs/heads/"+*newBranch); err == nil {
+		return fmt.Errorf("branch %q already exists", *newBranch)
+	}
+	opts := applyOptions{Plan: planPath, Branch: *newBranch, AllowMerges: *allowMerges, KeepFooter: *keepFooter, Checkout: *checkout, Empty: *empty, Verify: *verify, DateMode: *dateMode, Interactive: *interactive, Onto: *onto, Retag: *retagFlag, SignTags: *signTags, NoPostRewrite: !*postRewrite}
+	if *authorMapFile != "" {
+		// Parsed now so a bad file fails before anything is checked out;
+		// the absolute path is what --continue reloads.
+		if _, err := loadAuthorMap(*authorMapFile); err != nil {
+			return err
+		}
+		opts.AuthorMap, _ = filepath.Abs(*authorMapFile)
+	}
+	if *backend == "commit-tree" {
+		opts.Orig, _ = currentHead()
+		return applyCommitTree(plan, base, opts)
+	}
+	if *detached {
+		opts.Worktree = true
+		return applyInWorktree(plan, base, opts)
+	}
+
+	if err := ensureCleanWorktree(); err != nil {
+		return err
+	}
+	if opts.Orig, err = currentHead(); err != nil {
+		return err
+	}
+	// 起点 base の detached HEAD 上で書き換え、最後にブランチを作る
+	if _, err := git("checkout", "-q", "--detach", base); err != nil {
+		return err
+	}
+	return applyItems(plan, opts, 0, 0, nil)
+}
+
+// authorMap is a parsed .mailmap file. Entries take the same four forms git
+// accepts:
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+type authorMap []authorMapEntry
+
+type authorMapEntry struct {
+	name, email             string // replacements; empty keeps the original
+	commitName, commitEmail string // what to match; an empty name matches any
+}
+
+var mailmapRe = regexp.MustCompile(`^([^<]*)<([^>]*)>\s*(?:([^<]*)<([^>]*)>)?\s*$`)
+
+func loadAuthorMap(path string) (authorMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m authorMap
+	for n, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		g := mailmapRe.FindStringSubmatch(line)
+		if g == nil {
+			return nil, fmt.Errorf("%s:%d: expected `Name <email>` entries as in .mailmap", path, n+1)
+		}
+		e := authorMapEntry{name: strings.TrimSpace(g[1]), email: g[2]}
+		if g[4] != "" || g[3] != "" {
+			e.commitName, e.commitEmail = strings.TrimSpace(g[3]), g[4]
+		} else {
+			// "Proper Name <commit@email>" only fixes the name.
+			e.commitEmail, e.email = e.email, ""
+		}
+		if e.commitEmail == "" {
+			return nil, fmt.Errorf("%s:%d: entry has no commit email to match", path, n+1)
+		}
+		m = append(m, e)
+	}
+	return m, nil
+}
+
+// apply maps an identity the way git's mailmap does: emails and names
+// match case-insensitively, and an entry naming both wins over one that
+// matches by email alone. Email-only entries combine, so one line can fix
+// the name and another the address.
+func (m authorMap) apply(name, email string) (string, string) {
+	var newName, newEmail string
+	for _, e := range m {
+		if !strings.EqualFold(e.commitEmail, email) {
+			continue
+		}
+		if e.commitName != "" {
+			if strings.EqualFold(e.commitName, name) {
+				return cmp.Or(e.name, name), cmp.Or(e.email, email)
+			}
+			continue
+		}
+		newName, newEmail = cmp.Or(e.name, newName), cmp.Or(e.email, newEmail)
+	}
+	return cmp.Or(newName, name), cmp.Or(newEmail, email)
+}
+
+// commitIdentity is the author and committer environment for a rewritten
+// commit. preserve (the default, and what older resume states mean) stamps
+// both with the original author and date, as git filter-branch would;
+// committer-now leaves the committer to git, so the rewrite shows up as you
+// and now like git rebase; author-now also resets the author date.
+func commitIdentity(it PlanItem, mode string) []string {
+	env := []string{
+		"GIT_AUTHOR_NAME=" + it.AuthorName,
+		"GIT_AUTHOR_EMAIL=" + it.AuthorEmail,
+	}
+	switch mode {
+	case "committer-now":
+		return append(env, "GIT_AUTHOR_DATE="+it.AuthorDate)
+	case "author-now":
+		return env
+	}
+	return append(env,
+		"GIT_AUTHOR_DATE="+it.AuthorDate,
+		"GIT_COMMITTER_NAME="+it.AuthorName,
+		"GIT_COMMITTER_EMAIL="+it.AuthorEmail,
+		"GIT_COMMITTER_DATE="+it.AuthorDate,
+	)
+}
+
+// currentHead names what is checked out: the branch, or the commit when
+// HEAD is detached.
+func currentHead() (string, error) {
+	if out, err := git("symbolic-ref", "--quiet", "--short", "HEAD"); err == nil {
+		return strings.TrimSpace(out), nil
+	}
+	out, err := git("rev-parse", "HEAD")
+	return strings.TrimSpace(out), err
+}
+
+// restoreHead discards a half-applied pick and checks out orig again.
+func restoreHead(orig string) {
+	_, _ = git("reset", "-q", "--hard")
+	if _, err := git("checkout", "-q", orig); err != nil {
+		slog.Warn("cannot return to the original checkout", "ref", orig, "err", err)
+	}
+}
+
+// applyInWorktree runs the rewrite in a temporary detached worktree and only
+// creates the branch once every item is committed, so the user's checkout
+// (dirty or not) is never touched and a failure leaves nothing behind.
+func applyInWorktree(plan Plan, base string, opts applyOptions) error {
+	dir, err := os.MkdirTemp("", "smartmsg-apply-")
+	if err != nil {
+		return err
+	}
+	if _, err := git("worktree", "add", "--detach", dir, base); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	orig, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Chdir(orig)
+		if _, err := git("worktree", "remove", "--force", dir); err != nil {
+			slog.Warn("cannot remove temporary worktree", "dir", dir, "err", err)
+		}
+	}()
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	return applyItems(plan, opts, 0, 0, nil)
+}
+
+// applyCommitTree is the commit-tree backend: every rewritten commit reuses
+// the tree of its original with git commit-tree, so nothing is checked out
+// and no work tree is needed, which is what makes apply possible in a bare
+// repository. The branch is created with update-ref once the whole series
+// is written, so an interrupted or failed run leaves no ref behind. Reusing
+// trees as they are only gives the same changes when the plan's commits
+// still form an unbroken chain from base.
+func applyCommitTree(plan Plan, base string, opts applyOptions) error {
+	var authors authorMap
+	if opts.AuthorMap != "" {
+		var err error
+		if authors, err = loadAuthorMap(opts.AuthorMap); err != nil {
+			return err
+		}
+	}
+	if notify != nil {
+		notify.summary.Commits, notify.summary.Output = len(plan.Items), opts.Branch
+	}
+	bodies, gerrit, err := originalBodies(plan.Items)
+	if err != nil {
+		return err
+	}
+	mode := messageMode{mode: plan.Mode, generate: plan.Generate}
+	rewritten := map[string]string{}
+	tip, prev := base, base
+	for i, it := range plan.Items {
+		if rootCtx.Err() != nil {
+			return fmt.Errorf("interrupted after %d of %d commits; no branch was created", i, len(plan.Items))
+		}
+		// A consolidated item is its last commit's tree; the other parents
+		// of merges are carried over, rewritten where they are in the plan.
+		var merged []string
+		for _, sha := range append([]string{it.SHA}, it.Squash...) {
+			out, err := git("rev-list", "--parents", "-n", "1", sha)
+			if err != nil {
+				return err
+			}
+			parents := strings.Fields(out)[1:]
+			if len(parents) == 0 || parents[0] != prev {
+				return fmt.Errorf("%s does not follow %s: the commit-tree backend reuses each commit's tree, so the plan must cover an unbroken run of commits from its base; use --backend cherry-pick in a checkout", sha[:7], prev[:7])
+			}
+			if len(parents) > 1 && !opts.AllowMerges {
+				return fmt.Errorf("merge commit detected (%s). rerun with --allow-merges (experimental).", sha[:7])
+			}
+			merged = append(merged, parents[1:]...)
+			prev = sha
+		}
+		tree, err := git("rev-parse", prev+"^{tree}")
+		if err != nil {
+			return err
+		}
+		tipTree, err := git("rev-parse", tip+"^{tree}")
+		if err != nil {
+			return err
+		}
+
+		it.AuthorName, it.AuthorEmail = authors.apply(it.AuthorName, it.AuthorEmail)
+		msg := applyMessage(it, mode, opts.KeepFooter, bodies, rewritten, gerrit)
+		if tree == tipTree && len(merged) == 0 {
+			keep := opts.Empty == "keep" ||
+				opts.Empty == "ask" && askYesNo(fmt.Sprintf("%s %q changes nothing. Keep it as an empty commit? [y/N]: ", it.SHA[:7], firstLine(msg)), false)
+			if !keep {
+				slog.Info("skip empty commit", "sha", it.SHA[:7])
+				continue
+			}
+			slog.Info("keep empty commit", "sha", it.SHA[:7])
+		}
+		args := []string{"commit-tree", strings.TrimSpace(tree), "-p", tip}
+		for _, p := range merged {
+			args = append(args, "-p", cmp.Or(rewritten[p], p))
+		}
+		sha, err := commitTree(args, msg, gitEnv(commitIdentity(it, opts.DateMode)...))
+		if err != nil {
+			return err
+		}
+		for _, old := range append([]string{it.SHA}, it.Squash...) {
+			rewritten[old] = sha
+		}
+		tip = sha
+		slog.Info("rewritten", "sha", it.SHA[:7])
+		if notify != nil {
+			notify.summary.Processed++
+		}
+	}
+
+	// The empty old value makes update-ref fail if the branch appeared in
+	// the meantime rather than overwrite it.
+	if _, err := git("update-ref", "-m", "git-smartmsg apply", "refs/heads/"+opts.Branch, tip, ""); err != nil {
+		return err
+	}
+	var tags []string
+	if opts.Retag {
+		tags = retag(plan.Tags, rewritten, opts.SignTags)
+	}
+	if !opts.NoPostRewrite {
+		runPostRewrite(plan.Items, rewritten)
+	}
+	printApplyDone(opts, tags, gerrit)
+	return nil
+}
+
+// commitTree runs git commit-tree args with msg on stdin, cleaned up first
+// the way git commit -m would, and returns the new commit.
+func commitTree(args []string, msg string, env []string) (string, error) {
+	run := func(in string, args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("git", args...)
+		cmd.Stdin = strings.NewReader(in)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		cmd.Env = env
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("git %s failed: %v, %s", args[0], err, stderr.String())
+		}
+		return stdout.String(), nil
+	}
+	clean, err := run(msg, "stripspace")
+	if err != nil {
+		return "", err
+	}
+	out, err := run(clean, args...)
+	return strings.TrimSpace(out), err
+}
+
+// applyOptions are the apply settings that a resumed run must reuse; they
+// are saved in the apply state file on interruption.
+type applyOptions struct {
+	Plan        string `json:"plan"`
+	Branch      string `json:"branch"`
+	AllowMerges bool   `json:"allow_merges,omitempty"`
+	KeepFooter  bool   `json:"keep_original_footer,omitempty"`
+	Checkout    bool   `json:"checkout,omitempty"`
+	Empty       string `json:"empty,omitempty"` // drop, keep or ask, as in git rebase --empty
+	Verify      bool   `json:"verify,omitempty"`
+	DateMode    string `json:"date_mode,omitempty"` // preserve, committer-now or author-now
+	AuthorMap   string `json:"author_map,omitempty"`
+	Interactive bool   `json:"interactive,omitempty"`
+	Onto        string `json:"onto,omitempty"` // ref the commits are replayed onto, as given
+	Retag       bool   `json:"retag,omitempty"`
+	SignTags    bool   `json:"sign_tags,omitempty"`
+	// NoPostRewrite skips the post-rewrite hook, which runs by default
+	// (and for states saved before it existed).
+	NoPostRewrite bool `json:"no_post_rewrite,omitempty"`
+	// Orig is what was checked out before apply; it is restored on failure
+	// and, without Checkout, on success.
+	Orig string `json:"-"`
+	// Worktree: items are committed in a temporary worktree instead, which
+	// leaves the user's checkout alone entirely.
+	Worktree bool `json:"-"`
+}
+
+// applyState records where an interrupted apply stopped: every item before
+// Next is committed on a detached chain ending at Head. Branch is not created
+// until the run completes.
+type applyState struct {
+	applyOptions
+	Next int    `json:"next"`
+	Head string `json:"head"`
+	// Rewritten maps the original SHAs applied so far to their new ones,
+	// for revert messages further on.
+	Rewritten map[string]string `json:"rewritten,omitempty"`
+	// Picked is set when apply stopped at a cherry-pick conflict: the first
+	// Picked commits of item Next are in the index, the last one with
+	// conflicts for the user to resolve on the detached Head. Restore is
+	// what to check out again once the apply finishes or is aborted.
+	Picked  int    `json:"picked,omitempty"`
+	Restore string `json:"restore,omitempty"`
+}
+
+func applyStatePath() (string, error) {
+	out, err := git("rev-parse", "--git-path", "smartmsg-apply.json")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// resumeApply continues (or, with abort, forgets) the apply recorded in the
+// state file, after checking the branch is still where it stopped.
+func resumeApply(abort bool) error {
+	path, err := applyStatePath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.New("no interrupted apply to resume")
+	}
+	var st applyState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("corrupt apply state %s: %w", path, err)
+	}
+	if abort {
+		if st.Picked > 0 {
+			restoreHead(st.Restore)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		fmt.Printf("Forgot the interrupted apply; branch %q was not created.\n", st.Branch)
+		return nil
+	}
+	if _, err := git("rev-parse", "--verify", "--quiet", "refs/heads/"+st.Branch); err == nil {
+		return fmt.Errorf("branch %q already exists; delete it or --abort", st.Branch)
+	}
+	if st.Picked == 0 {
+		if err := ensureCleanWorktree(); err != nil {
+			return err
+		}
+	}
+	plan, err := loadPlan(st.Plan)
+	if err != nil {
+		return err
+	}
+	if st.Next > len(plan.Items) {
+		return fmt.Errorf("plan %s has only %d items but apply stopped at %d; was it edited?", st.Plan, len(plan.Items), st.Next)
+	}
+	opts := st.applyOptions
+	if st.Picked > 0 {
+		// Stopped at a conflict: carry on from the index the user resolved.
+		if out, _ := git("diff", "--name-only", "--diff-filter=U"); strings.TrimSpace(out) != "" {
+			return fmt.Errorf("unresolved conflicts remain; resolve them and `git add` the files first:\n%s", strings.TrimRight(out, "\n"))
+		}
+		if head, _ := git("rev-parse", "HEAD"); strings.TrimSpace(head) != st.Head {
+			return fmt.Errorf("HEAD has moved since apply stopped at the conflict (expected %s); check out %s and stage the resolution, or --abort", st.Head[:7], st.Head[:7])
+		}
+		opts.Orig = st.Restore
+	} else {
+		if opts.Orig, err = currentHead(); err != nil {
+			return err
+		}
+		if _, err := git("checkout", "-q", "--detach", st.Head); err != nil {
+			return fmt.Errorf("cannot check out the partial rewrite %s: %w", st.Head[:7], err)
+		}
+	}
+	slog.Info("resuming", "item", st.Next+1, "of", len(plan.Items))
+	return applyItems(plan, opts, st.Next, st.Picked, st.Rewritten)
+}
+
+// applyItems cherry-picks plan.Items[start:] onto the detached HEAD and
+// then creates the branch at the rewritten tip. On SIGINT/SIGTERM it stops
+// between items, discarding a half-done pick, and saves an applyState for
+// --continue. Outside a temporary worktree, the original checkout is
+// restored whenever it returns an error, except at a cherry-pick conflict,
+// which is left for the user to resolve. picked commits of the item at
+// start are already in the index, and rewritten carries the SHA mapping of
+// the items before start.
+func applyItems(plan Plan, opts applyOptions, start, picked int, rewritten map[string]string) (err error) {
+	if rewritten == nil {
+		rewritten = map[string]string{}
+	}
+	var authors authorMap
+	if opts.AuthorMap != "" {
+		if authors, err = loadAuthorMap(opts.AuthorMap); err != nil {
+			return err
+		}
+	}
+	if notify != nil {
+		notify.summary.Commits, notify.summary.Output = len(plan.Items), opts.Branch
+	}
+	var policy *Policy
+	if opts.Interactive {
+		// Messages edited at the prompt are held to the policy too.
+		if policy, err = loadPolicy(); err != nil {
+			return err
+		}
+	}
+	bodies, gerrit, err := originalBodies(plan.Items[start:])
+	if err != nil {
+		return err
+	}
+	mode := messageMode{mode: plan.Mode, generate: plan.Generate}
+	conflict := false
+	if !opts.Worktree {
+		defer func() {
+			if err != nil && !conflict {
+				restoreHead(opts.Orig)
+			}
+		}()
+	}
+	stopAt := func(i int) error {
+		if opts.Worktree {
+			return errors.New("interrupted; the temporary worktree is discarded and no branch was created")
+		}
+		_, _ = git("reset", "--hard", "HEAD")
+		head, err := git("rev-parse", "HEAD")
+		if err != nil {
+			return err
+		}
+		st := applyState{applyOptions: opts, Next: i, Head: strings.TrimSpace(head), Rewritten: rewritten}
+		path, err := applyStatePath()
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(st, "", "  ")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		return fmt.Errorf("interrupted after %d of %d commits (partial rewrite at %s); %s is checked out again.\n"+
+			"Resume with `git-smartmsg apply --continue`, or discard with `git-smartmsg apply --abort`",
+			i, len(plan.Items), st.Head[:7], opts.Orig)
+	}
+	// stopAtConflict leaves the conflicted pick of the item at i, whose
+	// first n commits are now in the index, for the user to resolve.
+	stopAtConflict := func(i, n int, sha string) error {
+		if opts.Worktree {
+			return fmt.Errorf("cherry-pick of %s conflicts; the temporary worktree is discarded and no branch was created.\n"+
+				"Rerun without --detached-worktree to resolve the conflict in your checkout", sha[:7])
+		}
+		head, err := git("rev-parse", "HEAD")
+		if err != nil {
+			return err
+		}
+		st := applyState{applyOptions: opts, Next: i, Head: strings.TrimSpace(head), Rewritten: rewritten, Picked: n, Restore: opts.Orig}
+		path, err := applyStatePath()
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(st, "", "  ")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		conflict = true
+		files, _ := git("diff", "--name-only", "--diff-filter=U")
+		return fmt.Errorf("cherry-pick of %s (%d of %d) conflicts in:\n%s\n"+
+			"Resolve the conflicts, `git add` the files, then run `git-smartmsg apply --continue` (or `git-smartmsg apply --abort`)",
+			sha[:7], i+1, len(plan.Items), strings.TrimRight(files, "\n"))
+	}
+
+	// cherry-pick で1件ずつ適用
+	for i := start; i < len(plan.Items); i++ {
+		it := plan.Items[i]
+		if rootCtx.Err() != nil {
+			return stopAt(i)
+		}
+		if !opts.AllowMerges {
+			parents, _ := git("rev-list", "--parents", "-n", "1", it.SHA)
+			if strings.Count(strings.TrimSpace(parents), " ") >= 2 {
+				return fmt.Errorf("merge commit detected (%s). rerun with --allow-merges (experimental).", it.SHA[:7])
+			}
+		}
+
+		// A consolidated item accumulates its squashed commits in the index
+		// before the single commit below.
+		shas := append([]string{it.SHA}, it.Squash...)
+		if i == start {
+			shas = shas[min(picked, len(shas)):]
+		}
+		for k, sha := range shas {
+			if _, err := git("cherry-pick", "-n", sha); err != nil {
+				if rootCtx.Err() != nil {
+					return stopAt(i)
+				}
+				if out, _ := git("diff", "--name-only", "--diff-filter=U"); strings.TrimSpace(out) != "" {
+					return stopAtConflict(i, len(it.Squash)+1-len(shas)+k+1, sha)
+				}
+				return fmt.Errorf("cherry-pick failed at %s; nothing was changed (edit the plan or rerun with a narrower range)", sha[:7])
+			}
+		}
+
+		// Identity goes through the environment rather than --author, so
+		// names with quotes or angle brackets need no escaping on any OS.
+		it.AuthorName, it.AuthorEmail = authors.apply(it.AuthorName, it.AuthorEmail)
+		commitEnv := gitEnv(commitIdentity(it, opts.DateMode)...)
+		msg := applyMessage(it, mode, opts.KeepFooter, bodies, rewritten, gerrit)
+
+		var extra []string
+		diffIndex, _ := git("diff", "--cached", "--name-only")
+		if strings.TrimSpace(diffIndex) == "" {
+			keep := opts.Empty == "keep" ||
+				opts.Empty == "ask" && askYesNo(fmt.Sprintf("%s %q stages no changes. Keep it as an empty commit? [y/N]: ", it.SHA[:7], firstLine(msg)), false)
+			if !keep {
+				slog.Info("skip empty commit", "sha", it.SHA[:7])
+				_, _ = git("reset")
+				continue
+			}
+			slog.Info("keep empty commit", "sha", it.SHA[:7])
+			extra = append(extra, "--allow-empty")
+		}
+		if opts.Interactive {
+			var orig []string
+			for _, sha := range append([]string{it.SHA}, it.Squash...) {
+				orig = append(orig, strings.TrimSpace(bodies[sha]))
+			}
+			old := strings.Join(orig, "\n\n")
+			if n, ok := rewritten[it.Reverts]; ok && it.Reverts != "" {
+				old = strings.ReplaceAll(old, it.Reverts, n)
+			}
+			var quit bool
+			msg, quit, err = reviewApplyItem(it.SHA, msg, old, i+1, len(plan.Items), policy)
+			if err != nil {
+				return err
+			}
+			if quit {
+				return stopAt(i)
+			}
+		}
+		commitArgs := append([]string{"commit", "-m", msg}, extra...)
+		if !opts.Verify {
+			commitArgs = append(commitArgs, "--no-verify")
+		}
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("git", commitArgs...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		cmd.Env = commitEnv
+		if err := cmd.Run(); err != nil {
+			if rootCtx.Err() != nil {
+				return stopAt(i)
+			}
+			if opts.Verify {
+				// Most likely a hook said no: record why on the item so the
+				// message can be fixed with `edit` before the next run.
+				out := strings.TrimSpace(stderr.String() + "\n" + stdout.String())
+				plan.Items[i].NeedsReview = true
+				plan.Items[i].ReviewNotes = append(plan.Items[i].ReviewNotes, "rejected by commit hook: "+firstLine(out))
+				if serr := savePlan(opts.Plan, plan); serr != nil {
+					slog.Warn("cannot mark item for review", "sha", it.SHA[:7], "err", serr)
+				}
+				return fmt.Errorf("commit hook rejected %s (marked needs_review in %s):\n%s", it.SHA[:7], opts.Plan, out)
+			}
+			return fmt.Errorf("git commit failed: %v, %s", err, stderr.String())
+		}
+		if head, err := git("rev-parse", "HEAD"); err == nil {
+			for _, sha := range append([]string{it.SHA}, it.Squash...) {
+				rewritten[sha] = strings.TrimSpace(head)
+			}
+		}
+		slog.Info("rewritten", "sha", it.SHA[:7])
+		if notify != nil {
+			notify.summary.Processed++
+		}
+	}
+
+	if _, err := git("branch", opts.Branch, "HEAD"); err != nil {
+		return err
+	}
+	var tags []string
+	if opts.Retag {
+		tags = retag(plan.Tags, rewritten, opts.SignTags)
+	}
+	if !opts.Worktree {
+		if path, err := applyStatePath(); err == nil {
+			_ = os.Remove(path)
+		}
+		next := opts.Orig
+		if opts.Checkout {
+			next = opts.Branch
+		}
+		if _, err := git("checkout", "-q", next); err != nil {
+			return err
+		}
+	}
+	if !opts.NoPostRewrite {
+		runPostRewrite(plan.Items, rewritten)
+	}
+	printApplyDone(opts, tags, gerrit)
+	return nil
+}
+
+// originalBodies reads the original messages of items, for their
+// Change-Ids and the parts --mode and --generate keep. In a Gerrit
+// repository (or one whose history already uses Change-Ids) commits
+// without one get a new one, as the commit-msg hook would have given them;
+// gerrit reports whether that applies.
+func originalBodies(items []PlanItem) (bodies map[string]string, gerrit bool, err error) {
+	bodies = map[string]string{}
+	gerrit = gerritRepo()
+	for _, it := range items {
+		for _, sha := range append([]string{it.SHA}, it.Squash...) {
+			body, err := git("log", "-1", "--format=%B", sha)
+			if err != nil {
+				return nil, false, err
+			}
+			bodies[sha] = body
+			gerrit = gerrit || changeID(body) != ""
+		}
+	}
+	return bodies, gerrit, nil
+}
+
+// applyMessage is the message it is committed with: the new message (or
+// the original one) with the part mode keeps put back from the original
+// messages, so hand edits to it in the plan are undone, the Original-*
+// trailers if asked for, its Change-Id, and the reverted commit's SHA
+// replaced by its rewritten one.
+func applyMessage(it PlanItem, mode messageMode, keepFooter bool, bodies, rewritten map[string]string, gerrit bool) string {
+	var olds, kept []string
+	for _, sha := range append([]string{it.SHA}, it.Squash...) {
+		olds = append(olds, bodies[sha])
+		kept = append(kept, strings.TrimSpace(bodies[sha]))
+	}
+	msg := it.NewMessage
+	if strings.TrimSpace(msg) == "" {
+		msg = it.OldMessage
+	} else {
+		msg = mode.enforce(msg, strings.Join(kept, "\n\n"))
+	}
+	if keepFooter {
+		trailers := []string{"Original-Message: " + firstLine(it.OldMessage)}
+		for _, sha := range append([]string{it.SHA}, it.Squash...) {
+			trailers = append(trailers, "Original-Commit: "+sha)
+		}
+		msg = appendTrailers(msg, trailers...)
+	}
+	msg = keepChangeID(msg, olds...)
+	if n, ok := rewritten[it.Reverts]; ok && it.Reverts != "" {
+		msg = strings.ReplaceAll(msg, it.Reverts, n)
+	}
+	if gerrit && !hasTrailer(msg, "Change-Id") {
+		msg = appendTrailers(msg, "Change-Id: "+newChangeID(it.SHA, msg))
+	}
+	return msg
+}
+
+// runPostRewrite runs the post-rewrite hook the way git rebase does: with
+// the argument "rebase" and one "<old-sha> <new-sha>" line per rewritten
+// commit on stdin, in the order they were rewritten. Squashed commits map
+// to the commit they were folded into; dropped ones are left out. Like
+// git, it ignores the hook's exit status beyond a warning.
+func runPostRewrite(items []PlanItem, rewritten map[string]string) {
+	path, err := hookPath("post-rewrite")
+	if err != nil {
+		return
+	}
+	if fi, err := os.Stat(path); err != nil || fi.IsDir() || runtime.GOOS != "windows" && fi.Mode()&0111 == 0 {
+		return
+	}
+	var in strings.Builder
+	for _, it := range items {
+		for _, sha := range append([]string{it.SHA}, it.Squash...) {
+			if n, ok := rewritten[sha]; ok {
+				fmt.Fprintf(&in, "%s %s\n", sha, n)
+			}
+		}
+	}
+	if in.Len() == 0 {
+		return
+	}
+	cmd := exec.Command(path, "rebase")
+	if runtime.GOOS == "windows" {
+		// Hooks are shell scripts; Git for Windows runs them with its sh.
+		cmd = exec.Command("sh", path, "rebase")
+	}
+	cmd.Dir, _ = repoPath()
+	cmd.Stdin = strings.NewReader(in.String())
+	cmd.Stdout = os.Stderr // hook output is diagnostics, as with git
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		slog.Warn("post-rewrite hook failed", "hook", path, "err", err)
+		return
+	}
+	slog.Info("ran post-rewrite hook", "commits", strings.Count(in.String(), "\n"))
+}
+
+func printApplyDone(opts applyOptions, tags []string, gerrit bool) {
+	fmt.Printf("\n✅ Done. New branch %q contains rewritten history.\n", opts.Branch)
+	if opts.Onto != "" {
+		fmt.Printf("   It is based on %s.\n", opts.Onto)
+	}
+	if len(tags) > 0 {
+		fmt.Printf("🏷️  Moved %d tag(s) to the rewritten commits (originals under %s): %s\n", len(tags), originalTagsRef, strings.Join(tags, ", "))
+		fmt.Printf("   Publish them with: git push --force origin %s\n", strings.Join(tags, " "))
+	}
+	if gerrit {
+		fmt.Println("📤 Change-Ids are kept, so uploading updates the existing reviews with new patch sets:")
+		fmt.Printf("   %s\n", gerritPushCommand(opts.Branch, opts.Orig))
+		return
+	}
+	fmt.Println("⚠️  Rewriting history rewrites SHAs. Coordinate with your team before force-pushing:")
+	fmt.Printf("   git push --force-with-lease origin %s\n", opts.Branch)
+}
+
+// reviewApplyItem shows the staged diffstat and the old and new message of
+// the item at position n and asks what to commit: the new message, the
+// original one, or an edited one. quit is set when the user stops, or stdin
+// ends, before the item is committed.
+func reviewApplyItem(sha, msg, orig string, n, total int, policy *Policy) (string, bool, error) {
+	stat, _ := git("diff", "--cached", "--stat=80")
+	lines := splitLines(strings.TrimRight(stat, "\n"))
+	if len(lines) > 9 {
+		lines = append(lines[:8], fmt.Sprintf(" ... %d more files", len(lines)-9), lines[len(lines)-1])
+	}
+	fmt.Printf("\n[%d/%d] %s\n%s\n\n", n, total, sha[:7], strings.Join(lines, "\n"))
+	fmt.Println("- " + firstLine(orig))
+	for _, l := range splitLines(msg) {
+		fmt.Println(strings.TrimRight("+ "+l, " "))
+	}
+	for {
+		answer, ok := readAnswer("Use this message? [y]es, [n]o (keep the original), [e]dit, [q]uit: ")
+		if !ok {
+			fmt.Println()
+			return msg, true, nil
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return msg, false, nil
+		case "n", "no":
+			return orig, false, nil
+		case "q", "quit":
+			return msg, true, nil
+		case "e", "edit":
+			text, err := editText(msg+"\n\n# Message for "+sha[:7]+". Lines starting with '#' are ignored.\n", "COMMIT_EDITMSG")
+			if err != nil {
+				return "", false, err
+			}
+			edited := stripComments(text)
+			if edited == "" {
+				fmt.Println("Empty message; nothing changed.")
+				continue
+			}
+			if policy != nil {
+				if v := policy.check(edited); len(v) > 0 {
+					fmt.Println("The edited message breaks the commit policy: " + strings.Join(v, "; "))
+					continue
+				}
+			}
+			return edited, false, nil
+		}
+	}
+}
+
+// ============================
+// Tags in the rewritten range
+// ============================
+
+// rangeTags lists the tags pointing at the commits of items, so apply can
+// recreate them on the rewritten history instead of leaving them behind.
+func rangeTags(items []PlanItem) ([]PlanTag, error) {
+	inRange := map[string]bool{}
+	for _, it := range items {
+		for _, sha := range append([]string{it.SHA}, it.Squash...) {
+			inRange[sha] = true
+		}
+	}
+	out, err := git("for-each-ref", "refs/tags",
+		"--format=%(refname:strip=2)%00%(objecttype)%00%(objectname)%00%(*objectname)%00%(taggername)%00%(taggeremail:trim)%00%(taggerdate:iso-strict)")
+	if err != nil {
+		return nil, err
+	}
+	var tags []PlanTag
+	for _, line := range splitLines(strings.TrimRight(out, "\n")) {
+		f := strings.Split(line, "\x00")
+		if len(f) != 7 {
+			continue
+		}
+		t := PlanTag{Name: f[0], Target: f[2]}
+		if f[1] == "tag" {
+			t.Target, t.Annotated = f[3], true
+			t.TaggerName, t.TaggerEmail, t.TaggerDate = f[4], f[5], f[6]
+		}
+		if !inRange[t.Target] {
+			continue
+		}
+		if t.Annotated {
+			msg, err := git("for-each-ref", "--format=%(contents)", "refs/tags/"+t.Name)
+			if err != nil {
+				return nil, err
+			}
+			sig, _ := git("for-each-ref", "--format=%(contents:signature)", "refs/tags/"+t.Name)
+			t.Signed = strings.TrimSpace(sig) != ""
+			t.Message = strings.TrimRight(strings.TrimSuffix(msg, sig), "\n")
+		}
+		slog.Info("tag in range", "tag", t.Name, "sha", t.Target[:7], "annotated", t.Annotated, "signed", t.Signed)
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// originalTagsRef is where retag keeps each tag it replaces.
+const originalTagsRef = "refs/smartmsg-original/tags/"
+
+// retag recreates tags on the rewritten commits, with their original
+// message, tagger and date; sign re-signs the signed ones with your key
+// (and as you), since the old signature cannot cover the new commit. A tag
+// that no longer points where the plan found it was moved since, possibly
+// by an earlier apply, and is left alone. It returns the names recreated.
+func retag(tags []PlanTag, rewritten map[string]string, sign bool) []string {
+	var done []string
+	for _, t := range tags {
+		target, ok := rewritten[t.Target]
+		if !ok {
+			slog.Warn("tag not recreated: its commit was dropped", "tag", t.Name, "sha", t.Target[:7])
+			continue
+		}
+		cur, err := git("rev-parse", "--verify", "--quiet", "refs/tags/"+t.Name+"^{commit}")
+		if err != nil || strings.TrimSpace(cur) != t.Target {
+			slog.Warn("tag not recreated: it has moved since planning", "tag", t.Name)
+			continue
+		}
+		old, err := git("rev-parse", "refs/tags/"+t.Name)
+		if err == nil {
+			_, err = git("update-ref", originalTagsRef+t.Name, strings.TrimSpace(old))
+		}
+		if err != nil {
+			slog.Warn("tag not recreated: cannot keep the original", "tag", t.Name, "err", err)
+			continue
+		}
+		args := []string{"tag", "-f"}
+		var env []string
+		if t.Annotated {
+			mode := "-a"
+			env = append(env, "GIT_COMMITTER_DATE="+t.TaggerDate)
+			if t.Signed && sign {
+				mode = "-s"
+			} else {
+				env = append(env, "GIT_COMMITTER_NAME="+t.TaggerName, "GIT_COMMITTER_EMAIL="+t.TaggerEmail)
+			}
+			args = append(args, mode, "--cleanup=verbatim", "-m", t.Message+"\n")
+		}
+		cmd := exec.Command("git", append(args, t.Name, target)...)
+		cmd.Env = gitEnv(env...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			slog.Warn("tag not recreated", "tag", t.Name, "err", strings.TrimSpace(string(out)))
+			continue
+		}
+		if t.Signed && !sign {
+			slog.Warn("tag recreated without its signature; pass --sign-tags to re-sign", "tag", t.Name)
+		}
+		slog.Info("retagged", "tag", t.Name, "sha", target[:7])
+		done = append(done, t.Name)
+	}
+	return done
+}
+
+// ============================
+// Gerrit (Change-Id)
+// ============================
+
+// Gerrit ties every patch set of a review to the Change-Id trailer, so a
+// rewritten commit that loses it would open a new change instead of
+// updating the old one.
+var changeIDRe = regexp.MustCompile(`(?m)^Change-Id:\s*(I[0-9a-f]{40})\s*$`)
+
+// changeID returns msg's Change-Id, the last one if there are several as
+// Gerrit itself does, or "".
+func changeID(msg string) string {
+	m := changeIDRe.FindAllStringSubmatch(msg, -1)
+	if len(m) == 0 {
+		return ""
+	}
+	return m[len(m)-1][1]
+}
+
+// keepChangeID carries the first Change-Id found in olds over to msg unless
+// msg already has one. For a squashed group olds starts with the group's
+// head commit, whose change the result continues.
+func keepChangeID(msg string, olds ...string) string {
+	if hasTrailer(msg, "Change-Id") {
+		return msg
+	}
+	for _, old := range olds {
+		if id := changeID(old); id != "" {
+			return appendTrailers(msg, "Change-Id: "+id)
+		}
+	}
+	return msg
+}
+
+// newChangeID makes a fresh Change-Id the way Gerrit's commit-msg hook
+// does: "I" and a SHA-1 over data unique to the commit.
+func newChangeID(seed ...string) string {
+	h := sha1.New()
+	for _, s := range seed {
+		io.WriteString(h, s+"\n")
+	}
+	io.WriteString(h, time.Now().String())
+	return "I" + hex.EncodeToString(h.Sum(nil))
+}
+
+// gerritRepo reports whether the repository is set up for Gerrit: its
+// commit-msg hook adds Change-Ids, or gerrit.createChangeId is configured.
+func gerritRepo() bool {
+	if v, err := git("config", "--get", "gerrit.createChangeId"); err == nil && strings.TrimSpace(v) != "false" {
+		return true
+	}
+	path, err := hookPath("commit-msg")
+	if err != nil {
+		return false
+	}
+	hook, err := os.ReadFile(path)
+	return err == nil && bytes.Contains(hook, []byte("Change-Id"))
+}
+
+// gerritPushCommand is the command that uploads branch for review against
+// the upstream of orig (or a placeholder if orig tracks nothing).
+func gerritPushCommand(branch, orig string) string {
+	remote, target := "origin", "<target-branch>"
+	if up, err := git("rev-parse", "--abbrev-ref", "--symbolic-full-name", orig+"@{upstream}"); err == nil {
+		if r, b, ok := strings.Cut(strings.TrimSpace(up), "/"); ok {
+			remote, target = r, b
+		}
+	}
+	return fmt.Sprintf("git push %s %s:refs/for/%s", remote, branch, target)
+}
+
+// ============================
+// Advise command (commit-splitting advisor)
+// ============================
+
+// adviseSystemPrompt asks for a split proposal as JSON so it can be
+// rendered as a report and consumed by --json.
+const adviseSystemPrompt = `You review a single Git commit and decide whether it mixes unrelated concerns that would have been easier to review as separate commits (for example a refactor bundled with a feature, or changes to independent subsystems).
+Reply with JSON only, no prose and no code fences:
+{"split": true|false, "reason": "<one sentence>", "commits": [{"message": "<Conventional Commit summary line>", "files": ["<path>", ...]}]}
+When split is true, list 2-5 suggested commits in the order they should be made, assigning every changed file to exactly one of them. When split is false, leave commits empty.`
+
+// splitAdvice is the model's verdict on one commit.
+type splitAdvice struct {
+	Split   bool          `json:"split"`
+	Reason  string        `json:"reason"`
+	Commits []splitCommit `json:"commits"`
+}
+
+type splitCommit struct {
+	Message string   `json:"message"`
+	Files   []string `json:"files"`
+}
+
+// adviceReport is one line of the advise output (and of --json).
+type adviceReport struct {
+	SHA     string      `json:"sha"`
+	Subject string      `json:"subject"`
+	Areas   []string    `json:"areas"`
+	Lines   int         `json:"lines"`
+	Advice  splitAdvice `json:"advice"`
+}
+
+// changeAreas groups changed paths by their top-level directory, which is
+// the cheap signal for "this commit touches independent parts of the tree".
+func changeAreas(files []fileChange) ([]string, int) {
+	seen := map[string]bool{}
+	var areas []string
+	lines := 0
+	for _, f := range files {
+		area := "(root)"
+		if dir, _, ok := strings.Cut(f.Path, "/"); ok {
+			area = dir
+		}
+		if !seen[area] {
+			seen[area] = true
+			areas = append(areas, area)
+		}
+		lines += f.Added + f.Deleted
+	}
+	return areas, lines
+}
+
+var jsonObjectRe = regexp.MustCompile(`(?s)\{.*\}`)
+
+func cmdAdvise(args []string) error {
+	fs := flag.NewFlagSet("advise", flag.ExitOnError)
+	limit := fs.Int("limit", 20, "number of commits from HEAD to review")
+	rangeExpr := fs.String("range", "", "explicit git range (e.g., <base>..<head>)")
+	var af aiFlags
+	af.register(fs)
+	minAreas := fs.Int("min-areas", 3, "review commits touching at least this many top-level directories")
+	maxLines := fs.Int("max-lines", 400, "review commits changing more lines than this across two or more directories")
+	all := fs.Bool("all", false, "send every commit to the model, not just those the heuristics pick")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	timeout := fs.Duration("timeout", 25*time.Second, "per-commit AI timeout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *rangeExpr == "" {
+		head, err := defaultHead()
+		if err != nil {
+			return err
+		}
+		base, err := nthAncestor(head, *limit)
+		if err != nil {
+			*rangeExpr = head
+		} else {
+			*rangeExpr = base + ".." + head
+		}
+	}
+	commits, err := listCommits(*rangeExpr)
+	if err != nil {
+		return err
+	}
+	if len(commits) > *limit {
+		commits = commits[len(commits)-*limit:]
+	}
+	ai, err := af.client()
+	if err != nil {
+		return err
+	}
+
+	var reports []adviceReport
+	for _, c := range commits {
+		if rootCtx.Err() != nil {
+			break
+		}
+		if c.IsMerge {
+			continue
+		}
+		diff, err := showDiff(c.SHA, false)
+		if err != nil {
+			return err
+		}
+		areas, lines := changeAreas(parseDiffFiles(diff))
+		if !*all && len(areas) < *minAreas && (len(areas) < 2 || lines <= *maxLines) {
+			continue
+		}
+		user := fmt.Sprintf("Commit message:\n%s\n\n%s\nDiff:\n%s", c.Subject, summarizeDiff(diff), truncate(diff, diffBudgetOf(ai)))
+		ctx, cancel := context.WithTimeout(rootCtx, *timeout)
+		txt, err := ai.Complete(withAIRequest(ctx, aiRequest{Kind: kindAdvise}), af.model, adviseSystemPrompt, user)
+		cancel()
+		if err != nil {
+			if rootCtx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("AI failed for %s: %w", c.SHA, err)
+		}
+		var adv splitAdvice
+		if err := json.Unmarshal([]byte(jsonObjectRe.FindString(txt)), &adv); err != nil {
+			slog.Warn("skip commit: unreadable advice", "sha", c.SHA[:7], "err", err)
+			continue
+		}
+		reports = append(reports, adviceReport{SHA: c.SHA, Subject: c.Subject, Areas: areas, Lines: lines, Advice: adv})
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	}
+	split := 0
+	for _, r := range reports {
+		if !r.Advice.Split {
+			continue
+		}
+		split++
+		fmt.Printf("%s  %s\n", r.SHA[:7], truncate(r.Subject, 72))
+		fmt.Printf("  touches %s; %d lines changed\n", strings.Join(r.Areas, ", "), r.Lines)
+		if r.Advice.Reason != "" {
+			fmt.Printf("  %s\n", r.Advice.Reason)
+		}
+		for i, sc := range r.Advice.Commits {
+			fmt.Printf("  %d. %s\n", i+1, sc.Message)
+			for _, f := range sc.Files {
+				fmt.Printf("       %s\n", f)
+			}
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d of %d commits reviewed could be split (%d checked in total).\n", split, len(reports), len(commits))
+	return nil
+}
+
+// ============================
+// Export command
+// ============================
+
+func cmdExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	inFile := fs.String("in", "plan.json", "plan file path (.json or .yaml/.yml)")
+	format := fs.String("format", "", "output format: filter-repo (commit callback), replace-message (expressions file) or rebase-todo")
+	outFile := fs.String("out", "", "write to this file instead of stdout")
+	includeUnreviewed := fs.Bool("include-unreviewed", false, "export items still flagged needs_review")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	switch *format {
+	case "filter-repo", "replace-message", "rebase-todo":
+	case "":
+		return errors.New("--format is required")
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	plan, err := loadPlan(*inFile)
+	if err != nil {
+		return err
+	}
+	if *format == "rebase-todo" {
+		// Squashes are fine here: they become fixup lines.
+		base := plan.Base
+		if base == "" {
+			base = plan.Items[0].SHA + "^"
+		}
+		todo, err := rebaseTodo(plan, base)
+		if err != nil {
+			return err
+		}
+		if *outFile == "" {
+			fmt.Print(todo)
+			return nil
+		}
+		if err := os.WriteFile(*outFile, []byte(todo), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s. `git-smartmsg rebase --in %s` runs the rebase and fills in the messages.\n", *outFile, *inFile)
+		return nil
+	}
+	var items []PlanItem
+	for _, it := range plan.Items {
+		if len(it.Squash) > 0 {
+			return fmt.Errorf("%s squashes %d commit(s), which %s cannot express; use apply", it.SHA[:7], len(it.Squash), *format)
+		}
+		if it.NeedsReview && !*includeUnreviewed {
+			slog.Info("skip item: needs review", "sha", it.SHA[:7])
+			continue
+		}
+		if strings.TrimSpace(it.NewMessage) != "" {
+			items = append(items, it)
+		}
+	}
+	// The messages are the ones apply would commit: the kept parts put
+	// back and the Change-Ids carried over, so the rewritten commits stay
+	// the same Gerrit changes.
+	bodies, gerrit, err := originalBodies(items)
+	if err != nil {
+		return err
+	}
+	mode := messageMode{mode: plan.Mode, generate: plan.Generate}
+	for i, it := range items {
+		items[i].NewMessage = applyMessage(it, mode, false, bodies, nil, gerrit)
+	}
+
+	var out string
+	if *format == "filter-repo" {
+		out = filterRepoCallback(items)
+	} else {
+		out = replaceMessageRules(items)
+	}
+	if *outFile == "" {
+		fmt.Print(out)
+		return nil
+	}
+	if err := os.WriteFile(*outFile, []byte(out), 0644); err != nil {
+		return err
+	}
+	switch *format {
+	case "filter-repo":
+		fmt.Fprintf(os.Stderr, "Wrote %s. Run: git filter-repo --commit-callback \"$(cat %s)\"\n", *outFile, *outFile)
+	case "replace-message":
+		fmt.Fprintf(os.Stderr, "Wrote %s. Run: git filter-repo --replace-message %s\n", *outFile, *outFile)
+	}
+	return nil
+}
+
+// filterRepoCallback renders a --commit-callback body that replaces whole
+// messages, keyed by the original commit ID so identical subjects elsewhere
+// in history are left alone. JSON string literals are valid Python.
+func filterRepoCallback(items []PlanItem) string {
+	var sb strings.Builder
+	sb.WriteString("# generated by git-smartmsg export --format filter-repo\n")
+	sb.WriteString("msgs = {\n")
+	for _, it := range items {
+		lit, _ := json.Marshal(strings.TrimRight(it.NewMessage, "\n") + "\n")
+		fmt.Fprintf(&sb, "    %q: %s,\n", it.SHA, lit)
+	}
+	sb.WriteString("}\n")
+	sb.WriteString("new = msgs.get(commit.original_id.decode())\n")
+	sb.WriteString("if new is not None:\n")
+	sb.WriteString("    commit.message = new.encode(\"utf-8\")\n")
+	return sb.String()
+}
+
+// replaceMessageRules renders literal "old==>new" subject replacements.
+// --replace-message works on text, not commits, so only single-line
+// subjects that are unique within the plan can be expressed safely.
+func replaceMessageRules(items []PlanItem) string {
+	count := map[string]int{}
+	for _, it := range items {
+		count[firstLine(it.OldMessage)]++
+	}
+	var sb strings.Builder
+	for _, it := range items {
+		old, repl := firstLine(it.OldMessage), firstLine(it.NewMessage)
+		switch {
+		case old == repl:
+			continue
+		case old == "" || strings.Contains(old, "==>"):
+			slog.Warn("skip item: subject cannot be written as a literal rule", "sha", it.SHA[:7])
+			continue
+		case count[old] > 1:
+			slog.Warn("skip item: subject is shared by several commits; use --format filter-repo", "sha", it.SHA[:7], "subject", old, "commits", count[old])
+			continue
+		}
+		if strings.Contains(it.NewMessage, "\n") {
+			slog.Info("only the subject line is replaced", "sha", it.SHA[:7])
+		}
+		fmt.Fprintf(&sb, "literal:%s==>%s\n", old, repl)
+	}
+	return sb.String()
+}
+
+// ============================
+// Native rebase (export --format rebase-todo, rebase)
+// ============================
+
+// planLookup resolves full or abbreviated SHAs, as they appear in a rebase
+// todo, to the plan item that rewrites them. squash is true for commits
+// folded into an item rather than the item's own commit.
+func planLookup(plan Plan, sha string) (it PlanItem, squash bool, ok bool) {
+	if len(sha) < 4 {
+		return PlanItem{}, false, false
+	}
+	for _, it := range plan.Items {
+		if strings.HasPrefix(it.SHA, sha) {
+			return it, false, true
+		}
+		for _, s := range it.Squash {
+			if strings.HasPrefix(s, sha) {
+				return it, true, true
+			}
+		}
+	}
+	return PlanItem{}, false, false
+}
+
+// rebaseTodo renders a complete todo for base..head: reword for planned
+// commits, fixup for commits squashed into them, pick for the rest. A flat
+// todo cannot replay merges, so ranges with merges are left to
+// `git-smartmsg rebase`, which edits the todo git writes for them.
+func rebaseTodo(plan Plan, base string) (string, error) {
+	commits, err := listCommits(base + ".." + plan.Head)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, c := range commits {
+		if c.IsMerge {
+			return "", fmt.Errorf("%s is a merge, which a rebase todo cannot replay; use `git-smartmsg rebase`, which keeps merges", c.SHA[:7])
+		}
+		if it, squash, ok := planLookup(plan, c.SHA); ok && !squash {
+			fmt.Fprintf(&sb, "reword %s # %s\n", c.SHA[:12], firstLine(it.NewMessage))
+		} else if ok {
+			fmt.Fprintf(&sb, "fixup %s # %s\n", c.SHA[:12], c.Subject)
+		} else {
+			fmt.Fprintf(&sb, "pick %s # %s\n", c.SHA[:12], c.Subject)
+		}
+	}
+	return sb.String(), nil
+}
+
+// rewriteTodo edits the todo git generated with --rebase-merges, so label,
+// reset and merge lines are kept: only planned commits change. A planned
+// merge's "merge -C" becomes "merge -c", which asks the editor for its
+// message.
+func rewriteTodo(todo string, plan Plan) string {
+	lines := splitLines(todo)
+	for i, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) >= 3 && (fields[0] == "merge" || fields[0] == "m") && fields[1] == "-C" {
+			if _, squash, ok := planLookup(plan, fields[2]); ok && !squash {
+				lines[i] = strings.Replace(l, " -C ", " -c ", 1)
+			}
+			continue
+		}
+		if len(fields) < 2 || (fields[0] != "pick" && fields[0] != "p") {
+			continue
+		}
+		if _, squash, ok := planLookup(plan, fields[1]); ok {
+			cmd := "reword"
+			if squash {
+				cmd = "fixup"
+			}
+			lines[i] = cmd + strings.TrimPrefix(l, fields[0])
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// shellQuote quotes s for the POSIX shell git uses to run editors.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// cmdRebase drives `git rebase -i` with this binary as both sequence editor
+// (marking planned commits reword/fixup) and editor (supplying each new
+// message), so hooks, signing and merge handling are git's own.
+func cmdRebase(args []string) error {
+	fs := flag.NewFlagSet("rebase", flag.ExitOnError)
+	inFile := fs.String("in", "plan.json", "plan file path (.json or .yaml/.yml)")
+	includeUnreviewed := fs.Bool("include-unreviewed", false, "reword items still flagged needs_review")
+	allowStale := fs.Bool("allow-stale", false, "rebase even if HEAD has moved since the plan was created")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	planPath, _ := filepath.Abs(*inFile)
+	plan, err := loadPlan(*inFile)
+	if err != nil {
+		return err
+	}
+	if err := enterPlanRepo(plan); err != nil {
+		return err
+	}
+	unlock, err := lockRepo("rebase")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := checkPlanCommits(plan); err != nil {
+		return err
+	}
+	if !*allowStale {
+		if err := checkPlanHead(plan, "HEAD"); err != nil {
+			return err
+		}
+	}
+	// As for apply, the policy holds for reviewed and hand-edited items too.
+	if policy, err := loadPolicy(); err != nil {
+		return err
+	} else if policy != nil {
+		if err := checkPlanPolicy(policy, plan); err != nil {
+			return err
+		}
+	}
+	for _, it := range plan.Items {
+		if it.NeedsReview && !*includeUnreviewed {
+			return fmt.Errorf("%s needs review; run `git-smartmsg edit` or pass --include-unreviewed", it.SHA[:7])
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	shim := shellQuote(self) + " rebase-shim --in " + shellQuote(planPath)
+	// Without --rebase-merges git drops merges and flattens their branches.
+	rebaseArgs := []string{"rebase", "-i", "--rebase-merges"}
+	if plan.Base != "" {
+		rebaseArgs = append(rebaseArgs, plan.Base)
+	} else if _, err := git("rev-parse", "--verify", "--quiet", plan.Items[0].SHA+"^"); err == nil {
+		rebaseArgs = append(rebaseArgs, plan.Items[0].SHA+"^")
+	} else {
+		rebaseArgs = append(rebaseArgs, "--root")
+	}
+	cmd := exec.Command("git", rebaseArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = gitEnv("GIT_SEQUENCE_EDITOR="+shim+" todo", "GIT_EDITOR="+shim+" msg")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git rebase stopped: %w (fix and `git rebase --continue`, or `git rebase --abort`)", err)
+	}
+	return nil
+}
+
+// cmdRebaseShim is invoked by git during cmdRebase: "todo <file>" as the
+// sequence editor, "msg <file>" as the editor for each reword.
+func cmdRebaseShim(args []string) error {
+	fs := flag.NewFlagSet("rebase-shim", flag.ExitOnError)
+	inFile := fs.String("in", "plan.json", "plan file path")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: rebase-shim --in <plan> todo|msg <file>")
+	}
+	plan, err := loadPlan(*inFile)
+	if err != nil {
+		return err
+	}
+	mode, path := fs.Arg(0), fs.Arg(1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case "todo":
+		return os.WriteFile(path, []byte(rewriteTodo(string(data), plan)), 0644)
+	case "msg":
+		// The commit being reworded is the last entry in the done list.
+		donePath, err := git("rev-parse", "--git-path", "rebase-merge/done")
+		if err != nil {
+			return err
+		}
+		done, err := os.ReadFile(strings.TrimSpace(donePath))
+		if err != nil {
+			return nil // not a rebase-driven edit; leave the message alone
+		}
+		lines := splitLines(strings.TrimSpace(string(done)))
+		fields := strings.Fields(lines[len(lines)-1])
+		var sha string
+		switch {
+		case len(fields) >= 2 && (fields[0] == "reword" || fields[0] == "r"):
+			sha = fields[1]
+		case len(fields) >= 3 && (fields[0] == "merge" || fields[0] == "m") && fields[1] == "-c":
+			sha = fields[2]
+		default:
+			return nil
+		}
+		it, squash, ok := planLookup(plan, sha)
+		if !ok || squash || strings.TrimSpace(it.NewMessage) == "" {
+			return nil
+		}
+		msg := keepChangeID(it.NewMessage, string(data))
+		return os.WriteFile(path, []byte(strings.TrimRight(msg, "\n")+"\n"), 0644)
+	}
+	return fmt.Errorf("unknown shim mode %q", mode)
+}
+
+// ============================
+// Stats command
+// ============================
+
+// modelPrices are USD per 1M input/output tokens, matched by substring of
+// the model name (longest match wins). Override with --price-in/--price-out.
+var modelPrices = map[string][2]float64{
+	"gpt-5-nano":         {0.05, 0.40},
+	"gpt-5-mini":         {0.25, 2.00},
+	"gpt-5":              {1.25, 10.00},
+	"gpt-4.1-nano":       {0.10, 0.40},
+	"gpt-4.1-mini":       {0.40, 1.60},
+	"gpt-4.1":            {2.00, 8.00},
+	"gpt-4o-mini":        {0.15, 0.60},
+	"gpt-4o":             {2.50, 10.00},
+	"gemini-2.0-flash":   {0.10, 0.40},
+	"gemini-2.5-flash":   {0.30, 2.50},
+	"gemini-2.5-pro":     {1.25, 10.00},
+	"claude-3-5-haiku":   {0.80, 4.00},
+	"claude-3-5-sonnet":  {3.00, 15.00},
+	"titan-text-express": {0.20, 0.60},
+	"titan-text-premier": {0.50, 1.50},
+	"mock":               {0, 0},
+}
+
+func lookupPrice(model string) ([2]float64, bool) {
+	best, ok := "", false
+	for k := range modelPrices {
+		if strings.Contains(model, k) && len(k) > len(best) {
+			best, ok = k, true
+		}
+	}
+	return modelPrices[best], ok
+}
+
+var ccTypeRe = regexp.MustCompile(`^(?:\S+\s+)?([a-z]+)(?:\([^)]*\))?!?:\s`)
+
+// commitType returns the Conventional Commit type of a subject, or "" when
+// the subject doesn't follow the convention. A leading emoji is tolerated.
+func commitType(subject string) string {
+	if m := ccTypeRe.FindStringSubmatch(subject); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+type planStats struct {
+	Items              int            `json:"items"`
+	Changed            int            `json:"changed"`
+	NeedsReview        int            `json:"needs_review"`
+	Failed             int            `json:"failed"`
+	AvgSubjectBefore   float64        `json:"avg_subject_len_before"`
+	AvgSubjectAfter    float64        `json:"avg_subject_len_after"`
+	LongSubjectsBefore int            `json:"subjects_over_72_before"`
+	LongSubjectsAfter  int            `json:"subjects_over_72_after"`
+	TypesBefore        map[string]int `json:"types_before"`
+	TypesAfter         map[string]int `json:"types_after"`
+	Model              string         `json:"model"`
+	Usage              Usage          `json:"usage"`
+	CostUSD            *float64       `json:"cost_usd,omitempty"`
+	ElapsedSec         float64        `json:"elapsed_seconds"`
+}
+
+func computeStats(plan Plan, priceIn, priceOut float64) planStats {
+	st := planStats{
+		Items:       len(plan.Items),
+		TypesBefore: map[string]int{},
+		TypesAfter:  map[string]int{},
+		Model:       plan.Model,
+		ElapsedSec:  plan.ElapsedSec,
+	}
+	var before, after int
+	for _, it := range plan.Items {
+		oldSubj := firstLine(it.OldMessage)
+		newMsg := it.NewMessage
+		if strings.TrimSpace(newMsg) == "" {
+			newMsg = it.OldMessage
+		}
+		newSubj := firstLine(newMsg)
+		if it.failed() {
+			st.Failed++
+		} else if strings.TrimSpace(newMsg) != strings.TrimSpace(it.OldMessage) {
+			st.Changed++
+		}
+		if it.NeedsReview {
+			st.NeedsReview++
+		}
+		ob, na := utf8.RuneCountInString(oldSubj), utf8.RuneCountInString(newSubj)
+		before += ob
+		after += na
+		if ob > 72 {
+			st.LongSubjectsBefore++
+		}
+		if na > 72 {
+			st.LongSubjectsAfter++
+		}
+		st.TypesBefore[cmp.Or(commitType(oldSubj), "(none)")]++
+		st.TypesAfter[cmp.Or(commitType(newSubj), "(none)")]++
+	}
+	if st.Items > 0 {
+		st.AvgSubjectBefore = float64(before) / float64(st.Items)
+		st.AvgSubjectAfter = float64(after) / float64(st.Items)
+	}
+	if plan.Usage != nil {
+		st.Usage = *plan.Usage
+	}
+	price, ok := lookupPrice(plan.Model)
+	if priceIn >= 0 && priceOut >= 0 {
+		price, ok = [2]float64{priceIn, priceOut}, true
+	} else if len(plan.UsageByModel) > 0 {
+		// Routed plans are priced model by model; one unknown price makes
+		// the total unknown.
+		var cost float64
+		for m, u := range plan.UsageByModel {
+			p, known := lookupPrice(m)
+			if !known {
+				return st
+			}
+			cost += (float64(u.PromptTokens)*p[0] + float64(u.CompletionTokens)*p[1]) / 1e6
+		}
+		st.CostUSD = &cost
+		return st
+	}
+	if ok && plan.Usage != nil {
+		cost := (float64(st.Usage.PromptTokens)*price[0] + float64(st.Usage.CompletionTokens)*price[1]) / 1e6
+		if b := plan.BatchUsage; b != nil {
+			cost -= (float64(b.PromptTokens)*price[0] + float64(b.CompletionTokens)*price[1]) / 1e6 / 2
+		}
+		st.CostUSD = &cost
+	}
+	return st
+}
+
+func cmdStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	inFile := fs.String("in", "plan.json", "plan file path (.json or .yaml/.yml)")
+	asJSON := fs.Bool("json", false, "print machine-readable JSON instead of a table")
+	priceIn := fs.Float64("price-in", -1, "override USD per 1M input tokens")
+	priceOut := fs.Float64("price-out", -1, "override USD per 1M output tokens")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	plan, err := loadPlan(*inFile)
+	if err != nil {
+		return err
+	}
+	st := computeStats(plan, *priceIn, *priceOut)
+	if *asJSON {
+		data, _ := json.MarshalIndent(st, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Messages changed\t%d / %d\n", st.Changed, st.Items)
+	fmt.Fprintf(w, "Needs review\t%d\n", st.NeedsReview)
+	if st.Failed > 0 {
+		fmt.Fprintf(w, "Failed\t%d\n", st.Failed)
+	}
+	fmt.Fprintf(w, "Avg subject length\t%.1f -> %.1f\n", st.AvgSubjectBefore, st.AvgSubjectAfter)
+	fmt.Fprintf(w, "Subjects over 72 chars\t%d -> %d\n", st.LongSubjectsBefore, st.LongSubjectsAfter)
+	fmt.Fprintf(w, "Model\t%s\n", st.Model)
+	if plan.ModelRouting != "" {
+		fmt.Fprintf(w, "Model routing\t%s\n", plan.ModelRouting)
+		models := slices.Sorted(maps.Keys(plan.UsageByModel))
+		for _, m := range models {
+			u := plan.UsageByModel[m]
+			fmt.Fprintf(w, "  %s\t%d requests, %d / %d tokens\n", m, u.Requests, u.PromptTokens, u.CompletionTokens)
+		}
+	}
+	if plan.Usage != nil {
+		fmt.Fprintf(w, "API requests\t%d\n", st.Usage.Requests)
+		fmt.Fprintf(w, "Tokens (prompt / completion)\t%d / %d\n", st.Usage.PromptTokens, st.Usage.CompletionTokens)
+	} else {
+		fmt.Fprintf(w, "Token usage\tnot recorded\n")
+	}
+	if st.CostUSD != nil {
+		fmt.Fprintf(w, "Estimated cost\t$%.4f\n", *st.CostUSD)
+	} else {
+		fmt.Fprintf(w, "Estimated cost\tunknown (use --price-in/--price-out)\n")
+	}
+	if st.ElapsedSec > 0 {
+		fmt.Fprintf(w, "Wall time\t%s\n", time.Duration(st.ElapsedSec*float64(time.Second)).Round(time.Second))
+	}
+	w.Flush()
+
+	fmt.Println("\nConventional Commit types (before -> after):")
+	types := map[string]bool{}
+	for t := range st.TypesBefore {
+		types[t] = true
+	}
+	for t := range st.TypesAfter {
+		types[t] = true
+	}
+	names := make([]string, 0, len(types))
+	for t := range types {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, t := range names {
+		fmt.Fprintf(w, "  %s\t%d -> %d\n", t, st.TypesBefore[t], st.TypesAfter[t])
+	}
+	w.Flush()
+	return nil
+}
+
+// ============================
+// Edit command ($EDITOR round-trip)
+// ============================
+
+var editHeaderRe = regexp.MustCompile(`^=== ([0-9a-f]{40}|[0-9a-f]{64})\b`)
+
+func cmdEdit(args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	inFile := fs.String("in", "plan.json", "plan file path (.json or .yaml/.yml)")
+	each := fs.Bool("each", false, "open each message in its own editor session instead of one combined file")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	plan, err := loadPlan(*inFile)
+	if err != nil {
+		return err
+	}
+
+	if *each {
+		for i := range plan.Items {
+			it := &plan.Items[i]
+			var sb strings.Builder
+			sb.WriteString(it.NewMessage)
+			sb.WriteString("\n\n# Commit " + it.SHA + "\n")
+			sb.WriteString("# Original message: " + firstLine(it.OldMessage) + "\n")
+			writeFileSummary(&sb, *it)
+			writeReviewMarkers(&sb, *it)
+			sb.WriteString("# Lines starting with '#' are ignored. An empty message keeps the original.\n")
+			edited, err := editText(sb.String(), "COMMIT_EDITMSG")
+			if err != nil {
+				return err
+			}
+			markWritten(it, stripComments(edited))
+			if !strings.Contains(edited, reviewMarker) {
+				markReviewed(it)
+			}
+		}
+	} else {
+		text := renderEditFile(*inFile, plan)
+		for {
+			edited, err := editText(text, "smartmsg-edit.txt")
+			if err != nil {
+				return err
+			}
+			msgs, perr := parseEditFile(edited, plan)
+			if perr == nil {
+				for i := range plan.Items {
+					if e, ok := msgs[plan.Items[i].SHA]; ok {
+						markWritten(&plan.Items[i], e.message)
+						if !e.flagged {
+							markReviewed(&plan.Items[i])
+						}
+					}
+				}
+				break
+			}
+			fmt.Fprintf(os.Stderr, "❌ %v\n", perr)
+			if !askYesNo("✏️  Edit again? [Y/n]: ", true) {
+				return errors.New("edit aborted; plan left unchanged")
+			}
+			text = edited
+		}
+	}
+
+	if err := validatePlan(plan); err != nil {
+		return fmt.Errorf("edited plan is invalid:\n%w", err)
+	}
+	if err := savePlan(*inFile, plan); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s (%d messages)\n", *inFile, len(plan.Items))
+	return nil
+}
+
+// reviewMarker starts the comment lines explaining why an item needs
+// review; deleting them in the editor marks the item as reviewed.
+const reviewMarker = "# REVIEW:"
+
+func writeReviewMarkers(sb *strings.Builder, it PlanItem) {
+	if it.failed() {
+		sb.WriteString("# FAILED (" + it.Status + "): " + firstLine(it.Error) + "\n")
+		sb.WriteString("#   (this is the original message; change it to mark the item ok)\n")
+	}
+	if !it.NeedsReview {
+		return
+	}
+	notes := it.ReviewNotes
+	if len(notes) == 0 {
+		notes = []string{"flagged for review"}
+	}
+	for _, n := range notes {
+		sb.WriteString(reviewMarker + " " + n + "\n")
+	}
+	sb.WriteString("#   (delete the REVIEW lines to mark this message as reviewed)\n")
+}
+
+// writeFileSummary lists the files an item changes, so its message can be
+// judged without looking up the diff.
+func writeFileSummary(sb *strings.Builder, it PlanItem) {
+	if len(it.Files) == 0 {
+		return
+	}
+	var names []string
+	for _, f := range it.Files[:min(len(it.Files), 5)] {
+		names = append(names, f.Path)
+	}
+	if n := len(it.Files) - len(names); n > 0 {
+		names = append(names, fmt.Sprintf("and %d more", n))
+	}
+	fmt.Fprintf(sb, "# %d file(s), +%d -%d: %s\n", len(it.Files), it.Insertions, it.Deletions, strings.Join(names, ", "))
+}
+
+func markReviewed(it *PlanItem) {
+	it.NeedsReview = false
+	it.ReviewNotes = nil
+}
+
+// markWritten sets an item's message; a failed item whose message was
+// changed by hand is ok from then on.
+func markWritten(it *PlanItem, msg string) {
+	if it.failed() && strings.TrimSpace(msg) != strings.TrimSpace(it.NewMessage) {
+		it.Status, it.Error = statusOK, ""
+	}
+	it.NewMessage = msg
+}
+
+// renderEditFile lists items needing review first so they get attention.
+func renderEditFile(path string, plan Plan) string {
+	var sb strings.Builder
+	sb.WriteString("# git-smartmsg edit: " + path + "\n")
+	sb.WriteString("# Each message follows a \"=== <sha> <original subject>\" header; do not edit headers.\n")
+	sb.WriteString("# Lines starting with '#' are ignored. Leave a message empty to keep the original.\n")
+	sb.WriteString("# Removing a header (and its message) leaves that item unchanged.\n")
+	items := slices.Clone(plan.Items)
+	slices.SortStableFunc(items, func(a, b PlanItem) int {
+		return cmp.Compare(boolInt(b.NeedsReview || b.failed()), boolInt(a.NeedsReview || a.failed()))
+	})
+	for _, it := range items {
+		sb.WriteString("\n=== " + it.SHA + " " + firstLine(it.OldMessage) + "\n")
+		writeFileSummary(&sb, it)
+		writeReviewMarkers(&sb, it)
+		sb.WriteString(it.NewMessage + "\n")
+	}
+	return sb.String()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type editedItem struct {
+	message string
+	flagged bool // REVIEW lines were left in place
+}
+
+// parseEditFile maps SHAs to edited messages, rejecting unknown or
+// duplicated headers.
+func parseEditFile(text string, plan Plan) (map[string]editedItem, error) {
+	known := map[string]bool{}
+	for _, it := range plan.Items {
+		known[it.SHA] = true
+	}
+	msgs := map[string]editedItem{}
+	var cur string
+	var buf []string
+	flush := func() {
+		if cur != "" {
+			joined := strings.Join(buf, "\n")
+			msgs[cur] = editedItem{
+				message: stripComments(joined),
+				flagged: strings.Contains(joined, reviewMarker),
+			}
+		}
+	}
+	for n, line := range splitLines(text) {
+		if m := editHeaderRe.FindStringSubmatch(line); m != nil {
+			flush()
+			cur, buf = m[1], nil
+			if !known[cur] {
+				return nil, fmt.Errorf("line %d: %s is not in the plan", n+1, cur[:7])
+			}
+			if _, dup := msgs[cur]; dup {
+				return nil, fmt.Errorf("line %d: %s appears twice", n+1, cur[:7])
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "===") {
+			return nil, fmt.Errorf("line %d: malformed header %q", n+1, line)
+		}
+		if cur == "" {
+			if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#") {
+				return nil, fmt.Errorf("line %d: text before the first header", n+1)
+			}
+			continue
+		}
+		buf = append(buf, line)
+	}
+	flush()
+	return msgs, nil
+}
+
+// stripComments drops '#' lines and surrounding blank lines, like git does
+// for commit messages.
+func stripComments(s string) string {
+	var keep []string
+	for _, l := range splitLines(s) {
+		if !strings.HasPrefix(l, "#") {
+			keep = append(keep, strings.TrimRight(l, " \t\r"))
+		}
+	}
+	return strings.TrimSpace(strings.Join(keep, "\n"))
+}
+
+// editText opens text in the user's git editor and returns the result.
+func editText(text, name string) (string, error) {
+	dir, err := os.MkdirTemp("", "smartmsg-edit-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		return "", err
+	}
+
+	editor, err := git("var", "GIT_EDITOR")
+	if err != nil || strings.TrimSpace(editor) == "" {
+		editor = envOr("VISUAL", envOr("EDITOR", "vi"))
+	}
+	// Editors may carry arguments ("code --wait"), so let the shell split
+	// them, exactly as git does. Git for Windows ships sh; without it, fall
+	// back to cmd.exe.
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("sh"); err != nil && runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", strings.TrimSpace(editor)+` "`+path+`"`)
+	} else {
+		cmd = exec.Command("sh", "-c", strings.TrimSpace(editor)+` "$@"`, "editor", path)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor failed: %w", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// stdinLines is shared by every prompt: a scanner per prompt would buffer
+// ahead and swallow the answers to later ones when stdin is piped.
+var stdinLines = bufio.NewScanner(os.Stdin)
+
+// readAnswer prints prompt and reads one line; ok is false at end of input.
+func readAnswer(prompt string) (answer string, ok bool) {
+	fmt.Print(prompt)
+	if !stdinLines.Scan() {
+		return "", false
+	}
+	return strings.TrimSpace(stdinLines.Text()), true
+}
+
+func askYesNo(prompt string, def bool) bool {
+	answer, ok := readAnswer(prompt)
+	if !ok {
+		return def
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	}
+	return def
+}
+
+// ============================
+// rewrite-msg filter (stdin -> stdout)
+// ============================
+
+// cmdRewriteMsg reads a commit message on stdin and prints the improved
+// message on stdout and nothing else, so it composes with editors, hooks
+// and `git rebase --exec`.
+func cmdRewriteMsg(args []string) error {
+	fs := flag.NewFlagSet("rewrite-msg", flag.ExitOnError)
+	var af aiFlags
+	af.register(fs)
+	var lr lengthRules
+	lr.register(fs)
+	var mode messageMode
+	mode.register(fs)
+	diffFile := fs.String("diff-file", "", "read the diff the message describes from this file")
+	staged := fs.Bool("staged", false, "use the staged changes as the diff")
+	rev := fs.String("commit", "", "use this commit's diff (e.g. HEAD in a rebase --exec loop)")
+	emoji := fs.Bool("emoji", false, "use emoji style commit messages")
+	refine := fs.Bool("refine", false, "add a self-critique pass that checks the message against the diff and revises it")
+	timeout := fs.Duration("timeout", 25*time.Second, "AI timeout")
+	repoCtxFlag := fs.Bool("repo-context", false, "add the README intro, CONTRIBUTING commit guidelines and a shallow file tree to the prompt")
+	contextFile := fs.String("context-file", "", "add this file's text to the prompt as repository context (replaces --repo-context)")
+	keep := fs.Bool("keep-on-error", false, "print the input unchanged (and exit 0) if the AI call fails or the result violates the commit policy")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := mode.check(); err != nil {
+		return err
+	}
+
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	oldMsg := stripComments(string(in))
+
+	var diff string
+	switch {
+	case *diffFile != "" && (*staged || *rev != ""), *staged && *rev != "":
+		return errors.New("--diff-file, --staged and --commit are mutually exclusive")
+	case *diffFile != "":
+		b, err := os.ReadFile(*diffFile)
+		if err != nil {
+			return err
+		}
+		diff = promptDiff(string(b))
+	case *staged:
+		if diff, err = getStagedDiff(false); err != nil {
+			return err
+		}
+	case *rev != "":
+		if diff, err = showDiff(*rev, false); err != nil {
+			return err
+		}
+	}
+	if strings.TrimSpace(oldMsg) == "" && strings.TrimSpace(diff) == "" {
+		return errors.New("nothing to rewrite: empty message on stdin and no diff")
+	}
+	if strings.TrimSpace(diff) == "" {
+		diff = "(no diff available; improve the wording of the old message only)"
+	}
+
+	ai, err := af.client()
+	if err != nil {
+		return err
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	lr = lr.withPolicy(policy)
+	lr = mode.lengthRules(lr)
+	req := suggestRequest{Model: af.model, Diff: diff, OldMsg: oldMsg, Emoji: *emoji, Mode: mode, Refine: *refine}
+	if req.Context, err = repoContext(*repoCtxFlag, *contextFile); err != nil {
+		return err
+	}
+	if policy != nil {
+		req.Context = policy.instructions() + req.Context
+	}
+	ctx, cancel := context.WithTimeout(rootCtx, *timeout)
+	defer cancel()
+	sg, err := suggest(ctx, ai, req)
+	msg := lr.apply(sanitizeMessage(sg.Message))
+	if err == nil {
+		msg = keepChangeID(msg, oldMsg)
+	}
+	if err == nil && policy != nil {
+		msg = policy.carryTrailers(msg, oldMsg)
+		if vs := policy.check(msg); len(vs) > 0 {
+			err = fmt.Errorf("message violates %s: %s", policy.path, strings.Join(vs, "; "))
+		}
+	}
+	if err != nil {
+		if *keep {
+			slog.Warn("rewrite-msg: keeping the original message", "err", err)
+			fmt.Print(string(in))
+			return nil
+		}
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+// ============================
+// Commit command (staged changes)
+// ============================
+
+func cmdCommit(args []string) error {
+	fs := flag.NewFlagSet("commit", flag.ExitOnError)
+	var af aiFlags
+	af.register(fs)
+	var lr lengthRules
+	lr.register(fs)
+	emoji := fs.Bool("emoji", false, "use emoji style commit messages")
+	timeout := fs.Duration("timeout", 25*time.Second, "AI timeout")
+	auto := fs.Bool("auto", false, "auto-commit without confirmation")
+	refine := fs.Bool("refine", false, "add a self-critique pass that checks the message against the diff and revises it")
+	funcContext := fs.Bool("function-context", false, "show whole enclosing functions around each hunk (git diff -W)")
+	issueContext := fs.Bool("issue-context", false, "fetch GitHub/Jira issues referenced by the branch name and add them to the prompt")
+	detectTrivial := fs.Bool("detect-trivial", true, "write messages for rename-only and whitespace-only changes without calling the AI")
+	repoCtxFlag := fs.Bool("repo-context", false, "add the README intro, CONTRIBUTING commit guidelines and a shallow file tree to the prompt")
+	contextFile := fs.String("context-file", "", "add this file's text to the prompt as repository context (replaces --repo-context)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Check if staging area has changes
+	stagedFiles, err := git("diff", "--cached", "--name-only")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(stagedFiles) == "" {
+		return errors.New("no staged changes found. Use 'git add' to stage your changes first")
+	}
+
+	// Get staged diff
+	diff, err := getStagedDiff(*funcContext)
+	if err != nil {
+		return err
+	}
+
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	lr = lr.withPolicy(policy)
+
+	// A pure rename or reformat needs no model.
+	var newMsg string
+	if *detectTrivial {
+		_, err := git("diff", "--cached", "--quiet", "-w", "--ignore-blank-lines")
+		if msg := trivialMessage(diff, err == nil, *emoji); msg != "" && policy.ruleBased(msg) {
+			newMsg = msg
+			fmt.Println("📐 Only renames or whitespace are staged; message written without AI")
+		}
+	}
+
+	if newMsg == "" {
+		// Initialize AI client
+		ai, err := af.client()
+		if err != nil {
+			return err
+		}
+
+		// Generate commit message
+		ctx, cancel := context.WithTimeout(rootCtx, *timeout)
+		defer cancel()
+
+		fmt.Println("🤖 Generating commit message from staged changes...")
+		req := suggestRequest{Model: af.model, Diff: diff, Emoji: *emoji, Refine: *refine}
+		if *issueContext {
+			branch, _ := git("symbolic-ref", "--quiet", "--short", "HEAD")
+			req.Context = newIssueFetcher().context(ctx, branch)
+		}
+		if req.Context, err = withRepoContext(req.Context, *repoCtxFlag, *contextFile); err != nil {
+			return err
+		}
+		if policy != nil {
+			req.Context = policy.instructions() + req.Context
+		}
+		sg, err := suggest(ctx, ai, req)
+		if err != nil {
+			return fmt.Errorf("AI failed to generate message: %w", err)
+		}
+		newMsg = sg.Message
+	}
+
+	// Sanitize message
+	cleanMsg := lr.apply(sanitizeMessage(newMsg))
+
+	// Show generated message
+	fmt.Printf("\n📝 Generated commit message:\n")
+	fmt.Printf("   %s\n\n", strings.ReplaceAll(cleanMsg, "\n", "\n   "))
+	if missing, _ := unverifiedClaims(cleanMsg, diff, ""); len(missing) > 0 {
+		fmt.Printf("⚠️  Not found in the staged diff: %s\n\n", strings.Join(missing, ", "))
+	}
+	if policy != nil {
+		if vs := policy.check(cleanMsg); len(vs) > 0 {
+			fmt.Printf("⛔ Violates %s:\n   %s\n\n", filepath.Base(policy.path), strings.Join(vs, "\n   "))
+		}
+	}
+
+	// Get confirmation unless auto mode
+	if !*auto {
+		var ok bool
+		if cleanMsg, ok = confirmMessage("❓ Commit with this message? [y/N/e(dit)]: ", cleanMsg); !ok {
+			fmt.Println("❌ Commit cancelled")
+			return nil
+		}
+	}
+
+	if policy != nil {
+		if vs := policy.check(cleanMsg); len(vs) > 0 {
+			return fmt.Errorf("not committing: message violates %s: %s", policy.path, strings.Join(vs, "; "))
+		}
+	}
+
+	// Execute commit
+	_, err = git("commit", "-m", cleanMsg)
+	if err != nil {
+		return fmt.Errorf("git commit failed: %w", err)
+	}
+
+	fmt.Printf("✅ Successfully committed with message:\n   %s\n", strings.ReplaceAll(cleanMsg, "\n", "\n   "))
+	return nil
+}
+
+// confirmMessage asks whether to use msg, letting the user type a
+// replacement; ok is false when they decline.
+func confirmMessage(prompt, msg string) (string, bool) {
+	answer, _ := readAnswer(prompt)
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return msg, true
+	case "e", "edit":
+		if edited, _ := readAnswer("✏️  Enter your commit message: "); edited != "" {
+			msg = edited
+		}
+		return msg, true
+	}
+	return msg, false
+}
+
+// ============================
+// Amend command (reword HEAD)
+// ============================
+
+func cmdAmend(args []string) error {
+	fs := flag.NewFlagSet("amend", flag.ExitOnError)
+	var af aiFlags
+	af.register(fs)
+	var lr lengthRules
+	lr.register(fs)
+	var mode messageMode
+	mode.register(fs)
+	emoji := fs.Bool("emoji", false, "use emoji style commit messages")
+	timeout := fs.Duration("timeout", 25*time.Second, "AI timeout")
+	auto := fs.Bool("auto", false, "amend without confirmation")
+	refine := fs.Bool("refine", false, "add a self-critique pass that checks the message against the diff and revises it")
+	funcContext := fs.Bool("function-context", false, "show whole enclosing functions around each hunk (git show -W)")
+	issueContext := fs.Bool("issue-context", false, "fetch GitHub/Jira issues referenced by the message or branch name and add them to the prompt")
+	repoCtxFlag := fs.Bool("repo-context", false, "add the README intro, CONTRIBUTING commit guidelines and a shallow file tree to the prompt")
+	contextFile := fs.String("context-file", "", "add this file's text to the prompt as repository context (replaces --repo-context)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := mode.check(); err != nil {
+		return err
+	}
+
+	parents, err := git("rev-list", "--parents", "-n", "1", "HEAD")
+	if err != nil {
+		return errors.New("no HEAD commit to amend")
+	}
+	if strings.Count(strings.TrimSpace(parents), " ") >= 2 {
+		return errors.New("HEAD is a merge commit; amend only rewords ordinary commits")
+	}
+	oldMsg, err := git("log", "-1", "--format=%B", "HEAD")
+	if err != nil {
+		return err
+	}
+	oldMsg = strings.TrimSpace(oldMsg)
+	diff, err := showDiff("HEAD", *funcContext)
+	if err != nil {
+		return err
+	}
+	if refs, _ := git("for-each-ref", "--format=%(refname:short)", "--contains", "HEAD", "refs/remotes"); strings.TrimSpace(refs) != "" {
+		fmt.Printf("⚠️  HEAD is already on %s; publishing the amended commit needs a force-push.\n\n", strings.Join(splitLines(strings.TrimSpace(refs)), ", "))
+	}
+
+	ai, err := af.client()
+	if err != nil {
+		return err
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	lr = lr.withPolicy(policy)
+	lr = mode.lengthRules(lr)
+
+	ctx, cancel := context.WithTimeout(rootCtx, *timeout)
+	defer cancel()
+
+	fmt.Println("🤖 Generating a new message for HEAD...")
+	req := suggestRequest{Model: af.model, Diff: diff, OldMsg: oldMsg, Emoji: *emoji, Mode: mode, Refine: *refine}
+	if *issueContext {
+		branch, _ := git("symbolic-ref", "--quiet", "--short", "HEAD")
+		req.Context = newIssueFetcher().context(ctx, branch, oldMsg)
+	}
+	if req.Context, err = withRepoContext(req.Context, *repoCtxFlag, *contextFile); err != nil {
+		return err
+	}
+	if policy != nil {
+		req.Context = policy.instructions() + req.Context
+	}
+	sg, err := suggest(ctx, ai, req)
+	if err != nil {
+		return fmt.Errorf("AI failed to generate message: %w", err)
+	}
+	// Keeping the Change-Id makes a Gerrit upload a new patch set of the
+	// same change.
+	newMsg := keepChangeID(lr.apply(sanitizeMessage(sg.Message)), oldMsg)
+	if policy != nil {
+		newMsg = policy.carryTrailers(newMsg, oldMsg)
+	}
+
+	fmt.Printf("\n📝 Current message:\n   %s\n", strings.ReplaceAll(oldMsg, "\n", "\n   "))
+	fmt.Printf("\n📝 New message:\n   %s\n\n", strings.ReplaceAll(newMsg, "\n", "\n   "))
+	if missing, _ := unverifiedClaims(newMsg, diff, oldMsg); len(missing) > 0 {
+		fmt.Printf("⚠️  Not found in the commit's diff: %s\n\n", strings.Join(missing, ", "))
+	}
+	if policy != nil {
+		if vs := policy.check(newMsg); len(vs) > 0 {
+			fmt.Printf("⛔ Violates %s:\n   %s\n\n", filepath.Base(policy.path), strings.Join(vs, "\n   "))
+		}
+	}
+	if !*auto {
+		var ok bool
+		if newMsg, ok = confirmMessage("❓ Amend HEAD with this message? [y/N/e(dit)]: ", newMsg); !ok {
+			fmt.Println("❌ Amend cancelled")
+			return nil
+		}
+	}
+	if policy != nil {
+		if vs := policy.check(newMsg); len(vs) > 0 {
+			return fmt.Errorf("not amending: message violates %s: %s", policy.path, strings.Join(vs, "; "))
+		}
+	}
+
+	// --only leaves anything already staged out of the amended commit, so
+	// only the message changes.
+	if _, err := git("commit", "--amend", "--only", "--no-edit", "-m", newMsg); err != nil {
+		return fmt.Errorf("git commit --amend failed: %w", err)
+	}
+	fmt.Printf("✅ Amended HEAD:\n   %s\n", strings.ReplaceAll(newMsg, "\n", "\n   "))
+	return nil
+}
+
+// ============================
+// Translate command
+// ============================
+
+// translateSystemPrompt asks for a faithful translation: the message is
+// rendered in another language, not rewritten from the diff.
+const translateSystemPrompt = `You translate Git commit messages.
+Translate the message into the requested language, keeping its meaning, structure and level of detail:
+- Keep the subject line a single line and keep a Conventional Commits prefix ("fix:", "feat(api):") and any emoji untranslated.
+- Keep commit hashes, issue and PR references, file paths, identifiers, code, URLs and text inside backticks exactly as written.
+- Keep line breaks, blank lines and list markers.
+- If the message is already in the requested language, return it unchanged.
+Return only the translated message, with no explanation and no code fences.`
+
+// translateKeepRe finds the tokens a translation must carry over verbatim:
+// URLs, issue references and abbreviated or full commit hashes.
+var translateKeepRe = regexp.MustCompile(`https?://\S+|(?:[\w.-]+/[\w.-]+)?#\d+|\b[0-9a-f]{7,40}\b`)
+
+// splitTrailerBlock separates a trailing "Key: value" block (sign-offs,
+// Change-Id) from the text above it. Trailers are never translated.
+func splitTrailerBlock(msg string) (text, trailers string) {
+	lines := splitLines(strings.TrimRight(msg, " \n"))
+	i := len(lines)
+	for i > 1 && strings.TrimSpace(lines[i-1]) != "" && trailerLineRe.MatchString(lines[i-1]) {
+		i--
+	}
+	if i == len(lines) || i < 2 || strings.TrimSpace(lines[i-1]) != "" {
+		return strings.Join(lines, "\n"), ""
+	}
+	return strings.TrimRight(strings.Join(lines[:i], "\n"), " \n"), strings.Join(lines[i:], "\n")
+}
+
+// translateMessage renders msg in lang, reattaching its trailers as they
+// were.
+func translateMessage(ctx context.Context, ai AIClient, model, lang, msg string) (string, error) {
+	text, trailers := splitTrailerBlock(msg)
+	txt, err := ai.Complete(withAIRequest(ctx, aiRequest{Kind: kindTranslate}), model, translateSystemPrompt, "Target language: "+lang+"\n\nMessage:\n"+text)
+	if err != nil {
+		return "", err
+	}
+	out := sanitizeMessage(txt)
+	if trailers != "" {
+		out = appendTrailers(out, splitLines(trailers)...)
+	}
+	return out, nil
+}
+
+func cmdTranslate(args []string) error {
+	fs := flag.NewFlagSet("translate", flag.ExitOnError)
+	lang := fs.String("to", "", "language to translate the messages into, e.g. English (required)")
+	limit := fs.Int("limit", 20, "number of commits from HEAD to include")
+	rangeExpr := fs.String("range", "", "explicit git range (e.g., <base>..<head>)")
+	var af aiFlags
+	af.register(fs)
+	var lr lengthRules
+	lr.register(fs)
+	allowMerges := fs.Bool("allow-merges", false, "include merge commits (not recommended)")
+	outFile := fs.String("out", "plan.json", "output plan file (.json, or .yaml/.yml for YAML)")
+	timeout := fs.Duration("timeout", 25*time.Second, "per-commit AI timeout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*lang) == "" {
+		return errors.New("--to is required (e.g. --to English)")
+	}
+	unlock, err := lockRepo("translate")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	shallow, err := prepareHistory(false, 0)
+	if err != nil {
+		return err
+	}
+	base, head, headRef, err := resolveRange(rangeExpr, *limit, shallow)
+	if err != nil {
+		return err
+	}
+	commits, err := listCommits(*rangeExpr)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return errors.New("no commits in range")
+	}
+	ai, err := af.client()
+	if err != nil {
+		return err
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	lr = lr.withPolicy(policy)
+
+	started := time.Now()
+	var items []PlanItem
+	done := map[string]string{} // original message -> translation, for repeated messages
+	for _, c := range commits {
+		if c.IsMerge && !*allowMerges {
+			slog.Info("skip merge commit", "sha", c.SHA[:7])
+			continue
+		}
+		if rootCtx.Err() != nil {
+			break
+		}
+		out, err := git("log", "-1", "--format=%B", c.SHA)
+		if err != nil {
+			return err
+		}
+		old := strings.TrimRight(out, " \n")
+		msg, ok := done[old]
+		if !ok {
+			ctx, cancel := context.WithTimeout(rootCtx, *timeout)
+			msg, err = translateMessage(ctx, ai, af.model, *lang, old)
+			cancel()
+			if err != nil {
+				if rootCtx.Err() != nil {
+					break
+				}
+				return fmt.Errorf("AI failed for %s: %w", c.SHA, err)
+			}
+			done[old] = msg
+		}
+		item := PlanItem{
+			SHA:         c.SHA,
+			OldMessage:  old,
+			NewMessage:  lr.apply(msg),
+			AuthorName:  c.AuthorName,
+			AuthorEmail: c.AuthorEmail,
+			AuthorDate:  c.AuthorDate.Format(time.RFC3339),
+			Model:       af.model,
+		}
+		// Let apply point a revert at the rewritten commit, as plan does.
+		if m := revertBodyRe.FindStringSubmatch(old); m != nil && len(m[1]) == 40 {
+			item.Reverts = m[1]
+		}
+		if firstLine(item.NewMessage) != firstLine(msg) {
+			flagForReview(&item, fmt.Sprintf("subject shortened to %d characters", lr.subjectMax))
+		}
+		var lost []string
+		for _, tok := range translateKeepRe.FindAllString(old, -1) {
+			if !strings.Contains(item.NewMessage, tok) && !slices.Contains(lost, tok) {
+				lost = append(lost, tok)
+			}
+		}
+		if len(lost) > 0 {
+			flagForReview(&item, "dropped in translation: "+strings.Join(lost, ", "))
+		}
+		if policy != nil {
+			for _, v := range policy.check(item.NewMessage) {
+				slog.Warn("policy violation", "sha", c.SHA[:7], "rule", v)
+				flagForReview(&item, "policy: "+v)
+			}
+		}
+		items = append(items, item)
+		slog.Info("translated", "sha", c.SHA[:7], "old", truncate(c.Subject, 60), "new", truncate(firstLine(item.NewMessage), 60))
+	}
+
+	top, _ := repoPath()
+	plan := Plan{
+		RepoPath:    top,
+		RepoID:      repoFingerprint(head),
+		Base:        base,
+		Head:        head,
+		HeadRef:     headRef,
+		CreatedAt:   time.Now().Format(time.RFC3339),
+		Model:       af.model,
+		Provider:    af.provider,
+		GenParams:   af.gen,
+		Translate:   *lang,
+		ElapsedSec:  time.Since(started).Round(time.Millisecond).Seconds(),
+		AllowMerges: *allowMerges,
+		Items:       items,
+	}
+	if plan.Tags, err = rangeTags(items); err != nil {
+		return err
+	}
+	if u := apiUsage.snapshot(); u.Requests > 0 {
+		plan.Usage = &u
+	}
+	if rootCtx.Err() != nil {
+		if len(items) == 0 {
+			return errors.New("interrupted before any commit was translated")
+		}
+		plan.Partial = true
+		plan.Head = items[len(items)-1].SHA
+		if err := savePlan(*outFile, plan); err != nil {
+			return err
+		}
+		return fmt.Errorf("interrupted: wrote partial plan %s (%d of %d commits, up to %s)", *outFile, len(items), len(commits), plan.Head[:7])
+	}
+	if err := savePlan(*outFile, plan); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s (%d translated messages)\n", *outFile, len(items))
+	return nil
+}
+
+// ============================
+// Scrub command
+// ============================
+
+// internalHostRe matches host names under suffixes only used on private
+// networks, and private IPv4 addresses.
+var internalHostRe = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+(?:internal|corp|local|lan|intranet|localdomain|home\.arpa)\b|\b(?:10\.\d{1,3}|192\.168|172\.(?:1[6-9]|2\d|3[01]))\.\d{1,3}\.\d{1,3}\b`)
+
+var redactMaskRe = regexp.MustCompile(`\[REDACTED:[a-z-]+\]`)
+
+// paraphraseSystemPrompt smooths over the masks. The model only ever sees
+// the redacted message.
+const paraphraseSystemPrompt = `You edit a Git commit message in which sensitive values were replaced by markers such as [REDACTED:internal-host].
+Rewrite only the sentences that contain a marker so they read naturally without the removed value, for example "the staging database host" instead of a marker.
+Do not guess or invent the removed values, and do not add any other information.
+Keep every other line, the subject format and any trailers exactly as they are.
+Return only the edited message, with no explanation and no code fences.`
+
+// scrubRules builds the rule list: credentials always, then internal host
+// names, the given domains and the user's own patterns.
+func scrubRules(hosts bool, domains, patterns []string) ([]redactRule, error) {
+	rules := slices.Clone(secretPatterns)
+	if hosts {
+		rules = append(rules, redactRule{"internal-host", internalHostRe})
+	}
+	for _, d := range domains {
+		d = strings.Trim(strings.TrimSpace(d), ".")
+		if d == "" {
+			continue
+		}
+		rules = append(rules, redactRule{"domain", regexp.MustCompile(`(?i)\b(?:[a-z0-9-]+\.)*` + regexp.QuoteMeta(d) + `\b`)})
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("--pattern %q: %w", p, err)
+		}
+		rules = append(rules, redactRule{"pattern", re})
+	}
+	return rules, nil
+}
+
+// readPatternFile reads one regular expression per line; blank lines and
+// lines starting with '#' are skipped.
+func readPatternFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, l := range splitLines(string(data)) {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+func cmdScrub(args []string) error {
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	limit := fs.Int("limit", 0, "number of commits from HEAD to scan (0: the whole history)")
+	rangeExpr := fs.String("range", "", "explicit git range (e.g., <base>..<head>)")
+	var patterns, domains []string
+	fs.Func("pattern", "also redact matches of this regular expression (repeatable)", func(v string) error {
+		patterns = append(patterns, v)
+		return nil
+	})
+	patternFile := fs.String("pattern-file", "", "read more regular expressions from this `file`, one per line")
+	fs.Func("domain", "also redact host names under this internal domain, e.g. corp.example.com (repeatable)", func(v string) error {
+		domains = append(domains, strings.Split(v, ",")...)
+		return nil
+	})
+	hosts := fs.Bool("internal-hosts", true, "redact host names under .internal, .corp, .local, .lan etc. and private IP addresses")
+	replacement := fs.String("replacement", "", "replace every match with this text (default: [REDACTED:<kind>])")
+	paraphrase := fs.Bool("paraphrase", false, "have the model reword sentences around each redaction so they read naturally (it only sees the redacted text)")
+	var af aiFlags
+	af.register(fs)
+	allowMerges := fs.Bool("allow-merges", false, "include merge commits (not recommended)")
+	outFile := fs.String("out", "plan.json", "output plan file (.json, or .yaml/.yml for YAML)")
+	timeout := fs.Duration("timeout", 25*time.Second, "per-commit AI timeout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *patternFile != "" {
+		more, err := readPatternFile(*patternFile)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, more...)
+	}
+	rules, err := scrubRules(*hosts, domains, patterns)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockRepo("scrub")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	shallow, err := prepareHistory(false, 0)
+	if err != nil {
+		return err
+	}
+	if *rangeExpr == "" && *limit <= 0 {
+		// Past the root, resolveRange falls back to it as the base.
+		n, err := git("rev-list", "--count", "HEAD")
+		if err != nil {
+			return err
+		}
+		*limit = mustAtoi(strings.TrimSpace(n))
+	}
+	base, head, headRef, err := resolveRange(rangeExpr, *limit, shallow)
+	if err != nil {
+		return err
+	}
+	commits, err := listCommits(*rangeExpr)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return errors.New("no commits in range")
+	}
+	if base != "" {
+		parents, _ := git("rev-list", "--parents", "-n", "1", base)
+		if len(strings.Fields(parents)) > 1 {
+			slog.Warn("older commits were not scanned and may still hold secrets; omit --limit and --range to scan the whole history", "commits", len(commits), "base", base[:7])
+		} else if old, err := git("log", "-1", "--format=%B", base); err == nil {
+			// The root commit is the base and apply cannot rewrite it, but
+			// what it says should not go unnoticed.
+			counts := map[string]int{}
+			if redact(old, rules, *replacement, counts); len(counts) > 0 {
+				slog.Warn("the root commit's message matches too, but apply cannot rewrite it; use `git rebase -i --root`", "sha", base[:7], "kinds", strings.Join(slices.Sorted(maps.Keys(counts)), ","))
+			}
+		}
+	}
+	var ai AIClient
+	if *paraphrase {
+		if ai, err = af.client(); err != nil {
+			return err
+		}
+	}
+
+	started := time.Now()
+	var items []PlanItem
+	total := map[string]int{}
+	changed := 0
+	for _, c := range commits {
+		if c.IsMerge && !*allowMerges {
+			slog.Info("skip merge commit", "sha", c.SHA[:7])
+			continue
+		}
+		out, err := git("log", "-1", "--format=%B", c.SHA)
+		if err != nil {
+			return err
+		}
+		old := strings.TrimRight(out, " \n")
+		counts := map[string]int{}
+		msg := redact(old, rules, *replacement, counts)
+		item := PlanItem{
+			SHA:         c.SHA,
+			OldMessage:  old,
+			NewMessage:  msg,
+			AuthorName:  c.AuthorName,
+			AuthorEmail: c.AuthorEmail,
+			AuthorDate:  c.AuthorDate.Format(time.RFC3339),
+		}
+		if m := revertBodyRe.FindStringSubmatch(old); m != nil && len(m[1]) == 40 {
+			item.Reverts = m[1]
+		}
+		if len(counts) > 0 {
+			changed++
+			var kinds []string
+			for _, k := range slices.Sorted(maps.Keys(counts)) {
+				total[k] += counts[k]
+				kinds = append(kinds, fmt.Sprintf("%s×%d", k, counts[k]))
+			}
+			fmt.Printf("%s  %s  (%s)\n", c.SHA[:7], truncate(c.Subject, 60), strings.Join(kinds, ", "))
+			if ai != nil && rootCtx.Err() == nil {
+				text, trailers := splitTrailerBlock(msg)
+				ctx, cancel := context.WithTimeout(rootCtx, *timeout)
+				txt, err := ai.Complete(withAIRequest(ctx, aiRequest{Kind: kindParaphrase}), af.model, paraphraseSystemPrompt, "Message:\n"+text)
+				cancel()
+				// The masks themselves can look like an assigned secret.
+				probe := redactMaskRe.ReplaceAllString(txt, "")
+				if *replacement != "" {
+					probe = strings.ReplaceAll(probe, *replacement, "")
+				}
+				again := map[string]int{}
+				redact(probe, rules, "", again)
+				switch {
+				case err != nil:
+					slog.Warn("paraphrasing failed; keeping the masked message", "sha", c.SHA[:7], "err", err)
+				case len(again) > 0:
+					// Never trust a rewrite that still matches a rule.
+					slog.Warn("paraphrase still matches a rule; keeping the masked message", "sha", c.SHA[:7])
+				default:
+					item.NewMessage = sanitizeMessage(txt)
+					if trailers != "" {
+						item.NewMessage = appendTrailers(item.NewMessage, splitLines(trailers)...)
+					}
+					item.Model = af.model
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	if rootCtx.Err() != nil {
+		return errors.New("interrupted; no plan was written")
+	}
+	if changed == 0 {
+		fmt.Printf("Nothing to scrub in %d commits.\n", len(commits))
+		return nil
+	}
+
+	top, _ := repoPath()
+	plan := Plan{
+		RepoPath:    top,
+		RepoID:      repoFingerprint(head),
 		Base:        base,
 		Head:        head,
+		HeadRef:     headRef,
 		CreatedAt:   time.Now().Format(time.RFC3339),
-		Model:       *model,
+		Scrub:       true,
+		ElapsedSec:  time.Since(started).Round(time.Millisecond).Seconds(),
 		AllowMerges: *allowMerges,
 		Items:       items,
 	}
-	data, _ := json.MarshalIndent(plan, "", "  ")
-	if err := os.WriteFile(*outFile, data, 0644); err != nil {
-		return err
+	if plan.Tags, err = rangeTags(items); err != nil {
+		return err
+	}
+	if *paraphrase {
+		plan.Model, plan.Provider, plan.GenParams = af.model, af.provider, af.gen
+	}
+	if u := apiUsage.snapshot(); u.Requests > 0 {
+		plan.Usage = &u
+	}
+	if err := savePlan(*outFile, plan); err != nil {
+		return err
+	}
+	var kinds []string
+	for _, k := range slices.Sorted(maps.Keys(total)) {
+		kinds = append(kinds, fmt.Sprintf("%d %s", total[k], k))
+	}
+	fmt.Printf("Wrote %s: %d of %d messages redacted (%s)\n", *outFile, changed, len(items), strings.Join(kinds, ", "))
+	return nil
+}
+
+// ============================
+// Multi-repository command
+// ============================
+
+// multiManifest lists the repositories multi runs over. Every key of a
+// repository entry other than path, name and branch is passed to plan as
+// the option of the same name, on top of defaults:
+//
+//	defaults:
+//	  limit: 50
+//	  model: gpt-5-nano
+//	repos:
+//	  - path: ../service-a
+//	    range: v1.0..main
+//	  - path: ../service-b
+//	    branch: hygiene/2026-10
+type multiManifest struct {
+	Defaults map[string]any   `json:"defaults"`
+	Repos    []map[string]any `json:"repos"`
+}
+
+// multiJob is one manifest entry, resolved.
+type multiJob struct {
+	Name, Path, Branch string
+	Plan, Log          string // files in --plans-dir
+	Args               []string
+}
+
+// multiResult is one row of the combined report.
+type multiResult struct {
+	Name        string   `json:"name"`
+	Path        string   `json:"path"`
+	Status      string   `json:"status"` // planned, applied, failed or skipped
+	Error       string   `json:"error,omitempty"`
+	Plan        string   `json:"plan,omitempty"`
+	Branch      string   `json:"branch,omitempty"`
+	Log         string   `json:"log"`
+	Items       int      `json:"items"`
+	Changed     int      `json:"changed"`
+	NeedsReview int      `json:"needs_review"`
+	Usage       Usage    `json:"usage"`
+	CostUSD     *float64 `json:"cost_usd,omitempty"`
+	ElapsedSec  float64  `json:"elapsed_seconds"`
+}
+
+func loadManifest(path, plansDir, branch string) ([]multiJob, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if isYAMLPath(path) {
+		if b, err = yamlToJSON(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	var m multiManifest
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(m.Repos) == 0 {
+		return nil, fmt.Errorf("%s: no repos listed", path)
+	}
+	// Paths are relative to the manifest, not to where multi runs.
+	dir := filepath.Dir(path)
+	seen := map[string]int{}
+	var jobs []multiJob
+	for i, r := range m.Repos {
+		opts := maps.Clone(m.Defaults)
+		if opts == nil {
+			opts = map[string]any{}
+		}
+		maps.Copy(opts, r)
+		p, _ := opts["path"].(string)
+		if p == "" {
+			return nil, fmt.Errorf("%s: repos[%d] has no path", path, i)
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		if p, err = filepath.Abs(p); err != nil {
+			return nil, err
+		}
+		job := multiJob{Path: p, Branch: branch}
+		job.Name, _ = opts["name"].(string)
+		if job.Name == "" {
+			job.Name = filepath.Base(job.Path)
+		}
+		if seen[job.Name]++; seen[job.Name] > 1 {
+			job.Name = fmt.Sprintf("%s-%d", job.Name, seen[job.Name])
+		}
+		if b, ok := opts["branch"].(string); ok {
+			job.Branch = b
+		}
+		for _, k := range []string{"path", "name", "branch", "out"} {
+			delete(opts, k)
+		}
+		for _, k := range slices.Sorted(maps.Keys(opts)) {
+			switch v := opts[k].(type) {
+			case map[string]any, []any:
+				return nil, fmt.Errorf("%s: %s: %s: expected a single value", path, job.Name, k)
+			case nil:
+			default:
+				job.Args = append(job.Args, fmt.Sprintf("--%s=%v", strings.ReplaceAll(k, "_", "-"), v))
+			}
+		}
+		job.Plan = filepath.Join(plansDir, job.Name+".json")
+		job.Log = filepath.Join(plansDir, job.Name+".log")
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// runMulti plans one repository, and applies the plan when asked, by
+// running this program in it. Separate processes keep repositories from
+// sharing the working directory and usage counters, so jobs can overlap.
+func runMulti(job multiJob, apply bool) multiResult {
+	res := multiResult{Name: job.Name, Path: job.Path, Log: job.Log, Status: "failed"}
+	started := time.Now()
+	defer func() { res.ElapsedSec = time.Since(started).Round(time.Millisecond).Seconds() }()
+	logf, err := os.Create(job.Log)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer logf.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	run := func(args ...string) error {
+		fmt.Fprintf(logf, "$ git-smartmsg %s\n", strings.Join(args, " "))
+		cmd := exec.Command(exe, append([]string{"-C", job.Path}, args...)...)
+		cmd.Stdout, cmd.Stderr = logf, logf
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s failed (%v); see %s", args[0], err, job.Log)
+		}
+		return nil
+	}
+	if err := run(append([]string{"plan", "--out", job.Plan}, job.Args...)...); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	plan, err := loadPlan(job.Plan)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	st := computeStats(plan, -1, -1)
+	res.Status, res.Plan = "planned", job.Plan
+	res.Items, res.Changed, res.NeedsReview, res.Usage, res.CostUSD = st.Items, st.Changed, st.NeedsReview, st.Usage, st.CostUSD
+	if apply {
+		// A temporary worktree leaves each repository's checkout alone.
+		if err := run("apply", "--in", job.Plan, "--branch", job.Branch, "--detached-worktree"); err != nil {
+			res.Status, res.Error = "failed", err.Error()
+			return res
+		}
+		res.Status, res.Branch = "applied", job.Branch
+	}
+	return res
+}
+
+func cmdMulti(args []string) error {
+	fs := flag.NewFlagSet("multi", flag.ExitOnError)
+	manifest := fs.String("manifest", "smartmsg-multi.yaml", "manifest listing the repositories (.yaml/.yml or .json)")
+	jobs := fs.Int("jobs", 1, "repositories to process at the same time")
+	apply := fs.Bool("apply", false, "also apply each plan to a new branch (in a temporary worktree)")
+	branch := fs.String("branch", "", "branch that --apply creates in each repository (a repo's own branch key wins)")
+	plansDir := fs.String("plans-dir", "smartmsg-plans", "directory for each repository's plan and log")
+	report := fs.String("report", "", "also write the combined report as JSON to this file")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		*manifest = fs.Arg(0)
+	}
+	if *jobs < 1 {
+		return errors.New("--jobs must be at least 1")
+	}
+	dir, err := filepath.Abs(*plansDir)
+	if err != nil {
+		return err
+	}
+	list, err := loadManifest(*manifest, dir, *branch)
+	if err != nil {
+		return err
+	}
+	if *apply {
+		for _, j := range list {
+			if j.Branch == "" {
+				return fmt.Errorf("--apply needs --branch, or a branch for %s in the manifest", j.Name)
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	results := make([]multiResult, len(list))
+	sem := make(chan struct{}, *jobs)
+	var wg sync.WaitGroup
+	for i, j := range list {
+		sem <- struct{}{}
+		if rootCtx.Err() != nil {
+			// Running jobs got the signal too and stop on their own.
+			results[i] = multiResult{Name: j.Name, Path: j.Path, Status: "skipped", Error: "interrupted"}
+			<-sem
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			slog.Info("start", "repo", j.Name)
+			results[i] = runMulti(j, *apply)
+			r := results[i]
+			if r.Status == "failed" {
+				slog.Warn("failed", "repo", j.Name, "err", r.Error)
+			} else {
+				slog.Info(r.Status, "repo", j.Name, "items", r.Items, "changed", r.Changed, "needs_review", r.NeedsReview)
+			}
+		}()
+	}
+	wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tSTATUS\tCHANGED\tREVIEW\tREQUESTS\tCOST\tOUTPUT")
+	var total multiResult
+	var cost float64
+	costKnown := true
+	failed := 0
+	for _, r := range results {
+		out := r.Plan
+		if r.Branch != "" {
+			out = r.Branch
+		}
+		if r.Error != "" {
+			out = r.Error
+			failed++
+		}
+		c := "-"
+		if r.CostUSD != nil {
+			c = fmt.Sprintf("$%.4f", *r.CostUSD)
+			cost += *r.CostUSD
+		} else if r.Usage.Requests > 0 {
+			costKnown = false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%d\t%d\t%s\t%s\n", r.Name, r.Status, r.Changed, r.Items, r.NeedsReview, r.Usage.Requests, c, out)
+		total.Items += r.Items
+		total.Changed += r.Changed
+		total.NeedsReview += r.NeedsReview
+		total.Usage.Requests += r.Usage.Requests
+		total.Usage.PromptTokens += r.Usage.PromptTokens
+		total.Usage.CompletionTokens += r.Usage.CompletionTokens
+	}
+	c := fmt.Sprintf("$%.4f", cost)
+	if !costKnown {
+		c += "+"
+	}
+	fmt.Fprintf(w, "TOTAL\t%d failed\t%d/%d\t%d\t%d\t%s\t\n", failed, total.Changed, total.Items, total.NeedsReview, total.Usage.Requests, c)
+	w.Flush()
+
+	if *report != "" {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		if err := os.WriteFile(*report, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repositories failed", failed, len(results))
+	}
+	return nil
+}
+
+// ============================
+// CI command (pull request review)
+// ============================
+
+// ciMarker tags the review so later runs update it instead of piling up a
+// new one per push.
+const ciMarker = "<!-- git-smartmsg:ci -->"
+
+// ciEvent is the part of the GitHub Actions pull_request event payload that
+// ci reads.
+type ciEvent struct {
+	PullRequest struct {
+		Number int `json:"number"`
+		Base   struct {
+			SHA string `json:"sha"`
+		} `json:"base"`
+		Head struct {
+			SHA string `json:"sha"`
+		} `json:"head"`
+	} `json:"pull_request"`
+}
+
+type ciFinding struct {
+	SHA        string
+	Old        string
+	Suggested  string
+	Violations []string // policy violations of the current message
+}
+
+func cmdCI(args []string) error {
+	fs := flag.NewFlagSet("ci", flag.ExitOnError)
+	rangeExpr := fs.String("range", "", "commit range to review (default: base..head of the pull request event)")
+	pr := fs.Int("pr", 0, "pull request number (default: from $GITHUB_EVENT_PATH)")
+	repo := fs.String("github-repo", os.Getenv("GITHUB_REPOSITORY"), "owner/name of the repository to comment on")
+	var af aiFlags
+	af.register(fs)
+	var lr lengthRules
+	lr.register(fs)
+	emoji := fs.Bool("emoji", false, "use emoji style commit messages")
+	limit := fs.Int("limit", 50, "review at most this many commits (the newest)")
+	timeout := fs.Duration("timeout", 25*time.Second, "per-commit AI timeout")
+	failOnPolicy := fs.Bool("fail-on-policy", false, "exit non-zero if a commit message violates .smartmsg-policy.yaml")
+	dryRun := fs.Bool("dry-run", false, "print the review instead of posting it")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if path := os.Getenv("GITHUB_EVENT_PATH"); path != "" && (*rangeExpr == "" || *pr == 0) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var ev ciEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		if ev.PullRequest.Number == 0 {
+			return errors.New("the workflow event is not a pull request; run ci on pull_request events or pass --range and --pr")
+		}
+		if *rangeExpr == "" {
+			*rangeExpr = ev.PullRequest.Base.SHA + ".." + ev.PullRequest.Head.SHA
+		}
+		if *pr == 0 {
+			*pr = ev.PullRequest.Number
+		}
+	}
+	if *rangeExpr == "" {
+		return errors.New("no pull request event found; pass --range")
+	}
+	if !*dryRun {
+		if *pr == 0 || *repo == "" {
+			return errors.New("posting needs --pr and --github-repo (set automatically in GitHub Actions), or use --dry-run")
+		}
+		if os.Getenv("GITHUB_TOKEN") == "" {
+			return errors.New("GITHUB_TOKEN is not set; pass it to the step (env: GITHUB_TOKEN: ${{ secrets.GITHUB_TOKEN }})")
+		}
+	}
+
+	commits, err := listCommits(*rangeExpr)
+	if err != nil {
+		return fmt.Errorf("%w (actions/checkout needs fetch-depth: 0 for the PR's history)", err)
+	}
+	if len(commits) > *limit {
+		commits = commits[len(commits)-*limit:]
+	}
+	ai, err := af.client()
+	if err != nil {
+		return err
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	lr = lr.withPolicy(policy)
+	if *failOnPolicy && policy == nil {
+		slog.Warn("--fail-on-policy: no policy file in the repository; nothing to enforce", "file", policyFiles[0])
+	}
+
+	var findings []ciFinding
+	violations := 0
+	for _, c := range commits {
+		if rootCtx.Err() != nil {
+			return rootCtx.Err()
+		}
+		if c.IsMerge {
+			continue
+		}
+		old, err := git("log", "-1", "--format=%B", c.SHA)
+		if err != nil {
+			return err
+		}
+		old = strings.TrimSpace(old)
+		f := ciFinding{SHA: c.SHA, Old: old}
+		if policy != nil {
+			f.Violations = policy.check(old)
+			violations += len(f.Violations)
+		}
+		diff, err := showDiff(c.SHA, false)
+		if err != nil {
+			return err
+		}
+		req := suggestRequest{Model: af.model, Diff: diff, OldMsg: old, Emoji: *emoji}
+		if policy != nil {
+			req.Context = policy.instructions()
+		}
+		ctx, cancel := context.WithTimeout(rootCtx, *timeout)
+		sg, err := suggest(ctx, ai, req)
+		cancel()
+		if err != nil {
+			slog.Warn("skip commit", "sha", c.SHA[:7], "err", err)
+		} else if msg := lr.apply(sanitizeMessage(sg.Message)); firstLine(msg) != firstLine(old) {
+			if policy != nil {
+				msg = policy.carryTrailers(msg, old)
+			}
+			f.Suggested = msg
+		}
+		if f.Suggested != "" || len(f.Violations) > 0 {
+			findings = append(findings, f)
+		}
+	}
+
+	body := ciReviewBody(findings, len(commits), policy)
+	if *dryRun {
+		fmt.Println(body)
+	} else if err := postReview(rootCtx, *repo, *pr, body); err != nil {
+		return err
+	}
+	if *failOnPolicy && violations > 0 {
+		return fmt.Errorf("%d policy violation(s) in commit messages; see the review", violations)
+	}
+	return nil
+}
+
+// ciReviewBody renders the findings as the Markdown review text.
+func ciReviewBody(findings []ciFinding, total int, policy *Policy) string {
+	var sb strings.Builder
+	sb.WriteString(ciMarker + "\n### Commit message suggestions\n\n")
+	if len(findings) == 0 {
+		fmt.Fprintf(&sb, "All %d commit message(s) look good. 👍\n", total)
+		return sb.String()
+	}
+	fmt.Fprintf(&sb, "%d of %d commit(s) could use a better message.\n", len(findings), total)
+	for _, f := range findings {
+		fmt.Fprintf(&sb, "\n#### %s `%s`\n", f.SHA[:7], strings.ReplaceAll(firstLine(f.Old), "`", "'"))
+		if len(f.Violations) > 0 {
+			fmt.Fprintf(&sb, "\n⛔ Violates `%s`:\n", filepath.Base(policy.path))
+			for _, v := range f.Violations {
+				fmt.Fprintf(&sb, "- %s\n", v)
+			}
+		}
+		if f.Suggested != "" {
+			fmt.Fprintf(&sb, "\nSuggested:\n```text\n%s\n```\n", f.Suggested)
+		}
+	}
+	sb.WriteString("\n<sub>Rewrite locally with `git-smartmsg plan` and `git-smartmsg apply`.</sub>\n")
+	return sb.String()
+}
+
+// postReview creates the pull request review, or edits the one an earlier
+// run left.
+func postReview(ctx context.Context, repo string, pr int, body string) error {
+	base := fmt.Sprintf("%s/repos/%s/pulls/%d/reviews", strings.TrimRight(envOr("GITHUB_API_URL", "https://api.github.com"), "/"), repo, pr)
+	call := func(method, endpoint string, in, out any) error {
+		var rd io.Reader
+		if in != nil {
+			data, _ := json.Marshal(in)
+			rd = bytes.NewReader(data)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, rd)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("Authorization", "Bearer "+os.Getenv("GITHUB_TOKEN"))
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("%s %s: HTTP %d: %s", method, endpoint, resp.StatusCode, strings.TrimSpace(string(msg)))
+		}
+		if out != nil {
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+		return nil
+	}
+
+	var reviews []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}
+	if err := call(http.MethodGet, base+"?per_page=100", nil, &reviews); err != nil {
+		return err
+	}
+	for _, r := range reviews {
+		if strings.Contains(r.Body, ciMarker) {
+			return call(http.MethodPut, fmt.Sprintf("%s/%d", base, r.ID), map[string]string{"body": body}, nil)
+		}
+	}
+	return call(http.MethodPost, base, map[string]string{"body": body, "event": "COMMENT"}, nil)
+}
+
+// ============================
+// Notifications
+// ============================
+
+// runSummary is what --notify-url receives as JSON, and what the Slack
+// message is written from, when plan or apply ends.
+type runSummary struct {
+	Command     string   `json:"command"`
+	Repo        string   `json:"repo"`
+	Status      string   `json:"status"` // ok, interrupted or failed
+	Error       string   `json:"error,omitempty"`
+	Commits     int      `json:"commits"`   // commits in the range or plan
+	Processed   int      `json:"processed"` // planned or rewritten by this run
+	NeedsReview int      `json:"needs_review"`
+	Failed      int      `json:"failed"`           // items without a generated message
+	Output      string   `json:"output,omitempty"` // plan file or branch
+	Usage       *Usage   `json:"usage,omitempty"`
+	CostUSD     *float64 `json:"cost_usd,omitempty"`
+	ElapsedSec  float64  `json:"elapsed_seconds"`
+}
+
+// notifier posts a runSummary when the command finishes or fails. The
+// command fills in summary as it goes; main sends it.
+type notifier struct {
+	url, slack string
+	started    time.Time
+	summary    runSummary
+}
+
+// notify is the notifier of the running command, nil for commands without
+// the options.
+var notify *notifier
+
+func (n *notifier) register(fs *flag.FlagSet) {
+	fs.StringVar(&n.url, "notify-url", os.Getenv("SMARTMSG_NOTIFY_URL"), "POST a JSON summary to this webhook when the command finishes or fails")
+	fs.StringVar(&n.slack, "notify-slack", os.Getenv("SMARTMSG_NOTIFY_SLACK"), "post a summary to this Slack incoming-webhook URL when the command finishes or fails")
+	n.started = time.Now()
+	notify = n
+}
+
+// send reports how the command ended. Delivery problems are only logged:
+// the command's own result is what matters.
+func (n *notifier) send(command string, runErr error) {
+	if n == nil || n.url == "" && n.slack == "" {
+		return
+	}
+	s := n.summary
+	s.Command = command
+	s.Repo, _ = repoPath()
+	s.Status = "ok"
+	if runErr != nil {
+		s.Status, s.Error = "failed", runErr.Error()
+		if rootCtx.Err() != nil {
+			s.Status = "interrupted"
+		}
+	}
+	if u := apiUsage.snapshot(); u.Requests > 0 {
+		s.Usage = &u
+	}
+	s.ElapsedSec = time.Since(n.started).Round(time.Second).Seconds()
+
+	// The run may have been interrupted, so rootCtx is not used here.
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if n.url != "" {
+		if err := postWebhook(ctx, n.url, s); err != nil {
+			slog.Warn("notification failed", "to", "notify-url", "err", err)
+		}
+	}
+	if n.slack != "" {
+		if err := postWebhook(ctx, n.slack, map[string]string{"text": slackSummary(s)}); err != nil {
+			slog.Warn("notification failed", "to", "notify-slack", "err", err)
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// slackSummary renders s as one short Slack message.
+func slackSummary(s runSummary) string {
+	esc := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+	icon := map[string]string{"ok": "✅", "interrupted": "⏸️", "failed": "❌"}[s.Status]
+	outcome := map[string]string{"ok": "finished", "interrupted": "was interrupted", "failed": "failed"}[s.Status]
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s git-smartmsg %s %s in `%s`", icon, s.Command, outcome, esc(filepath.Base(s.Repo)))
+	fmt.Fprintf(&sb, "\n%d of %d commits processed", s.Processed, s.Commits)
+	if s.NeedsReview > 0 {
+		fmt.Fprintf(&sb, ", %d need review", s.NeedsReview)
+	}
+	if s.Failed > 0 {
+		fmt.Fprintf(&sb, ", %d failed", s.Failed)
+	}
+	if s.Usage != nil {
+		fmt.Fprintf(&sb, ", %d API requests", s.Usage.Requests)
+	}
+	if s.CostUSD != nil {
+		fmt.Fprintf(&sb, ", ~$%.4f", *s.CostUSD)
+	}
+	fmt.Fprintf(&sb, ", %s", time.Duration(s.ElapsedSec*float64(time.Second)))
+	if s.Output != "" {
+		fmt.Fprintf(&sb, "\nOutput: `%s`", esc(s.Output))
+	}
+	if s.Error != "" {
+		fmt.Fprintf(&sb, "\n```%s```", esc(s.Error))
+	}
+	return sb.String()
+}
+
+// ============================
+// Serve command (editor integration)
+// ============================
+
+// server answers requests from editor plugins with the options serve was
+// started with, the same work as commit, a policy check and plan, with
+// JSON results instead of terminal output. Requests are handled one at a
+// time, since they share the repository and plan runs in-process.
+type server struct {
+	mu       sync.Mutex
+	ai       AIClient
+	model    string
+	lr       lengthRules
+	emoji    bool
+	timeout  time.Duration
+	planArgs []string // serve's options that plan takes too
+}
+
+var (
+	errServeMethod = errors.New("unknown method")
+	errServeParams = errors.New("invalid params")
+)
+
+type serveSuggestParams struct {
+	Diff       string `json:"diff,omitempty"` // default: the staged changes
+	OldMessage string `json:"old_message,omitempty"`
+	Emoji      *bool  `json:"emoji,omitempty"`
+}
+
+type serveSuggestResult struct {
+	Message    string   `json:"message"`
+	Confidence *float64 `json:"confidence,omitempty"`
+	AI         bool     `json:"ai"` // false for renames and reformats, written without the model
+	Violations []string `json:"violations,omitempty"`
+	Unverified []string `json:"unverified,omitempty"`
+}
+
+type serveLintParams struct {
+	Message string `json:"message"`
+	Diff    string `json:"diff,omitempty"` // also check what the message mentions against it
+}
+
+type serveLintResult struct {
+	OK         bool     `json:"ok"`
+	Policy     string   `json:"policy,omitempty"`
+	Violations []string `json:"violations,omitempty"`
+	Unverified []string `json:"unverified,omitempty"`
+}
+
+type servePlanParams struct {
+	Range string `json:"range,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+type servePlanResult struct {
+	Plan Plan `json:"plan"`
+	// Error is set when plan wrote the plan but failed anyway, e.g. for
+	// failed items or policy violations.
+	Error string `json:"error,omitempty"`
+}
+
+// call runs one method with its JSON params.
+func (s *server) call(method string, params json.RawMessage) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	decode := func(v any) error {
+		if len(params) == 0 || string(params) == "null" {
+			return nil
+		}
+		dec := json.NewDecoder(bytes.NewReader(params))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(v); err != nil {
+			return fmt.Errorf("%w: %v", errServeParams, err)
+		}
+		return nil
+	}
+	switch method {
+	case "suggest":
+		var p serveSuggestParams
+		if err := decode(&p); err != nil {
+			return nil, err
+		}
+		return s.suggest(p)
+	case "lint":
+		var p serveLintParams
+		if err := decode(&p); err != nil {
+			return nil, err
+		}
+		return s.lint(p)
+	case "plan":
+		var p servePlanParams
+		if err := decode(&p); err != nil {
+			return nil, err
+		}
+		return s.plan(p)
+	}
+	return nil, fmt.Errorf("%w %q (expected suggest, lint or plan)", errServeMethod, method)
+}
+
+// suggest writes a message for a diff, the staged changes by default,
+// as commit does.
+func (s *server) suggest(p serveSuggestParams) (serveSuggestResult, error) {
+	var res serveSuggestResult
+	diff, spaceOnly := promptDiff(p.Diff), false
+	if p.Diff == "" {
+		var err error
+		if diff, err = getStagedDiff(false); err != nil {
+			return res, err
+		}
+		if strings.TrimSpace(diff) == "" {
+			return res, errors.New("no staged changes")
+		}
+		_, err = git("diff", "--cached", "--quiet", "-w", "--ignore-blank-lines")
+		spaceOnly = err == nil
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		return res, err
+	}
+	lr := s.lr.withPolicy(policy)
+	emoji := s.emoji
+	if p.Emoji != nil {
+		emoji = *p.Emoji
+	}
+	if msg := trivialMessage(diff, spaceOnly, emoji); msg != "" && policy.ruleBased(msg) {
+		res.Message = lr.apply(msg)
+	} else {
+		req := suggestRequest{Model: s.model, Diff: diff, OldMsg: p.OldMessage, Emoji: emoji, Confidence: true}
+		if policy != nil {
+			req.Context = policy.instructions()
+		}
+		ctx, cancel := context.WithTimeout(rootCtx, s.timeout)
+		sg, err := suggest(ctx, s.ai, req)
+		cancel()
+		if err != nil {
+			return res, fmt.Errorf("AI failed to generate message: %w", err)
+		}
+		res.Message, res.Confidence, res.AI = lr.apply(sanitizeMessage(sg.Message)), sg.Confidence, true
+		res.Message = keepChangeID(res.Message, p.OldMessage)
+		if policy != nil {
+			res.Message = policy.carryTrailers(res.Message, p.OldMessage)
+		}
+	}
+	if policy != nil {
+		res.Violations = policy.check(res.Message)
+	}
+	res.Unverified, _ = unverifiedClaims(res.Message, diff, p.OldMessage)
+	return res, nil
+}
+
+// lint checks a message against the repository's commit policy and, given
+// a diff, what it mentions against the diff.
+func (s *server) lint(p serveLintParams) (serveLintResult, error) {
+	var res serveLintResult
+	msg := strings.TrimSpace(stripComments(p.Message))
+	if msg == "" {
+		return res, fmt.Errorf("%w: empty message", errServeParams)
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		return res, err
+	}
+	if policy != nil {
+		res.Policy, res.Violations = policy.path, policy.check(msg)
+	}
+	if p.Diff != "" {
+		res.Unverified, _ = unverifiedClaims(msg, promptDiff(p.Diff), "")
+	}
+	res.OK = len(res.Violations) == 0 && len(res.Unverified) == 0
+	return res, nil
+}
+
+// plan runs the plan command on a temporary file and returns the plan.
+func (s *server) plan(p servePlanParams) (servePlanResult, error) {
+	var res servePlanResult
+	f, err := os.CreateTemp("", "smartmsg-serve-*.json")
+	if err != nil {
+		return res, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	args := append(slices.Clone(s.planArgs), "--out", f.Name())
+	if p.Range != "" {
+		args = append(args, "--range", p.Range)
+	}
+	if p.Limit > 0 {
+		args = append(args, "--limit", strconv.Itoa(p.Limit))
+	}
+	apiUsage.reset() // the plan reports its own requests only
+	runErr := cmdPlan(args)
+	notify = nil // plan's, not serve's
+	plan, err := loadPlan(f.Name())
+	if err != nil {
+		return res, cmp.Or(runErr, err)
+	}
+	res.Plan = plan
+	if runErr != nil {
+		res.Error = runErr.Error()
+	}
+	return res, nil
+}
+
+// serveMaxBody caps a request body; diffs far larger than a model takes
+// are cut anyway.
+const serveMaxBody = 16 << 20
+
+// serveHTTP answers POST /<method> with the params as the JSON body, and
+// GET /health. A web page can reach a local port through DNS rebinding, as
+// if it were same-origin, and --listen may expose the port beyond this
+// machine, so every request must name a loopback host, and methods need
+// the bearer token made for this run. The token is printed at startup and
+// written to smartmsg-serve.token in the git directory for plugins to read.
+func (s *server) serveHTTP(addr string) error {
+	token, err := serveToken()
+	if err != nil {
+		return err
+	}
+	tokenPath, err := git("rev-parse", "--git-path", "smartmsg-serve.token")
+	if err != nil {
+		return err
+	}
+	if tokenPath, err = filepath.Abs(strings.TrimSpace(tokenPath)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(tokenPath)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"ok":true}`)
+	})
+	mux.HandleFunc("POST /{method}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		reply := func(code int, v any) {
+			w.WriteHeader(code)
+			_ = json.NewEncoder(w).Encode(v)
+		}
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth)), []byte(token)) != 1 {
+			reply(http.StatusUnauthorized, map[string]string{"error": "missing or wrong token; see " + tokenPath})
+			return
+		}
+		if ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(ct) != "application/json" {
+			reply(http.StatusUnsupportedMediaType, map[string]string{"error": "Content-Type must be application/json"})
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, serveMaxBody))
+		if err != nil {
+			code := http.StatusBadRequest
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				code = http.StatusRequestEntityTooLarge
+			}
+			reply(code, map[string]string{"error": err.Error()})
+			return
+		}
+		res, err := s.call(r.PathValue("method"), body)
+		switch {
+		case errors.Is(err, errServeMethod):
+			reply(http.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, errServeParams):
+			reply(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case err != nil:
+			reply(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			reply(http.StatusOK, res)
+		}
+	})
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if host, _, _ := net.SplitHostPort(ln.Addr().String()); !loopbackHost(host) {
+		slog.Warn("serve is reachable from other machines; anyone with the token can spend your API key", "listen", ln.Addr().String())
+	}
+	srv := &http.Server{Handler: loopbackOnly(mux)}
+	context.AfterFunc(rootCtx, func() { _ = srv.Close() })
+	fmt.Fprintf(os.Stderr, "Listening on http://%s\n", ln.Addr())
+	fmt.Fprintf(os.Stderr, "Token: %s (also in %s)\n", token, tokenPath)
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// serveToken makes a random bearer token for one serve run.
+func serveToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// loopbackHost reports whether host, a name or an IP, is this machine.
+func loopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loopbackOnly refuses requests whose Host header is not a loopback name or
+// address, as a page served from a rebound DNS name would send.
+func loopbackOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !loopbackHost(host) {
+			http.Error(w, `{"error":"Host must be localhost or a loopback address"}`, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// rpcMessage is a JSON-RPC 2.0 request or response.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// serveStdio speaks JSON-RPC 2.0 on stdin and stdout, one message per
+// line, until stdin is closed. Requests without an id (notifications) get
+// no response.
+func (s *server) serveStdio() error {
+	out := json.NewEncoder(os.Stdout)
+	// Stray output would corrupt the stream; plan prints its progress.
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+	in := json.NewDecoder(os.Stdin)
+	for rootCtx.Err() == nil {
+		var req rpcMessage
+		if err := in.Decode(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			_ = out.Encode(rpcMessage{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: -32700, Message: err.Error()}})
+			return err
+		}
+		res, err := s.call(req.Method, req.Params)
+		if req.ID == nil {
+			continue
+		}
+		resp := rpcMessage{JSONRPC: "2.0", ID: req.ID, Result: res}
+		if err != nil {
+			code := -32000
+			switch {
+			case errors.Is(err, errServeMethod):
+				code = -32601
+			case errors.Is(err, errServeParams):
+				code = -32602
+			}
+			resp.Result, resp.Error = nil, &rpcError{Code: code, Message: err.Error()}
+		}
+		if err := out.Encode(resp); err != nil {
+			return err
+		}
+	}
+	return rootCtx.Err()
+}
+
+func cmdServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:7878", "HTTP `address` to listen on")
+	stdio := fs.Bool("stdio", false, "speak JSON-RPC 2.0 on stdin/stdout instead of HTTP")
+	var af aiFlags
+	af.register(fs)
+	var lr lengthRules
+	lr.register(fs)
+	emoji := fs.Bool("emoji", false, "use emoji style commit messages")
+	timeout := fs.Duration("timeout", 25*time.Second, "AI timeout per suggestion")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	ai, err := af.client()
+	if err != nil {
+		return err
+	}
+	s := &server{ai: ai, model: af.model, lr: lr, emoji: *emoji, timeout: *timeout}
+	// plan reads the config files itself; only the command line is passed
+	// on, checked here so a value plan rejects fails serve, not a request.
+	planFlags := commandFlags(subcommand{name: "plan", run: cmdPlan})
+	for _, a := range commandLineFlags(fs, args) {
+		if planFlags.Lookup(a.name) != nil {
+			s.planArgs = append(s.planArgs, "--"+a.name+"="+a.value)
+		}
+	}
+	planFlags.Init("plan", flag.ContinueOnError)
+	planFlags.SetOutput(io.Discard)
+	if err := planFlags.Parse(s.planArgs); err != nil {
+		return fmt.Errorf("options passed on to plan: %w", err)
+	}
+	if *stdio {
+		return s.serveStdio()
+	}
+	return s.serveHTTP(*listen)
+}
+
+// flagArg is one option as given on the command line.
+type flagArg struct{ name, value string }
+
+// flagRecorder stands in for a flag to record the values it is set to.
+type flagRecorder struct {
+	name    string
+	boolean bool
+	args    *[]flagArg
+}
+
+func (r flagRecorder) String() string   { return "" }
+func (r flagRecorder) IsBoolFlag() bool { return r.boolean }
+
+func (r flagRecorder) Set(v string) error {
+	*r.args = append(*r.args, flagArg{r.name, v})
+	return nil
+}
+
+// commandLineFlags lists the options args sets among fs's flags, in order
+// and with repeats, as given rather than as the flags print their values:
+// fs.Func flags print nothing and repeatable ones only their last value.
+// args must already have been parsed by fs.
+func commandLineFlags(fs *flag.FlagSet, args []string) []flagArg {
+	var out []flagArg
+	rec := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	rec.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+		rec.Var(flagRecorder{name: f.Name, boolean: ok && bf.IsBoolFlag(), args: &out}, f.Name, "")
+	})
+	_ = rec.Parse(args)
+	return out
+}
+
+// ============================
+// Init command (first-run setup)
+// ============================
+
+// providerChoice is one provider init offers, with whether its
+// credentials were found.
+type providerChoice struct {
+	name     string // value of --provider
+	label    string
+	found    bool
+	detail   string   // where the credentials came from, or what is missing
+	models   []string // known models (Ollama), the first is the default
+	ollamaV1 string   // OpenAI-compatible endpoint of a local Ollama
+}
+
+// detectProviders looks for credentials in the environment, the way each
+// client reads them, and for an Ollama server on this machine. Nothing is
+// sent to a hosted provider.
+func detectProviders() []providerChoice {
+	env := func(names ...string) string {
+		for _, n := range names {
+			if strings.TrimSpace(os.Getenv(n)) != "" {
+				return n
+			}
+		}
+		return ""
+	}
+	var out []providerChoice
+	c := providerChoice{name: "openai", label: "OpenAI", detail: "OPENAI_API_KEY is not set"}
+	if env("OPENAI_API_KEY") != "" {
+		c.found, c.detail = true, "OPENAI_API_KEY"
+		if base := os.Getenv("OPENAI_API_BASE"); base != "" {
+			c.detail += ", OPENAI_API_BASE=" + base
+		}
+	}
+	out = append(out, c)
+
+	c = providerChoice{name: "azure", label: "Azure OpenAI", detail: "AZURE_OPENAI_ENDPOINT is not set"}
+	if env("AZURE_OPENAI_ENDPOINT") != "" {
+		c.found, c.detail = true, "AZURE_OPENAI_ENDPOINT"
+		if k := env("AZURE_OPENAI_API_KEY", "AZURE_OPENAI_AD_TOKEN"); k != "" {
+			c.detail += ", " + k
+		} else {
+			c.detail += ", Entra ID token from the Azure CLI"
+		}
+	}
+	out = append(out, c)
+
+	c = providerChoice{name: "gemini", label: "Google Gemini", detail: "GOOGLE_API_KEY or GEMINI_API_KEY is not set"}
+	if k := env("GOOGLE_API_KEY", "GEMINI_API_KEY"); k != "" {
+		c.found, c.detail = true, k
+	}
+	out = append(out, c)
+
+	c = providerChoice{name: "bedrock", label: "AWS Bedrock", detail: "no AWS region and credentials found"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if cfg, err := loadAWSConfig(ctx); err != nil {
+		c.detail = err.Error()
+	} else if creds, err := cfg.Credentials.Retrieve(ctx); err == nil {
+		c.found, c.detail = true, creds.Source+", region "+cfg.Region
+	}
+	cancel()
+	out = append(out, c)
+
+	c = providerChoice{name: "openai", label: "Ollama (local)", detail: "no Ollama server answered"}
+	host := envOr("OLLAMA_HOST", "127.0.0.1:11434")
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	host = strings.TrimRight(host, "/")
+	if models, err := ollamaModels(host); err == nil {
+		c.found, c.models, c.ollamaV1 = true, models, host+"/v1"
+		c.detail = fmt.Sprintf("%s, %d model(s)", host, len(models))
+	}
+	out = append(out, c)
+
+	return append(out, providerChoice{name: "mock", label: "Mock", found: true, detail: "no AI, canned messages for trying things out"})
+}
+
+// pointsAt reports whether OPENAI_API_BASE sends requests to the endpoint
+// v1, treating localhost and the loopback addresses as the same host.
+func pointsAt(v1 string) bool {
+	base, err := url.Parse(strings.TrimSpace(os.Getenv("OPENAI_API_BASE")))
+	want, err2 := url.Parse(v1)
+	if err != nil || err2 != nil || base.Host == "" {
+		return false
+	}
+	loopback := func(h string) bool {
+		ip := net.ParseIP(h)
+		return h == "localhost" || ip != nil && ip.IsLoopback()
+	}
+	sameHost := base.Hostname() == want.Hostname() || loopback(base.Hostname()) && loopback(want.Hostname())
+	return sameHost && base.Scheme == want.Scheme && base.Port() == want.Port() &&
+		strings.TrimRight(base.Path, "/") == strings.TrimRight(want.Path, "/")
+}
+
+// ollamaModels lists the models pulled into the Ollama server at host.
+func ollamaModels(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(rootCtx, time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, host+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama: %s", resp.Status)
+	}
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, err
 	}
-	fmt.Printf("Wrote %s (%d messages)\n", *outFile, len(items))
-	return nil
+	var names []string
+	for _, m := range tags.Models {
+		names = append(names, m.Name)
+	}
+	return names, nil
 }
 
-func sanitizeMessage(s string) string {
-	// 先頭行の長さを72字程度に抑える（切り捨てはしない、整形のみ）
-	lines := splitLines(s)
-	if len(lines) == 0 {
-		return "chore: update"
+// askChoice asks for a number between 1 and n; an empty answer, or the
+// end of input, picks def.
+func askChoice(prompt string, n, def int) int {
+	for {
+		answer, ok := readAnswer(fmt.Sprintf("%s [%d]: ", prompt, def))
+		if !ok || answer == "" {
+			return def
+		}
+		if i, err := strconv.Atoi(answer); err == nil && i >= 1 && i <= n {
+			return i
+		}
+		fmt.Printf("Please enter a number from 1 to %d.\n", n)
 	}
-	first := strings.TrimSpace(lines[0])
-	first = regexp.MustCompile(`^\[(feat|fix|docs|style|refactor|perf|test|chore)\]\s*:`).ReplaceAllString(first, "$1:")
-	rest := strings.Join(lines[1:], "\n")
-	first = strings.Trim(first, "# ")
-	msg := first
-	if strings.TrimSpace(rest) != "" {
-		msg += "\n\n" + strings.TrimSpace(rest)
+}
+
+// askString asks for a line of text, def if left empty.
+func askString(prompt, def string) string {
+	answer, ok := readAnswer(fmt.Sprintf("%s [%s]: ", prompt, def))
+	if !ok || answer == "" {
+		return def
 	}
-	return msg
+	return answer
 }
 
-func splitLines(s string) []string {
-	return regexp.MustCompile(`\r?\n`).Split(s, -1)
+// hookMarker identifies the prepare-commit-msg hook init installs, so it
+// can be replaced by a later init but a hand-written one is never touched.
+const hookMarker = "# installed by git-smartmsg init"
+
+// prepareCommitMsgHook returns the hook script. It only fills in messages
+// for a plain `git commit` (no -m, -F, merge, squash or amend), keeps git's
+// comment block (and the diff of `commit -v`) below the suggestion, and
+// leaves the message alone whenever the suggestion fails.
+func prepareCommitMsgHook(exe string) string {
+	return `#!/bin/sh
+` + hookMarker + `
+case "$2" in
+"" | template) ;;
+*) exit 0 ;;
+esac
+msg=$1
+tmp="$msg.smartmsg"
+sed -e '/^#/,$d' "$msg" |
+	` + shellQuote(exe) + ` rewrite-msg --staged --keep-on-error >"$tmp" &&
+	{ echo; sed -n '/^#/,$p' "$msg"; } >>"$tmp" &&
+	mv "$tmp" "$msg"
+rm -f "$tmp"
+exit 0
+`
 }
 
-func envOr(k, def string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
+// installHook writes the prepare-commit-msg hook, declining to replace a
+// hook that init did not write.
+func installHook() (string, error) {
+	path, err := hookPath("prepare-commit-msg")
+	if err != nil {
+		return "", err
 	}
-	return def
+	if b, err := os.ReadFile(path); err == nil && !strings.Contains(string(b), hookMarker) {
+		return path, fmt.Errorf("%s already exists and was not written by git-smartmsg; leaving it alone", path)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, []byte(prepareCommitMsgHook(exe)), 0755)
 }
 
-// ============================
-// Apply command (linear history only)
-// ============================
+// cmdInit walks a new user through choosing a provider, model, message
+// style and language, writes them to the repository's .smartmsg.yaml (and
+// the language to the commit policy), and can install a prepare-commit-msg
+// hook. Every question has a default, so `init < /dev/null` accepts them all.
+func cmdInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	force := fs.Bool("force", false, "overwrite an existing .smartmsg.yaml without asking")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	top, err := repoPath()
+	if err != nil {
+		return errors.New("init must be run inside a git repository")
+	}
+	if bareRepo() {
+		return errors.New("init needs a work tree to write .smartmsg.yaml into")
+	}
+	cfgPath := filepath.Join(top, repoConfigFile)
+	if _, err := os.Stat(cfgPath); err == nil && !*force {
+		if !askYesNo(cfgPath+" already exists. Overwrite it? [y/N] ", false) {
+			return errors.New("keeping the existing " + repoConfigFile + " (use --force to overwrite)")
+		}
+	}
 
-func cmdApply(args []string) error {
-	fs := flag.NewFlagSet("apply", flag.ExitOnError)
-	inFile := fs.String("in", "plan.json", "plan file path")
-	newBranch := fs.String("branch", "", "new branch to create (required)")
-	allowMerges := fs.Bool("allow-merges", false, "attempt to preserve merge commits (best-effort; otherwise abort)")
-	fs.Parse(args)
+	fmt.Println("Providers:")
+	choices := detectProviders()
+	def := 0
+	for i, c := range choices {
+		mark := "✗"
+		if c.found {
+			mark = "✓"
+			if def == 0 && c.name != "mock" {
+				def = i + 1
+			}
+		}
+		fmt.Printf("  %d) %s %-15s %s\n", i+1, mark, c.label, c.detail)
+	}
+	if def == 0 {
+		def = len(choices) // mock
+		fmt.Println("No credentials were found; see README \"Environment Variables\" to set up a provider.")
+	}
+	pc := choices[askChoice("Provider", len(choices), def)-1]
+	if !pc.found {
+		fmt.Printf("Note: %s; set it up before running plan or commit.\n", pc.detail)
+	}
+	if pc.ollamaV1 != "" && !pointsAt(pc.ollamaV1) {
+		// Ollama is configured as the openai provider; without the base URL
+		// the same configuration sends diffs to api.openai.com.
+		fmt.Printf("⚠️  OPENAI_API_BASE is not set to %s, so plan and commit would send your diffs to api.openai.com, not to Ollama.\n", pc.ollamaV1)
+		fmt.Println("   Set these first, in this shell and your shell profile:")
+		fmt.Printf("     export OPENAI_API_BASE=%s\n", pc.ollamaV1)
+		fmt.Println("     export OPENAI_API_KEY=ollama   # any non-empty value")
+		if !askYesNo("Write the configuration anyway? [y/N] ", false) {
+			return errors.New("not writing " + repoConfigFile + ": set OPENAI_API_BASE and rerun init")
+		}
+	}
 
-	if *newBranch == "" {
-		return errors.New("--branch is required")
+	model := defaultModel(pc.name)
+	if len(pc.models) > 0 {
+		fmt.Println("Local models:")
+		for i, m := range pc.models {
+			fmt.Printf("  %d) %s\n", i+1, m)
+		}
+		model = pc.models[0]
+	}
+	if pc.name != "mock" {
+		model = askString("Model", model)
+		if i, err := strconv.Atoi(model); err == nil && i >= 1 && i <= len(pc.models) {
+			model = pc.models[i-1]
+		}
 	}
 
-	if err := ensureCleanWorktree(); err != nil {
-		return err
+	fmt.Println("Message style:")
+	fmt.Println("  1) Conventional Commits (feat: add login form)")
+	fmt.Println("  2) Conventional Commits with emoji (✨ feat: add login form)")
+	emoji := askChoice("Style", 2, 1) == 2
+	language := askString("Message language", "English")
+
+	var sb strings.Builder
+	sb.WriteString("# Defaults for git-smartmsg, written by `git-smartmsg init`.\n")
+	sb.WriteString("# Keys are option names; command-line flags override them.\n")
+	fmt.Fprintf(&sb, "provider: %s\n", pc.name)
+	if pc.name != "mock" {
+		fmt.Fprintf(&sb, "model: %s\n", strconv.Quote(model))
 	}
-	var plan Plan
-	b, err := os.ReadFile(*inFile)
-	if err != nil {
+	fmt.Fprintf(&sb, "emoji: %t\n", emoji)
+	if err := os.WriteFile(cfgPath, []byte(sb.String()), 0644); err != nil {
 		return err
 	}
-	if err := json.Unmarshal(b, &plan); err != nil {
-		return err
+	fmt.Println("Wrote " + cfgPath)
+
+	if err := initPolicyLanguage(top, language); err != nil {
+		slog.Warn("could not record the message language", "err", err)
 	}
-	if len(plan.Items) == 0 {
-		return errors.New("plan has no items")
+
+	if askYesNo("Install a prepare-commit-msg hook that suggests a message on every `git commit`? [y/N] ", false) {
+		path, err := installHook()
+		if err != nil {
+			slog.Warn("hook not installed", "err", err)
+		} else {
+			fmt.Println("Installed " + path)
+		}
 	}
 
-	// 作業ブランチ
-	if _, err := git("checkout", "-b", *newBranch); err != nil {
+	fmt.Println()
+	if pc.ollamaV1 != "" && !pointsAt(pc.ollamaV1) {
+		fmt.Println("⚠️  Until OPENAI_API_BASE is set to " + pc.ollamaV1 + ", do not run plan or commit: diffs would go to api.openai.com.")
+	}
+	fmt.Println("Next steps:")
+	fmt.Println("  git-smartmsg plan --limit 5   # suggest messages for the last 5 commits")
+	fmt.Println("  git-smartmsg commit           # write a message for the staged changes")
+	return nil
+}
+
+// initPolicyLanguage records the message language in the commit policy:
+// in a new .smartmsg-policy.yaml, or, when the repository already has a
+// policy, as a note on what to change, since init does not rewrite it.
+// English is the default and needs no policy.
+func initPolicyLanguage(top, language string) error {
+	policy, err := loadPolicy()
+	if err != nil {
 		return err
 	}
-	// 起点を base にリセット
-	base := plan.Base
-	if strings.TrimSpace(base) == "" {
-		first := plan.Items[0].SHA
-		parent, err := git("rev-parse", first+"^")
-		if err != nil {
-			return fmt.Errorf("cannot determine base: %w", err)
+	english := englishLanguage(language)
+	if policy != nil {
+		if !strings.EqualFold(policy.Language, language) && !(english && policy.Language == "") {
+			fmt.Printf("Set `language: %s` in %s to have messages written in %s.\n", language, policy.path, language)
 		}
-		base = strings.TrimSpace(parent)
+		return nil
 	}
-	if _, err := git("reset", "--hard", base); err != nil {
+	if english {
+		return nil
+	}
+	path := filepath.Join(top, policyFiles[0])
+	if err := os.WriteFile(path, []byte("language: "+strconv.Quote(language)+"\n"), 0644); err != nil {
 		return err
 	}
+	fmt.Println("Wrote " + path)
+	return nil
+}
 
-	// cherry-pick で1件ずつ適用
-	for _, it := range plan.Items {
-		if !*allowMerges {
-			parents, _ := git("rev-list", "--parents", "-n", "1", it.SHA)
-			if strings.Count(strings.TrimSpace(parents), " ") >= 2 {
-				return fmt.Errorf("merge commit detected (%s). rerun with --allow-merges (experimental).", it.SHA[:7])
+// ============================
+// Shell completion and manual page
+// ============================
+
+// subcommand is one entry of the command table main dispatches on.
+// Names with a space ("plan validate") are reached through their parent
+// and are listed only for completion and the manual page.
+type subcommand struct {
+	name    string
+	summary string
+	run     func(args []string) error
+	hidden  bool // internal plumbing, left out of completion and man
+}
+
+func subcommands() []subcommand {
+	return []subcommand{
+		{name: "plan", summary: "generate AI commit messages for a range (writes plan.json)", run: cmdPlan},
+		{name: "plan validate", summary: "check a plan file against the schema", run: cmdPlanValidate},
+		{name: "plan diff", summary: "show which suggestions changed between two plans", run: cmdPlanDiff},
+		{name: "plan show", summary: "list old and new subjects side by side, or draw the rewrite as a graph", run: cmdPlanShow},
+		{name: "apply", summary: "apply plan.json on a new branch as rewritten linear history", run: cmdApply},
+		{name: "commit", summary: "generate an AI commit message from staged changes and commit", run: cmdCommit},
+		{name: "amend", summary: "regenerate the HEAD commit's message from its diff and reword it", run: cmdAmend},
+		{name: "rewrite-msg", summary: "read a message on stdin and print the improved one", run: cmdRewriteMsg},
+		{name: "edit", summary: "edit the plan's proposed messages in $EDITOR", run: cmdEdit},
+		{name: "stats", summary: "report what a plan changes and what it cost", run: cmdStats},
+		{name: "export", summary: "convert a plan for other rewrite tools", run: cmdExport},
+		{name: "rebase", summary: "apply a plan through native git rebase -i, keeping hooks and signing", run: cmdRebase},
+		{name: "rebase-shim", summary: "sequence and message editor used by rebase", run: cmdRebaseShim, hidden: true},
+		{name: "advise", summary: "flag commits that mix unrelated concerns and suggest how to split them", run: cmdAdvise},
+		{name: "translate", summary: "translate existing messages into another language (writes plan.json)", run: cmdTranslate},
+		{name: "scrub", summary: "redact secrets, internal host names and custom patterns from messages (writes plan.json)", run: cmdScrub},
+		{name: "multi", summary: "plan (and optionally apply) across the repositories of a manifest, with one combined report", run: cmdMulti},
+		{name: "ci", summary: "review a pull request's commit messages and post suggestions", run: cmdCI},
+		{name: "init", summary: "set up provider, model, style and language for this repository, and optionally a prepare-commit-msg hook", run: cmdInit},
+		{name: "serve", summary: "answer suggest, lint and plan requests from editor plugins over HTTP or stdio JSON-RPC", run: cmdServe},
+		{name: "completion", summary: "print a bash, zsh or fish completion script", run: cmdCompletion},
+		{name: "man", summary: "print the git-smartmsg(1) manual page in roff", run: cmdMan},
+	}
+}
+
+// globalOpts are the options accepted before the subcommand.
+type globalOpts struct {
+	verbose, debug, quiet bool
+	logFormat             string
+}
+
+func (g *globalOpts) register(fs *flag.FlagSet) {
+	fs.StringVar(&repoFlag, "C", "", "run as if started in `path`")
+	fs.StringVar(&repoFlag, "repo", "", "run as if started in `path`")
+	fs.BoolVar(&g.verbose, "v", false, "log AI calls with their latency and token use")
+	fs.BoolVar(&g.verbose, "verbose", false, "log AI calls with their latency and token use")
+	fs.BoolVar(&g.debug, "debug", false, "like --verbose, and also log every git command with its duration")
+	fs.BoolVar(&g.quiet, "q", false, "log only warnings and errors (no per-commit lines)")
+	fs.BoolVar(&g.quiet, "quiet", false, "log only warnings and errors (no per-commit lines)")
+	fs.StringVar(&g.logFormat, "log-format", envOr("SMARTMSG_LOG_FORMAT", "text"), "diagnostics `format` on stderr: text or json")
+	fs.BoolVar(&forceUnlock, "force-unlock", false, "take over the repository lock even if another run seems to hold it")
+}
+
+var (
+	collectFlags      func(fs *flag.FlagSet)
+	errFlagsCollected = errors.New("flags collected")
+)
+
+// commandFlags returns the flags c defines, by running it with
+// collectFlags set so that it stops inside parseFlags.
+func commandFlags(c subcommand) *flag.FlagSet {
+	var got *flag.FlagSet
+	collectFlags = func(fs *flag.FlagSet) { got = fs }
+	defer func() { collectFlags, notify = nil, nil }()
+	if err := c.run(nil); !errors.Is(err, errFlagsCollected) || got == nil {
+		panic("subcommand " + c.name + " does not parse its flags with parseFlags")
+	}
+	return got
+}
+
+// optionSpec is one option with its aliases (-C and --repo) folded
+// together; aliases share the same flag.Value.
+type optionSpec struct {
+	names   []string // as typed: -C, --repo
+	arg     string   // argument name, empty for boolean options
+	usage   string
+	defText string
+}
+
+func optionSpecs(fs *flag.FlagSet) []optionSpec {
+	var specs []optionSpec
+	seen := map[flag.Value]int{}
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "--" + f.Name
+		if len(f.Name) == 1 {
+			name = "-" + f.Name
+		}
+		// fs.Func values are not comparable and never aliased.
+		aliasable := reflect.TypeOf(f.Value).Kind() == reflect.Pointer
+		if aliasable {
+			if i, ok := seen[f.Value]; ok {
+				specs[i].names = append(specs[i].names, name)
+				return
 			}
 		}
+		arg, usage := flag.UnquoteUsage(f)
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			arg = ""
+		}
+		def := f.DefValue
+		switch def {
+		case "", "0", "false", "0s":
+			def = ""
+		}
+		if aliasable {
+			seen[f.Value] = len(specs)
+		}
+		specs = append(specs, optionSpec{names: []string{name}, arg: arg, usage: usage, defText: def})
+	})
+	for i := range specs {
+		// Short forms first, as in the usage text.
+		slices.SortStableFunc(specs[i].names, func(a, b string) int { return cmp.Compare(len(a), len(b)) })
+	}
+	return specs
+}
+
+// completionCommand is a visible subcommand with its options, resolved
+// once for all three shells.
+type completionCommand struct {
+	subcommand
+	opts []optionSpec
+}
 
-		if _, err := git("cherry-pick", "-n", it.SHA); err != nil {
-			_, _ = git("cherry-pick", "--abort")
-			return fmt.Errorf("cherry-pick failed at %s; resolve manually and rerun", it.SHA[:7])
+func completionCommands() []completionCommand {
+	var out []completionCommand
+	for _, c := range subcommands() {
+		if !c.hidden {
+			out = append(out, completionCommand{c, optionSpecs(commandFlags(c))})
 		}
+	}
+	return out
+}
 
-		authorFlag := fmt.Sprintf("--author=%s <%s>", it.AuthorName, it.AuthorEmail)
-		commitEnv := os.Environ()
-		commitEnv = append(commitEnv,
-			"GIT_COMMITTER_NAME="+it.AuthorName,
-			"GIT_COMMITTER_EMAIL="+it.AuthorEmail,
-			"GIT_COMMITTER_DATE="+it.AuthorDate,
-			"GIT_AUTHOR_DATE="+it.AuthorDate,
-		)
+func globalOptionSpecs() []optionSpec {
+	fs := flag.NewFlagSet("git-smartmsg", flag.ContinueOnError)
+	var g globalOpts
+	saved := repoFlag
+	g.register(fs)
+	repoFlag = saved
+	return optionSpecs(fs)
+}
 
-		msg := it.NewMessage
-		if strings.TrimSpace(msg) == "" {
-			msg = it.OldMessage
+// optionNames returns every spelling of opts, restricted to those that
+// take an argument when valued is set.
+func optionNames(opts []optionSpec, valued bool) []string {
+	var names []string
+	for _, o := range opts {
+		if !valued || o.arg != "" {
+			names = append(names, o.names...)
 		}
+	}
+	return names
+}
 
-		diffIndex, _ := git("diff", "--cached", "--name-only")
-		if strings.TrimSpace(diffIndex) == "" {
-			log.Printf("skip empty commit %s", it.SHA[:7])
-			_, _ = git("reset")
-			continue
+func cmdCompletion(args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: completion bash|zsh|fish")
+	}
+	var script string
+	switch fs.Arg(0) {
+	case "bash":
+		script = bashCompletion(globalOptionSpecs(), completionCommands())
+	case "zsh":
+		script = zshCompletion(globalOptionSpecs(), completionCommands())
+	case "fish":
+		script = fishCompletion(globalOptionSpecs(), completionCommands())
+	default:
+		return fmt.Errorf("unsupported shell %q (want bash, zsh or fish)", fs.Arg(0))
+	}
+	_, err := io.WriteString(os.Stdout, script)
+	return err
+}
+
+// bashCompletion completes subcommands, then the options of the chosen one;
+// an option's value falls back to file names. _git_smartmsg lets git's own
+// completion handle "git smartmsg ...".
+func bashCompletion(global []optionSpec, cmds []completionCommand) string {
+	var b strings.Builder
+	var top []string
+	for _, c := range cmds {
+		if !strings.Contains(c.name, " ") {
+			top = append(top, c.name)
+		}
+	}
+	fmt.Fprintf(&b, `# bash completion for git-smartmsg
+_git_smartmsg_complete() {
+	local cur prev sub opts valued i=1
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+	[[ ${COMP_WORDS[0]} == git ]] && i=2
+	for (( ; i < COMP_CWORD; i++ )); do
+		case "${COMP_WORDS[i]}" in
+		%s) ((i++)) ;;
+		-*) ;;
+		*)
+			sub="${COMP_WORDS[i]}"
+			if [[ $sub == plan && $((i+1)) -lt $COMP_CWORD ]]; then
+				case "${COMP_WORDS[i+1]}" in validate|diff|show) sub="plan ${COMP_WORDS[i+1]}" ;; esac
+			fi
+			break ;;
+		esac
+	done
+	case "$sub" in
+	"")
+		opts=%q
+		valued=%q ;;
+`, strings.Join(optionNames(global, true), "|"),
+		strings.Join(append(top, optionNames(global, false)...), " "),
+		strings.Join(optionNames(global, true), " "))
+	for _, c := range cmds {
+		words := optionNames(c.opts, false)
+		if c.name == "plan" {
+			words = append([]string{"validate", "diff", "show"}, words...)
 		}
+		fmt.Fprintf(&b, "\t%q)\n\t\topts=%q\n\t\tvalued=%q ;;\n", c.name, strings.Join(words, " "), strings.Join(optionNames(c.opts, true), " "))
+	}
+	b.WriteString(`	esac
+	if [[ " $valued " == *" $prev "* ]]; then
+		COMPREPLY=( $(compgen -f -- "$cur") )
+		return
+	fi
+	COMPREPLY=( $(compgen -W "$opts" -- "$cur") )
+}
+_git_smartmsg() { _git_smartmsg_complete; }
+complete -o default -F _git_smartmsg_complete git-smartmsg
+`)
+	return b.String()
+}
 
-		var stdout, stderr bytes.Buffer
-		cmd := exec.Command("git", "commit", "-m", msg, authorFlag, "--no-verify")
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		cmd.Env = commitEnv
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("git commit failed: %v, %s", err, stderr.String())
+// zshQuote escapes s for use inside a single-quoted _arguments spec.
+func zshQuote(s string) string {
+	s = strings.NewReplacer(`[`, `\[`, `]`, `\]`, `:`, `\:`).Replace(s)
+	return strings.ReplaceAll(s, `'`, `'\''`)
+}
+
+func zshOptionSpecs(b *strings.Builder, indent string, opts []optionSpec) {
+	for _, o := range opts {
+		value := ""
+		if o.arg != "" {
+			value = ":" + zshQuote(o.arg) + ":_files"
+		}
+		for _, n := range o.names {
+			fmt.Fprintf(b, "%s'%s[%s]%s' \\\n", indent, n, zshQuote(o.usage), value)
 		}
-		log.Printf("rewritten: %s", it.SHA[:7])
 	}
+}
 
-	fmt.Printf("\n✅ Done. New branch %q contains rewritten history.\n", *newBranch)
-	fmt.Println("⚠️  Rewriting history rewrites SHAs. Coordinate with your team before force-pushing:")
-	fmt.Printf("   git push --force-with-lease origin %s\n", *newBranch)
-	return nil
+func zshCompletion(global []optionSpec, cmds []completionCommand) string {
+	var b strings.Builder
+	b.WriteString("#compdef git-smartmsg\n\n_git-smartmsg() {\n\tlocal curcontext=\"$curcontext\" state line\n\ttypeset -A opt_args\n\t_arguments -C \\\n")
+	zshOptionSpecs(&b, "\t\t", global)
+	b.WriteString("\t\t'1:subcommand:->cmd' \\\n\t\t'*::arg:->args'\n\tcase $state in\n\tcmd)\n\t\tlocal -a cmds\n\t\tcmds=(\n")
+	byName := map[string]completionCommand{}
+	for _, c := range cmds {
+		byName[c.name] = c
+		if !strings.Contains(c.name, " ") {
+			fmt.Fprintf(&b, "\t\t\t'%s:%s'\n", c.name, zshQuote(c.summary))
+		}
+	}
+	b.WriteString("\t\t)\n\t\t_describe -t commands subcommand cmds ;;\n\targs)\n\t\tcase $words[1] in\n")
+	for _, c := range cmds {
+		if strings.Contains(c.name, " ") {
+			continue
+		}
+		fmt.Fprintf(&b, "\t\t%s)\n", c.name)
+		if c.name == "plan" {
+			b.WriteString("\t\t\tcase $words[2] in\n")
+			for _, sub := range []string{"validate", "diff", "show"} {
+				fmt.Fprintf(&b, "\t\t\t%s)\n\t\t\t\t_arguments \\\n", sub)
+				zshOptionSpecs(&b, "\t\t\t\t\t", byName["plan "+sub].opts)
+				b.WriteString("\t\t\t\t\t'*:file:_files' ;;\n")
+			}
+			b.WriteString("\t\t\t*)\n\t\t\t\t_arguments \\\n")
+			zshOptionSpecs(&b, "\t\t\t\t\t", c.opts)
+			b.WriteString("\t\t\t\t\t'1:: :(validate diff show)' ;;\n\t\t\tesac ;;\n")
+			continue
+		}
+		b.WriteString("\t\t\t_arguments \\\n")
+		zshOptionSpecs(&b, "\t\t\t\t", c.opts)
+		if c.name == "completion" {
+			b.WriteString("\t\t\t\t'1:shell:(bash zsh fish)' ;;\n")
+		} else {
+			b.WriteString("\t\t\t\t'*:file:_files' ;;\n")
+		}
+	}
+	b.WriteString("\t\tesac ;;\n\tesac\n}\n\n_git-smartmsg \"$@\"\n")
+	return b.String()
 }
 
-// ============================
-// Commit command (staged changes)
-// ============================
+// fishQuote single-quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
 
-func cmdCommit(args []string) error {
-	fs := flag.NewFlagSet("commit", flag.ExitOnError)
-	model := fs.String("model", envOr("OPENAI_MODEL", "gpt-5-nano"), "LLM model")
-	emoji := fs.Bool("emoji", false, "use emoji style commit messages")
-	timeout := fs.Duration("timeout", 25*time.Second, "AI timeout")
-	auto := fs.Bool("auto", false, "auto-commit without confirmation")
-	fs.Parse(args)
+func fishOptions(b *strings.Builder, cond string, opts []optionSpec) {
+	for _, o := range opts {
+		var names []string
+		for _, n := range o.names {
+			if strings.HasPrefix(n, "--") {
+				names = append(names, "-l "+n[2:])
+			} else {
+				names = append(names, "-s "+n[1:])
+			}
+		}
+		value := ""
+		if o.arg != "" {
+			value = " -r -F"
+		}
+		fmt.Fprintf(b, "complete -c git-smartmsg -n %s %s%s -d %s\n", fishQuote(cond), strings.Join(names, " "), value, fishQuote(o.usage))
+	}
+}
 
-	// Check if staging area has changes
-	stagedFiles, err := git("diff", "--cached", "--name-only")
-	if err != nil {
-		return err
+func fishCompletion(global []optionSpec, cmds []completionCommand) string {
+	var b strings.Builder
+	b.WriteString("# fish completion for git-smartmsg\ncomplete -c git-smartmsg -f\n")
+	fishOptions(&b, "__fish_use_subcommand", global)
+	for _, c := range cmds {
+		parent, sub, nested := strings.Cut(c.name, " ")
+		if !nested {
+			fmt.Fprintf(&b, "complete -c git-smartmsg -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+		}
+		cond := "__fish_seen_subcommand_from " + c.name
+		switch {
+		case nested:
+			cond = "__fish_seen_subcommand_from " + parent + "; and __fish_seen_subcommand_from " + sub
+			fmt.Fprintf(&b, "complete -c git-smartmsg -n %s -a %s -d %s\n",
+				fishQuote("__fish_seen_subcommand_from "+parent+"; and not __fish_seen_subcommand_from validate diff show"), sub, fishQuote(c.summary))
+		case c.name == "plan":
+			cond += "; and not __fish_seen_subcommand_from validate diff show"
+		case c.name == "completion":
+			fmt.Fprintf(&b, "complete -c git-smartmsg -n %s -a 'bash zsh fish'\n", fishQuote(cond))
+		}
+		fishOptions(&b, cond, c.opts)
 	}
-	if strings.TrimSpace(stagedFiles) == "" {
-		return errors.New("no staged changes found. Use 'git add' to stage your changes first")
+	return b.String()
+}
+
+// roffEscape escapes text for a roff body line.
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, `-`, `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
 	}
+	return s
+}
 
-	// Get staged diff
-	diff, err := getStagedDiff()
-	if err != nil {
-		return err
+func roffOptions(b *strings.Builder, opts []optionSpec) {
+	for _, o := range opts {
+		var names []string
+		for _, n := range o.names {
+			names = append(names, `\fB`+roffEscape(n)+`\fR`)
+		}
+		b.WriteString(".TP\n" + strings.Join(names, ", "))
+		if o.arg != "" {
+			b.WriteString(` \fI` + roffEscape(o.arg) + `\fR`)
+		}
+		b.WriteString("\n" + roffEscape(o.usage))
+		if o.defText != "" {
+			b.WriteString(" (default: " + roffEscape(o.defText) + ")")
+		}
+		b.WriteString("\n")
 	}
+}
 
-	// Initialize AI client
-	ai, err := NewOpenAIClient()
-	if err != nil {
+func cmdMan(args []string) error {
+	fs := flag.NewFlagSet("man", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
 		return err
 	}
+	var b strings.Builder
+	b.WriteString(`.TH GIT\-SMARTMSG 1 "" "git-smartmsg" "Git Manual"
+.SH NAME
+git\-smartmsg \- write and rewrite Git commit messages with an AI model
+.SH SYNOPSIS
+.B git\-smartmsg
+[\fIglobal options\fR] \fIsubcommand\fR [\fIoptions\fR]
+.SH DESCRIPTION
+git\-smartmsg generates commit messages from diffs.
+\fBplan\fR writes suggested messages for a range of commits to a plan file,
+which can be reviewed with \fBedit\fR and \fBstats\fR and applied on a new
+branch with \fBapply\fR or \fBrebase\fR.
+\fBcommit\fR and \fBamend\fR write the message for staged changes or HEAD.
+.PP
+Options can also be set in the user configuration file and in
+\fI.smartmsg.yaml\fR at the repository root.
+Diagnostics are written to standard error.
+.SH GLOBAL OPTIONS
+`)
+	roffOptions(&b, globalOptionSpecs())
+	b.WriteString(".SH COMMANDS\n")
+	for _, c := range completionCommands() {
+		b.WriteString(".SS " + roffEscape(c.name) + "\n" + roffEscape(c.summary) + "\n")
+		if c.name == "completion" {
+			b.WriteString(".PP\nUsage: \\fBgit\\-smartmsg completion\\fR \\fIbash\\fR|\\fIzsh\\fR|\\fIfish\\fR\n")
+		}
+		roffOptions(&b, c.opts)
+	}
+	b.WriteString(`.SH SEE ALSO
+\fBgit\-commit\fR(1), \fBgit\-rebase\fR(1)
+`)
+	_, err := io.WriteString(os.Stdout, b.String())
+	return err
+}
 
-	// Generate commit message
-	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
-	defer cancel()
+// ============================
+// Logging
+// ============================
 
-	fmt.Println("🤖 Generating commit message from staged changes...")
-	newMsg, err := ai.SuggestMessage(ctx, *model, diff, "", *emoji)
-	if err != nil {
-		return fmt.Errorf("AI failed to generate message: %w", err)
-	}
+// levelVerbose sits between debug and info: AI calls with their latency
+// and token use. --debug adds every git command.
+const levelVerbose = slog.LevelDebug + 2
 
-	// Sanitize message
-	cleanMsg := sanitizeMessage(newMsg)
+// cliHandler writes records to stderr as one line each: the message, then
+// key=value attributes. Info has no prefix; other levels are marked, so
+// default output reads like plain log lines.
+type cliHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	attrs []slog.Attr
+}
 
-	// Show generated message
-	fmt.Printf("\n📝 Generated commit message:\n")
-	fmt.Printf("   %s\n\n", strings.ReplaceAll(cleanMsg, "\n", "\n   "))
+func (h *cliHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
 
-	// Get confirmation unless auto mode
-	if !*auto {
-		fmt.Print("❓ Commit with this message? [y/N/e(dit)]: ")
-		scanner := bufio.NewScanner(os.Stdin)
-		scanner.Scan()
-		response := strings.ToLower(strings.TrimSpace(scanner.Text()))
+func (h *cliHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		sb.WriteString("error: ")
+	case r.Level >= slog.LevelWarn:
+		sb.WriteString("warning: ")
+	case r.Level < levelVerbose:
+		sb.WriteString("debug: ")
+	}
+	sb.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		v := a.Value.Resolve().String()
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		sb.WriteString(" " + a.Key + "=" + v)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	sb.WriteString("\n")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, sb.String())
+	return err
+}
 
-		switch response {
-		case "y", "yes":
-			// Proceed with commit
-		case "e", "edit":
-			// Allow editing the message
-			fmt.Print("✏️  Enter your commit message: ")
-			scanner.Scan()
-			editedMsg := strings.TrimSpace(scanner.Text())
-			if editedMsg != "" {
-				cleanMsg = editedMsg
+func (h *cliHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(slices.Clip(h.attrs), attrs...)
+	return &c
+}
+
+func (h *cliHandler) WithGroup(string) slog.Handler { return h }
+
+// setupLogging installs the default logger for the global --verbose,
+// --debug, --quiet and --log-format options. Diagnostics always go to
+// stderr, so stdout carries only command output such as --json reports.
+func setupLogging(verbose, debug, quiet bool, format string) error {
+	level := slog.LevelInfo
+	switch {
+	case debug:
+		level = slog.LevelDebug
+	case verbose:
+		level = levelVerbose
+	case quiet:
+		level = slog.LevelWarn
+	}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = &cliHandler{mu: &sync.Mutex{}, w: os.Stderr, level: level}
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level, ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any() == levelVerbose {
+				a.Value = slog.StringValue("VERBOSE")
 			}
-		default:
-			fmt.Println("❌ Commit cancelled")
-			return nil
-		}
+			return a
+		}})
+	default:
+		return fmt.Errorf("--log-format must be text or json, got %q", format)
 	}
+	slog.SetDefault(slog.New(h))
+	// log.Fatal is only used for the final error, which --quiet must not hide.
+	slog.SetLogLoggerLevel(slog.LevelError)
+	return nil
+}
 
-	// Execute commit
-	_, err = git("commit", "-m", cleanMsg)
+// loggingClient logs each AI call with its latency and token use at the
+// --verbose level.
+type loggingClient struct {
+	inner    AIClient
+	provider string
+}
+
+func (c *loggingClient) Complete(ctx context.Context, model, system, user string) (string, error) {
+	if !slog.Default().Enabled(ctx, levelVerbose) {
+		return c.inner.Complete(ctx, model, system, user)
+	}
+	start, before := time.Now(), apiUsage.snapshot()
+	txt, err := c.inner.Complete(ctx, model, system, user)
+	after := apiUsage.snapshot()
+	attrs := []any{"provider", c.provider, "model", model, "took", time.Since(start).Round(time.Millisecond),
+		"prompt_tokens", after.PromptTokens - before.PromptTokens, "completion_tokens", after.CompletionTokens - before.CompletionTokens}
 	if err != nil {
-		return fmt.Errorf("git commit failed: %w", err)
+		attrs = append(attrs, "err", err)
 	}
-
-	fmt.Printf("✅ Successfully committed with message:\n   %s\n", strings.ReplaceAll(cleanMsg, "\n", "\n   "))
-	return nil
+	slog.Log(ctx, levelVerbose, "ai call", attrs...)
+	return txt, err
 }
 
+func (c *loggingClient) DiffBudget() int { return diffBudgetOf(c.inner) }
+
 // ============================
 // main
 // ============================
 
-func main() {
-	log.SetFlags(0)
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, `git-smartmsg
+// repoFlag is the global -C/--repo value, empty when not given.
+var repoFlag string
+
+// rootCtx is cancelled by the first SIGINT/SIGTERM; long-running commands
+// check it between steps so they can stop at a safe point.
+var rootCtx = context.Background()
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `git-smartmsg [-C <path>] <subcommand> [options]
+
+Global options:
+  -C, --repo <path>  run as if started in <path> (like git -C)
+  -v, --verbose      also log each AI call with its latency and token use
+  --debug            like --verbose, and log every git command with its duration
+  -q, --quiet        log only warnings and errors
+  --log-format <f>   diagnostics on stderr as text (default) or json
+  --force-unlock     take over the repository lock left by another run
 
 Subcommands:
+  init   - first-run setup: provider, model, style and language (writes .smartmsg.yaml)
   plan   - generate AI commit messages for a range (writes plan.json)
+           plan validate [file] checks a plan file against the schema
+           plan diff <old> <new> shows which suggestions changed between runs
+           plan show [--graph] [file] lists old and new subjects side by side
   apply  - apply plan.json on a new branch as rewritten linear history
   commit - generate AI commit message from staged changes and commit
+  amend  - regenerate the HEAD commit's message from its diff and reword it
+  rewrite-msg - read a message on stdin, print the improved one (filter for pipelines)
+  edit   - edit the plan's proposed messages in $EDITOR
+  stats  - report what a plan changes and what it cost
+  export - convert a plan for other tools (export --format filter-repo|replace-message|rebase-todo)
+  rebase - apply a plan through native git rebase -i (reword/fixup), keeping hooks and signing
+  advise - flag commits that mix unrelated concerns and suggest how to split them
+  ci     - review a pull request's commit messages and post suggestions (GitHub Actions)
+  translate - translate existing messages into another language (writes plan.json for apply)
+  scrub  - redact secrets, internal host names and custom patterns from messages (writes plan.json)
+  multi  - plan (and optionally apply) across many repositories listed in a manifest
+  serve  - answer suggest, lint and plan requests from editor plugins (HTTP, or JSON-RPC with --stdio)
+  completion - print a shell completion script (completion bash|zsh|fish)
+  man    - print the git-smartmsg(1) manual page
 
 Examples:
+  git-smartmsg init
   git-smartmsg plan --limit 30 --model gpt-5-nano
   git-smartmsg plan --emoji --limit 10
   git-smartmsg apply --branch rewrite/2025-09-20
   git-smartmsg commit --emoji
   git-smartmsg commit --auto --model gpt-4o
+  git-smartmsg amend
+  git-smartmsg -C ../other-repo plan --limit 10
 `)
+}
+
+func main() {
+	log.SetFlags(0)
+	gfs := flag.NewFlagSet("git-smartmsg", flag.ExitOnError)
+	gfs.Usage = usage
+	var g globalOpts
+	g.register(gfs)
+	gfs.Parse(os.Args[1:])
+	if err := setupLogging(g.verbose, g.debug, g.quiet, g.logFormat); err != nil {
+		log.Fatal(err)
+	}
+	args := gfs.Args()
+	if len(args) < 1 {
+		usage()
 		os.Exit(2)
 	}
-	switch os.Args[1] {
-	case "plan":
-		if err := cmdPlan(os.Args[2:]); err != nil {
-			log.Fatal("plan error: ", err)
-		}
-	case "apply":
-		if err := cmdApply(os.Args[2:]); err != nil {
-			log.Fatal("apply error: ", err)
+	if repoFlag != "" {
+		if err := os.Chdir(repoFlag); err != nil {
+			log.Fatal("cannot change to repository: ", err)
 		}
-	case "commit":
-		if err := cmdCommit(os.Args[2:]); err != nil {
-			log.Fatal("commit error: ", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// A second signal kills the process the usual way.
+	context.AfterFunc(ctx, func() {
+		stop()
+		slog.Warn("interrupted; finishing the current step (press Ctrl-C again to force quit)")
+	})
+	rootCtx = ctx
+	for _, c := range subcommands() {
+		if c.name == args[0] {
+			err := c.run(args[1:])
+			notify.send(c.name, err)
+			if err != nil {
+				log.Fatal(c.name, ": ", err)
+			}
+			return
 		}
-	default:
-		log.Fatal("unknown subcommand")
 	}
+	log.Fatal("unknown subcommand")
 }
-
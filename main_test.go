@@ -0,0 +1,2588 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestYAMLRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"plain",
+		"subject\n\nbody line\n",
+		"\n  x",
+		"a\n \n b",
+		"\n",
+		"\n\n",
+		"  indented\nnext",
+		"a\n\n\n",
+		"tab\tinside\nsecond",
+	} {
+		in, _ := json.Marshal(map[string]any{"items": []any{map[string]any{"sha": "abc", "new_message": s}}, "message": s})
+		y, err := jsonToYAML(in)
+		if err != nil {
+			t.Fatalf("jsonToYAML(%q): %v", s, err)
+		}
+		out, err := yamlToJSON(y)
+		if err != nil {
+			t.Fatalf("yamlToJSON(%q): %v\n%s", s, err, y)
+		}
+		var got struct {
+			Items []struct {
+				NewMessage string `json:"new_message"`
+			} `json:"items"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(out, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Message != s || len(got.Items) != 1 || got.Items[0].NewMessage != s {
+			t.Errorf("round trip of %q gave %q / %+v\n%s", s, got.Message, got.Items, y)
+		}
+	}
+}
+
+func TestUnverifiedClaimsKeepsAuthorText(t *testing.T) {
+	diff := "diff --git a/server.go b/server.go\n--- a/server.go\n+++ b/server.go\n@@ -1 +1 @@\n-func serve() {}\n+func serve(ctx context.Context) {}\n"
+	old := "fix: pass a context to serve\n\nMatches retryPolicy in client.go, see incident_2024_03."
+	msg := "fix(server): pass a context to serve\n\nMatches retryPolicy in client.go, see incident_2024_03.\nAlso updates handlerRegistry."
+
+	missing, stripped := unverifiedClaims(msg, diff, old)
+	if !slices.Equal(missing, []string{"handlerRegistry"}) {
+		t.Errorf("missing = %q, want only handlerRegistry", missing)
+	}
+	want := "fix(server): pass a context to serve\n\nMatches retryPolicy in client.go, see incident_2024_03."
+	if stripped != want {
+		t.Errorf("stripped = %q, want %q", stripped, want)
+	}
+
+	if missing, _ := unverifiedClaims(msg, diff, ""); len(missing) != 4 {
+		t.Errorf("without the old message missing = %q, want client.go, retryPolicy, incident_2024_03 and handlerRegistry", missing)
+	}
+}
+
+// tempRepo creates an empty repository, isolated from the user's and the
+// system's git config, and makes it the working directory.
+func tempRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Chdir(dir)
+	if _, err := git("init", "-q", "-b", "main"); err != nil {
+		t.Skip("git is not available: ", err)
+	}
+	mustGit(t, "config", "user.name", "Test")
+	mustGit(t, "config", "user.email", "test@example.com")
+	return dir
+}
+
+// mustGit runs git and fails the test if it does.
+func mustGit(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := git(args...)
+	if err != nil {
+		t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(out)
+}
+
+// commitFile commits content to name and returns the new commit.
+func commitFile(t *testing.T, name, content, msg string) string {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustGit(t, "add", name)
+	mustGit(t, "commit", "-q", "-m", msg)
+	return mustGit(t, "rev-parse", "HEAD")
+}
+
+func TestGitEnvOverrides(t *testing.T) {
+	tempRepo(t)
+	t.Setenv("GIT_AUTHOR_NAME", "stale")
+	env := gitEnv("GIT_AUTHOR_NAME=fresh", "GIT_AUTHOR_EMAIL=fresh@example.com")
+	var names []string
+	for _, kv := range env {
+		if k, v, _ := strings.Cut(kv, "="); strings.EqualFold(k, "GIT_AUTHOR_NAME") {
+			names = append(names, v)
+		}
+	}
+	if !slices.Equal(names, []string{"fresh"}) {
+		t.Fatalf("GIT_AUTHOR_NAME entries = %q, want only the override", names)
+	}
+	cmd := exec.Command("git", "var", "GIT_AUTHOR_IDENT")
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(out), "fresh <fresh@example.com> ") {
+		t.Errorf("git sees author %q", out)
+	}
+}
+
+func TestCommitIdentityQuoting(t *testing.T) {
+	tempRepo(t)
+	tree, err := git("mktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ name, email, wantName string }{
+		{`Bob "The Builder" O'Brien`, "bob@example.com", `Bob "The Builder" O'Brien`},
+		{"Renée $HOME `id` ; rm", "renee@example.com", "Renée $HOME `id` ; rm"},
+		// git itself drops angle brackets from names rather than failing
+		{"Ann <Admin>", "ann+tag@example.com", "Ann Admin"},
+	} {
+		for _, mode := range []string{"preserve", "committer-now", "author-now"} {
+			it := PlanItem{AuthorName: tc.name, AuthorEmail: tc.email, AuthorDate: "2024-01-02T03:04:05+09:00"}
+			env := gitEnv(commitIdentity(it, mode)...)
+			if mode != "preserve" {
+				env = append(env, "GIT_COMMITTER_NAME=c", "GIT_COMMITTER_EMAIL=c@example.com")
+			}
+			sha, err := commitTree([]string{"commit-tree", strings.TrimSpace(tree)}, "msg", env)
+			if err != nil {
+				t.Fatalf("%s, %s: %v", tc.name, mode, err)
+			}
+			out, err := git("log", "-1", "--format=%an%x00%ae%x00%cn", sha)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Split(strings.TrimSpace(out), "\x00")
+			if got[0] != tc.wantName || got[1] != tc.email {
+				t.Errorf("%s: author %q <%s>, want %q <%s>", mode, got[0], got[1], tc.wantName, tc.email)
+			}
+			if mode == "preserve" && got[2] != tc.wantName {
+				t.Errorf("preserve: committer %q, want the author", got[2])
+			}
+		}
+	}
+}
+
+func TestSplitLinesCRLF(t *testing.T) {
+	for in, want := range map[string][]string{
+		"a\r\nb\nc":       {"a", "b", "c"},
+		"subject\r\n\r\n": {"subject", "", ""},
+		"one":             {"one"},
+		"a\rb":            {"a\rb"}, // a lone CR is not a line break
+	} {
+		if got := splitLines(in); !slices.Equal(got, want) {
+			t.Errorf("splitLines(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	// A message committed with CRLF line endings, as editors on Windows
+	// write them, reads back as clean lines.
+	tempRepo(t)
+	tree, err := git("mktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := gitEnv("GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+	sha, err := commitTree([]string{"commit-tree", strings.TrimSpace(tree)}, "fix: subject\r\n\r\nbody line\r\n", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := git("log", "-1", "--format=%B", sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := splitLines(strings.TrimRight(out, "\r\n"))
+	if !slices.Equal(lines, []string{"fix: subject", "", "body line"}) {
+		t.Errorf("lines = %q", lines)
+	}
+}
+
+func TestShortenSubjectCJK(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"fix: ログイン画面を修正", 72, "fix: ログイン画面を修正"},
+		// no spaces to break at: cut at the rune limit, never inside a rune
+		{"feat: ユーザー設定画面に通知のオンオフを切り替えるスイッチを追加", 20, "feat: ユーザー設定画面に通知のオン"},
+		{"fix: 認証の不具合を修正、ログを追加", 15, "fix: 認証の不具合を修正"},
+		{"fix(api): 修正 retry handling for 大きな requests", 30, "fix(api): 修正 retry handling"},
+		{"docs: 更新 README の説明（インストール手順）", 25, "docs: 更新 README の説明"},
+		{"feat: ✨ 絵文字 🎉 を含む件名", 12, "feat: ✨ 絵文字"},
+	} {
+		got := shortenSubject(tc.in, tc.max)
+		if got != tc.want {
+			t.Errorf("shortenSubject(%q, %d) = %q, want %q", tc.in, tc.max, got, tc.want)
+		}
+		if n := utf8.RuneCountInString(got); n > tc.max || !utf8.ValidString(got) {
+			t.Errorf("shortenSubject(%q, %d) = %q (%d runes)", tc.in, tc.max, got, n)
+		}
+	}
+}
+
+func TestLengthRulesApplyCJK(t *testing.T) {
+	r := lengthRules{subjectMax: 20, bodyWrap: 20}
+	for _, tc := range []struct{ in, want string }{
+		{
+			"feat: 日本語の件名\n\n本文は短い。",
+			"feat: 日本語の件名\n\n本文は短い。",
+		},
+		{
+			// a CJK line without spaces cannot be wrapped and is kept whole
+			"fix: 修正\n\nこの行はとても長いのですが空白がないので折り返すことができません",
+			"fix: 修正\n\nこの行はとても長いのですが空白がないので折り返すことができません",
+		},
+		{
+			// mixed text wraps at its spaces, counting runes rather than bytes
+			"fix: 修正\n\n- 設定 ファイル の 読み込み を 修正 して エラー を 表示",
+			"fix: 修正\n\n- 設定 ファイル の 読み込み を\n  修正 して エラー を 表示",
+		},
+		{
+			"fix: 修正\n\n長い本文 長い本文 長い本文 長い本文 長い本文\n\nSigned-off-by: 山田 太郎 <taro@example.com>",
+			"fix: 修正\n\n長い本文 長い本文 長い本文 長い本文\n長い本文\n\nSigned-off-by: 山田 太郎 <taro@example.com>",
+		},
+	} {
+		if got := r.apply(tc.in); got != tc.want {
+			t.Errorf("apply(%q)\n got %q\nwant %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMessageModeEnforce(t *testing.T) {
+	const old = "Fix the parser\n\nIt choked on tabs.\n\nSigned-off-by: A <a@example.com>"
+	for _, tc := range []struct {
+		name string
+		mode messageMode
+		msg  string
+		want string
+	}{
+		{
+			name: "rewrite keeps the new message",
+			mode: messageMode{mode: modeRewrite, generate: generateBoth},
+			msg:  "fix(parser): accept tabs\n\nTabs are whitespace.",
+			want: "fix(parser): accept tabs\n\nTabs are whitespace.",
+		},
+		{
+			name: "polish keeps the new message and its trailers",
+			mode: messageMode{mode: modePolish, generate: generateBoth},
+			msg:  "fix(parser): accept tabs\n\nIt failed on tabs.\n\nSigned-off-by: A <a@example.com>",
+			want: "fix(parser): accept tabs\n\nIt failed on tabs.\n\nSigned-off-by: A <a@example.com>",
+		},
+		{
+			name: "keep-subject restores a hand-edited subject",
+			mode: messageMode{mode: modeKeepSubject, generate: generateBoth},
+			msg:  "fix(parser): edited by hand\n\nTabs are whitespace.",
+			want: "Fix the parser\n\nTabs are whitespace.",
+		},
+		{
+			name: "keep-subject without a body",
+			mode: messageMode{mode: modeKeepSubject, generate: generateBoth},
+			msg:  "fix(parser): edited by hand",
+			want: "Fix the parser",
+		},
+		{
+			name: "generate body keeps the subject",
+			mode: messageMode{mode: modeRewrite, generate: generateBody},
+			msg:  "other\n\nNew body.",
+			want: "Fix the parser\n\nNew body.",
+		},
+		{
+			name: "generate subject keeps the body and its trailers",
+			mode: messageMode{mode: modePolish, generate: generateSubject},
+			msg:  "fix(parser): accept tabs\n\nA body the model added.",
+			want: "fix(parser): accept tabs\n\nIt choked on tabs.\n\nSigned-off-by: A <a@example.com>",
+		},
+	} {
+		if got := tc.mode.enforce(tc.msg, old); got != tc.want {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, got, tc.want)
+		}
+		if got := tc.mode.enforce(tc.msg, ""); got != tc.msg {
+			t.Errorf("%s: without an old message got %q", tc.name, got)
+		}
+	}
+}
+
+func TestMessageModeLengthRules(t *testing.T) {
+	lr := lengthRules{subjectMax: 20, bodyWrap: 20}
+	long := "Keep this subject exactly as written\n\nA body line that is longer than twenty.\n\nSigned-off-by: Someone With A Long Name <someone@example.com>"
+	for _, tc := range []struct {
+		name string
+		mode messageMode
+		want string
+	}{
+		{
+			name: "polish applies both limits but leaves trailers alone",
+			mode: messageMode{mode: modePolish, generate: generateBoth},
+			want: "Keep this subject\n\nA body line that is\nlonger than twenty.\n\nSigned-off-by: Someone With A Long Name <someone@example.com>",
+		},
+		{
+			name: "keep-subject leaves the subject",
+			mode: messageMode{mode: modeKeepSubject, generate: generateBoth},
+			want: "Keep this subject exactly as written\n\nA body line that is\nlonger than twenty.\n\nSigned-off-by: Someone With A Long Name <someone@example.com>",
+		},
+		{
+			name: "generate subject leaves the body",
+			mode: messageMode{mode: modePolish, generate: generateSubject},
+			want: "Keep this subject\n\nA body line that is longer than twenty.\n\nSigned-off-by: Someone With A Long Name <someone@example.com>",
+		},
+	} {
+		if got := tc.mode.lengthRules(lr).apply(long); got != tc.want {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestApplyMessageModes(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "a.txt", "a\n", "init")
+	const id = "I0123456789abcdef0123456789abcdef01234567"
+	sha := commitFile(t, "a.txt", "a2\n", "Update a\n\nSome reason.\n\nSigned-off-by: A <a@example.com>\nChange-Id: "+id)
+	bodies, gerrit, err := originalBodies([]PlanItem{{SHA: sha}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		mode messageMode
+		msg  string
+		want string
+	}{
+		{
+			name: "keep-subject undoes a hand edit in the plan",
+			mode: messageMode{mode: modeKeepSubject, generate: generateBoth},
+			msg:  "feat: edited subject\n\nExplains the update.",
+			want: "Update a\n\nExplains the update.\n\nChange-Id: " + id,
+		},
+		{
+			name: "polish keeps trailers",
+			mode: messageMode{mode: modePolish, generate: generateBoth},
+			msg:  "chore: update a\n\nSome reason.\n\nSigned-off-by: A <a@example.com>",
+			want: "chore: update a\n\nSome reason.\n\nSigned-off-by: A <a@example.com>\nChange-Id: " + id,
+		},
+	} {
+		it := PlanItem{SHA: sha, OldMessage: bodies[sha], NewMessage: tc.msg}
+		if got := applyMessage(it, tc.mode, false, bodies, nil, gerrit); got != tc.want {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyCheckCJK(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy Policy
+		msg    string
+		want   []string
+	}{
+		{"caseless description passes lower", Policy{SubjectCase: "lower"}, "fix: 認証を修正", nil},
+		{"caseless description passes sentence", Policy{SubjectCase: "sentence"}, "fix(api): 認証を修正", nil},
+		{"cased description still checked", Policy{SubjectCase: "lower"}, "fix: Ｆix 全角", []string{"subject description must start lowercase"}},
+		{"length counts runes, not bytes", Policy{SubjectMax: 10}, "fix: 認証を修正", nil},
+		{"too long in runes", Policy{SubjectMax: 8}, "fix: 認証を修正する", []string{"subject is 12 characters (max 8)"}},
+		{"type and scope with CJK description", Policy{Types: []string{"fix"}, Scopes: []string{"api"}, RequireScope: true}, "fix(api): 修正", nil},
+		{"unspaced CJK body line is exempt", Policy{MaxBodyWidth: 10}, "fix: 修正\n\nこれは十文字を超える長い本文の行です", nil},
+		{"mixed-width body line is checked", Policy{MaxBodyWidth: 10}, "fix: 修正\n\n長い 本文 の 行 です よ", []string{"line 3 is 14 characters (max 10)"}},
+		{"forbidden word next to CJK", Policy{ForbiddenWords: []string{"WIP"}}, "fix: WIP対応", []string{`contains forbidden word "WIP"`}},
+	} {
+		tc.policy.compile()
+		if got := tc.policy.check(tc.msg); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: check(%q) = %q, want %q", tc.name, tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestCheckPlanHeadExplicitRange(t *testing.T) {
+	tempRepo(t)
+	base := commitFile(t, "a.txt", "a\n", "init")
+	mustGit(t, "checkout", "-q", "-b", "feature")
+	commitFile(t, "b.txt", "b\n", "add b")
+	mustGit(t, "checkout", "-q", "main")
+	commitFile(t, "c.txt", "c\n", "main moves on")
+
+	rng := "main~1..feature"
+	gotBase, head, headRef, err := resolveRange(&rng, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotBase != base || headRef != "refs/heads/feature" {
+		t.Fatalf("base %s, head_ref %q; want %s, refs/heads/feature", gotBase, headRef, base)
+	}
+	plan := Plan{Head: head, HeadRef: headRef}
+
+	// Applying from main, or any other checkout, is fine while feature
+	// still ends at the planned head.
+	if err := checkPlanHead(plan, plan.HeadRef); err != nil {
+		t.Errorf("from a main checkout: %v", err)
+	}
+	mustGit(t, "checkout", "-q", "--detach", base)
+	if err := checkPlanHead(plan, plan.HeadRef); err != nil {
+		t.Errorf("from a detached checkout: %v", err)
+	}
+
+	mustGit(t, "checkout", "-q", "feature")
+	commitFile(t, "d.txt", "d\n", "feature moves on")
+	mustGit(t, "checkout", "-q", "main")
+	if err := checkPlanHead(plan, plan.HeadRef); err == nil || !strings.Contains(err.Error(), "feature moved 1 commit(s)") {
+		t.Errorf("after feature moved: %v", err)
+	}
+	mustGit(t, "branch", "-q", "-f", "feature", base)
+	if err := checkPlanHead(plan, plan.HeadRef); err == nil || !strings.Contains(err.Error(), "rewritten") {
+		t.Errorf("after feature was reset: %v", err)
+	}
+
+	// A range ending at a commit rather than a ref has nothing to go stale.
+	rng = base + ".." + head
+	if _, _, headRef, err = resolveRange(&rng, 0, nil); err != nil || headRef != "" {
+		t.Errorf("SHA range: head_ref %q, %v", headRef, err)
+	}
+}
+
+func TestValidatePlanRequiresHead(t *testing.T) {
+	sha := strings.Repeat("a", 40)
+	plan := Plan{Items: []PlanItem{{SHA: sha, OldMessage: "x", AuthorName: "A", AuthorEmail: "a@example.com", AuthorDate: "2024-01-01T00:00:00Z"}}}
+	if err := validatePlan(plan); err == nil || !strings.Contains(err.Error(), "head: missing") {
+		t.Errorf("without head: %v", err)
+	}
+	// checkPlanHead must not slice a head validatePlan was never shown.
+	tempRepo(t)
+	commitFile(t, "a.txt", "a\n", "init")
+	if err := checkPlanHead(plan, "HEAD"); err == nil || !strings.Contains(err.Error(), "no head") {
+		t.Errorf("checkPlanHead without head: %v", err)
+	}
+	plan.Head = sha
+	if err := validatePlan(plan); err != nil {
+		t.Errorf("with head: %v", err)
+	}
+}
+
+func TestRewriteTodoMerges(t *testing.T) {
+	merge, side, squashed := strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40)
+	plan := Plan{Items: []PlanItem{{SHA: merge}, {SHA: side, Squash: []string{squashed}}}}
+	todo := "label onto\n\nreset onto\npick bbbbbbb side\npick ccccccc squashed\nlabel side\n\n" +
+		"reset onto\npick ddddddd main work\nmerge -C aaaaaaa side # Merge side\nmerge -C eeeeeee other # Merge other"
+	want := "label onto\n\nreset onto\nreword bbbbbbb side\nfixup ccccccc squashed\nlabel side\n\n" +
+		"reset onto\npick ddddddd main work\nmerge -c aaaaaaa side # Merge side\nmerge -C eeeeeee other # Merge other"
+	if got := rewriteTodo(todo, plan); got != want {
+		t.Errorf("rewriteTodo:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestRebaseTodoRefusesMerges(t *testing.T) {
+	tempRepo(t)
+	base := commitFile(t, "a.txt", "a\n", "init")
+	mustGit(t, "checkout", "-q", "-b", "side")
+	commitFile(t, "b.txt", "b\n", "side work")
+	mustGit(t, "checkout", "-q", "main")
+	commitFile(t, "c.txt", "c\n", "main work")
+	mustGit(t, "merge", "-q", "--no-ff", "side", "-m", "Merge side")
+	head := mustGit(t, "rev-parse", "HEAD")
+	if _, err := rebaseTodo(Plan{Head: head}, base); err == nil || !strings.Contains(err.Error(), "is a merge") {
+		t.Errorf("range with a merge: %v", err)
+	}
+	if _, err := rebaseTodo(Plan{Head: head + "^1"}, base); err != nil {
+		t.Errorf("linear range: %v", err)
+	}
+}
+
+func TestServeLoopbackOnly(t *testing.T) {
+	h := loopbackOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for host, want := range map[string]int{
+		"127.0.0.1:7878":         http.StatusOK,
+		"localhost:7878":         http.StatusOK,
+		"LOCALHOST":              http.StatusOK,
+		"[::1]:7878":             http.StatusOK,
+		"127.8.9.10:7878":        http.StatusOK,
+		"rebound.example.com":    http.StatusForbidden, // DNS rebinding
+		"rebound.example.com:80": http.StatusForbidden,
+		"192.168.1.20:7878":      http.StatusForbidden,
+		"localhost.evil.example": http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("POST", "/suggest", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("Host %q: status %d, want %d", host, w.Code, want)
+		}
+	}
+}
+
+func TestRepoConfigConfinesPaths(t *testing.T) {
+	dir := tempRepo(t)
+	top, _ := filepath.EvalSymlinks(dir)
+	newFS := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+		for _, name := range []string{"out", "context-file", "diff-file", "audit-log", "record", "replay", "limit"} {
+			fs.String(name, "", "")
+		}
+		fs.Bool("repo-context", false, "")
+		return fs
+	}
+	for _, tc := range []struct {
+		yaml, key, want, err string
+	}{
+		{yaml: "out: plans/next.yaml", key: "out", want: filepath.Join(top, "plans", "next.yaml")},
+		{yaml: "out: ~/.bashrc", key: "out", want: filepath.Join(top, "~", ".bashrc")},
+		{yaml: "out: ../../.bashrc", err: "outside the repository"},
+		{yaml: "out: /etc/passwd", err: "outside the repository"},
+		{yaml: "diff-file: ../secret", err: "outside the repository"},
+		{yaml: "context-file: notes.md", err: "can only be set in"},
+		{yaml: "repo-context: true", err: "can only be set in"},
+		{yaml: "audit-log: /tmp/prompts", err: "can only be set in"},
+		{yaml: "record: fixtures", err: "can only be set in"},
+		{yaml: "replay: fixtures", err: "can only be set in"},
+		{yaml: "limit: 5", key: "limit", want: "5"},
+	} {
+		fs := newFS()
+		err := applyConfigData(fs, ".smartmsg.yaml", []byte(tc.yaml+"\n"), false)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: err = %v, want %q", tc.yaml, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.yaml, err)
+		} else if got := fs.Lookup(tc.key).Value.String(); got != tc.want {
+			t.Errorf("%s: %s = %q, want %q", tc.yaml, tc.key, got, tc.want)
+		}
+	}
+
+	// A symlink in the work tree does not lead a written file outside it.
+	if err := os.Symlink(t.TempDir(), filepath.Join(dir, "elsewhere")); err != nil {
+		t.Skip(err)
+	}
+	if err := applyConfigData(newFS(), ".smartmsg.yaml", []byte("out: elsewhere/plan.json\n"), false); err == nil {
+		t.Error("out through a symlink to outside the repository was accepted")
+	}
+	// The user's own config may write anywhere.
+	fs := newFS()
+	if err := applyConfigData(fs, "config.yaml", []byte("out: /tmp/plan.json\nreplay: fixtures\n"), true); err != nil || fs.Lookup("out").Value.String() != "/tmp/plan.json" {
+		t.Errorf("user config: %v", err)
+	}
+}
+
+func TestReadRepoFileRefusesSymlinksOut(t *testing.T) {
+	dir := tempRepo(t)
+	secret := filepath.Join(t.TempDir(), "fakecreds")
+	if err := os.WriteFile(secret, []byte("SECRET_TOKEN=hunter2-very-private\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(dir, "README.md")); err != nil {
+		t.Skip(err)
+	}
+	commitFile(t, "main.go", "package main\n", "init")
+	if _, _, err := readRepoFile("README.md"); err == nil || !strings.Contains(err.Error(), "outside the repository") {
+		t.Errorf("readRepoFile through a symlink out of the work tree: err = %v", err)
+	}
+	rc, err := repoContext(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(rc, "hunter2") {
+		t.Errorf("repository context contains the symlinked file:\n%s", rc)
+	}
+
+	// A symlink that stays inside the work tree is still followed.
+	if err := os.WriteFile("INTRO.md", []byte("# demo\n\nA demo project.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove("README.md"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("INTRO.md", "README.md"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readmeIntro(); got != "# demo\n\nA demo project." {
+		t.Errorf("readmeIntro through an in-tree symlink = %q", got)
+	}
+}
+
+func TestReadmeIntro(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name:  "first section",
+			files: map[string]string{"README.md": "# tool\n\nDoes things.\n\n## Install\n\ngo install\n"},
+			want:  "# tool\n\nDoes things.",
+		},
+		{
+			name:  "badges and HTML dropped",
+			files: map[string]string{"README.md": "[![CI](x.svg)](y)\n<p align=\"center\">\n# tool\nDoes things.\n# Usage\n"},
+			want:  "# tool\nDoes things.",
+		},
+		{
+			name:  "no heading",
+			files: map[string]string{"README": "Just text.\nMore text.\n"},
+			want:  "Just text.\nMore text.",
+		},
+		{
+			name:  "shortest name wins",
+			files: map[string]string{"README.ja.md": "# ツール\n", "README.md": "# tool\n"},
+			want:  "# tool",
+		},
+		{
+			name:  "no README",
+			files: map[string]string{"NOTES.md": "# notes\n"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tempRepo(t)
+			for name, content := range tc.files {
+				commitFile(t, name, content, "add "+name)
+			}
+			if got := readmeIntro(); got != tc.want {
+				t.Errorf("readmeIntro() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCommitGuidelines(t *testing.T) {
+	for _, tc := range []struct {
+		name, path, content, want string
+	}{
+		{
+			name:    "same level ends the section",
+			path:    "CONTRIBUTING.md",
+			content: "# Contributing\n\n## Setup\n\nmake\n\n## Commit messages\n\nUse Conventional Commits.\n\n### Scopes\n\napi, cli\n\n## Reviews\n\nTwo approvals.\n",
+			want:    "## Commit messages\n\nUse Conventional Commits.\n\n### Scopes\n\napi, cli",
+		},
+		{
+			name:    "higher level ends the section",
+			path:    ".github/CONTRIBUTING.md",
+			content: "## Committing\n\nSign off.\n# License\n",
+			want:    "## Committing\n\nSign off.",
+		},
+		{
+			name:    "runs to the end",
+			path:    "docs/CONTRIBUTING.md",
+			content: "# How we COMMIT\nImperative mood.\n",
+			want:    "# How we COMMIT\nImperative mood.",
+		},
+		{
+			name:    "no commit heading",
+			path:    "CONTRIBUTING.md",
+			content: "# Contributing\n\nOpen a PR.\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tempRepo(t)
+			if err := os.MkdirAll(filepath.Dir(tc.path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			commitFile(t, tc.path, tc.content, "add guidelines")
+			if got := commitGuidelines(); got != tc.want {
+				t.Errorf("commitGuidelines() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShallowTree(t *testing.T) {
+	tempRepo(t)
+	for _, name := range []string{"go.mod", "cmd/tool/main.go", "internal/api/v1/handler.go", "docs/guide.md"} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustGit(t, "add", ".")
+	mustGit(t, "commit", "-q", "-m", "init")
+	want := "cmd/\ncmd/tool/\ndocs/\ngo.mod\ninternal/\ninternal/api/"
+	if got := shallowTree(); got != want {
+		t.Errorf("shallowTree() = %q, want %q", got, want)
+	}
+}
+
+func TestRepoContext(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "README.md", "# tool\n\nDoes things.\n", "init")
+	if err := os.WriteFile("glossary.txt", []byte("\nsvc: the billing service\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		auto bool
+		file string
+		want string
+	}{
+		{name: "off"},
+		{name: "gathered", auto: true, want: "Repository context:\nAbout the project (README):\n# tool\n\nDoes things.\n\nLayout:\nREADME.md\n\n"},
+		{name: "file replaces gathered", auto: true, file: "glossary.txt", want: "Repository context:\nsvc: the billing service\n\n"},
+		{name: "file alone", file: "glossary.txt", want: "Repository context:\nsvc: the billing service\n\n"},
+	} {
+		got, err := repoContext(tc.auto, tc.file)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("%s: repoContext() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	if _, err := repoContext(true, "missing.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing context file: err = %v", err)
+	}
+}
+
+// lockFile returns the path of the repository lock and its holder.
+func lockFile(t *testing.T) (string, repoLock) {
+	t.Helper()
+	path := filepath.Join(mustGit(t, "rev-parse", "--absolute-git-dir"), "smartmsg.lock")
+	var l repoLock
+	if b, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(b, &l)
+	}
+	return path, l
+}
+
+func TestLockRepoStale(t *testing.T) {
+	tempRepo(t)
+	path, _ := lockFile(t)
+	host, _ := os.Hostname()
+
+	// A lock held by a live process is refused.
+	live, _ := json.Marshal(repoLock{PID: os.Getppid(), Host: host, Command: "plan", Started: time.Now().Format(time.RFC3339), ID: "live"})
+	if err := os.WriteFile(path, live, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockRepo("apply"); err == nil || !strings.Contains(err.Error(), "another git-smartmsg plan") {
+		t.Fatalf("live lock: %v", err)
+	}
+
+	// A lock whose process has exited is taken over.
+	cmd := exec.Command("git", "--version")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead, _ := json.Marshal(repoLock{PID: cmd.Process.Pid, Host: host, Command: "plan", Started: time.Now().Format(time.RFC3339), ID: "dead"})
+	if err := os.WriteFile(path, dead, 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockRepo("apply")
+	if err != nil {
+		t.Fatalf("stale lock: %v", err)
+	}
+	if _, l := lockFile(t); l.PID != os.Getpid() || l.Command != "apply" {
+		t.Errorf("lock after takeover: %+v", l)
+	}
+	unlock()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock left after release: %v", err)
+	}
+	if m, _ := filepath.Glob(path + ".*"); len(m) > 0 {
+		t.Errorf("temporary files left: %q", m)
+	}
+}
+
+func TestLockRepoForced(t *testing.T) {
+	tempRepo(t)
+	path, _ := lockFile(t)
+	first, err := lockRepo("plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockRepo("apply"); err == nil {
+		t.Fatal("second lock was granted")
+	}
+	forceUnlock = true
+	second, err := lockRepo("apply")
+	forceUnlock = false
+	if err != nil {
+		t.Fatalf("--force-unlock: %v", err)
+	}
+
+	// The run whose lock was taken must not release the new holder's.
+	first()
+	if _, l := lockFile(t); l.Command != "apply" {
+		t.Fatalf("first release removed the forced lock: %+v", l)
+	}
+	second()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock left after release: %v", err)
+	}
+}
+
+func TestRemoveIfSame(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smartmsg.lock")
+	if err := os.WriteFile(path, []byte("fresh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Two runs read the same stale lock; the first removed it and the new
+	// holder wrote "fresh". The second must leave that alone.
+	if ok, err := removeIfSame(path, []byte("stale")); ok || err != nil {
+		t.Fatalf("removeIfSame(stale) = %v, %v", ok, err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "fresh" {
+		t.Fatalf("lock is now %q", b)
+	}
+	if ok, err := removeIfSame(path, []byte("fresh")); !ok || err != nil {
+		t.Fatalf("removeIfSame(fresh) = %v, %v", ok, err)
+	}
+	if ok, err := removeIfSame(path, []byte("fresh")); ok || err != nil {
+		t.Errorf("removeIfSame on a missing file = %v, %v", ok, err)
+	}
+	if m, _ := filepath.Glob(path + "*"); len(m) > 0 {
+		t.Errorf("files left: %q", m)
+	}
+}
+
+func TestCheckPlanPolicySkipsUnchanged(t *testing.T) {
+	p := &Policy{path: ".smartmsg-policy.yaml", SubjectCase: "lower"}
+	sha := strings.Repeat("a", 40)
+	legacy := PlanItem{SHA: sha, OldMessage: "Legacy commit", NewMessage: "Legacy commit"}
+	redacted := PlanItem{SHA: sha, OldMessage: "Deploy to db1.corp", NewMessage: "Deploy to [REDACTED:internal-host]"}
+	generated := PlanItem{SHA: sha, OldMessage: "wip", NewMessage: "fix: Handle nil"}
+
+	if err := checkPlanPolicy(p, Plan{Items: []PlanItem{legacy}}); err != nil {
+		t.Errorf("unchanged message: %v", err)
+	}
+	if err := checkPlanPolicy(p, Plan{Scrub: true, Items: []PlanItem{legacy, redacted}}); err != nil {
+		t.Errorf("scrub plan: %v", err)
+	}
+	if err := checkPlanPolicy(p, Plan{Items: []PlanItem{legacy, generated}}); err == nil || !strings.Contains(err.Error(), "1 policy violation") {
+		t.Errorf("generated message: %v", err)
+	}
+}
+
+// awsTestEnv points the AWS SDK at files in a temporary directory and
+// clears every other source of region and credentials.
+func awsTestEnv(t *testing.T, config, credentials string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{"config": config, "credentials": credentials} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	for _, k := range []string{"AWS_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY",
+		"AWS_SESSION_TOKEN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI", "BEDROCK_ENDPOINT"} {
+		t.Setenv(k, "")
+	}
+}
+
+func TestLoadAWSConfig(t *testing.T) {
+	awsTestEnv(t, "[default]\nregion = eu-west-1\n\n[profile team]\nregion = us-west-2\n",
+		"[default]\naws_access_key_id = FILEKEY\naws_secret_access_key = filesecret\n\n[team]\naws_access_key_id = TEAMKEY\naws_secret_access_key = teamsecret\n")
+	ctx := t.Context()
+	creds := func() (string, string) {
+		t.Helper()
+		cfg, err := loadAWSConfig(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := cfg.Credentials.Retrieve(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.AccessKeyID, cfg.Region
+	}
+
+	if id, region := creds(); id != "FILEKEY" || region != "eu-west-1" {
+		t.Errorf("default profile: %s in %s", id, region)
+	}
+	t.Setenv("AWS_PROFILE", "team")
+	if id, region := creds(); id != "TEAMKEY" || region != "us-west-2" {
+		t.Errorf("AWS_PROFILE=team: %s in %s", id, region)
+	}
+
+	// The environment comes before the files.
+	t.Setenv("AWS_ACCESS_KEY_ID", "ENVKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	if id, _ := creds(); id != "ENVKEY" {
+		t.Errorf("env: %s", id)
+	}
+	// A key ID without its secret is an error, not a reason to fall back.
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if _, err := loadAWSConfig(ctx); err == nil || !strings.Contains(err.Error(), "AWS_SECRET_ACCESS_KEY is not") {
+		t.Errorf("key ID without secret: %v", err)
+	}
+}
+
+func TestLoadAWSConfigRegion(t *testing.T) {
+	awsTestEnv(t, "", "[default]\naws_access_key_id = K\naws_secret_access_key = s\n")
+	if _, err := loadAWSConfig(t.Context()); err == nil || !strings.Contains(err.Error(), "region is not set") {
+		t.Errorf("no region: %v", err)
+	}
+	t.Setenv("AWS_DEFAULT_REGION", "ap-northeast-1")
+	if cfg, err := loadAWSConfig(t.Context()); err != nil || cfg.Region != "ap-northeast-1" {
+		t.Errorf("AWS_DEFAULT_REGION: %q, %v", cfg.Region, err)
+	}
+}
+
+func TestBedrockComplete(t *testing.T) {
+	awsTestEnv(t, "", "")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	var got struct {
+		path, auth string
+		body       map[string]any
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.path, got.auth = r.URL.EscapedPath(), r.Header.Get("Authorization")
+		got.body = nil
+		_ = json.NewDecoder(r.Body).Decode(&got.body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "denied") {
+			w.Header().Set("X-Amzn-Errortype", "AccessDeniedException")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"message":"no access"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"output":{"message":{"role":"assistant","content":[{"text":"fix: handle it"}]}},"stopReason":"end_turn","usage":{"inputTokens":3,"outputTokens":4,"totalTokens":7}}`))
+	}))
+	defer srv.Close()
+	t.Setenv("BEDROCK_ENDPOINT", srv.URL)
+
+	c, err := NewBedrockClient(GenParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c.Complete(t.Context(), "anthropic.claude-3-5-haiku-20241022-v1:0", "sys", "diff")
+	if err != nil || msg != "fix: handle it" {
+		t.Fatalf("Complete = %q, %v", msg, err)
+	}
+	if got.path != "/model/anthropic.claude-3-5-haiku-20241022-v1%3A0/converse" || !strings.HasPrefix(got.auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+		t.Errorf("request: %s, %s", got.path, got.auth)
+	}
+	if got.body["system"] == nil {
+		t.Errorf("Claude request has no system prompt: %v", got.body)
+	}
+
+	// Titan takes the instructions in the user turn.
+	if _, err := c.Complete(t.Context(), "amazon.titan-text-premier-v1:0", "sys", "diff"); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := json.Marshal(got.body["messages"]); got.body["system"] != nil || !strings.Contains(string(messages), `sys\n\ndiff`) {
+		t.Errorf("Titan request: %v", got.body)
+	}
+
+	_, err = c.Complete(t.Context(), "denied", "sys", "diff")
+	if err == nil || classifyError(err) != statusAuth {
+		t.Errorf("403: %v classified as %q", err, classifyError(err))
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"empty document", "", `{}`},
+		{"comments only", "# nothing\n\n  # here\n", `{}`},
+		{"document marker", "---\na: 1\n", `{"a":1}`},
+		{"scalars", "s: text\nn: 42\nf: 1.5\nneg: -3\nt: true\nF: False\nnil: ~\nnull2: null\nempty:\nver: 1.2.3\n",
+			`{"F":false,"empty":null,"f":1.5,"n":42,"neg":-3,"nil":null,"null2":null,"s":"text","t":true,"ver":"1.2.3"}`},
+		{"comments after values", "a: 1 # one\nb: \"x # not a comment\" # but this is\nc: x#y\n", `{"a":1,"b":"x # not a comment","c":"x#y"}`},
+		{"colon inside a value", "url: http://example.com:8080/x\ntime: 12:30\n", `{"time":"12:30","url":"http://example.com:8080/x"}`},
+		{"nested maps", "plan:\n  limit: 50\n  ai:\n    model: m\ntop: 1\n", `{"plan":{"ai":{"model":"m"},"limit":50},"top":1}`},
+		{"sequences", "a:\n  - 1\n  - two\nb:\n- x\n- y\n", `{"a":[1,"two"],"b":["x","y"]}`},
+		{"sequence of maps", "items:\n  - sha: abc\n    squash: [d, e]\n  - sha: f\n", `{"items":[{"sha":"abc","squash":["d","e"]},{"sha":"f"}]}`},
+		{"nested sequences", "- - 1\n  - 2\n- - 3\n", `[[1,2],[3]]`},
+		{"flow collections", "a: [1, \"two, three\", [x, y], {k: v}]\nb: {x: 1, \"y z\": [2], w: }\nc: []\nd: {}\n",
+			`{"a":[1,"two, three",["x","y"],{"k":"v"}],"b":{"w":null,"x":1,"y z":[2]},"c":[],"d":{}}`},
+		{"quoted keys with escapes", "\"a\\tb\": 1\n'it''s': 2\n\"q\\\"k\": 3\n\"\\u00e9\": 4\n", `{"a\tb":1,"it's":2,"q\"k":3,"é":4}`},
+		{"quoted values", "d: \"line\\nnext\\t\\\"q\\\"\"\ns: 'single ''quoted'' \\n raw'\nnum: \"42\"\n",
+			`{"d":"line\nnext\t\"q\"","num":"42","s":"single 'quoted' \\n raw"}`},
+		{"literal block", "m: |\n  subject\n\n  body\nnext: 1\n", `{"m":"subject\n\nbody\n","next":1}`},
+		{"strip chomping", "m: |-\n  one\n  two\n\n\nnext: 1\n", `{"m":"one\ntwo","next":1}`},
+		{"keep chomping", "m: |+\n  one\n\n\nnext: 1\n", `{"m":"one\n\n\n","next":1}`},
+		{"keep chomping at the end", "m: |+\n  one\n\n", `{"m":"one\n\n"}`},
+		{"indentation indicator", "m: |2\n    indented\n  less\n", `{"m":"  indented\nless\n"}`},
+		{"indicator with chomping", "m: |-2\n   x\n", `{"m":" x"}`},
+		{"comment after block header", "m: | # note\n  text\n", `{"m":"text\n"}`},
+		{"folded block", "m: >\n  one\n  two\n\n  three\n    kept\n", `{"m":"one two\nthree\n  kept\n"}`},
+		{"folded empty lines", "m: >-\n\n  lead\n  on\n\n\n  far\n", `{"m":"\nlead on\n\nfar"}`},
+		{"empty block", "m: |\nnext: 1\n", `{"m":"","next":1}`},
+		{"block in sequence", "- |\n  a\n- b\n", `["a\n","b"]`},
+		{"crlf", "a: 1\r\nb:\r\n  - x\r\n", `{"a":1,"b":["x"]}`},
+		{"YAML-only escapes", `e: "\0 \N \_ \ x \x41"` + "\n", "{\"e\":\"\\u0000 \u0085 \u00a0  x A\"}"},
+		{"multi-line double quote", "d: \"one\n  two\n\n  three\"\n", `{"d":"one two\nthree"}`},
+	} {
+		v, err := parseYAML([]byte(tc.in))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		got, _ := json.Marshal(v)
+		if string(got) != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"tab indentation", "a:\n\tb: 1\n", "cannot start any token"},
+		{"duplicate key", "a: 1\na: 2\n", "already defined"},
+		{"over-indented key", "a: 1\n  b: 2\n", "mapping values are not allowed"},
+		{"not a mapping", "a: 1\njust text\n", "could not find expected ':'"},
+		{"unterminated flow sequence", "a: [1, 2\n", "did not find expected ',' or ']'"},
+		{"unterminated flow mapping", "a: {x: 1\n", "did not find expected ',' or '}'"},
+		{"non-string key", "a: {[x]: 1}\n", "invalid map key"},
+		{"numeric key", "1: x\n", "is not a string"},
+		{"unterminated double quote", "a: \"open\n", "unexpected end of stream"},
+		{"unterminated single quote", "a: 'open\n", "unexpected end of stream"},
+		{"bad escape", "a: \"\\q\"\n", "unknown escape character"},
+		{"text after a quoted value", "a: \"x\" y\n", "did not find expected key"},
+		{"bad block header", "a: |x\n  t\n", "did not find expected comment or line break"},
+		{"content after the root", "- a\nb: 1\n", "did not find expected '-' indicator"},
+	} {
+		if v, err := parseYAML([]byte(tc.in)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, %v; want an error containing %q", tc.name, v, err, tc.want)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	full := Policy{
+		Types:            []string{"feat", "fix"},
+		Scopes:           []string{"api", "cli"},
+		RequireScope:     true,
+		SubjectCase:      "lower",
+		SubjectMax:       40,
+		MaxBodyWidth:     30,
+		ForbiddenWords:   []string{"WIP", "C++", "hack"},
+		RequiredTrailers: []string{"Signed-off-by"},
+	}
+	signed := "\n\nSigned-off-by: A <a@example.com>"
+	for _, tc := range []struct {
+		name   string
+		policy Policy
+		msg    string
+		want   []string
+	}{
+		{"all rules pass", full, "fix(api): handle empty bodies" + signed, nil},
+		{"type not allowed", full, "docs(api): describe it" + signed, []string{`type "docs" is not allowed (allowed: feat, fix)`}},
+		{"scope not allowed", full, "fix(ui): align" + signed, []string{`scope "ui" is not allowed (allowed: api, cli)`}},
+		{"scope required", full, "fix: align" + signed, []string{"subject has no scope"}},
+		{"scope optional", Policy{Scopes: []string{"api"}}, "fix: align", nil},
+		{"breaking change marker", full, "feat(cli)!: drop --old" + signed, nil},
+		{"emoji prefix", Policy{Types: []string{"feat"}}, "✨ feat: add login", nil},
+		{"not conventional", full, "Fixed stuff" + signed, []string{`subject "Fixed stuff" is not "type(scope): description"`, "subject description must start lowercase"}},
+		{"free-form allowed without type rules", Policy{SubjectCase: "sentence"}, "Fixed stuff", nil},
+		{"lowercase required", full, "fix(api): Handle it" + signed, []string{"subject description must start lowercase"}},
+		{"capital required", Policy{SubjectCase: "sentence"}, "fix: handle it", []string{"subject description must start with a capital letter"}},
+		{"leading digit has no case", Policy{SubjectCase: "sentence"}, "fix: 404 on empty path", nil},
+		{"subject too long", full, "fix(api): " + strings.Repeat("x", 31) + signed, []string{"subject is 41 characters (max 40)"}},
+		{"body line too wide", full, "fix(api): x\n\nthis body line is wider than thirty\nshort" + signed, []string{"line 3 is 35 characters (max 30)"}},
+		{"unbreakable body line", full, "fix(api): x\n\nhttps://example.com/a/very/long/path/that/cannot/wrap" + signed, nil},
+		{"forbidden word", full, "fix(api): wip parser" + signed, []string{`contains forbidden word "WIP"`}},
+		{"forbidden word in body", full, "fix(api): parser\n\nquick hack." + signed, []string{`contains forbidden word "hack"`}},
+		{"forbidden word inside another", full, "fix(api): hackathon notes" + signed, nil},
+		{"forbidden word ending in punctuation", full, "fix(api): port to C++" + signed, []string{`contains forbidden word "C++"`}},
+		{"punctuated word followed by text", full, "fix(api): use C++ here" + signed, []string{`contains forbidden word "C++"`}},
+		{"punctuated word as a prefix", full, "fix(api): port to C++20" + signed, nil},
+		{"forbidden word inside a non-ASCII word", full, "fix(api): überhack" + signed, nil},
+		{"forbidden word before an accented letter", full, "fix(api): hacké" + signed, nil},
+		{"forbidden word next to Cyrillic", Policy{ForbiddenWords: []string{"wip"}}, "fix: wipчасть", nil},
+		{"forbidden word after accented punctuation", full, "fix(api): «hack»" + signed, []string{`contains forbidden word "hack"`}},
+		{"missing trailer", full, "fix(api): x", []string{"missing required trailer Signed-off-by"}},
+		{"trailer key is case-insensitive", full, "fix(api): x\n\nsigned-off-by: A <a@example.com>", nil},
+	} {
+		tc.policy.compile()
+		if got := tc.policy.check(tc.msg); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: check(%q)\n got %q\nwant %q", tc.name, tc.msg, got, tc.want)
+		}
+	}
+}
+
+// planItem describes commit sha as plan would, with msg as its new message.
+func planItem(t *testing.T, sha, msg string) PlanItem {
+	t.Helper()
+	f := strings.Split(mustGit(t, "log", "-1", "--format=%an%x00%ae%x00%aI%x00%B", sha), "\x00")
+	return PlanItem{SHA: sha, AuthorName: f[0], AuthorEmail: f[1], AuthorDate: f[2], OldMessage: f[3], NewMessage: msg}
+}
+
+// branchLog is what apply must get right on branch: each commit's tree,
+// parents' count, message, author and committer.
+func branchLog(t *testing.T, branch string) []string {
+	t.Helper()
+	return strings.Split(mustGit(t, "log", "--format=%T %p|%B|%an <%ae> %aI|%cn <%ce> %cI%x1e", "--no-abbrev", branch), "\x1e")
+}
+
+func TestApplyCommitTree(t *testing.T) {
+	tempRepo(t)
+	base := commitFile(t, "a.txt", "a\n", "init")
+	b := commitFile(t, "b.txt", "b\n", "add b")
+	mustGit(t, "commit", "-q", "--allow-empty", "-m", "nothing")
+	empty := mustGit(t, "rev-parse", "HEAD")
+	c := commitFile(t, "c.txt", "c\n", "add c")
+	plan := Plan{Head: c, Items: []PlanItem{
+		planItem(t, b, "feat: add b\n\nWhy b."),
+		planItem(t, empty, "chore: nothing"),
+		planItem(t, c, "feat: add c"),
+	}}
+	opts := applyOptions{Empty: "drop", DateMode: "preserve", NoPostRewrite: true, Orig: "main"}
+
+	// The commit-tree backend writes exactly what cherry-picking does.
+	opts.Branch = "tree"
+	if err := applyCommitTree(plan, base, opts); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := currentHead(); cur != "main" {
+		t.Errorf("commit-tree checked out %s", cur)
+	}
+	mustGit(t, "checkout", "-q", "--detach", base)
+	opts.Branch = "pick"
+	if err := applyItems(plan, opts, 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	tree, pick := branchLog(t, "tree"), branchLog(t, "pick")
+	if !slices.Equal(tree, pick) {
+		t.Errorf("commit-tree and cherry-pick differ:\n%q\n%q", tree, pick)
+	}
+	if got := mustGit(t, "log", "--format=%s", "tree"); got != "feat: add c\nfeat: add b\ninit" {
+		t.Errorf("empty commit not dropped:\n%s", got)
+	}
+	if got := mustGit(t, "rev-parse", "tree^{tree}"); got != mustGit(t, "rev-parse", c+"^{tree}") {
+		t.Errorf("tip tree %s differs from the original", got)
+	}
+
+	opts.Branch, opts.Empty = "keep", "keep"
+	if err := applyCommitTree(plan, base, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGit(t, "log", "--format=%s", "keep"); got != "feat: add c\nchore: nothing\nfeat: add b\ninit" {
+		t.Errorf("--empty keep:\n%s", got)
+	}
+
+	// A consolidated item takes its last commit's tree.
+	squashed := Plan{Head: c, Items: []PlanItem{planItem(t, b, "feat: add b and c")}}
+	squashed.Items[0].Squash = []string{empty, c}
+	opts.Branch = "squash"
+	if err := applyCommitTree(squashed, base, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGit(t, "log", "--format=%s %T", "squash"); !strings.HasPrefix(got, "feat: add b and c "+mustGit(t, "rev-parse", c+"^{tree}")+"\ninit ") {
+		t.Errorf("squash:\n%s", got)
+	}
+
+	// Leaving a commit out would silently take its changes along.
+	gap := Plan{Head: c, Items: []PlanItem{plan.Items[0], plan.Items[2]}}
+	opts.Branch = "gap"
+	if err := applyCommitTree(gap, base, opts); err == nil || !strings.Contains(err.Error(), "does not follow") {
+		t.Errorf("broken chain: %v", err)
+	}
+	if _, err := git("rev-parse", "--verify", "--quiet", "refs/heads/gap"); err == nil {
+		t.Error("a failed run created its branch")
+	}
+
+	// A branch created in the meantime is not overwritten.
+	opts.Branch = "taken"
+	mustGit(t, "branch", "taken", base)
+	if err := applyCommitTree(plan, base, opts); err == nil {
+		t.Error("an existing branch was overwritten")
+	}
+	if got := mustGit(t, "rev-parse", "taken"); got != base {
+		t.Errorf("taken moved to %s", got)
+	}
+}
+
+func TestExportKeepsChangeIDs(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "a.txt", "a\n", "init")
+	const id = "I0123456789abcdef0123456789abcdef01234567"
+	a := commitFile(t, "a.txt", "a2\n", "update a\n\nChange-Id: "+id)
+	b := commitFile(t, "b.txt", "b\n", "add b")
+	plan := Plan{Head: b, Items: []PlanItem{
+		planItem(t, a, "chore: update a\n\n- Update a\n"),
+		planItem(t, b, "feat: add b"),
+	}}
+	export := func(plan Plan) string {
+		t.Helper()
+		if err := savePlan("plan.json", plan); err != nil {
+			t.Fatal(err)
+		}
+		if err := cmdExport([]string{"--format", "filter-repo", "--out", "callback.py"}); err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.ReadFile("callback.py")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	out := export(plan)
+	if want := `"chore: update a\n\n- Update a\n\nChange-Id: ` + id + `\n"`; !strings.Contains(out, want) {
+		t.Errorf("Change-Id not carried over, want %s in:\n%s", want, out)
+	}
+	// Once the series uses Change-Ids, the commits without one get a new one.
+	withNew := regexp.MustCompile(`"feat: add b\\n\\nChange-Id: I[0-9a-f]{40}\\n"`)
+	if !withNew.MatchString(out) {
+		t.Errorf("no Change-Id generated next to an existing one:\n%s", out)
+	}
+
+	// Outside Gerrit a series without Change-Ids gets none.
+	alone := Plan{Head: b, Items: plan.Items[1:]}
+	if out := export(alone); !strings.Contains(out, `"feat: add b\n"`) {
+		t.Errorf("Change-Id generated outside Gerrit:\n%s", out)
+	}
+
+	// --mode is enforced as apply does.
+	alone.Mode = modeKeepSubject
+	alone.Items[0].NewMessage = "feat: add b\n\nExplain b."
+	if out := export(alone); !strings.Contains(out, `"add b\n\nExplain b.\n"`) {
+		t.Errorf("keep-subject not enforced:\n%s", out)
+	}
+
+	mustGit(t, "config", "gerrit.createChangeId", "true")
+	alone.Mode = ""
+	alone.Items[0].NewMessage = "feat: add b"
+	if out := export(alone); !withNew.MatchString(out) {
+		t.Errorf("no Change-Id generated in a Gerrit repository:\n%s", out)
+	}
+}
+
+func TestKeepChangeID(t *testing.T) {
+	const (
+		id1 = "I1111111111111111111111111111111111111111"
+		id2 = "I2222222222222222222222222222222222222222"
+		id3 = "I3333333333333333333333333333333333333333"
+	)
+	for _, tc := range []struct {
+		name string
+		msg  string
+		olds []string
+		want string
+	}{
+		{name: "none", msg: "fix: x", olds: []string{"x"}, want: "fix: x"},
+		{name: "carried over", msg: "fix: x", olds: []string{"x\n\nChange-Id: " + id1}, want: "fix: x\n\nChange-Id: " + id1},
+		{name: "last of several", msg: "fix: x", olds: []string{"x\n\nChange-Id: " + id1 + "\nChange-Id: " + id2}, want: "fix: x\n\nChange-Id: " + id2},
+		{name: "squash head wins", msg: "fix: x", olds: []string{"x\n\nChange-Id: " + id1, "y\n\nChange-Id: " + id2}, want: "fix: x\n\nChange-Id: " + id1},
+		{name: "squash head without one", msg: "fix: x", olds: []string{"x", "y\n\nChange-Id: " + id2}, want: "fix: x\n\nChange-Id: " + id2},
+		{name: "existing trailer kept", msg: "fix: x\n\nChange-Id: " + id3, olds: []string{"x\n\nChange-Id: " + id1}, want: "fix: x\n\nChange-Id: " + id3},
+		{name: "joins other trailers", msg: "fix: x\n\nSigned-off-by: A <a@example.com>", olds: []string{"x\n\nChange-Id: " + id1}, want: "fix: x\n\nSigned-off-by: A <a@example.com>\nChange-Id: " + id1},
+	} {
+		if got := keepChangeID(tc.msg, tc.olds...); got != tc.want {
+			t.Errorf("%s: keepChangeID = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewChangeID(t *testing.T) {
+	id := newChangeID("abc", "fix: x")
+	if !regexp.MustCompile(`^I[0-9a-f]{40}$`).MatchString(id) {
+		t.Errorf("newChangeID = %q", id)
+	}
+	if changeID("fix: x\n\nChange-Id: "+id) != id {
+		t.Errorf("changeID does not read back %q", id)
+	}
+
+	tempRepo(t)
+	commitFile(t, "a.txt", "a\n", "init")
+	a := commitFile(t, "a.txt", "a2\n", "update a")
+	it := planItem(t, a, "fix: update a")
+	for _, tc := range []struct {
+		name   string
+		setup  func()
+		gerrit bool
+	}{
+		{name: "plain repository", setup: func() {}},
+		{name: "gerrit.createChangeId", setup: func() { mustGit(t, "config", "gerrit.createChangeId", "true") }, gerrit: true},
+		{name: "gerrit.createChangeId false", setup: func() { mustGit(t, "config", "gerrit.createChangeId", "false") }},
+		{name: "commit-msg hook", setup: func() {
+			path := filepath.Join(mustGit(t, "rev-parse", "--git-path", "hooks"), "commit-msg")
+			if err := os.WriteFile(path, []byte("#!/bin/sh\n# adds a Change-Id\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, gerrit: true},
+	} {
+		tc.setup()
+		if got := gerritRepo(); got != tc.gerrit {
+			t.Errorf("%s: gerritRepo() = %v, want %v", tc.name, got, tc.gerrit)
+		}
+		bodies, gerrit, err := originalBodies([]PlanItem{it})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := applyMessage(it, messageMode{}, false, bodies, nil, gerrit)
+		if got := changeID(msg) != ""; got != tc.gerrit {
+			t.Errorf("%s: Change-Id generated = %v, want %v: %q", tc.name, got, tc.gerrit, msg)
+		}
+	}
+}
+
+func TestGerritPushCommand(t *testing.T) {
+	remote := t.TempDir()
+	tempRepo(t)
+	commitFile(t, "a.txt", "a\n", "init")
+	mustGit(t, "init", "-q", "--bare", remote)
+	mustGit(t, "remote", "add", "review", remote)
+	mustGit(t, "push", "-q", "review", "main:stable")
+	mustGit(t, "branch", "tracking", "--track", "review/stable")
+	for _, tc := range []struct {
+		orig, want string
+	}{
+		{orig: "main", want: "git push origin rewritten:refs/for/<target-branch>"},
+		{orig: "tracking", want: "git push review rewritten:refs/for/stable"},
+	} {
+		if got := gerritPushCommand("rewritten", tc.orig); got != tc.want {
+			t.Errorf("gerritPushCommand(%s) = %q, want %q", tc.orig, got, tc.want)
+		}
+	}
+}
+
+func TestResumeApply(t *testing.T) {
+	tempRepo(t)
+	base := commitFile(t, "f.txt", "1\n", "init")
+	x := commitFile(t, "f.txt", "2\n", "two")
+	y := commitFile(t, "g.txt", "g\n", "add g")
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	plan := Plan{Head: y, Items: []PlanItem{planItem(t, x, "fix: two"), planItem(t, y, "feat: add g")}}
+	if err := savePlan(planPath, plan); err != nil {
+		t.Fatal(err)
+	}
+	opts := applyOptions{Plan: planPath, Empty: "drop", DateMode: "preserve", NoPostRewrite: true, Orig: "main"}
+	statePath, _ := applyStatePath()
+
+	// Interrupted between items: --continue picks up where it stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer func(ctx context.Context) { rootCtx = ctx }(rootCtx)
+	rootCtx = ctx
+	mustGit(t, "checkout", "-q", "--detach", base)
+	opts.Branch = "resumed"
+	if err := applyItems(plan, opts, 0, 0, nil); err == nil || !strings.Contains(err.Error(), "interrupted after 0 of 2") {
+		t.Fatalf("interrupted apply: %v", err)
+	}
+	if cur, _ := currentHead(); cur != "main" {
+		t.Errorf("interrupted apply left %s checked out", cur)
+	}
+	rootCtx = context.Background()
+	if err := resumeApply(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGit(t, "log", "--format=%s", "resumed"); got != "feat: add g\nfix: two\ninit" {
+		t.Errorf("resumed branch:\n%s", got)
+	}
+	if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("state file left behind: %v", err)
+	}
+	if err := resumeApply(false); err == nil || !strings.Contains(err.Error(), "no interrupted apply") {
+		t.Errorf("nothing to resume: %v", err)
+	}
+
+	// A conflict stops with the pick in the index; --continue commits the
+	// resolution, and --abort restores the checkout.
+	mustGit(t, "checkout", "-q", "main")
+	mustGit(t, "checkout", "-q", "-b", "other", base)
+	onto := commitFile(t, "f.txt", "other\n", "other")
+	mustGit(t, "checkout", "-q", "main")
+	conflicted := func(branch string) {
+		t.Helper()
+		mustGit(t, "checkout", "-q", "--detach", onto)
+		opts.Branch, opts.Onto = branch, "other"
+		if err := applyItems(plan, opts, 0, 0, nil); err == nil || !strings.Contains(err.Error(), "conflicts in:\nf.txt") {
+			t.Fatalf("conflicting apply: %v", err)
+		}
+	}
+	conflicted("resolved")
+	if err := resumeApply(false); err == nil || !strings.Contains(err.Error(), "unresolved conflicts remain") {
+		t.Errorf("continue before resolving: %v", err)
+	}
+	if err := os.WriteFile("f.txt", []byte("resolved\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustGit(t, "add", "f.txt")
+	if err := resumeApply(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGit(t, "log", "--format=%s", "resolved"); got != "feat: add g\nfix: two\nother\ninit" {
+		t.Errorf("resolved branch:\n%s", got)
+	}
+	if got := mustGit(t, "show", "resolved:f.txt"); got != "resolved" {
+		t.Errorf("resolution not committed: %q", got)
+	}
+
+	mustGit(t, "checkout", "-q", "main")
+	conflicted("aborted")
+	if err := resumeApply(true); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := currentHead(); cur != "main" {
+		t.Errorf("--abort left %s checked out", cur)
+	}
+	if _, err := git("rev-parse", "--verify", "--quiet", "refs/heads/aborted"); err == nil {
+		t.Error("--abort created the branch")
+	}
+	if st := mustGit(t, "status", "--porcelain"); st != "" {
+		t.Errorf("--abort left changes:\n%s", st)
+	}
+	if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("--abort left the state file: %v", err)
+	}
+}
+
+func TestAuthorMap(t *testing.T) {
+	tempRepo(t)
+	mailmap := `# the four .mailmap forms
+Proper Name <commit@example.com>
+<proper@example.com> <old@example.com>
+Both Fixed <both@example.com> <both-old@example.com>
+Only Bob <bob@example.com> Bob <shared@example.com>
+Name Fix <split@example.com>
+<split-new@example.com> <split@example.com>
+`
+	if err := os.WriteFile(".mailmap", []byte(mailmap), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadAuthorMap(".mailmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ name, email, wantName, wantEmail string }{
+		{"Someone", "commit@example.com", "Proper Name", "commit@example.com"},
+		{"Someone", "COMMIT@example.com", "Proper Name", "COMMIT@example.com"},
+		{"Someone", "old@example.com", "Someone", "proper@example.com"},
+		{"Anyone", "both-old@example.com", "Both Fixed", "both@example.com"},
+		{"bob", "shared@example.com", "Only Bob", "bob@example.com"},
+		{"Alice", "shared@example.com", "Alice", "shared@example.com"},
+		{"Split", "split@example.com", "Name Fix", "split-new@example.com"},
+		{"Stranger", "stranger@example.com", "Stranger", "stranger@example.com"},
+	} {
+		name, email := m.apply(tc.name, tc.email)
+		if name != tc.wantName || email != tc.wantEmail {
+			t.Errorf("apply(%q, %q) = %q, %q; want %q, %q", tc.name, tc.email, name, email, tc.wantName, tc.wantEmail)
+		}
+		// git reads the same file the same way.
+		want := tc.wantName + " <" + tc.wantEmail + ">"
+		if got := mustGit(t, "-c", "mailmap.file=.mailmap", "check-mailmap", tc.name+" <"+tc.email+">"); got != want {
+			t.Errorf("git check-mailmap %s <%s> = %q; apply disagrees with git", tc.name, tc.email, got)
+		}
+	}
+
+	// apply rewrites the authors of the commits it writes.
+	base := commitFile(t, "a.txt", "a\n", "init")
+	mustGit(t, "-c", "user.email=old@example.com", "commit", "-q", "--allow-empty", "-m", "old address")
+	head := mustGit(t, "rev-parse", "HEAD")
+	plan := Plan{Head: head, Items: []PlanItem{planItem(t, head, "chore: old address")}}
+	opts := applyOptions{Branch: "mapped", Empty: "keep", DateMode: "preserve", NoPostRewrite: true, AuthorMap: ".mailmap"}
+	if err := applyCommitTree(plan, base, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGit(t, "log", "-1", "--format=%an <%ae> / %cn <%ce>", "mapped"); got != "Test <proper@example.com> / Test <proper@example.com>" {
+		t.Errorf("mapped author: %s", got)
+	}
+
+	for _, bad := range []string{"no email here\n", "Name <>\n", "<a@example.com> <b@example.com> trailing\n"} {
+		if err := os.WriteFile("bad.mailmap", []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadAuthorMap("bad.mailmap"); err == nil {
+			t.Errorf("loadAuthorMap(%q) accepted it", bad)
+		}
+	}
+}
+
+func TestRetag(t *testing.T) {
+	tempRepo(t)
+	base := commitFile(t, "a.txt", "a\n", "init")
+	b := commitFile(t, "b.txt", "b\n", "add b")
+	mustGit(t, "commit", "-q", "--allow-empty", "-m", "nothing")
+	empty := mustGit(t, "rev-parse", "HEAD")
+	c := commitFile(t, "c.txt", "c\n", "add c")
+	mustGit(t, "tag", "light", b)
+	cmd := exec.Command("git", "tag", "-a", "-m", "Release 1\n\nNotes.", "v1", c)
+	cmd.Env = gitEnv("GIT_COMMITTER_NAME=Releaser", "GIT_COMMITTER_EMAIL=rel@example.com", "GIT_COMMITTER_DATE=2024-05-06T07:08:09+00:00")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	mustGit(t, "tag", "moved", b)
+	mustGit(t, "tag", "dropped", empty)
+	plan := Plan{Head: c, Items: []PlanItem{planItem(t, b, "feat: add b"), planItem(t, empty, "chore: nothing"), planItem(t, c, "feat: add c")}}
+	var err error
+	if plan.Tags, err = rangeTags(plan.Items); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Tags) != 4 {
+		t.Fatalf("rangeTags = %+v", plan.Tags)
+	}
+	mustGit(t, "tag", "-f", "moved", base)
+
+	opts := applyOptions{Branch: "new", Empty: "drop", DateMode: "preserve", NoPostRewrite: true, Retag: true}
+	if err := applyCommitTree(plan, base, opts); err != nil {
+		t.Fatal(err)
+	}
+	newB, newC := mustGit(t, "rev-parse", "new~1"), mustGit(t, "rev-parse", "new")
+	for tag, want := range map[string]string{
+		"light":   newB,
+		"v1":      newC,
+		"moved":   base,  // moved since planning, so left alone
+		"dropped": empty, // its commit is not in the rewrite
+	} {
+		if got := mustGit(t, "rev-parse", tag+"^{commit}"); got != want {
+			t.Errorf("%s points at %s, want %s", tag, got, want)
+		}
+	}
+	// The annotated tag keeps its message, tagger and date, and the
+	// original is kept aside.
+	if got := mustGit(t, "for-each-ref", "--format=%(taggername) %(taggeremail) %(taggerdate:iso-strict) %(contents)", "refs/tags/v1"); got != "Releaser <rel@example.com> 2024-05-06T07:08:09+00:00 Release 1\n\nNotes." {
+		t.Errorf("v1: %q", got)
+	}
+	if got := mustGit(t, "rev-parse", originalTagsRef+"v1^{commit}"); got != c {
+		t.Errorf("original v1 kept at %s, want %s", got, c)
+	}
+	if _, err := git("rev-parse", "--verify", "--quiet", originalTagsRef+"moved"); err == nil {
+		t.Error("a tag left alone was set aside")
+	}
+
+	// A second run finds the tags already moved and leaves them.
+	opts.Branch = "again"
+	plan.Items[2].NewMessage = "feat: add c again"
+	if err := applyCommitTree(plan, base, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustGit(t, "rev-parse", "v1^{commit}"); got != newC || got == mustGit(t, "rev-parse", "again") {
+		t.Errorf("second apply moved v1 to %s", got)
+	}
+}
+
+func TestIssueContextJiraProjects(t *testing.T) {
+	var asked []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, strings.TrimPrefix(r.URL.Path, "/rest/api/2/issue/"))
+		_, _ = w.Write([]byte(`{"fields":{"summary":"Login fails","description":"Steps."}}`))
+	}))
+	defer srv.Close()
+	t.Setenv("JIRA_BASE_URL", srv.URL)
+	msg := "fix: PROJ-12 read UTF-8 names, check SHA-256 and ISO-8601 dates (ops-3, OPS-3)"
+
+	t.Setenv("JIRA_PROJECTS", "")
+	if got := newIssueFetcher().context(t.Context(), msg); got != "" || len(asked) > 0 {
+		t.Errorf("without JIRA_PROJECTS: asked for %q, got %q", asked, got)
+	}
+	t.Setenv("JIRA_PROJECTS", "proj, OPS")
+	got := newIssueFetcher().context(t.Context(), msg, "feature/PROJ-12-login")
+	if !slices.Equal(asked, []string{"PROJ-12", "OPS-3"}) {
+		t.Errorf("asked for %q, want PROJ-12 and OPS-3 only", asked)
+	}
+	if !strings.Contains(got, "Login fails") {
+		t.Errorf("context = %q", got)
+	}
+}
+
+// fakeBatchAPI serves the OpenAI chat endpoint, and the file and batch
+// endpoints plan --batch-api and --collect use. Its batch finishes with
+// status, answering every request but the last from the batch; that one
+// fails inside it and is answered by the chat endpoint instead.
+type fakeBatchAPI struct {
+	status string
+	input  []string // custom_ids submitted
+	live   int      // chat completions asked directly
+}
+
+func (f *fakeBatchAPI) serve(t *testing.T) *httptest.Server {
+	t.Helper()
+	completion := func(content string) map[string]any {
+		return map[string]any{
+			"id": "chatcmpl", "object": "chat.completion", "model": "gpt-test",
+			"choices": []any{map[string]any{"index": 0, "finish_reason": "stop", "message": map[string]any{"role": "assistant", "content": content}}},
+			"usage":   map[string]any{"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15},
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reply any
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/files":
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.input = nil
+			dec := json.NewDecoder(file)
+			for {
+				var line struct {
+					CustomID string `json:"custom_id"`
+					URL      string `json:"url"`
+				}
+				if dec.Decode(&line) != nil {
+					break
+				}
+				if line.URL != "/v1/chat/completions" {
+					t.Errorf("batch line for %s", line.URL)
+				}
+				f.input = append(f.input, line.CustomID)
+			}
+			reply = map[string]any{"id": "file-in", "object": "file", "purpose": "batch", "filename": "smartmsg-batch.jsonl", "status": "processed"}
+		case r.URL.Path == "/v1/batches" || r.URL.Path == "/v1/batches/batch_1":
+			status := f.status
+			if r.Method == "POST" {
+				status = "validating"
+			}
+			reply = map[string]any{
+				"id": "batch_1", "object": "batch", "endpoint": "/v1/chat/completions", "input_file_id": "file-in",
+				"completion_window": "24h", "status": status, "output_file_id": "file-out", "error_file_id": "file-err",
+				"request_counts": map[string]any{"completed": len(f.input) - 1, "failed": 1, "total": len(f.input)},
+				"errors":         map[string]any{"data": []any{map[string]any{"message": "quota exceeded"}}},
+			}
+		case r.URL.Path == "/v1/files/file-out/content" || r.URL.Path == "/v1/files/file-err/content":
+			out := r.URL.Path == "/v1/files/file-out/content"
+			for i, id := range f.input {
+				last := i == len(f.input)-1
+				if last == out {
+					continue
+				}
+				line := map[string]any{"custom_id": id, "response": map[string]any{"status_code": 200, "body": completion("fix: answered by the batch\n\nConfidence: 0.9")}}
+				if last {
+					line["response"] = map[string]any{"status_code": 500, "body": map[string]any{"error": map[string]any{"message": "boom"}}}
+				}
+				b, _ := json.Marshal(line)
+				w.Write(append(b, '\n'))
+			}
+			return
+		case r.Method == "POST" && r.URL.Path == "/v1/chat/completions":
+			f.live++
+			reply = completion("fix: answered directly\n\nConfidence: 0.9")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	t.Setenv("OPENAI_API_BASE", srv.URL+"/v1/")
+	return srv
+}
+
+func TestPlanBatchAPI(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "a.txt", "a\n", "init")
+	b := commitFile(t, "b.txt", "b\n", "add b")
+	c := commitFile(t, "c.txt", "c\n", "add c")
+	api := &fakeBatchAPI{status: "completed"}
+	api.serve(t)
+
+	// The provider is matched in any case, as for a plain plan.
+	args := []string{"--provider", "OpenAI", "--limit", "2", "--model", "gpt-test", "--detect-trivial=false"}
+	if err := cmdPlan(append(args, "--batch-api")); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.input) != 2 {
+		t.Fatalf("submitted %d requests, want 2", len(api.input))
+	}
+	if _, err := os.Stat("plan.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("--batch-api wrote a plan: %v", err)
+	}
+
+	if err := cmdPlan(append(args, "--collect", "batch_1")); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := loadPlan("plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, it := range plan.Items {
+		got[it.SHA] = firstLine(it.NewMessage)
+	}
+	// Commits are planned oldest first, so the failed last request is c's.
+	want := map[string]string{b: "fix: answered by the batch", c: "fix: answered directly"}
+	if !maps.Equal(got, want) {
+		t.Errorf("plan messages = %q, want %q", got, want)
+	}
+	if api.live != 1 {
+		t.Errorf("%d requests asked directly, want only the one that failed in the batch", api.live)
+	}
+	if plan.Provider != "openai" {
+		t.Errorf("plan provider = %q", plan.Provider)
+	}
+
+	oc, err := NewOpenAIClient(GenParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ status, err string }{
+		{status: "in_progress", err: "batch batch_1 is in_progress (1 of 2 done); try again later"},
+		{status: "failed", err: "batch batch_1 failed: quota exceeded"},
+	} {
+		api.status = tc.status
+		if _, err := collectBatch(context.Background(), oc, "batch_1"); err == nil || err.Error() != tc.err {
+			t.Errorf("%s batch: err = %v, want %q", tc.status, err, tc.err)
+		}
+	}
+	// An expired batch keeps what it finished.
+	api.status = "expired"
+	res, err := collectBatch(context.Background(), oc, "batch_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.results) != 1 || len(res.failed) != 1 {
+		t.Errorf("expired batch: %d results, %d failed", len(res.results), len(res.failed))
+	}
+	if _, err := res.Complete(context.Background(), "gpt-test", "other system", "other user"); err == nil || !strings.Contains(err.Error(), "is not in batch batch_1") {
+		t.Errorf("prompt missing from the batch: err = %v", err)
+	}
+}
+
+func TestPlanDedup(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "README", "demo\n", "init")
+	const id1, id3 = "I1111111111111111111111111111111111111111", "I3333333333333333333333333333333333333333"
+	first := commitFile(t, "a.txt", "x\n", "add a\n\nChange-Id: "+id1)
+	mustGit(t, "rm", "-q", "a.txt")
+	mustGit(t, "commit", "-q", "-m", "drop a")
+	again := commitFile(t, "a.txt", "x\n", "add a again\n\nChange-Id: "+id3)
+	api := &fakeBatchAPI{}
+	api.serve(t)
+
+	if err := cmdPlan([]string{"--limit", "3", "--model", "gpt-test", "--detect-trivial=false"}); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := loadPlan("plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.live != 2 {
+		t.Errorf("%d AI requests for 3 commits, 2 with the same diff; want 2", api.live)
+	}
+	if len(plan.Items) != 3 {
+		t.Fatalf("%d items, want 3", len(plan.Items))
+	}
+	orig, repeat := plan.Items[0], plan.Items[2]
+	if orig.SHA != first || repeat.SHA != again {
+		t.Fatalf("items in the wrong order: %s, %s", orig.SHA, repeat.SHA)
+	}
+	if repeat.RepeatOf != first || orig.RepeatOf != "" || plan.Items[1].RepeatOf != "" {
+		t.Errorf("repeat_of = %q, %q, %q; want only the last to repeat the first", orig.RepeatOf, plan.Items[1].RepeatOf, repeat.RepeatOf)
+	}
+	if repeat.DiffHash != orig.DiffHash || repeat.NewMessage != orig.NewMessage {
+		t.Errorf("repeat differs from its original: %+v / %+v", repeat, orig)
+	}
+
+	// Applied, the repeat keeps its own Change-Id.
+	bodies, gerrit, err := originalBodies(plan.Items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := changeID(applyMessage(repeat, messageMode{}, false, bodies, nil, gerrit)); got != id3 {
+		t.Errorf("repeat applied with Change-Id %q, want %q", got, id3)
+	}
+
+	// --dedup=false asks for every commit.
+	api.live = 0
+	if err := cmdPlan([]string{"--limit", "3", "--model", "gpt-test", "--detect-trivial=false", "--dedup=false"}); err != nil {
+		t.Fatal(err)
+	}
+	if api.live != 3 {
+		t.Errorf("--dedup=false: %d AI requests, want 3", api.live)
+	}
+}
+
+func TestExportFormatRequired(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "a.txt", "a\n", "init")
+	a := commitFile(t, "a.txt", "a2\n", "update a")
+	b := commitFile(t, "b.txt", "b\n", "add b")
+	plan := Plan{Head: b, Items: []PlanItem{planItem(t, a, "feat: update a and add b")}}
+	plan.Items[0].Squash = []string{b}
+	if err := savePlan("plan.json", plan); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{err: "--format is required"},
+		{args: []string{"--format", "patch"}, err: `unknown format "patch"`},
+		{args: []string{"--format", "filter-repo"}, err: "squashes 1 commit(s), which filter-repo cannot express; use apply"},
+	} {
+		if err := cmdExport(tc.args); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("export %q: err = %v, want %q", tc.args, err, tc.err)
+		}
+	}
+}
+
+func TestFilterRepoCallback(t *testing.T) {
+	items := []PlanItem{
+		{SHA: "1111111111111111111111111111111111111111", NewMessage: "fix: quote \"x\" and 'y'\n\nPath C:\\tmp\\new, tab\there.\n\n"},
+		{SHA: "2222222222222222222222222222222222222222", NewMessage: "docs: 日本語の説明 \u2028 ok"},
+	}
+	got := filterRepoCallback(items)
+	for _, want := range []string{
+		`"1111111111111111111111111111111111111111": "fix: quote \"x\" and 'y'\n\nPath C:\\tmp\\new, tab\there.\n",`,
+		`"2222222222222222222222222222222222222222": "docs: 日本語の説明 \u2028 ok\n",`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("callback lacks %s:\n%s", want, got)
+		}
+	}
+
+	// The callback is run by filter-repo as the body of a Python function.
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not available")
+	}
+	script := "class Commit:\n    original_id = b\"1111111111111111111111111111111111111111\"\n    message = b\"old\"\n" +
+		"commit = Commit()\n" + got + "import sys\nsys.stdout.buffer.write(commit.message)\n"
+	out, err := exec.Command(python, "-c", script).Output()
+	if err != nil {
+		t.Fatalf("python: %v\n%s", err, script)
+	}
+	if want := strings.TrimRight(items[0].NewMessage, "\n") + "\n"; string(out) != want {
+		t.Errorf("python message = %q, want %q", out, want)
+	}
+}
+
+func TestReplaceMessageRules(t *testing.T) {
+	sha := func(c byte) string { return strings.Repeat(string(c), 40) }
+	items := []PlanItem{
+		{SHA: sha('1'), OldMessage: "fix stuff\n\nbody", NewMessage: "fix(io): close the reader\n\nWhy."},
+		{SHA: sha('2'), OldMessage: "wip", NewMessage: "feat: add a"},
+		{SHA: sha('3'), OldMessage: "wip", NewMessage: "feat: add b"},
+		{SHA: sha('4'), OldMessage: "map a==>b", NewMessage: "refactor: rename a to b"},
+		{SHA: sha('5'), OldMessage: "docs: fine", NewMessage: "docs: fine\n\nNew body."},
+		{SHA: sha('6'), OldMessage: "", NewMessage: "chore: empty"},
+	}
+	if got, want := replaceMessageRules(items), "literal:fix stuff==>fix(io): close the reader\n"; got != want {
+		t.Errorf("replaceMessageRules = %q, want %q", got, want)
+	}
+}
+
+func TestCommandLineFlags(t *testing.T) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	var af aiFlags
+	af.register(fs)
+	fs.Bool("emoji", false, "")
+	var tags []string
+	fs.Func("tag", "", func(v string) error { tags = append(tags, v); return nil })
+	args := []string{"--provider", "Mock", "-temperature=0.5", "--emoji", "--tag", "a", "--tag=b", "--rpm", "3", "rest"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	want := []flagArg{{"provider", "Mock"}, {"temperature", "0.5"}, {"emoji", "true"}, {"tag", "a"}, {"tag", "b"}, {"rpm", "3"}}
+	if got := commandLineFlags(fs, args); !slices.Equal(got, want) {
+		t.Errorf("commandLineFlags = %q, want %q", got, want)
+	}
+}
+
+// servePolicy makes subjects need a type and forbids "WIP".
+const servePolicy = "types: [feat, fix, chore, docs]\nforbidden_words: [WIP]\n"
+
+func TestServeCall(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, ".smartmsg-policy.yaml", servePolicy, "chore: add policy")
+	commitFile(t, "a.go", "package a\n", "feat: add a")
+	s := &server{ai: MockClient{}, model: "mock", lr: lengthRules{subjectMax: 72, bodyWrap: 72}, timeout: 5 * time.Second, planArgs: []string{"--provider=mock"}}
+
+	if _, err := s.call("suggest", nil); err == nil || err.Error() != "no staged changes" {
+		t.Errorf("suggest without staged changes: err = %v", err)
+	}
+	if err := os.WriteFile("b.go", []byte("package b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustGit(t, "add", "b.go")
+	res, err := s.call("suggest", json.RawMessage(`{"old_message":"wip\n\nChange-Id: I0123456789abcdef0123456789abcdef01234567"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sg := res.(serveSuggestResult)
+	if !sg.AI || sg.Message == "" || len(sg.Violations) != 0 {
+		t.Errorf("suggest = %+v", sg)
+	}
+	if changeID(sg.Message) != "I0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("suggest dropped the old Change-Id: %q", sg.Message)
+	}
+
+	for _, tc := range []struct {
+		params string
+		want   serveLintResult
+	}{
+		{`{"message":"fix: handle tabs"}`, serveLintResult{OK: true, Policy: ".smartmsg-policy.yaml"}},
+		{`{"message":"WIP tabs"}`, serveLintResult{Policy: ".smartmsg-policy.yaml", Violations: []string{
+			`subject "WIP tabs" is not "type(scope): description"`, `contains forbidden word "WIP"`,
+		}}},
+		{`{"message":"fix: update parser.go","diff":"diff --git a/b.go b/b.go\n+package b\n"}`, serveLintResult{Policy: ".smartmsg-policy.yaml", Unverified: []string{"parser.go"}}},
+	} {
+		res, err := s.call("lint", json.RawMessage(tc.params))
+		if err != nil {
+			t.Errorf("lint %s: %v", tc.params, err)
+			continue
+		}
+		got := res.(serveLintResult)
+		if got.OK != tc.want.OK || filepath.Base(got.Policy) != tc.want.Policy || !slices.Equal(got.Violations, tc.want.Violations) || !slices.Equal(got.Unverified, tc.want.Unverified) {
+			t.Errorf("lint %s = %+v, want %+v", tc.params, got, tc.want)
+		}
+	}
+
+	mustGit(t, "commit", "-q", "-m", "add b")
+	res, err = s.call("plan", json.RawMessage(`{"limit":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := res.(servePlanResult)
+	if len(pr.Plan.Items) != 2 || pr.Plan.Provider != "mock" || pr.Error != "" {
+		t.Errorf("plan = %+v", pr)
+	}
+
+	for _, tc := range []struct {
+		method, params string
+		err            error
+	}{
+		{"reword", `{}`, errServeMethod},
+		{"lint", `{"message":""}`, errServeParams},
+		{"lint", `{"msg":"fix: x"}`, errServeParams},
+		{"plan", `{"limit":"two"}`, errServeParams},
+	} {
+		if _, err := s.call(tc.method, json.RawMessage(tc.params)); !errors.Is(err, tc.err) {
+			t.Errorf("%s %s: err = %v, want %v", tc.method, tc.params, err, tc.err)
+		}
+	}
+}
+
+func TestServeStdio(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "a.go", "package a\n", "add a")
+	commitFile(t, "b.go", "package b\n", "add b")
+	in := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"plan","params":{"limit":1}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"reword"}`,
+		`{"jsonrpc":"2.0","id":3,"method":"lint","params":{"message":1}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"suggest"}`,
+		`{"jsonrpc":"2.0","method":"lint","params":{"message":"fix: x"}}`,
+		`{"jsonrpc":"2.0","id":"five","method":"lint","params":{"message":"fix: x"}}`,
+		`{"jsonrpc":`,
+	}, "\n")
+	stdin, stdout := filepath.Join(t.TempDir(), "in"), filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(stdin, []byte(in), 0600); err != nil {
+		t.Fatal(err)
+	}
+	inF, err := os.Open(stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inF.Close()
+	outF, err := os.Create(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outF.Close()
+	oldIn, oldOut := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = inF, outF
+	err = cmdServe([]string{"--stdio", "--provider", "Mock", "--temperature", "0.5"})
+	os.Stdin, os.Stdout = oldIn, oldOut
+	if err == nil {
+		t.Error("serve ended without an error on malformed input")
+	}
+
+	data, err := os.ReadFile(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var plan Plan
+	for _, line := range splitLines(strings.TrimSpace(string(data))) {
+		var resp struct {
+			ID     json.RawMessage `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  *rpcError       `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		code := 0
+		if resp.Error != nil {
+			code = resp.Error.Code
+		}
+		if string(resp.ID) == "1" {
+			var res servePlanResult
+			if err := json.Unmarshal(resp.Result, &res); err != nil {
+				t.Fatal(err)
+			}
+			plan = res.Plan
+		}
+		got = append(got, fmt.Sprintf("%s:%d", resp.ID, code))
+	}
+	// The notification gets no response; the malformed line ends the stream.
+	want := []string{"1:0", "2:-32601", "3:-32602", "4:-32000", `"five":0`, "null:-32700"}
+	if !slices.Equal(got, want) {
+		t.Errorf("responses = %q, want %q\n%s", got, want, data)
+	}
+	// Options given to serve reach plan, fs.Func ones included.
+	if len(plan.Items) != 1 || plan.Provider != "mock" || plan.Temperature == nil || *plan.Temperature != 0.5 {
+		t.Errorf("plan over stdio = %+v", plan)
+	}
+}
+
+// captureStdout runs f with os.Stdout sent to a file and returns what it
+// printed.
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	runErr := f()
+	os.Stdout = stdout
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), runErr
+}
+
+// writeFiles writes name-content pairs, creating directories as needed.
+func writeFiles(t *testing.T, files ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(files); i += 2 {
+		if err := os.MkdirAll(filepath.Dir(files[i]), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(files[i], []byte(files[i+1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChangeAreas(t *testing.T) {
+	areas, lines := changeAreas([]fileChange{
+		{Path: "api/server.go", Added: 10, Deleted: 2},
+		{Path: "README.md", Added: 1},
+		{Path: "api/v2/routes.go", Added: 3},
+		{Path: "web/app.js", Deleted: 4},
+	})
+	if want := []string{"api", "(root)", "web"}; !slices.Equal(areas, want) || lines != 20 {
+		t.Errorf("changeAreas = %q, %d; want %q, 20", areas, lines, want)
+	}
+}
+
+func TestAdvise(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "README.md", "demo\n", "init")
+	writeFiles(t, "api/server.go", "package api\n", "web/app.js", "app()\n", "docs/guide.md", "guide\n")
+	mustGit(t, "add", ".")
+	mustGit(t, "commit", "-q", "-m", "misc")
+	mixed := mustGit(t, "rev-parse", "HEAD")
+	commitFile(t, "api/server.go", "package api\n\nfunc Serve() {}\n", "add Serve")
+	writeFiles(t, "api/big.go", strings.Repeat("// line\n", 30), "web/big.js", strings.Repeat("// line\n", 30))
+	mustGit(t, "add", ".")
+	mustGit(t, "commit", "-q", "-m", "two areas")
+	big := mustGit(t, "rev-parse", "HEAD")
+
+	advise := func(args ...string) []adviceReport {
+		t.Helper()
+		out, err := captureStdout(t, func() error {
+			return cmdAdvise(append([]string{"--provider", "mock", "--json", "--limit", "3"}, args...))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reports []adviceReport
+		if err := json.Unmarshal([]byte(out), &reports); err != nil {
+			t.Fatalf("%v:\n%s", err, out)
+		}
+		return reports
+	}
+
+	// By default only commits touching three areas, or two with many lines,
+	// are sent to the model.
+	reports := advise()
+	if len(reports) != 1 || reports[0].SHA != mixed {
+		t.Fatalf("reports = %+v, want only %s", reports, mixed)
+	}
+	r := reports[0]
+	if !slices.Equal(r.Areas, []string{"api", "docs", "web"}) || r.Lines != 3 || !r.Advice.Split || len(r.Advice.Commits) != 3 {
+		t.Errorf("report = %+v", r)
+	}
+	var files []string
+	for _, c := range r.Advice.Commits {
+		files = append(files, c.Files...)
+	}
+	slices.Sort(files)
+	if !slices.Equal(files, []string{"api/server.go", "docs/guide.md", "web/app.js"}) {
+		t.Errorf("suggested commits cover %q", files)
+	}
+
+	if reports := advise("--max-lines", "50"); len(reports) != 2 || reports[1].SHA != big {
+		t.Errorf("--max-lines 50: %+v", reports)
+	}
+	if reports := advise("--all"); len(reports) != 3 || reports[1].Advice.Split {
+		t.Errorf("--all: %+v", reports)
+	}
+
+	out, err := captureStdout(t, func() error { return cmdAdvise([]string{"--provider", "mock", "--limit", "3"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{mixed[:7] + "  misc\n  touches api, docs, web; 3 lines changed\n", "1 of 1 commits reviewed could be split (3 checked in total)."} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+// fakeChat serves the OpenAI chat endpoint, answering with respond, and
+// returns the number of requests it has answered.
+func fakeChat(t *testing.T, respond func(system, user string) string) *int {
+	t.Helper()
+	n := new(int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Messages []struct{ Role, Content string } `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Messages) != 2 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		*n++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id": "chatcmpl", "object": "chat.completion", "model": "gpt-test",
+			"choices": []any{map[string]any{"index": 0, "finish_reason": "stop", "message": map[string]any{"role": "assistant", "content": respond(req.Messages[0].Content, req.Messages[1].Content)}}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	t.Setenv("OPENAI_API_BASE", srv.URL+"/v1/")
+	return n
+}
+
+func TestSplitTrailerBlock(t *testing.T) {
+	for _, tc := range []struct{ msg, text, trailers string }{
+		{"fix: x", "fix: x", ""},
+		{"fix: x\n\nBody.", "fix: x\n\nBody.", ""},
+		{"fix: x\n\nBody.\n\nSigned-off-by: A <a@example.com>\nChange-Id: I1\n", "fix: x\n\nBody.", "Signed-off-by: A <a@example.com>\nChange-Id: I1"},
+		{"fix: x\n\nSigned-off-by: A <a@example.com>", "fix: x", "Signed-off-by: A <a@example.com>"},
+		// Not a trailer block: it is not separated by a blank line.
+		{"fix: x\n\nBody.\nNote: this stays", "fix: x\n\nBody.\nNote: this stays", ""},
+		{"Key: value", "Key: value", ""},
+	} {
+		text, trailers := splitTrailerBlock(tc.msg)
+		if text != tc.text || trailers != tc.trailers {
+			t.Errorf("splitTrailerBlock(%q) = %q, %q; want %q, %q", tc.msg, text, trailers, tc.text, tc.trailers)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tempRepo(t)
+	commitFile(t, "README", "demo\n", "init")
+	const ja = "パーサーのタブ対応\n\nhttps://example.com/x と #12 を参照。\n\nSigned-off-by: A <a@example.com>"
+	first := commitFile(t, "a.txt", "a\n", ja)
+	second := commitFile(t, "b.txt", "b\n", ja)
+	third := commitFile(t, "c.txt", "c\n", "docs: already English")
+	var users []string
+	requests := fakeChat(t, func(system, user string) string {
+		users = append(users, user)
+		if strings.Contains(user, "already English") {
+			return "docs: already English"
+		}
+		return "```\nfix: handle tabs in the parser\n\nSee https://example.com/x.\n```"
+	})
+
+	if err := cmdTranslate([]string{"--limit", "3"}); err == nil || !strings.Contains(err.Error(), "--to is required") {
+		t.Errorf("without --to: err = %v", err)
+	}
+	if err := cmdTranslate([]string{"--to", "English", "--limit", "3", "--model", "gpt-test"}); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := loadPlan("plan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Repeated messages are translated once; trailers are never sent.
+	if *requests != 2 {
+		t.Errorf("%d translation requests, want 2", *requests)
+	}
+	for _, u := range users {
+		if !strings.HasPrefix(u, "Target language: English\n\nMessage:\n") || strings.Contains(u, "Signed-off-by") {
+			t.Errorf("translation prompt %q", u)
+		}
+	}
+	if plan.Translate != "English" || len(plan.Items) != 3 {
+		t.Fatalf("plan = %+v", plan)
+	}
+	want := "fix: handle tabs in the parser\n\nSee https://example.com/x.\n\nSigned-off-by: A <a@example.com>"
+	for i, sha := range []string{first, second} {
+		it := plan.Items[i]
+		if it.SHA != sha || it.NewMessage != want {
+			t.Errorf("item %d = %q, want %q", i, it.NewMessage, want)
+		}
+		if !it.NeedsReview || !slices.Contains(it.ReviewNotes, "dropped in translation: #12") {
+			t.Errorf("item %d review notes = %q", i, it.ReviewNotes)
+		}
+	}
+	if it := plan.Items[2]; it.SHA != third || it.NewMessage != "docs: already English" || it.NeedsReview {
+		t.Errorf("unchanged item = %+v", it)
+	}
+}
+
+// fakeGitHub serves the pull request review endpoints postReview uses and
+// records the calls made to them.
+type fakeGitHub struct {
+	reviews []map[string]any
+	calls   []string
+}
+
+func (g *fakeGitHub) serve(t *testing.T) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gh-token" {
+			http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		g.calls = append(g.calls, r.Method+" "+r.URL.Path)
+		var in map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/repos/o/r/pulls/7/reviews":
+			json.NewEncoder(w).Encode(g.reviews)
+		case r.Method == "POST" && r.URL.Path == "/repos/o/r/pulls/7/reviews":
+			in["id"] = float64(100 + len(g.reviews))
+			g.reviews = append(g.reviews, in)
+			json.NewEncoder(w).Encode(in)
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/repos/o/r/pulls/7/reviews/"):
+			for _, rv := range g.reviews {
+				if strings.HasSuffix(r.URL.Path, "/"+fmt.Sprint(rv["id"])) {
+					rv["body"] = in["body"]
+				}
+			}
+			json.NewEncoder(w).Encode(in)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+}
+
+func TestPostReview(t *testing.T) {
+	gh := &fakeGitHub{reviews: []map[string]any{{"id": float64(1), "body": "LGTM"}}}
+	gh.serve(t)
+	ctx := context.Background()
+	if err := postReview(ctx, "o/r", 7, ciMarker+"\nfirst"); err != nil {
+		t.Fatal(err)
+	}
+	// A later run edits its own review rather than adding another.
+	if err := postReview(ctx, "o/r", 7, ciMarker+"\nsecond"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /repos/o/r/pulls/7/reviews", "POST /repos/o/r/pulls/7/reviews",
+		"GET /repos/o/r/pulls/7/reviews", "PUT /repos/o/r/pulls/7/reviews/101",
+	}
+	if !slices.Equal(gh.calls, want) {
+		t.Errorf("calls = %q, want %q", gh.calls, want)
+	}
+	if len(gh.reviews) != 2 || gh.reviews[0]["body"] != "LGTM" || gh.reviews[1]["body"] != ciMarker+"\nsecond" || gh.reviews[1]["event"] != "COMMENT" {
+		t.Errorf("reviews = %v", gh.reviews)
+	}
+
+	t.Setenv("GITHUB_TOKEN", "wrong")
+	if err := postReview(ctx, "o/r", 7, "x"); err == nil || !strings.Contains(err.Error(), "HTTP 401: {\"message\":\"Bad credentials\"}") {
+		t.Errorf("rejected token: err = %v", err)
+	}
+}
+
+func TestCI(t *testing.T) {
+	tempRepo(t)
+	base := commitFile(t, ".smartmsg-policy.yaml", "types: [feat, fix, chore, docs]\n", "chore: add policy")
+	commitFile(t, "a.go", "package a\n", "stuff")
+	head := commitFile(t, "docs.md", "docs\n", "docs: update docs.md")
+	event := filepath.Join(t.TempDir(), "event.json")
+	writeFiles(t, event, `{"pull_request":{"number":7,"base":{"sha":"`+base+`"},"head":{"sha":"`+head+`"}}}`)
+	t.Setenv("GITHUB_EVENT_PATH", event)
+	t.Setenv("GITHUB_REPOSITORY", "o/r")
+	gh := &fakeGitHub{}
+	gh.serve(t)
+
+	err := cmdCI([]string{"--provider", "mock", "--fail-on-policy"})
+	if err == nil || err.Error() != "1 policy violation(s) in commit messages; see the review" {
+		t.Errorf("--fail-on-policy: err = %v", err)
+	}
+	if len(gh.reviews) != 1 {
+		t.Fatalf("reviews = %v", gh.reviews)
+	}
+	body := gh.reviews[0]["body"].(string)
+	for _, want := range []string{
+		ciMarker, "1 of 2 commit(s) could use a better message.",
+		"⛔ Violates `.smartmsg-policy.yaml`:\n- subject \"stuff\" is not \"type(scope): description\"",
+		"Suggested:\n```text\nchore: update a.go\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("review lacks %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "docs: update docs.md") {
+		t.Errorf("a good message was reported:\n%s", body)
+	}
+
+	// --dry-run prints the review and needs no token.
+	t.Setenv("GITHUB_TOKEN", "")
+	out, err := captureStdout(t, func() error {
+		return cmdCI([]string{"--provider", "mock", "--dry-run", "--range", head + "^.." + head})
+	})
+	if err != nil || !strings.Contains(out, "All 1 commit message(s) look good.") {
+		t.Errorf("--dry-run: %v\n%s", err, out)
+	}
+	if err := cmdCI([]string{"--provider", "mock"}); err == nil || !strings.Contains(err.Error(), "GITHUB_TOKEN is not set") {
+		t.Errorf("without a token: err = %v", err)
+	}
+	writeFiles(t, event, `{"push":{}}`)
+	if err := cmdCI([]string{"--provider", "mock", "--dry-run"}); err == nil || !strings.Contains(err.Error(), "not a pull request") {
+		t.Errorf("push event: err = %v", err)
+	}
+}
+
+// answer feeds lines to the interactive prompts.
+func answer(t *testing.T, lines ...string) {
+	t.Helper()
+	saved := stdinLines
+	stdinLines = bufio.NewScanner(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+	t.Cleanup(func() { stdinLines = saved })
+}
+
+func TestInit(t *testing.T) {
+	dir := tempRepo(t)
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"models":[{"name":"llama3:8b"},{"name":"qwen2.5"}]}`)
+	}))
+	defer ollama.Close()
+	for _, k := range []string{"OPENAI_API_KEY", "AZURE_OPENAI_ENDPOINT", "GOOGLE_API_KEY", "GEMINI_API_KEY"} {
+		t.Setenv(k, "")
+	}
+	awsTestEnv(t, "", "")
+	t.Setenv("OLLAMA_HOST", ollama.URL)
+	t.Setenv("OPENAI_API_BASE", ollama.URL+"/v1")
+	read := func(name string) string {
+		b, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(b)
+	}
+	hook := filepath.Join(dir, ".git", "hooks", "prepare-commit-msg")
+
+	// Ollama is the only provider found, so it is the default.
+	answer(t, "", "2", "2", "Japanese", "y")
+	if _, err := captureStdout(t, func() error { return cmdInit(nil) }); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(".smartmsg.yaml"), "provider: openai\nmodel: \"qwen2.5\"\nemoji: true\n"; !strings.HasSuffix(got, want) {
+		t.Errorf(".smartmsg.yaml =\n%s\nwant it to end in\n%s", got, want)
+	}
+	if got := read(".smartmsg-policy.yaml"); got != "language: \"Japanese\"\n" {
+		t.Errorf(".smartmsg-policy.yaml = %q", got)
+	}
+	if fi, err := os.Stat(hook); err != nil || fi.Mode()&0100 == 0 || !strings.Contains(read(".git/hooks/prepare-commit-msg"), hookMarker) {
+		t.Errorf("hook not installed: %v", err)
+	}
+
+	// An existing config is kept unless the user agrees.
+	answer(t, "")
+	if _, err := captureStdout(t, func() error { return cmdInit(nil) }); err == nil || !strings.Contains(err.Error(), "keeping the existing") {
+		t.Errorf("existing config: err = %v", err)
+	}
+
+	// A hook init wrote is replaced; the policy already names a language.
+	answer(t, "6", "1", "English", "y")
+	out, err := captureStdout(t, func() error { return cmdInit([]string{"--force"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(".smartmsg.yaml"); !strings.HasSuffix(got, "provider: mock\nemoji: false\n") {
+		t.Errorf(".smartmsg.yaml =\n%s", got)
+	}
+	if !strings.Contains(out, "Set `language: English` in") || !strings.Contains(out, "Installed "+hook) {
+		t.Errorf("second init:\n%s", out)
+	}
+
+	// A hook written by hand is left alone.
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := installHook(); err == nil || !strings.Contains(err.Error(), "was not written by git-smartmsg") {
+		t.Errorf("hand-written hook: err = %v", err)
+	}
+	if got := read(".git/hooks/prepare-commit-msg"); got != "#!/bin/sh\nexit 0\n" {
+		t.Errorf("hand-written hook replaced with:\n%s", got)
+	}
+}
+
+func TestPrepareCommitMsgHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook is a shell script")
+	}
+	dir := tempRepo(t)
+	// A stand-in for git-smartmsg that suggests a fixed message.
+	exe := filepath.Join(t.TempDir(), "smart msg")
+	writeFiles(t, exe, "#!/bin/sh\ncat >/dev/null\necho 'feat: suggested by the hook'\n")
+	if err := os.Chmod(exe, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook := filepath.Join(dir, ".git", "hooks", "prepare-commit-msg")
+	writeFiles(t, hook, prepareCommitMsgHook(exe))
+	if err := os.Chmod(hook, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_EDITOR", "true")
+
+	writeFiles(t, "a.txt", "a\n")
+	mustGit(t, "add", "a.txt")
+	mustGit(t, "commit", "-q")
+	if got := mustGit(t, "log", "-1", "--format=%B"); got != "feat: suggested by the hook" {
+		t.Errorf("plain commit message = %q", got)
+	}
+	// A message given with -m is not touched.
+	writeFiles(t, "b.txt", "b\n")
+	mustGit(t, "add", "b.txt")
+	mustGit(t, "commit", "-q", "-m", "add b by hand")
+	if got := mustGit(t, "log", "-1", "--format=%B"); got != "add b by hand" {
+		t.Errorf("commit -m message = %q", got)
+	}
+}
+
+func TestOptionSpecs(t *testing.T) {
+	fs := flag.NewFlagSet("x", flag.ContinueOnError)
+	var path string
+	fs.StringVar(&path, "C", "", "run as if started in `path`")
+	fs.StringVar(&path, "repo", "", "run as if started in `path`")
+	fs.Bool("dry-run", false, "only print")
+	fs.Int("limit", 20, "number of commits")
+	fs.Duration("timeout", 0, "per-commit timeout")
+	fs.Func("mode", "how much to keep (default rewrite)", func(string) error { return nil })
+	got := optionSpecs(fs)
+	want := []optionSpec{
+		{names: []string{"-C", "--repo"}, arg: "path", usage: "run as if started in path"},
+		{names: []string{"--dry-run"}, usage: "only print"},
+		{names: []string{"--limit"}, arg: "int", usage: "number of commits", defText: "20"},
+		{names: []string{"--mode"}, arg: "value", usage: "how much to keep (default rewrite)"},
+		{names: []string{"--timeout"}, arg: "duration", usage: "per-commit timeout"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("optionSpecs = %+v", got)
+	}
+	for i := range want {
+		if !slices.Equal(got[i].names, want[i].names) || got[i].arg != want[i].arg || got[i].usage != want[i].usage || got[i].defText != want[i].defText {
+			t.Errorf("spec %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		out, err := captureStdout(t, func() error { return cmdCompletion([]string{shell}) })
+		if err != nil {
+			t.Fatalf("%s: %v", shell, err)
+		}
+		for _, want := range []string{"apply", "batch-api", "plan", "validate", "completion"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s completion lacks %q", shell, want)
+			}
+		}
+		if strings.Contains(out, "rebase-shim") {
+			t.Errorf("%s completion offers the hidden rebase-shim", shell)
+		}
+		if sh, err := exec.LookPath(shell); err == nil && shell != "fish" {
+			if msg, err := exec.Command(sh, "-n", "-c", out).CombinedOutput(); err != nil {
+				t.Errorf("%s -n: %v\n%s", shell, err, msg)
+			}
+		}
+	}
+	if err := cmdCompletion([]string{"tcsh"}); err == nil || !strings.Contains(err.Error(), `unsupported shell "tcsh"`) {
+		t.Errorf("tcsh: err = %v", err)
+	}
+	if err := cmdCompletion(nil); err == nil || !strings.Contains(err.Error(), "usage: completion") {
+		t.Errorf("no shell: err = %v", err)
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not available")
+	}
+	script := bashCompletion(globalOptionSpecs(), completionCommands())
+	for _, tc := range []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"git-smartmsg", "ap"}, "apply"},
+		{[]string{"git-smartmsg", "-C", "repo", "tra"}, "translate"},
+		{[]string{"git", "smartmsg", "plan", "--batch-"}, "--batch-api --batch-size"},
+		{[]string{"git-smartmsg", "plan", "va"}, "validate"},
+		{[]string{"git-smartmsg", "plan", "validate", "--"}, strings.Join(optionNames(optionSpecs(commandFlags(subcommand{name: "plan validate", run: cmdPlanValidate})), false), " ")},
+		{[]string{"git-smartmsg", "export", "--for"}, "--format"},
+	} {
+		prog := script + fmt.Sprintf("COMP_WORDS=(%s); COMP_CWORD=%d; _git_smartmsg_complete; echo \"${COMPREPLY[*]}\"\n",
+			strings.Join(tc.words, " "), len(tc.words)-1)
+		out, err := exec.Command(bash, "-c", prog).Output()
+		if err != nil {
+			t.Fatalf("%q: %v", tc.words, err)
+		}
+		if got := strings.TrimSpace(string(out)); got != tc.want {
+			t.Errorf("completing %q = %q, want %q", tc.words, got, tc.want)
+		}
+	}
+}
+
+func TestRoffEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"--limit":         `\-\-limit`,
+		`C:\path`:         `C:\epath`,
+		".smartmsg.yaml":  `\&.smartmsg.yaml`,
+		"'quoted' option": `\&'quoted' option`,
+		"plain text":      "plain text",
+	} {
+		if got := roffEscape(in); got != want {
+			t.Errorf("roffEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMan(t *testing.T) {
+	out, err := captureStdout(t, func() error { return cmdMan(nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		".TH GIT\\-SMARTMSG 1",
+		".SH GLOBAL OPTIONS\n.TP\n\\fB\\-C\\fR, \\fB\\-\\-repo\\fR \\fIpath\\fR\nrun as if started in path\n",
+		".SS plan validate\n",
+		"\\fB\\-\\-limit\\fR \\fIint\\fR\nnumber of commits from HEAD to include (default: 20)\n",
+		".SS completion\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("man page lacks %q", want)
+		}
+	}
+	if strings.Contains(out, "rebase-shim") || strings.Contains(out, "rebase\\-shim") {
+		t.Error("man page lists the hidden rebase-shim")
+	}
+	// Every line that starts with a dot must be a request roff knows here.
+	for _, l := range splitLines(out) {
+		if strings.HasPrefix(l, ".") && !regexp.MustCompile(`^\.(TH|SH|SS|TP|PP|B) ?`).MatchString(l) {
+			t.Errorf("stray roff request %q", l)
+		}
+	}
+}